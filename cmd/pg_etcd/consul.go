@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/admin"
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// runConsul synchronizes PostgreSQL with the Consul KV store of --consul-dsn until ctx is done.
+// Options built on etcd, e.g. leader election, replicas and compaction, are ignored.
+func runConsul(ctx context.Context, cancel context.CancelFunc, config *Config, pgPool *pgxpool.Pool) {
+	backend, err := sync.NewConsulBackend(config.ConsulDSN)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to set up Consul backend")
+	}
+	if config.EtcdDSN != "" {
+		logrus.Warn("--etcd-dsn has no effect with --consul-dsn")
+	}
+
+	pollingInterval, err := time.ParseDuration(config.PollingInterval)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid polling interval format")
+	}
+	schemas, err := config.keySchemas()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid JSON Schema")
+	}
+	decoders, err := config.valueDecoders()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid decoder")
+	}
+	retention, err := config.retentionPolicies()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid retention policy")
+	}
+	secrets, err := config.secretRules()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid secret pattern")
+	}
+	prefixes := config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{backend.Prefix()}
+	}
+
+	syncService := sync.NewService(pgPool, nil, sync.WithConfig(sync.Config{
+		PostgresDSN:      config.PostgresDSN,
+		LogLevel:         config.LogLevel,
+		PollingInterval:  pollingInterval,
+		NotifyChannel:    config.NotifyChannel,
+		StatementTimeout: config.PgStmtTimeout,
+		StorageMode:      config.Storage,
+		IngestMode:       config.IngestMode,
+		MaxSyncAttempts:  config.MaxSyncAttempts,
+		ReadOnly:         config.ReadOnly,
+		RecentEvents:     config.RecentEvents,
+		Version:          version,
+
+		CompressThreshold: config.CompressMin,
+		Schemas:           schemas,
+		Dedup:             config.Dedup,
+		Decoders:          decoders,
+		KeyPath:           config.KeyPath,
+		KeyPolicy:         config.KeyPolicy,
+		MaxKeyBytes:       config.MaxKeyBytes,
+		Retention:         retention,
+		Secrets:           secrets,
+
+		Prefixes:       prefixes,
+		MetricPrefixes: config.MetricPrefixes,
+
+		Backend: backend,
+	}))
+
+	if config.AdminListen != "" {
+		adminServer := admin.NewServer(config.AdminListen, func() any { return syncService.Status() })
+		if config.AdminToken != "" {
+			adminServer.EnableControl(config.AdminToken, adminControl(syncService))
+		}
+		adminServer.Start()
+		defer func() { _ = adminServer.Shutdown(context.Background()) }()
+	}
+	defer startGRPCAdmin(config, syncService)()
+	defer startREST(config, pgPool)()
+	defer startFacade(ctx, config, pgPool)()
+
+	if err := sync.WaitForPrimary(ctx, pgPool, pollingInterval); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Fatal("Failed to check PostgreSQL recovery state")
+	}
+	if config.KeyPath {
+		if err := sync.SetKeyPath(ctx, pgPool, true); err != nil {
+			logrus.WithError(err).Fatal("Failed to enable key paths")
+		}
+	}
+	if config.ReadOnly {
+		if err := sync.SetReadOnly(ctx, pgPool, true); err != nil {
+			logrus.WithError(err).Fatal("Failed to enable read-only mirror")
+		}
+	}
+
+	if config.PgSimpleProto {
+		logrus.Warn("Instance lock disabled with --pg-simple-protocol, make sure only one instance runs per prefix")
+	} else {
+		lock, err := sync.AcquireInstanceLock(ctx, pgPool, "consul:"+syncService.InstanceName(), config.InstanceLock, pollingInterval)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to acquire instance lock")
+		}
+		defer lock.Release(context.Background())
+		lock.Monitor(ctx, cancel)
+	}
+
+	if err := syncService.Start(ctx); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Fatal("Synchronization failed")
+	}
+	logrus.Info("Graceful shutdown completed")
+}
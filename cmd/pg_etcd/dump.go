@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// dumpRowGroupSize is the number of rows of a Parquet row group, bounding the memory of the writer
+const dumpRowGroupSize = 100_000
+
+// DumpCommand is the dump subcommand writing the history of the prefixes in PostgreSQL instead of running the daemon
+type DumpCommand struct {
+	Format       string `long:"format" description:"Output format: JSON lines or Parquet (json if empty)" choice:"json" choice:"parquet"`
+	FromRevision int64  `long:"from-revision" description:"Only dump revisions after this one, e.g. the last revision of an earlier dump"`
+	Output       string `short:"o" long:"output" description:"Write the dump to this file instead of stdout"`
+
+	requested bool
+}
+
+// Execute marks the subcommand requested, the dump runs once logging is set up
+func (c *DumpCommand) Execute([]string) error {
+	c.requested = true
+	return nil
+}
+
+// historyWriter writes dumped history rows in one output format
+type historyWriter interface {
+	Write(row sync.HistoryRow) error
+	Close() error
+}
+
+// jsonHistoryWriter writes one JSON object per row
+type jsonHistoryWriter struct {
+	encoder *json.Encoder
+}
+
+func (w jsonHistoryWriter) Write(row sync.HistoryRow) error { return w.encoder.Encode(row) }
+
+func (w jsonHistoryWriter) Close() error { return nil }
+
+// parquetHistoryWriter writes the rows as a Parquet file with one column per field
+type parquetHistoryWriter struct {
+	writer *parquet.GenericWriter[sync.HistoryRow]
+	rows   []sync.HistoryRow
+}
+
+func (w *parquetHistoryWriter) Write(row sync.HistoryRow) error {
+	w.rows = append(w.rows, row)
+	if len(w.rows) < 1024 {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *parquetHistoryWriter) flush() error {
+	_, err := w.writer.Write(w.rows)
+	w.rows = w.rows[:0]
+	return err
+}
+
+func (w *parquetHistoryWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.writer.Close()
+}
+
+// newHistoryWriter returns the writer of format writing to output
+func newHistoryWriter(format string, output io.Writer) historyWriter {
+	if format == "parquet" {
+		return &parquetHistoryWriter{writer: parquet.NewGenericWriter[sync.HistoryRow](output, parquet.MaxRowsPerRowGroup(dumpRowGroupSize))}
+	}
+	return jsonHistoryWriter{encoder: json.NewEncoder(output)}
+}
+
+// runDump writes the history of the synced prefixes from PostgreSQL and returns the exit status. etcd is not
+// contacted, so the prefixes default to all keys.
+func runDump(ctx context.Context, config *Config) int {
+	if config.Storage == sync.StorageLatest {
+		logrus.Error("Dump needs the history, it is not available with --storage=latest")
+		return 1
+	}
+	pgPool, err := sync.NewWithRetry(ctx, config.PostgresDSN)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to connect to PostgreSQL after retries")
+		return 1
+	}
+	defer pgPool.Close()
+	prefixes := config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	var output io.Writer = os.Stdout
+	if config.Dump.Output != "" {
+		file, err := os.Create(config.Dump.Output)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to create dump file")
+			return 1
+		}
+		defer func() { _ = file.Close() }()
+		output = file
+	}
+	writer := newHistoryWriter(config.Dump.Format, output)
+	var count, revision int64
+	for _, prefix := range prefixes {
+		err := sync.DumpHistory(ctx, pgPool, prefix, config.Dump.FromRevision, func(row sync.HistoryRow) error {
+			count++
+			revision = max(revision, row.Revision)
+			return writer.Write(row)
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("prefix", prefix).Error("Failed to dump history")
+			return 1
+		}
+	}
+	if err := writer.Close(); err != nil {
+		logrus.WithError(err).Error("Failed to write dump")
+		return 1
+	}
+	logrus.WithFields(logrus.Fields{"rows": count, "revision": revision}).Info("Dump written")
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// ImportCommand is the import subcommand loading an etcd snapshot file into PostgreSQL instead of running the daemon
+type ImportCommand struct {
+	FromSnapshot string `long:"from-snapshot" description:"etcd snapshot file to load, e.g. written by etcdctl snapshot save"`
+
+	requested bool
+}
+
+// Execute marks the subcommand requested, the import runs once logging is set up
+func (c *ImportCommand) Execute([]string) error {
+	if c.FromSnapshot == "" {
+		return errors.New("import needs --from-snapshot")
+	}
+	c.requested = true
+	return nil
+}
+
+// runImport loads the keys of the prefixes with their revisions from an etcd snapshot file into PostgreSQL and
+// returns the exit status. The etcd DSN only scopes the keys, the cluster is not contacted.
+func runImport(ctx context.Context, config *Config) int {
+	prefix, namespace, err := sync.KeyScope(config.EtcdDSN)
+	if err != nil {
+		logrus.WithError(err).Error("Invalid etcd DSN")
+		return 1
+	}
+	prefixes := config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{prefix}
+	}
+	schemas, err := config.keySchemas()
+	if err != nil {
+		logrus.WithError(err).Error("Invalid JSON Schema")
+		return 1
+	}
+	decoders, err := config.valueDecoders()
+	if err != nil {
+		logrus.WithError(err).Error("Invalid decoder")
+		return 1
+	}
+	secrets, err := config.secretRules()
+	if err != nil {
+		logrus.WithError(err).Error("Invalid secret pattern")
+		return 1
+	}
+	pgPool, err := sync.NewWithRetry(ctx, config.PostgresDSN)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to connect to PostgreSQL after retries")
+		return 1
+	}
+	defer pgPool.Close()
+
+	service := sync.NewService(pgPool, nil, sync.WithConfig(sync.Config{
+		StorageMode:       config.Storage,
+		IngestMode:        config.IngestMode,
+		StatementTimeout:  config.PgStmtTimeout,
+		CompressThreshold: config.CompressMin,
+		Schemas:           schemas,
+		Dedup:             config.Dedup,
+		Decoders:          decoders,
+		KeyPolicy:         config.KeyPolicy,
+		MaxKeyBytes:       config.MaxKeyBytes,
+		Secrets:           secrets,
+
+		Prefixes: prefixes,
+	}))
+	count, revision, err := service.ImportSnapshot(ctx, config.Import.FromSnapshot, namespace)
+	logger := logrus.WithFields(logrus.Fields{"file": config.Import.FromSnapshot, "records": count})
+	if err != nil {
+		logger.WithError(err).Error("Failed to import etcd snapshot")
+		return 1
+	}
+	logger.WithField("revision", revision).Info("etcd snapshot imported")
+	return 0
+}
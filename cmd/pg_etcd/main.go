@@ -5,25 +5,126 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jessevdk/go-flags"
 	"github.com/sirupsen/logrus"
 
+	"github.com/cybertec-postgresql/pg_etcd/internal/admin"
+	"github.com/cybertec-postgresql/pg_etcd/internal/facade"
+	"github.com/cybertec-postgresql/pg_etcd/internal/failpoint"
 	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+	"github.com/cybertec-postgresql/pg_etcd/internal/migrations"
+	"github.com/cybertec-postgresql/pg_etcd/internal/rest"
 	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+	"github.com/cybertec-postgresql/pg_etcd/internal/tracing"
 )
 
 // Config holds the application configuration
 type Config struct {
-	PostgresDSN     string `short:"p" env:"pg_etcd_POSTGRES_DSN" long:"postgres-dsn" description:"PostgreSQL connection string"`
-	EtcdDSN         string `short:"e" env:"pg_etcd_ETCD_DSN" long:"etcd-dsn" description:"etcd connection string"`
-	LogLevel        string `short:"l" env:"pg_etcd_LOG_LEVEL" long:"log-level" description:"Log level: debug|info|warn|error" default:"info"`
-	PollingInterval string `long:"polling-interval" description:"Polling interval for PostgreSQL to etcd sync" default:"1s"`
-	Version         bool   `short:"v" long:"version" description:"Show version information"`
+	PostgresDSN     string        `short:"p" env:"pg_etcd_POSTGRES_DSN" long:"postgres-dsn" description:"PostgreSQL connection string"`
+	EtcdDSN         string        `short:"e" env:"pg_etcd_ETCD_DSN" long:"etcd-dsn" description:"etcd connection string"`
+	LogLevel        string        `short:"l" env:"pg_etcd_LOG_LEVEL" long:"log-level" description:"Log level: debug|info|warn|error" default:"info"`
+	LogFormat       string        `long:"log-format" env:"pg_etcd_LOG_FORMAT" description:"Log output format: text for humans or json lines with stable field names for log collectors" choice:"text" choice:"json" default:"text"`
+	LogFile         string        `long:"log-file" env:"pg_etcd_LOG_FILE" description:"Write the log to this file instead of stdout, rotated by size and optionally by time"`
+	LogMaxSize      int           `long:"log-max-size" env:"pg_etcd_LOG_MAX_SIZE" description:"Size in megabytes the log file is rotated at (0 means 100)"`
+	LogMaxAge       int           `long:"log-max-age" env:"pg_etcd_LOG_MAX_AGE" description:"Days rotated log files are kept (0 keeps them forever)"`
+	LogMaxBackups   int           `long:"log-max-backups" env:"pg_etcd_LOG_MAX_BACKUPS" description:"Number of rotated log files kept (0 keeps all)"`
+	LogDedup        time.Duration `long:"log-dedup-window" env:"pg_etcd_LOG_DEDUP_WINDOW" description:"Write a repeating warning or error once per window with its number of repetitions (0 disables)" default:"1m"`
+	LogRotate       time.Duration `long:"log-rotate-interval" env:"pg_etcd_LOG_ROTATE_INTERVAL" description:"Rotate the log file at least this often, e.g. 24h (0 rotates by size only)"`
+	EtcdCAFile      string        `long:"etcd-ca-file" env:"pg_etcd_ETCD_CA_FILE" description:"PEM CA bundle verifying the etcd server (overrides DSN ca_file)"`
+	EtcdCertFile    string        `long:"etcd-cert-file" env:"pg_etcd_ETCD_CERT_FILE" description:"PEM client certificate for etcd mutual TLS (overrides DSN cert_file)"`
+	EtcdKeyFile     string        `long:"etcd-key-file" env:"pg_etcd_ETCD_KEY_FILE" description:"PEM private key of the etcd client certificate (overrides DSN key_file)"`
+	EtcdServerName  string        `long:"etcd-server-name" env:"pg_etcd_ETCD_SERVER_NAME" description:"Server name verified against the etcd certificate (overrides DSN server_name)"`
+	EtcdInsecure    bool          `long:"etcd-insecure-skip-verify" description:"Skip etcd server certificate verification, for development only"`
+	ConsulDSN       string        `long:"consul-dsn" env:"pg_etcd_CONSUL_DSN" description:"Mirror the Consul KV store instead of etcd, e.g. consul://localhost:8500/config/?token=secret (consuls:// for HTTPS)"`
+	EtcdReplicas    []string      `long:"etcd-replica-dsn" description:"Connection string of a secondary etcd cluster receiving PostgreSQL changes, may be repeated"`
+	LeaderElection  bool          `long:"leader-election" env:"pg_etcd_LEADER_ELECTION" description:"Elect one active instance via etcd, the others wait as hot standbys"`
+	ElectionTTL     time.Duration `long:"election-ttl" env:"pg_etcd_ELECTION_TTL" description:"Lease TTL of the leadership, a standby takes over within it after the leader fails" default:"10s"`
+	PollingInterval string        `long:"polling-interval" description:"Polling interval for PostgreSQL to etcd sync" default:"1s"`
+	Prefixes        []string      `long:"prefix" description:"etcd key prefix to synchronize, may be repeated (defaults to the etcd DSN path)"`
+	Tenants         []string      `long:"tenant" description:"Mirror a top-level etcd prefix into its own PostgreSQL schema as PREFIX=SCHEMA[:retain|prune], optionally with the history mode of the tenant, may be repeated (replaces --prefix)"`
+	MetricPrefixes  []string      `long:"metrics-prefix" description:"Key prefix the sync metrics are broken down by, may be repeated (defaults to the synced prefixes)"`
+	JSONSchemas     []string      `long:"json-schema" description:"Validate the values of a key prefix against a JSON Schema file as PREFIX=FILE, violations are not pushed to etcd, may be repeated"`
+	Decoders        []string      `long:"decoder" description:"Store facts of the values of a key prefix in the facts column as PREFIX=DECODER[:FIELD,...], DECODER is json, yaml, patroni or kubernetes, FIELD a dot separated path, may be repeated"`
+	ChunkPrefixes   []string      `long:"chunk-prefix" description:"Key prefix whose values exceeding the etcd request limit are split into <key>/.chunks/NNN sub-keys, may be repeated"`
+	SyncConcurrency int           `long:"initial-sync-concurrency" description:"Maximum number of prefixes bootstrapped in parallel by the initial sync" default:"4"`
+	PgCapture       string        `long:"pg-capture" env:"pg_etcd_PG_CAPTURE" description:"PostgreSQL change capture: poll pending rows or consume a wal2json logical replication slot" choice:"poll" choice:"logical" default:"poll"`
+	NotifyChannel   string        `long:"notify-channel" env:"pg_etcd_NOTIFY_CHANNEL" description:"PostgreSQL channel to NOTIFY for every applied etcd change, e.g. etcd_changes (disabled if empty)"`
+	InstanceLock    string        `long:"instance-lock" env:"pg_etcd_INSTANCE_LOCK" description:"Behavior when another instance syncs the same schema and prefix: block|exit|standby" choice:"block" choice:"exit" choice:"standby" default:"block"`
+	PgMaxConns      int32         `long:"pg-max-conns" description:"Maximum size of the PostgreSQL connection pool (default from DSN pool_max_conns or pgxpool)"`
+	PgMinConns      int32         `long:"pg-min-conns" description:"Minimum size of the PostgreSQL connection pool"`
+	PgConnLifetime  time.Duration `long:"pg-max-conn-lifetime" description:"Maximum lifetime of a pooled PostgreSQL connection, e.g. 1h"`
+	PgConnIdleTime  time.Duration `long:"pg-max-conn-idle-time" description:"Maximum idle time of a pooled PostgreSQL connection, e.g. 30m"`
+	PgHealthCheck   time.Duration `long:"pg-health-check-period" description:"Interval between health checks of idle pooled connections"`
+	SlowOpThreshold time.Duration `long:"slow-op-threshold" env:"pg_etcd_SLOW_OP_THRESHOLD" description:"Log single PostgreSQL and etcd operations taking longer at warn level, parameter values redacted (0 disables)" default:"1s"`
+	PgStmtTimeout   time.Duration `long:"pg-statement-timeout" description:"Deadline for a single PostgreSQL sync operation, timed out operations are retried (0 disables)" default:"30s"`
+	Storage         string        `long:"storage" env:"pg_etcd_STORAGE" description:"PostgreSQL storage: full revision history in etcd or one row per key in etcd_latest" choice:"history" choice:"latest" default:"history"`
+	IngestMode      string        `long:"ingest-mode" env:"pg_etcd_INGEST_MODE" description:"Write etcd changes with per-row batch statements or COPY them into an unlogged staging table merged per batch (history storage only)" choice:"batch" choice:"staging" default:"batch"`
+	CompressMin     int           `long:"compress-threshold" env:"pg_etcd_COMPRESS_THRESHOLD" description:"Store values of at least this many bytes received from etcd zstd compressed in PostgreSQL (0 disables)"`
+	KeyPolicy       string        `long:"key-policy" env:"pg_etcd_KEY_POLICY" description:"Handling of etcd keys that are no valid UTF-8 or longer than --max-key-bytes: quarantine the raw bytes, reject them or store invalid UTF-8 hex encoded as \\x..." choice:"quarantine" choice:"reject" choice:"hex" default:"quarantine"`
+	Secrets         []string      `long:"secret" description:"Mask the values of the keys matching a pattern in logs and reported failures as PATTERN[:hash], PATTERN is a path.Match pattern of the keys or their parents, with :hash PostgreSQL stores the SHA-256 of the values instead, may be repeated"`
+	Retention       []string      `long:"retention" description:"Keep the history of a key prefix for a duration as PREFIX=DURATION, e.g. /telemetry/=1d or /config/=forever, the longest matching prefix applies, may be repeated (history storage only)"`
+	MaxKeyBytes     int           `long:"max-key-bytes" env:"pg_etcd_MAX_KEY_BYTES" description:"Longest etcd key stored in the etcd table, bounded by the btree index entry limit (0 means 2048, at most 2560)"`
+	KeyPath         bool          `long:"key-path" env:"pg_etcd_KEY_PATH" description:"Split keys on / into the key_path column and the namespace, service and item columns of etcd_current with a trigger"`
+	Dedup           bool          `long:"dedup" env:"pg_etcd_DEDUP" description:"Move the revision of the latest row of a key instead of adding a row when etcd sets it to its current value (history storage only)"`
+	History         string        `long:"history" env:"pg_etcd_HISTORY" description:"Revisions older than the etcd compact revision: retain them as long-term history or prune them like etcd" choice:"retain" choice:"prune" default:"retain"`
+	AuditLogTable   bool          `long:"audit-log-table" env:"pg_etcd_AUDIT_LOG_TABLE" description:"Record every applied change in the append-only etcd_audit_log table"`
+	AuditLogFile    string        `long:"audit-log-file" env:"pg_etcd_AUDIT_LOG_FILE" description:"Record every applied change as JSON lines appended to this file"`
+	SpillDir        string        `long:"spill-dir" env:"pg_etcd_SPILL_DIR" description:"Buffer etcd watch events in this directory while PostgreSQL is unreachable and replay them once it is back"`
+	SpillMaxSize    int           `long:"spill-max-size" env:"pg_etcd_SPILL_MAX_SIZE" description:"Size in megabytes of the spilled etcd watch events, further events are lost like failed ones (0 disables the limit)" default:"100"`
+	CompactInterval time.Duration `long:"etcd-compact-interval" env:"pg_etcd_ETCD_COMPACT_INTERVAL" description:"Interval of compacting etcd up to the revision persisted in PostgreSQL for all prefixes (0 disables)"`
+	AuditInterval   time.Duration `long:"audit-interval" env:"pg_etcd_AUDIT_INTERVAL" description:"Interval of the audit comparing etcd with PostgreSQL and reconciling lost events (0 disables)" default:"10m"`
+	ResyncThreshold int           `long:"resync-threshold" env:"pg_etcd_RESYNC_THRESHOLD" description:"Differences found by one audit that schedule a full resynchronization of the prefix instead of repairing single keys" default:"1"`
+	ResyncInterval  time.Duration `long:"resync-min-interval" env:"pg_etcd_RESYNC_MIN_INTERVAL" description:"Minimum time between automatic full resynchronizations of a prefix (0 disables the limit)" default:"10m"`
+	MaxSyncAttempts int           `long:"max-sync-attempts" env:"pg_etcd_MAX_SYNC_ATTEMPTS" description:"Failed pushes after which a pending row is marked failed and skipped until etcd_requeue_failed(), connection failures are not counted (0 retries forever)" default:"10"`
+	BacklogMaxAge   time.Duration `long:"backlog-age-threshold" env:"pg_etcd_BACKLOG_AGE_THRESHOLD" description:"Alert while the oldest PostgreSQL change pending for etcd is older than this, e.g. 30s (0 disables)"`
+	BacklogMaxRows  int64         `long:"backlog-depth-threshold" env:"pg_etcd_BACKLOG_DEPTH_THRESHOLD" description:"Alert while at least this many PostgreSQL changes are pending for etcd (0 disables)"`
+	BacklogAgeLimit time.Duration `long:"backlog-age-limit" env:"pg_etcd_BACKLOG_AGE_LIMIT" description:"Alert as broken forwarding while the oldest PostgreSQL change pending for etcd is older than this (0 disables)"`
+	BacklogRowLimit int64         `long:"backlog-depth-limit" env:"pg_etcd_BACKLOG_DEPTH_LIMIT" description:"Alert as broken forwarding while at least this many PostgreSQL changes are pending for etcd (0 disables)"`
+	BacklogReject   bool          `long:"backlog-reject" env:"pg_etcd_BACKLOG_REJECT" description:"Reject new etcd_put() and etcd_delete() calls with an SQL error while the backlog exceeds --backlog-age-limit or --backlog-depth-limit"`
+	BacklogWebhook  string        `long:"backlog-webhook" env:"pg_etcd_BACKLOG_WEBHOOK" description:"URL receiving a JSON POST when the backlog crosses a threshold and when it recovers"`
+	LagThreshold    time.Duration `long:"lag-warn-threshold" env:"pg_etcd_LAG_WARN_THRESHOLD" description:"Log a warning while the oldest etcd event not applied to PostgreSQL is older than this, e.g. 1m (0 disables)"`
+	Heartbeat       time.Duration `long:"heartbeat-interval" env:"pg_etcd_HEARTBEAT_INTERVAL" description:"Interval of writing the etcd_sync_heartbeat row for monitoring with SQL access only, e.g. 10s (0 disables)"`
+	ReadOnly        bool          `long:"read-only" env:"pg_etcd_READ_ONLY" description:"Run as read-only mirror: sync etcd to PostgreSQL only and reject pending rows with a trigger"`
+	PgSimpleProto   bool          `long:"pg-simple-protocol" env:"pg_etcd_PG_SIMPLE_PROTOCOL" description:"Use the simple query protocol without prepared statements or session locks, e.g. behind PgBouncer in transaction pooling mode"`
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" env:"pg_etcd_SHUTDOWN_TIMEOUT" description:"Deadline for a graceful shutdown after SIGTERM or SIGINT, exceeding it aborts outstanding operations and exits non-zero (0 waits forever)" default:"30s"`
+	Migrate         bool          `long:"migrate" env:"pg_etcd_MIGRATE" description:"Apply pending database migrations before starting"`
+	AdminListen     string        `long:"admin-listen" env:"pg_etcd_ADMIN_LISTEN" description:"Address for the admin HTTP listener serving /metrics and /status (disabled if empty)"`
+	MetricsSink     string        `long:"metrics-sink" env:"pg_etcd_METRICS_SINK" description:"Additionally push the metrics to a StatsD or DogStatsD agent, e.g. Telegraf or Datadog, instead of only serving them for scraping" choice:"prometheus" choice:"statsd" choice:"dogstatsd" default:"prometheus"`
+	StatsDAddress   string        `long:"statsd-address" env:"pg_etcd_STATSD_ADDRESS" description:"UDP address of the StatsD agent the metrics are pushed to every 10s" default:"127.0.0.1:8125"`
+	AdminGRPCListen string        `long:"admin-grpc-listen" env:"pg_etcd_ADMIN_GRPC_LISTEN" description:"Address for the gRPC admin listener serving the status, the controls of --admin-token and a stream of applied changes (disabled if empty)"`
+	RESTListen      string        `long:"rest-listen" env:"pg_etcd_REST_LISTEN" description:"Address for the HTTP key API under /v1/keys/ reading from the PostgreSQL mirror and enqueueing changes for etcd (disabled if empty)"`
+	FacadeListen    string        `long:"etcd-facade-listen" env:"pg_etcd_ETCD_FACADE_LISTEN" description:"Address for a read-only etcd gRPC endpoint serving Range and Watch from the PostgreSQL mirror, requires --notify-channel and history storage (disabled if empty)"`
+	RESTToken       string        `long:"rest-token" env:"pg_etcd_REST_TOKEN" description:"Bearer token required by the key API of --rest-listen (open if empty)"`
+	AdminToken      string        `long:"admin-token" env:"pg_etcd_ADMIN_TOKEN" description:"Bearer token enabling the /admin/ control endpoints on the admin listener: pause, resume, resync and checkpoints"`
+	RecentEvents    int           `long:"recent-events" env:"pg_etcd_RECENT_EVENTS" description:"Number of applied changes and failures kept in memory for /admin/recent (0 means 100)"`
+	OTLPTracing     bool          `long:"otlp-tracing" env:"pg_etcd_OTLP_TRACING" description:"Export OpenTelemetry spans of the sync pipeline via OTLP/gRPC, configured by the OTEL_EXPORTER_OTLP_* environment variables"`
+	EnablePprof     bool          `long:"enable-pprof" env:"pg_etcd_ENABLE_PPROF" description:"Serve CPU, heap and goroutine profiles under /debug/pprof/ on the admin listener"`
+	Version         bool          `short:"v" long:"version" description:"Show version information"`
+
+	Validate ValidateCommand `command:"validate" description:"Check the schema, privileges, etcd access and TLS certificates, print a JSON report and exit non-zero if a check fails"`
+	Snapshot SnapshotCommand `command:"snapshot" description:"Write the keys of the prefixes at one etcd revision as JSON, e.g. for backups and clones"`
+	Rollback RollbackCommand `command:"rollback" description:"Restore the keys of the prefixes in etcd to an earlier revision or point in time from the history in PostgreSQL"`
+	Import   ImportCommand   `command:"import" description:"Load the keys of the prefixes with their revisions from an etcd snapshot file into PostgreSQL, e.g. to bootstrap the mirror from a backup"`
+	Dump     DumpCommand     `command:"dump" description:"Write the history of the prefixes in PostgreSQL as JSON lines or Parquet, e.g. for data lakes and DuckDB or Spark"`
+}
+
+// ValidateCommand is the validate subcommand running the preflight checks instead of the daemon
+type ValidateCommand struct {
+	requested bool
+}
+
+// Execute marks the subcommand requested, the checks run once logging is set up
+func (c *ValidateCommand) Execute([]string) error {
+	c.requested = true
+	return nil
 }
 
 var (
@@ -36,6 +137,7 @@ var (
 func ParseCLI(args []string) (cmdOpts *Config, err error) {
 	cmdOpts = new(Config)
 	parser := flags.NewParser(cmdOpts, flags.Default)
+	parser.SubcommandsOptional = true
 	_, err = parser.ParseArgs(args) // parse and execute subcommand if any
 	if err != nil {
 		if !flags.WroteHelp(err) {
@@ -43,9 +145,73 @@ func ParseCLI(args []string) (cmdOpts *Config, err error) {
 		}
 		return cmdOpts, err
 	}
+	err = sync.CheckMaxKeyBytes(cmdOpts.MaxKeyBytes)
 	return
 }
 
+// etcdTLS returns the TLS settings of the etcd connection given by flags
+func (c *Config) etcdTLS() sync.EtcdTLS {
+	return sync.EtcdTLS{
+		CAFile:             c.EtcdCAFile,
+		CertFile:           c.EtcdCertFile,
+		KeyFile:            c.EtcdKeyFile,
+		ServerName:         c.EtcdServerName,
+		InsecureSkipVerify: c.EtcdInsecure,
+	}
+}
+
+// keySchemas compiles the JSON Schemas given by --json-schema
+func (c *Config) keySchemas() ([]sync.KeySchema, error) {
+	schemas := make([]sync.KeySchema, 0, len(c.JSONSchemas))
+	for _, spec := range c.JSONSchemas {
+		schema, err := sync.LoadKeySchema(spec)
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// valueDecoders parses the decoders given by --decoder
+func (c *Config) valueDecoders() ([]sync.PrefixDecoder, error) {
+	decoders := make([]sync.PrefixDecoder, 0, len(c.Decoders))
+	for _, spec := range c.Decoders {
+		decoder, err := sync.ParseDecoder(spec)
+		if err != nil {
+			return nil, err
+		}
+		decoders = append(decoders, decoder)
+	}
+	return decoders, nil
+}
+
+// retentionPolicies parses the retention policies given by --retention
+func (c *Config) retentionPolicies() ([]sync.RetentionPolicy, error) {
+	policies := make([]sync.RetentionPolicy, 0, len(c.Retention))
+	for _, spec := range c.Retention {
+		policy, err := sync.ParseRetention(spec)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// secretRules parses the secret key patterns given by --secret
+func (c *Config) secretRules() ([]sync.SecretRule, error) {
+	rules := make([]sync.SecretRule, 0, len(c.Secrets))
+	for _, spec := range c.Secrets {
+		rule, err := sync.ParseSecretRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
 // ShowVersion prints version information and exits
 func ShowVersion() {
 	fmt.Printf("pg_etcd version %s\n", version)
@@ -57,8 +223,10 @@ func ShowVersion() {
 	}
 }
 
-// SetupLogging configures the logging system with structured output
-func SetupLogging(logLevel string) error {
+// SetupLogging configures the logging system with structured output in the text or json format,
+// written to output or stdout if output is nil. Repeating warnings and errors are collapsed per
+// dedupWindow until ctx is done, unless it is zero.
+func SetupLogging(ctx context.Context, logLevel, logFormat string, dedupWindow time.Duration, output io.Writer) error {
 	// Parse log level
 	level, err := logrus.ParseLevel(logLevel)
 	if err != nil {
@@ -66,11 +234,24 @@ func SetupLogging(logLevel string) error {
 	}
 	logrus.SetLevel(level)
 
-	// Configure formatter with consistent structure
-	logrus.SetFormatter(log.NewFormatter(false))
+	// Configure formatter with consistent structure, files don't get terminal colors
+	if output != nil {
+		logrus.SetOutput(output)
+	}
+	var formatter logrus.Formatter = log.NewFormatter(output != nil)
+	if logFormat == "json" {
+		formatter = log.NewJSONFormatter()
+	}
+	if dedupWindow > 0 {
+		dedup := log.NewDedupFormatter(formatter, dedupWindow)
+		go dedup.FlushEvery(ctx, logrus.StandardLogger())
+		formatter = dedup
+	}
+	logrus.SetFormatter(formatter)
 
 	// Add common fields to all log entries
 	logrus.SetReportCaller(false) // Keep simple, don't include caller info
+	logrus.AddHook(log.CorrelationHook{})
 
 	// Add process info to context
 	logrus.WithFields(logrus.Fields{
@@ -84,14 +265,20 @@ func SetupLogging(logLevel string) error {
 
 // SetupCloseHandler creates a 'listener' on a new goroutine which will notify the
 // program if it receives an interrupt from the OS. We then handle this by calling
-// our clean up procedure and exiting the program.
-func SetupCloseHandler(cancel context.CancelFunc) {
+// our clean up procedure and exiting the program. If the clean up takes longer than
+// timeout, outstanding operations are aborted by exiting with a non-zero status.
+func SetupCloseHandler(cancel context.CancelFunc, timeout time.Duration) {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		logrus.Debug("SetupCloseHandler received an interrupt from OS. Closing session...")
 		cancel()
+		if timeout <= 0 {
+			return
+		}
+		time.Sleep(timeout)
+		logrus.WithField("timeout", timeout).Fatal("Graceful shutdown exceeded the shutdown timeout, aborting")
 	}()
 }
 
@@ -105,7 +292,7 @@ func main() {
 	}
 
 	// Parse CLI arguments
-	config, err := ParseCLI(os.Args)
+	config, err := ParseCLI(os.Args[1:])
 	if err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			os.Exit(0)
@@ -115,40 +302,415 @@ func main() {
 	}
 
 	// Setup logging
-	if err := SetupLogging(config.LogLevel); err != nil {
-		logrus.WithError(err).Fatal("Failed to setup logging")
-	}
-
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	SetupCloseHandler(cancel)
+
+	var logOutput io.Writer
+	if config.LogFile != "" {
+		logFile, err := log.NewFile(log.FileOptions{
+			Filename:   config.LogFile,
+			MaxSizeMB:  config.LogMaxSize,
+			MaxAgeDays: config.LogMaxAge,
+			MaxBackups: config.LogMaxBackups,
+		})
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to setup logging")
+		}
+		defer func() { _ = logFile.Close() }()
+		if config.LogRotate > 0 {
+			go log.RotateEvery(ctx, logFile, config.LogRotate)
+		}
+		logOutput = logFile
+	}
+	if err := SetupLogging(ctx, config.LogLevel, config.LogFormat, config.LogDedup, logOutput); err != nil {
+		logrus.WithError(err).Fatal("Failed to setup logging")
+	}
+	SetupCloseHandler(cancel, config.ShutdownTimeout)
+
+	// Run the preflight checks instead of the daemon if requested
+	if config.Validate.requested {
+		os.Exit(runValidate(ctx, config))
+	}
+	if config.Snapshot.requested {
+		os.Exit(runSnapshot(ctx, config))
+	}
+	if config.Rollback.requested {
+		os.Exit(runRollback(ctx, config))
+	}
+	if config.Import.requested {
+		os.Exit(runImport(ctx, config))
+	}
+	if config.Dump.requested {
+		os.Exit(runDump(ctx, config))
+	}
+
+	// Failpoints inject failures for resilience testing and are never enabled in production
+	if ok, err := failpoint.LoadEnv(); err != nil {
+		logrus.WithError(err).Fatal("Failed to enable failpoints")
+	} else if ok {
+		logrus.WithField("failpoints", os.Getenv(failpoint.Env)).Warn("Failpoints enabled, failures are injected for resilience testing")
+	}
+
+	// Export spans of the sync pipeline if requested, the default tracer provider discards them
+	if config.OTLPTracing {
+		shutdown, err := tracing.Setup(ctx, version)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to setup tracing")
+		}
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(shutdownCtx); err != nil {
+				logrus.WithError(err).Warn("Failed to flush trace spans")
+			}
+		}()
+	}
 
 	// Connect to PostgreSQL with retry logic
-	pgPool, err := sync.NewWithRetry(ctx, config.PostgresDSN)
+	poolSettings := sync.PoolSettings{
+		MaxConns:          config.PgMaxConns,
+		MinConns:          config.PgMinConns,
+		MaxConnLifetime:   config.PgConnLifetime,
+		MaxConnIdleTime:   config.PgConnIdleTime,
+		HealthCheckPeriod: config.PgHealthCheck,
+		SimpleProtocol:    config.PgSimpleProto,
+	}
+	slowOps := sync.SlowOps{Threshold: config.SlowOpThreshold}
+	pgPool, err := sync.NewWithRetry(ctx, config.PostgresDSN, poolSettings.Apply, slowOps.ApplyPostgreSQL)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to connect to PostgreSQL after retries")
 	}
 	defer pgPool.Close()
 
+	// Mirror every tenant prefix into its own schema instead of the schema of the DSN
+	if len(config.Tenants) > 0 {
+		runTenants(ctx, cancel, config, pgPool, poolSettings.Apply, slowOps.ApplyPostgreSQL)
+		return
+	}
+
+	// Bring the schema up to date if requested and refuse to run against an older one
+	if config.Migrate {
+		if err := sync.MigrateSchema(ctx, pgPool); err != nil {
+			logrus.WithError(err).Fatal("Failed to apply database migrations")
+		}
+	}
+	if err := migrations.CheckCompatibility(ctx, pgPool); err != nil {
+		logrus.WithError(err).Fatal("Incompatible database schema")
+	}
+
+	// Bridge the Consul KV store instead of etcd if requested
+	if config.ConsulDSN != "" {
+		runConsul(ctx, cancel, config, pgPool)
+		return
+	}
+
 	// Connect to etcd with retry logic
-	etcdClient, err := sync.NewEtcdClientWithRetry(ctx, config.EtcdDSN)
+	etcdTLS := config.etcdTLS()
+	etcdClient, err := sync.NewEtcdClientWithRetry(ctx, config.EtcdDSN, etcdTLS.Apply, slowOps.ApplyEtcd, sync.ApplyFailpoints)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to connect to etcd after retries")
 	}
 	defer func() { _ = etcdClient.Close() }()
 
+	// Connect to secondary clusters, they are configured by their DSN only
+	var replicas []*sync.Replica
+	for _, dsn := range config.EtcdReplicas {
+		replica, err := sync.NewReplica(ctx, dsn)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to connect to etcd replica after retries")
+		}
+		defer func() { _ = replica.Client.Close() }()
+		replicas = append(replicas, replica)
+	}
+
+	// Record every applied change for compliance if requested
+	var auditLog sync.AuditLog
+	switch {
+	case config.AuditLogTable && config.AuditLogFile != "":
+		logrus.Fatal("--audit-log-table and --audit-log-file are mutually exclusive")
+	case config.AuditLogTable:
+		auditLog = sync.NewTableAuditLog(pgPool)
+	case config.AuditLogFile != "":
+		fileLog, err := sync.NewFileAuditLog(config.AuditLogFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to open audit log")
+		}
+		defer func() { _ = fileLog.Close() }()
+		auditLog = fileLog
+	}
+
+	// Survive short PostgreSQL outages without losing watch events to etcd compaction
+	var spill *sync.SpillQueue
+	if config.SpillDir != "" {
+		if spill, err = sync.NewSpillQueue(config.SpillDir, int64(config.SpillMaxSize)<<20); err != nil {
+			logrus.WithError(err).Fatal("Failed to open spill directory")
+		}
+	}
+
+	// Every metric prefix is a label value, keep the number of series bounded
+	if len(config.MetricPrefixes) > sync.MaxMetricPrefixes {
+		logrus.Fatalf("At most %d --metrics-prefix values are allowed", sync.MaxMetricPrefixes)
+	}
+
 	// Parse polling interval
 	pollingInterval, err := time.ParseDuration(config.PollingInterval)
 	if err != nil {
 		logrus.WithError(err).Fatal("Invalid polling interval format")
 	}
 
+	schemas, err := config.keySchemas()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid JSON Schema")
+	}
+	decoders, err := config.valueDecoders()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid decoder")
+	}
+	retention, err := config.retentionPolicies()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid retention policy")
+	}
+	secrets, err := config.secretRules()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid secret pattern")
+	}
+
 	// Create and start sync service
-	syncService := sync.NewService(pgPool, etcdClient, pollingInterval)
+	syncService := sync.NewService(pgPool, etcdClient, sync.WithConfig(sync.Config{
+		PostgresDSN:       config.PostgresDSN,
+		EtcdDSN:           config.EtcdDSN,
+		LogLevel:          config.LogLevel,
+		PollingInterval:   pollingInterval,
+		CaptureMode:       config.PgCapture,
+		NotifyChannel:     config.NotifyChannel,
+		StatementTimeout:  config.PgStmtTimeout,
+		HistoryMode:       config.History,
+		StorageMode:       config.Storage,
+		IngestMode:        config.IngestMode,
+		AuditInterval:     config.AuditInterval,
+		AutoResync:        sync.AutoResync{Threshold: config.ResyncThreshold, MinInterval: config.ResyncInterval},
+		CompactInterval:   config.CompactInterval,
+		LagThreshold:      config.LagThreshold,
+		HeartbeatInterval: config.Heartbeat,
+		MaxSyncAttempts:   config.MaxSyncAttempts,
+		BacklogAlert: sync.BacklogAlert{
+			MaxAge:         config.BacklogMaxAge,
+			MaxRecords:     config.BacklogMaxRows,
+			HardMaxAge:     config.BacklogAgeLimit,
+			HardMaxRecords: config.BacklogRowLimit,
+			Reject:         config.BacklogReject,
+			Webhook:        config.BacklogWebhook,
+		},
+		ReadOnly:     config.ReadOnly,
+		Replicas:     replicas,
+		AuditLog:     auditLog,
+		Spill:        spill,
+		RecentEvents: config.RecentEvents,
+		Version:      version,
+
+		CompressThreshold: config.CompressMin,
+		ChunkPrefixes:     config.ChunkPrefixes,
+		Schemas:           schemas,
+		Dedup:             config.Dedup,
+		Decoders:          decoders,
+		KeyPath:           config.KeyPath,
+		KeyPolicy:         config.KeyPolicy,
+		MaxKeyBytes:       config.MaxKeyBytes,
+		Retention:         retention,
+		Secrets:           secrets,
+
+		Prefixes:               config.Prefixes,
+		MetricPrefixes:         config.MetricPrefixes,
+		InitialSyncConcurrency: config.SyncConcurrency,
+	}))
+
+	// Standbys of an active/passive setup wait for the leadership before syncing
+	var election *sync.Election
+	if config.LeaderElection {
+		election, err = sync.NewElection(etcdClient, syncService.InstanceName(), config.ElectionTTL)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to set up leader election")
+		}
+		defer election.Resign(context.Background())
+		syncService.SetElection(election)
+	}
+
+	if config.AdminListen != "" || config.MetricsSink != metrics.SinkPrometheus {
+		if err := metrics.RegisterPoolStats(pgPool.Stat); err != nil {
+			logrus.WithError(err).Fatal("Failed to register pool metrics")
+		}
+		if err := metrics.RegisterEtcdConnectionState(etcdClient.ConnectionState); err != nil {
+			logrus.WithError(err).Fatal("Failed to register etcd metrics")
+		}
+	}
+
+	// Push metrics to a StatsD agent for environments not scraping endpoints
+	if config.MetricsSink != metrics.SinkPrometheus {
+		statsd, err := metrics.NewStatsD(config.StatsDAddress, config.MetricsSink)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to set up statsd metrics")
+		}
+		go statsd.Run(ctx)
+	}
+
+	// Start admin listener with metrics and status endpoints
+	if config.AdminListen != "" {
+		adminServer := admin.NewServer(config.AdminListen, func() any { return syncService.Status() })
+		if config.EnablePprof {
+			adminServer.EnablePprof()
+		}
+		if config.AdminToken != "" {
+			adminServer.EnableControl(config.AdminToken, adminControl(syncService))
+		}
+		adminServer.Start()
+		defer func() { _ = adminServer.Shutdown(context.Background()) }()
+	}
+	defer startGRPCAdmin(config, syncService)()
+	defer startREST(config, pgPool)()
+	defer startFacade(ctx, config, pgPool)()
+
+	if config.EnablePprof && config.AdminListen == "" {
+		logrus.Warn("--enable-pprof has no effect without --admin-listen")
+	}
+	if config.AdminToken != "" && config.AdminListen == "" && config.AdminGRPCListen == "" {
+		logrus.Warn("--admin-token has no effect without --admin-listen or --admin-grpc-listen")
+	}
+	if config.RESTToken != "" && config.RESTListen == "" {
+		logrus.Warn("--rest-token has no effect without --rest-listen")
+	}
+	backlogLimits := config.BacklogAgeLimit > 0 || config.BacklogRowLimit > 0
+	if config.BacklogWebhook != "" && config.BacklogMaxAge == 0 && config.BacklogMaxRows == 0 && !backlogLimits {
+		logrus.Warn("--backlog-webhook has no effect without --backlog-age-threshold, --backlog-depth-threshold or a backlog limit")
+	}
+	if config.BacklogReject && !backlogLimits {
+		logrus.Warn("--backlog-reject has no effect without --backlog-age-limit or --backlog-depth-limit")
+	}
+
+	// Stay paused while attached to a standby, writes are only possible after promotion
+	if err := sync.WaitForPrimary(ctx, pgPool, pollingInterval); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Fatal("Failed to check PostgreSQL recovery state")
+	}
+	if config.KeyPath {
+		if err := sync.SetKeyPath(ctx, pgPool, true); err != nil {
+			logrus.WithError(err).Fatal("Failed to enable key paths")
+		}
+	}
+	if config.ReadOnly {
+		if err := sync.SetReadOnly(ctx, pgPool, true); err != nil {
+			logrus.WithError(err).Fatal("Failed to enable read-only mirror")
+		}
+	}
+
+	if election != nil {
+		if err := election.Campaign(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.WithError(err).Fatal("Leader election failed")
+		}
+		election.Monitor(ctx, cancel)
+	}
+
+	// Guarantee a single writer per schema and prefix. Session level advisory locks are not
+	// reliable behind a transaction pooler, so a single instance must be ensured by deployment.
+	if config.PgSimpleProto {
+		logrus.Warn("Instance lock disabled with --pg-simple-protocol, make sure only one instance runs per prefix")
+	} else {
+		lock, err := sync.AcquireInstanceLock(ctx, pgPool, syncService.InstanceName(), config.InstanceLock, pollingInterval)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to acquire instance lock")
+		}
+		defer lock.Release(context.Background())
+		lock.Monitor(ctx, cancel)
+	}
+
 	if err := syncService.Start(ctx); err != nil && ctx.Err() == nil {
 		logrus.WithError(err).Fatal("Synchronization failed")
 	}
 
 	logrus.Info("Graceful shutdown completed")
 }
+
+// adminControl returns the runtime controls of the sync service served by the admin listeners
+func adminControl(syncService *sync.Service) admin.Control {
+	return admin.Control{
+		Pause:       syncService.Pause,
+		Resume:      syncService.Resume,
+		Resync:      syncService.Resync,
+		Checkpoints: func(ctx context.Context) (any, error) { return syncService.Checkpoints(ctx) },
+		Recent:      func() any { return syncService.Recent() },
+		Events: func(ctx context.Context) <-chan any {
+			events := make(chan any)
+			go func() {
+				defer close(events)
+				for entry := range syncService.SubscribeAudit(ctx) {
+					select {
+					case events <- entry:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return events
+		},
+	}
+}
+
+// startGRPCAdmin starts the gRPC admin listener if requested and returns its shutdown function
+func startGRPCAdmin(config *Config, syncService *sync.Service) func() {
+	if config.AdminGRPCListen == "" {
+		return func() {}
+	}
+	grpcServer := admin.NewGRPCServer(config.AdminGRPCListen, func() any { return syncService.Status() })
+	if config.AdminToken != "" {
+		grpcServer.EnableControl(config.AdminToken, adminControl(syncService))
+	}
+	if err := grpcServer.Start(); err != nil {
+		logrus.WithError(err).Fatal("Failed to start gRPC admin listener")
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = grpcServer.Shutdown(ctx)
+	}
+}
+
+// startREST starts the key API listener if requested and returns its shutdown function
+func startREST(config *Config, pgPool *pgxpool.Pool) func() {
+	if config.RESTListen == "" {
+		return func() {}
+	}
+	if config.RESTToken == "" {
+		logrus.Warn("Key API of --rest-listen is open to every client, set --rest-token to require a token")
+	}
+	restServer := rest.NewServer(config.RESTListen, pgPool, config.Storage, config.RESTToken)
+	restServer.Start()
+	return func() { _ = restServer.Shutdown(context.Background()) }
+}
+
+// startFacade starts the etcd façade listener if requested and returns its shutdown function
+func startFacade(ctx context.Context, config *Config, pgPool *pgxpool.Pool) func() {
+	if config.FacadeListen == "" {
+		return func() {}
+	}
+	if config.Storage == sync.StorageLatest {
+		logrus.Fatal("--etcd-facade-listen requires --storage=history")
+	}
+	if config.NotifyChannel == "" {
+		logrus.Fatal("--etcd-facade-listen requires --notify-channel to follow changes")
+	}
+	facadeServer := facade.NewServer(config.FacadeListen, pgPool)
+	if err := facadeServer.Start(); err != nil {
+		logrus.WithError(err).Fatal("Failed to start etcd façade listener")
+	}
+	go sync.ListenNotifications(ctx, pgPool, config.NotifyChannel, facadeServer.Notify)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = facadeServer.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// RollbackCommand is the rollback subcommand restoring the keys of the prefixes from the history in PostgreSQL
+type RollbackCommand struct {
+	ToRevision  int64  `long:"to-revision" description:"etcd revision to restore the keys of the prefixes to"`
+	ToTimestamp string `long:"to-timestamp" description:"Point in time to restore the keys of the prefixes to, in RFC 3339 format"`
+	DryRun      bool   `long:"dry-run" description:"Only print the changes, leave etcd alone"`
+
+	requested bool
+}
+
+// Execute marks the subcommand requested, the rollback runs once logging is set up
+func (c *RollbackCommand) Execute([]string) error {
+	if (c.ToRevision > 0) == (c.ToTimestamp != "") {
+		return errors.New("rollback needs either --to-revision or --to-timestamp")
+	}
+	if c.ToTimestamp != "" {
+		if _, err := time.Parse(time.RFC3339, c.ToTimestamp); err != nil {
+			return fmt.Errorf("invalid --to-timestamp: %w", err)
+		}
+	}
+	c.requested = true
+	return nil
+}
+
+// runRollback prints the changes restoring the synced prefixes to the requested revision and applies them
+// to etcd unless --dry-run is set. It returns the exit status.
+func runRollback(ctx context.Context, config *Config) int {
+	if config.Storage == sync.StorageLatest {
+		logrus.Error("Rollback needs the history, it is not available with --storage=latest")
+		return 1
+	}
+	pgPool, err := sync.NewWithRetry(ctx, config.PostgresDSN)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to connect to PostgreSQL after retries")
+		return 1
+	}
+	defer pgPool.Close()
+	etcdTLS := config.etcdTLS()
+	etcdClient, err := sync.NewEtcdClientWithRetry(ctx, config.EtcdDSN, etcdTLS.Apply)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to connect to etcd after retries")
+		return 1
+	}
+	defer func() { _ = etcdClient.Close() }()
+	prefixes := config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{etcdClient.Prefix()}
+	}
+
+	revision := config.Rollback.ToRevision
+	if config.Rollback.ToTimestamp != "" {
+		ts, _ := time.Parse(time.RFC3339, config.Rollback.ToTimestamp)
+		if revision, err = sync.RevisionAt(ctx, pgPool, ts); err != nil {
+			logrus.WithError(err).Error("Failed to resolve rollback timestamp")
+			return 1
+		}
+	}
+
+	var changes []sync.RollbackChange
+	for _, prefix := range prefixes {
+		planned, err := sync.PlanRollback(ctx, pgPool, prefix, revision)
+		if err != nil {
+			logrus.WithError(err).WithField("prefix", prefix).Error("Failed to plan rollback")
+			return 1
+		}
+		for i := range planned {
+			planned[i].Key = sync.EtcdKey(planned[i].Key, config.KeyPolicy)
+		}
+		changes = append(changes, planned...)
+	}
+	printRollback(os.Stdout, changes)
+	logger := logrus.WithFields(logrus.Fields{"revision": revision, "changes": len(changes)})
+	if config.Rollback.DryRun || len(changes) == 0 {
+		logger.Info("Rollback planned, etcd left alone")
+		return 0
+	}
+	applied, err := etcdClient.ApplyRollback(ctx, changes)
+	if err != nil {
+		logger.WithError(err).Error("Failed to apply rollback")
+		return 1
+	}
+	logger.WithField("etcd_revision", applied).Info("Rollback applied")
+	return 0
+}
+
+// printRollback writes the changes as a diff, + for keys put back, - for deleted keys and ~ for changed values
+func printRollback(w io.Writer, changes []sync.RollbackChange) {
+	for _, change := range changes {
+		switch {
+		case change.Delete:
+			_, _ = fmt.Fprintf(w, "- %s %s\n", change.Key, strconv.Quote(change.CurrentValue))
+		case change.CurrentRevision == 0:
+			_, _ = fmt.Fprintf(w, "+ %s %s\n", change.Key, strconv.Quote(change.Value))
+		default:
+			_, _ = fmt.Fprintf(w, "~ %s %s -> %s\n", change.Key, strconv.Quote(change.CurrentValue), strconv.Quote(change.Value))
+		}
+	}
+}
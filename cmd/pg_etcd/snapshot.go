@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// SnapshotCommand is the snapshot subcommand writing the keys of the prefixes instead of running the daemon
+type SnapshotCommand struct {
+	Revision     int64  `long:"revision" description:"etcd revision of the snapshot, e.g. to repeat an earlier one (defaults to the current revision)"`
+	Output       string `short:"o" long:"output" description:"Write the snapshot to this file instead of stdout"`
+	FromPostgres bool   `long:"from-postgres" description:"Read the keys from the PostgreSQL mirror instead of etcd, e.g. to restore a lost cluster (defaults to the latest mirrored revision)"`
+	Format       string `long:"format" description:"Output format: JSON or a shell script restoring the keys with etcdctl (json if empty)" choice:"json" choice:"etcdctl"`
+
+	requested bool
+}
+
+// Execute marks the subcommand requested, the snapshot is taken once logging is set up
+func (c *SnapshotCommand) Execute([]string) error {
+	c.requested = true
+	return nil
+}
+
+// runSnapshot writes the snapshots of the synced prefixes as a JSON array or etcdctl script and returns the exit
+// status. All prefixes are read at the revision of the first one, so the snapshots are consistent with each other.
+func runSnapshot(ctx context.Context, config *Config) int {
+	var snapshots []*sync.Snapshot
+	var revision int64
+	var err error
+	if config.Snapshot.FromPostgres {
+		snapshots, revision, err = mirrorSnapshots(ctx, config)
+	} else {
+		snapshots, revision, err = etcdSnapshots(ctx, config)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to take snapshot")
+		return 1
+	}
+
+	var output io.Writer = os.Stdout
+	if config.Snapshot.Output != "" {
+		file, err := os.Create(config.Snapshot.Output)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to create snapshot file")
+			return 1
+		}
+		defer func() { _ = file.Close() }()
+		output = file
+	}
+	if config.Snapshot.Format == "etcdctl" {
+		err = writeEtcdctlScript(output, snapshots)
+	} else {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(snapshots)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to write snapshot")
+		return 1
+	}
+	logrus.WithField("revision", revision).Info("Snapshot written")
+	return 0
+}
+
+// etcdSnapshots reads the snapshots of the synced prefixes from etcd and returns them with their revision
+func etcdSnapshots(ctx context.Context, config *Config) ([]*sync.Snapshot, int64, error) {
+	etcdTLS := config.etcdTLS()
+	etcdClient, err := sync.NewEtcdClientWithRetry(ctx, config.EtcdDSN, etcdTLS.Apply)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to connect to etcd after retries: %w", err)
+	}
+	defer func() { _ = etcdClient.Close() }()
+	prefixes := config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{etcdClient.Prefix()}
+	}
+	service := sync.NewService(nil, etcdClient, sync.WithPrefix(prefixes...))
+
+	snapshots := make([]*sync.Snapshot, 0, len(prefixes))
+	revision := config.Snapshot.Revision
+	for _, prefix := range prefixes {
+		var snapshot *sync.Snapshot
+		if revision > 0 {
+			snapshot, err = service.SnapshotAt(ctx, prefix, revision)
+		} else {
+			snapshot, err = service.Snapshot(ctx, prefix)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("prefix %s: %w", prefix, err)
+		}
+		revision = snapshot.Revision
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, revision, nil
+}
+
+// mirrorSnapshots reads the snapshots of the synced prefixes from the PostgreSQL mirror and returns them with
+// their revision, etcd is not contacted
+func mirrorSnapshots(ctx context.Context, config *Config) ([]*sync.Snapshot, int64, error) {
+	prefix, _, err := sync.KeyScope(config.EtcdDSN)
+	if err != nil {
+		return nil, 0, err
+	}
+	prefixes := config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{prefix}
+	}
+	pgPool, err := sync.NewWithRetry(ctx, config.PostgresDSN)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to connect to PostgreSQL after retries: %w", err)
+	}
+	defer pgPool.Close()
+	service := sync.NewService(pgPool, nil, sync.WithConfig(sync.Config{
+		StorageMode: config.Storage,
+		KeyPolicy:   config.KeyPolicy,
+		Prefixes:    prefixes,
+	}))
+
+	snapshots := make([]*sync.Snapshot, 0, len(prefixes))
+	revision := config.Snapshot.Revision
+	for _, prefix := range prefixes {
+		snapshot, err := service.SnapshotFromMirror(ctx, prefix, revision)
+		if err != nil {
+			return nil, 0, fmt.Errorf("prefix %s: %w", prefix, err)
+		}
+		revision = snapshot.Revision
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, revision, nil
+}
+
+// writeEtcdctlScript writes the snapshots as a shell script putting every key with etcdctl, e.g. to restore a
+// fresh cluster. Values are piped to etcdctl, so their size is not limited by the shell. Leases are left out,
+// they do not survive the cluster.
+func writeEtcdctlScript(w io.Writer, snapshots []*sync.Snapshot) error {
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintln(bw, "#!/bin/sh")
+	_, _ = fmt.Fprintln(bw, "# Restores the keys of a pg_etcd snapshot, etcdctl connects to $ETCDCTL_ENDPOINTS")
+	_, _ = fmt.Fprintln(bw, "set -e")
+	for _, snapshot := range snapshots {
+		_, _ = fmt.Fprintf(bw, "# prefix %s at revision %d\n", shellQuote(snapshot.Prefix), snapshot.Revision)
+		for _, kv := range snapshot.KVs {
+			if kv.Value == "" {
+				// etcdctl rejects an empty stdin
+				_, _ = fmt.Fprintf(bw, "etcdctl put -- %s '' >/dev/null\n", shellQuote(kv.Key))
+				continue
+			}
+			_, _ = fmt.Fprintf(bw, "printf '%%s' %s | etcdctl put -- %s >/dev/null\n", shellQuote(kv.Value), shellQuote(kv.Key))
+		}
+	}
+	return bw.Flush()
+}
+
+// shellQuote quotes s as a single argument of a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
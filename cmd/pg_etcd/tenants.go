@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/admin"
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+	"github.com/cybertec-postgresql/pg_etcd/internal/migrations"
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// runTenants synchronizes every --tenant prefix with the mirror in its own schema until ctx is done.
+// Every tenant runs a service of its own on a pool resolving the mirror in the tenant schema. Options
+// spanning all prefixes, e.g. compaction, leader election, replicas and the key APIs, are ignored.
+func runTenants(ctx context.Context, cancel context.CancelFunc, config *Config, pgPool *pgxpool.Pool, poolConfig ...func(*pgxpool.Config) error) {
+	tenants, err := sync.ParseTenants(config.Tenants)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid tenant mapping")
+	}
+	if len(config.Prefixes) > 0 {
+		logrus.Warn("--prefix has no effect with --tenant")
+	}
+	if config.PgCapture == sync.CaptureLogical {
+		logrus.Fatal("--pg-capture=logical is not supported with --tenant, the replication slot spans all schemas")
+	}
+	for flag, set := range map[string]bool{
+		"--etcd-compact-interval": config.CompactInterval > 0,
+		"--leader-election":       config.LeaderElection,
+		"--etcd-replica-dsn":      len(config.EtcdReplicas) > 0,
+		"--spill-dir":             config.SpillDir != "",
+		"--audit-log-file":        config.AuditLogFile != "",
+		"--admin-token":           config.AdminToken != "",
+		"--admin-grpc-listen":     config.AdminGRPCListen != "",
+		"--rest-listen":           config.RESTListen != "",
+		"--etcd-facade-listen":    config.FacadeListen != "",
+		"--metrics-sink":          config.MetricsSink != metrics.SinkPrometheus,
+	} {
+		if set {
+			logrus.WithField("flag", flag).Warn("Flag has no effect with --tenant")
+		}
+	}
+
+	pollingInterval, err := time.ParseDuration(config.PollingInterval)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid polling interval format")
+	}
+	schemas, err := config.keySchemas()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid JSON Schema")
+	}
+	decoders, err := config.valueDecoders()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid decoder")
+	}
+	retention, err := config.retentionPolicies()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid retention policy")
+	}
+	secrets, err := config.secretRules()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid secret pattern")
+	}
+	etcdTLS := config.etcdTLS()
+	slowOps := sync.SlowOps{Threshold: config.SlowOpThreshold}
+	etcdClient, err := sync.NewEtcdClientWithRetry(ctx, config.EtcdDSN, etcdTLS.Apply, slowOps.ApplyEtcd, sync.ApplyFailpoints)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to connect to etcd after retries")
+	}
+	defer func() { _ = etcdClient.Close() }()
+
+	// Stay paused while attached to a standby, the schemas can only be created after promotion
+	if err := sync.WaitForPrimary(ctx, pgPool, pollingInterval); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Fatal("Failed to check PostgreSQL recovery state")
+	}
+
+	services := make(map[string]*sync.Service, len(tenants))
+	for _, tenant := range tenants {
+		logger := logrus.WithFields(logrus.Fields{"prefix": tenant.Prefix, "schema": tenant.Schema})
+		if config.Migrate {
+			if err := sync.CreateTenantSchema(ctx, pgPool, tenant.Schema); err != nil {
+				logger.WithError(err).Fatal("Failed to create tenant schema")
+			}
+		}
+		pool, err := sync.NewWithRetry(ctx, config.PostgresDSN, append(poolConfig, tenant.Apply)...)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to connect to PostgreSQL after retries")
+		}
+		defer pool.Close()
+		if config.Migrate {
+			if err := sync.MigrateSchema(ctx, pool); err != nil {
+				logger.WithError(err).Fatal("Failed to apply database migrations")
+			}
+		}
+		if err := migrations.CheckCompatibility(ctx, pool); err != nil {
+			logger.WithError(err).Fatal("Incompatible database schema")
+		}
+
+		history := tenant.History
+		if history == "" {
+			history = config.History
+		}
+		var auditLog sync.AuditLog
+		if config.AuditLogTable {
+			auditLog = sync.NewTableAuditLog(pool)
+		}
+		service := sync.NewService(pool, etcdClient, sync.WithConfig(sync.Config{
+			PostgresDSN:       config.PostgresDSN,
+			EtcdDSN:           config.EtcdDSN,
+			LogLevel:          config.LogLevel,
+			PollingInterval:   pollingInterval,
+			CaptureMode:       config.PgCapture,
+			NotifyChannel:     config.NotifyChannel,
+			StatementTimeout:  config.PgStmtTimeout,
+			HistoryMode:       history,
+			StorageMode:       config.Storage,
+			IngestMode:        config.IngestMode,
+			AuditInterval:     config.AuditInterval,
+			AutoResync:        sync.AutoResync{Threshold: config.ResyncThreshold, MinInterval: config.ResyncInterval},
+			LagThreshold:      config.LagThreshold,
+			HeartbeatInterval: config.Heartbeat,
+			MaxSyncAttempts:   config.MaxSyncAttempts,
+			BacklogAlert: sync.BacklogAlert{
+				MaxAge:         config.BacklogMaxAge,
+				MaxRecords:     config.BacklogMaxRows,
+				HardMaxAge:     config.BacklogAgeLimit,
+				HardMaxRecords: config.BacklogRowLimit,
+				Reject:         config.BacklogReject,
+				Webhook:        config.BacklogWebhook,
+			},
+			ReadOnly:     config.ReadOnly,
+			AuditLog:     auditLog,
+			RecentEvents: config.RecentEvents,
+			Version:      version,
+			Tenant:       tenant.Schema,
+
+			CompressThreshold: config.CompressMin,
+			ChunkPrefixes:     config.ChunkPrefixes,
+			Schemas:           schemas,
+			Dedup:             config.Dedup,
+			Decoders:          decoders,
+			KeyPath:           config.KeyPath,
+			KeyPolicy:         config.KeyPolicy,
+			MaxKeyBytes:       config.MaxKeyBytes,
+			Retention:         retention,
+			Secrets:           secrets,
+
+			Prefixes:       []string{tenant.Prefix},
+			MetricPrefixes: []string{tenant.Prefix},
+		}))
+		if config.KeyPath {
+			if err := sync.SetKeyPath(ctx, pool, true); err != nil {
+				logger.WithError(err).Fatal("Failed to enable key paths")
+			}
+		}
+		if config.ReadOnly {
+			if err := sync.SetReadOnly(ctx, pool, true); err != nil {
+				logger.WithError(err).Fatal("Failed to enable read-only mirror")
+			}
+		}
+		if config.PgSimpleProto {
+			logger.Warn("Instance lock disabled with --pg-simple-protocol, make sure only one instance runs per tenant")
+		} else {
+			lock, err := sync.AcquireInstanceLock(ctx, pool, service.InstanceName(), config.InstanceLock, pollingInterval)
+			if err != nil {
+				logger.WithError(err).Fatal("Failed to acquire instance lock")
+			}
+			defer lock.Release(context.Background())
+			lock.Monitor(ctx, cancel)
+		}
+		services[tenant.Schema] = service
+	}
+
+	if config.AdminListen != "" {
+		adminServer := admin.NewServer(config.AdminListen, func() any {
+			status := make(map[string]sync.Status, len(services))
+			for schema, service := range services {
+				status[schema] = service.Status()
+			}
+			return status
+		})
+		if config.EnablePprof {
+			adminServer.EnablePprof()
+		}
+		adminServer.Start()
+		defer func() { _ = adminServer.Shutdown(context.Background()) }()
+	}
+
+	errs := make(chan error, len(services))
+	for _, service := range services {
+		go func() { errs <- service.Start(ctx) }()
+	}
+	for range services {
+		if err := <-errs; err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Fatal("Synchronization failed")
+		}
+	}
+	logrus.Info("Graceful shutdown completed")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// runValidate runs the preflight checks of the validate subcommand, prints the JSON report to stdout and
+// returns the exit status, 1 if a check failed. Connections are tried once, a failure is reported as check.
+func runValidate(ctx context.Context, config *Config) int {
+	report := sync.NewValidationReport()
+	etcdTLS := config.etcdTLS()
+	sync.ValidateTLS(etcdTLS, report)
+
+	pgPool, err := sync.New(ctx, config.PostgresDSN)
+	if err == nil {
+		defer pgPool.Close()
+		pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err = pgPool.Ping(pingCtx)
+		cancel()
+	}
+	report.Add("postgresql_connection", "", err, "")
+	if err == nil {
+		sync.ValidatePostgreSQL(ctx, pgPool, report)
+	}
+
+	etcdClient, err := sync.NewEtcdClient(config.EtcdDSN, etcdTLS.Apply)
+	report.Add("etcd_connection", "", err, "")
+	if err == nil {
+		defer func() { _ = etcdClient.Close() }()
+		prefixes := config.Prefixes
+		if len(prefixes) == 0 {
+			prefixes = []string{etcdClient.Prefix()}
+		}
+		sync.ValidateEtcd(ctx, etcdClient, prefixes, report)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(report)
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
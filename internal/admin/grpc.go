@@ -0,0 +1,211 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// GRPCServiceName is the full name of the admin service described by admin.proto
+const GRPCServiceName = "pg_etcd.admin.v1.Admin"
+
+// GRPCServer serves the admin service of admin.proto: the status, the runtime controls and a stream of
+// applied changes. Messages are well-known protobuf types, the status and changes are JSON objects as
+// served by the HTTP admin listener.
+type GRPCServer struct {
+	addr    string
+	server  *grpc.Server
+	status  func() any
+	token   string
+	control *Control
+}
+
+// NewGRPCServer creates a gRPC admin server listening on addr, status is called for every Status call
+func NewGRPCServer(addr string, status func() any) *GRPCServer {
+	s := &GRPCServer{addr: addr, status: status}
+	s.server = grpc.NewServer(grpc.UnaryInterceptor(s.authorizeUnary), grpc.StreamInterceptor(s.authorizeStream))
+	s.server.RegisterService(&adminServiceDesc, s)
+	return s
+}
+
+// EnableControl serves Pause, Resume, Resync and Events, calls must send token as bearer token in the
+// authorization metadata. Call before Start.
+func (s *GRPCServer) EnableControl(token string, control Control) {
+	s.token = token
+	s.control = &control
+}
+
+// authorize rejects control calls without the bearer token, Status is public like /status
+func (s *GRPCServer) authorize(ctx context.Context, method string) error {
+	if method == "/"+GRPCServiceName+"/Status" {
+		return nil
+	}
+	if s.control == nil {
+		return status.Error(codes.Unimplemented, "admin controls are disabled, set --admin-token")
+	}
+	var header []string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		header = md.Get("authorization")
+	}
+	if len(header) != 1 || subtle.ConstantTimeCompare([]byte(header[0]), []byte("Bearer "+s.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return nil
+}
+
+func (s *GRPCServer) authorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) authorizeStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// Start serves calls in the background until Shutdown is called
+func (s *GRPCServer) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC admin calls: %w", err)
+	}
+	go func() {
+		logrus.WithField("address", listener.Addr().String()).Info("gRPC admin listener started")
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			logrus.WithError(err).Error("gRPC admin listener failed")
+		}
+	}()
+	return nil
+}
+
+// Shutdown gracefully stops the listener, open event streams are closed once ctx is done
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
+
+func (s *GRPCServer) getStatus(context.Context, *emptypb.Empty) (*structpb.Struct, error) {
+	return toStruct(s.status())
+}
+
+func (s *GRPCServer) pause(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	s.control.Pause()
+	return &emptypb.Empty{}, nil
+}
+
+func (s *GRPCServer) resume(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	s.control.Resume()
+	return &emptypb.Empty{}, nil
+}
+
+func (s *GRPCServer) resync(_ context.Context, prefix *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	if err := s.control.Resync(prefix.GetValue()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// events streams the applied changes until the client cancels the call or the server stops
+func (s *GRPCServer) events(stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+		return err
+	}
+	if s.control.Events == nil {
+		return status.Error(codes.Unimplemented, "event stream is not available")
+	}
+	ctx := stream.Context()
+	for event := range s.control.Events(ctx) {
+		message, err := toStruct(event)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(message); err != nil {
+			return err
+		}
+	}
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// toStruct converts v into its JSON object
+func toStruct(v any) (*structpb.Struct, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	message := &structpb.Struct{}
+	if err := message.UnmarshalJSON(data); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return message, nil
+}
+
+// unaryMethod describes a unary admin method implemented by call
+func unaryMethod[Req any, Resp proto.Message, PReq interface {
+	*Req
+	proto.Message
+}](name string, call func(*GRPCServer, context.Context, PReq) (Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := PReq(new(Req))
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return call(srv.(*GRPCServer), ctx, req.(PReq))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GRPCServiceName + "/" + name}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+// adminServiceDesc registers the service of admin.proto without generated code
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: GRPCServiceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("Status", (*GRPCServer).getStatus),
+		unaryMethod("Pause", (*GRPCServer).pause),
+		unaryMethod("Resume", (*GRPCServer).resume),
+		unaryMethod("Resync", (*GRPCServer).resync),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Events",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(*GRPCServer).events(stream)
+		},
+	}},
+	Metadata: "admin.proto",
+}
@@ -0,0 +1,105 @@
+// Package admin provides the HTTP listener serving metrics and status endpoints.
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/httpapi"
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+)
+
+// Server serves /metrics and /status on the admin listener
+type Server struct {
+	httpServer *http.Server
+	mux        *http.ServeMux
+}
+
+// NewServer creates an admin server listening on addr, status is called for every /status request
+func NewServer(addr string, status func() any) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		httpapi.WriteJSON(w, http.StatusOK, status())
+	})
+
+	return &Server{
+		httpServer: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		},
+		mux: mux,
+	}
+}
+
+// EnablePprof serves the runtime profiles of net/http/pprof under /debug/pprof/, call before Start
+func (s *Server) EnablePprof() {
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// Control are the runtime controls of the sync service served under /admin/
+type Control struct {
+	Pause       func()
+	Resume      func()
+	Resync      func(prefix string) error // all prefixes if empty
+	Checkpoints func(ctx context.Context) (any, error)
+	Recent      func() any                           // latest applied changes and failures
+	Events      func(ctx context.Context) <-chan any // changes applied from now on until ctx is done, gRPC only
+}
+
+// EnableControl serves the control endpoints, requests must send token as bearer token. Call before Start.
+func (s *Server) EnableControl(token string, control Control) {
+	s.mux.Handle("POST /admin/pause", httpapi.Authorize(token, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		control.Pause()
+		httpapi.WriteJSON(w, http.StatusOK, map[string]bool{"paused": true})
+	})))
+	s.mux.Handle("POST /admin/resume", httpapi.Authorize(token, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		control.Resume()
+		httpapi.WriteJSON(w, http.StatusOK, map[string]bool{"paused": false})
+	})))
+	s.mux.Handle("POST /admin/resync", httpapi.Authorize(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		if err := control.Resync(prefix); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		httpapi.WriteJSON(w, http.StatusAccepted, map[string]string{"resync": prefix})
+	})))
+	s.mux.Handle("GET /admin/checkpoints", httpapi.Authorize(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkpoints, err := control.Checkpoints(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpapi.WriteJSON(w, http.StatusOK, checkpoints)
+	})))
+	s.mux.Handle("GET /admin/recent", httpapi.Authorize(token, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		httpapi.WriteJSON(w, http.StatusOK, control.Recent())
+	})))
+}
+
+// Start serves requests in the background until Shutdown is called
+func (s *Server) Start() {
+	go func() {
+		logrus.WithField("address", s.httpServer.Addr).Info("Admin listener started")
+		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Error("Admin listener failed")
+		}
+	}()
+}
+
+// Shutdown gracefully stops the listener
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// TestControl tests the authentication and dispatch of the control endpoints
+func TestControl(t *testing.T) {
+	var paused bool
+	var resynced []string
+	server := NewServer(":0", func() any { return nil })
+	server.EnableControl("secret", Control{
+		Pause:  func() { paused = true },
+		Resume: func() { paused = false },
+		Resync: func(prefix string) error {
+			if prefix == "/unknown/" {
+				return errors.New("prefix is not synchronized")
+			}
+			resynced = append(resynced, prefix)
+			return nil
+		},
+		Checkpoints: func(context.Context) (any, error) { return []int{1}, nil },
+		Recent:      func() any { return map[string][]int{"applied": {2}} },
+	})
+
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.mux.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/admin/pause", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/admin/pause", "wrong").Code)
+	assert.False(t, paused)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/admin/pause", "secret").Code)
+	assert.True(t, paused)
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodGet, "/admin/resume", "secret").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/admin/resume", "secret").Code)
+	assert.False(t, paused)
+
+	assert.Equal(t, http.StatusAccepted, request(http.MethodPost, "/admin/resync?prefix=/config/", "secret").Code)
+	assert.Equal(t, http.StatusAccepted, request(http.MethodPost, "/admin/resync", "secret").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/admin/resync?prefix=/unknown/", "secret").Code)
+	assert.Equal(t, []string{"/config/", ""}, resynced)
+
+	w := request(http.MethodGet, "/admin/checkpoints", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, "[1]", w.Body.String())
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/admin/recent", "").Code)
+	w = request(http.MethodGet, "/admin/recent", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"applied":[2]}`, w.Body.String())
+}
+
+// TestGRPCServer tests the authentication and dispatch of the gRPC admin service
+func TestGRPCServer(t *testing.T) {
+	var paused bool
+	var resynced []string
+	server := NewGRPCServer(":0", func() any { return map[string]any{"paused": paused} })
+
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.server.Serve(listener) }()
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	ctx := context.Background()
+	method := func(name string) string { return "/" + GRPCServiceName + "/" + name }
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+
+	// Without a token only the status is served
+	statusDoc := &structpb.Struct{}
+	require.NoError(t, conn.Invoke(ctx, method("Status"), &emptypb.Empty{}, statusDoc))
+	assert.Equal(t, false, statusDoc.AsMap()["paused"])
+	err = conn.Invoke(authorized, method("Pause"), &emptypb.Empty{}, &emptypb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	events := make(chan any, 1)
+	server.EnableControl("secret", Control{
+		Pause:  func() { paused = true },
+		Resume: func() { paused = false },
+		Resync: func(prefix string) error {
+			if prefix == "/unknown/" {
+				return errors.New("prefix is not synchronized")
+			}
+			resynced = append(resynced, prefix)
+			return nil
+		},
+		Events: func(ctx context.Context) <-chan any {
+			go func() {
+				<-ctx.Done()
+				close(events)
+			}()
+			return events
+		},
+	})
+
+	err = conn.Invoke(ctx, method("Pause"), &emptypb.Empty{}, &emptypb.Empty{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.False(t, paused)
+	require.NoError(t, conn.Invoke(authorized, method("Pause"), &emptypb.Empty{}, &emptypb.Empty{}))
+	assert.True(t, paused)
+	require.NoError(t, conn.Invoke(ctx, method("Status"), &emptypb.Empty{}, statusDoc))
+	assert.Equal(t, true, statusDoc.AsMap()["paused"])
+	require.NoError(t, conn.Invoke(authorized, method("Resume"), &emptypb.Empty{}, &emptypb.Empty{}))
+	assert.False(t, paused)
+
+	require.NoError(t, conn.Invoke(authorized, method("Resync"), wrapperspb.String("/config/"), &emptypb.Empty{}))
+	err = conn.Invoke(authorized, method("Resync"), wrapperspb.String("/unknown/"), &emptypb.Empty{})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, []string{"/config/"}, resynced)
+
+	// Applied changes are streamed until the client cancels the call
+	streamCtx, cancel := context.WithCancel(authorized)
+	stream, err := conn.NewStream(streamCtx, &grpc.StreamDesc{ServerStreams: true}, method("Events"))
+	require.NoError(t, err)
+	require.NoError(t, stream.SendMsg(&emptypb.Empty{}))
+	require.NoError(t, stream.CloseSend())
+	events <- map[string]any{"key": "/config/a", "revision": 42}
+	event := &structpb.Struct{}
+	require.NoError(t, stream.RecvMsg(event))
+	assert.Equal(t, map[string]any{"key": "/config/a", "revision": float64(42)}, event.AsMap())
+	cancel()
+	assert.Equal(t, codes.Canceled, status.Code(stream.RecvMsg(event)))
+}
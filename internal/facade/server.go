@@ -0,0 +1,289 @@
+// Package facade serves a read-only subset of the etcd gRPC API from the PostgreSQL mirror, so etcd
+// clients can read current and historical revisions without load on the etcd cluster.
+package facade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	stdsync "sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/sirupsen/logrus"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// errReadOnly rejects every change, writes must go to the etcd cluster
+var errReadOnly = status.Error(codes.Unimplemented, "pg_etcd façade is read-only, send changes to the etcd cluster")
+
+// Server implements the etcd KV service for Range and the Watch service on the history storage.
+// The current revision is the revision every synchronized prefix is mirrored up to.
+type Server struct {
+	pb.UnimplementedKVServer
+
+	addr   string
+	server *grpc.Server
+	pool   sync.PgxIface
+
+	mu       stdsync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+// NewServer creates a façade server listening on addr
+func NewServer(addr string, pool sync.PgxIface) *Server {
+	s := &Server{addr: addr, pool: pool, watchers: make(map[*watcher]struct{})}
+	s.server = grpc.NewServer()
+	pb.RegisterKVServer(s.server, s)
+	pb.RegisterWatchServer(s.server, s)
+	return s
+}
+
+// Start serves calls in the background until Shutdown is called
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for etcd façade calls: %w", err)
+	}
+	go func() {
+		logrus.WithField("address", listener.Addr().String()).Info("etcd façade listener started")
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			logrus.WithError(err).Error("etcd façade listener failed")
+		}
+	}()
+	return nil
+}
+
+// Shutdown gracefully stops the listener, open watch streams are closed once ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
+
+// Notify wakes the watchers of the changed key, all watchers if change is nil
+func (s *Server) Notify(change *sync.ChangeNotification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.watchers {
+		if change == nil || w.matches(change.Key) {
+			w.wake()
+		}
+	}
+}
+
+// header returns the response header at the current revision of the mirror
+func (s *Server) header(ctx context.Context) (*pb.ResponseHeader, error) {
+	var revision int64
+	err := s.pool.QueryRow(ctx, `SELECT coalesce((SELECT min(revision) FROM etcd_sync_state),
+		(SELECT max(revision) FROM etcd), 0)`).Scan(&revision)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to read current revision: %v", err)
+	}
+	return &pb.ResponseHeader{Revision: revision}, nil
+}
+
+// compactRevision returns the revision the history in PostgreSQL is complete from, 0 if nothing was pruned
+func (s *Server) compactRevision(ctx context.Context) (int64, error) {
+	var revision int64
+	err := s.pool.QueryRow(ctx, `SELECT coalesce((SELECT revision FROM etcd_compaction), 0)`).Scan(&revision)
+	if err != nil {
+		return 0, status.Errorf(codes.Unavailable, "failed to read compact revision: %v", err)
+	}
+	return revision, nil
+}
+
+// Range returns the keys of the range at the requested revision, the current revision if zero
+func (s *Server) Range(ctx context.Context, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+	revision := req.Revision
+	if revision > header.Revision {
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+	if revision > 0 {
+		// Revisions older than the pruned history may miss values
+		compact, err := s.compactRevision(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if revision < compact {
+			return nil, rpctypes.ErrGRPCCompacted
+		}
+	} else {
+		revision = header.Revision
+	}
+
+	condition, args := keyCondition("key", string(req.Key), string(req.RangeEnd), []any{revision})
+	filters := ""
+	for _, filter := range []struct {
+		expr  string
+		value int64
+	}{
+		{"revision >= $%d", req.MinModRevision},
+		{"revision <= $%d", req.MaxModRevision},
+		{"create_revision >= $%d", req.MinCreateRevision},
+		{"create_revision <= $%d", req.MaxCreateRevision},
+	} {
+		if filter.value > 0 {
+			args = append(args, filter.value)
+			filters += " AND " + fmt.Sprintf(filter.expr, len(args))
+		}
+	}
+	// The latest row of every key up to the revision, deleted keys end in a tombstone
+	keys := `FROM (
+			SELECT DISTINCT ON (key) key, coalesce(value, '') AS value, coalesce(encoding, '') AS encoding, revision, tombstone,
+				coalesce(create_revision, 0) AS create_revision, coalesce(version, 0) AS version, coalesce(lease, 0) AS lease
+			FROM etcd
+			WHERE ` + condition + ` AND revision > 0 AND revision <= $1
+			ORDER BY key, revision DESC
+		) latest
+		WHERE NOT tombstone` + filters
+
+	resp := &pb.RangeResponse{Header: header}
+	if req.CountOnly {
+		if err := s.pool.QueryRow(ctx, "SELECT count(*) "+keys, args...).Scan(&resp.Count); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to count keys: %v", err)
+		}
+		return resp, nil
+	}
+
+	value := "value, encoding"
+	if req.KeysOnly {
+		value = "'', ''"
+	}
+	query := "SELECT key, " + value + ", revision, create_revision, version, lease " + keys + " ORDER BY " + sortOrder(req)
+	if req.Limit > 0 {
+		args = append(args, req.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to read keys: %v", err)
+	}
+	resp.Kvs, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (*mvccpb.KeyValue, error) {
+		var key, value, encoding string
+		kv := &mvccpb.KeyValue{}
+		if err := row.Scan(&key, &value, &encoding, &kv.ModRevision, &kv.CreateRevision, &kv.Version, &kv.Lease); err != nil {
+			return nil, err
+		}
+		value, err := decodeValue(key, value, encoding)
+		kv.Key, kv.Value = []byte(key), []byte(value)
+		return kv, err
+	})
+	if err != nil {
+		return nil, readError("read keys", err)
+	}
+	resp.Count = int64(len(resp.Kvs))
+	if req.Limit > 0 && resp.Count > req.Limit {
+		resp.Kvs, resp.More = resp.Kvs[:req.Limit], true
+		// The count covers the whole range like etcd, without the limit
+		if err := s.pool.QueryRow(ctx, "SELECT count(*) "+keys, args[:len(args)-1]...).Scan(&resp.Count); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to count keys: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// decodeValue decodes a value of the mirror, values only stored as their hash cannot be served
+func decodeValue(key, value, encoding string) (string, error) {
+	if encoding == sync.EncodingSHA256 {
+		return "", fmt.Errorf("%w, cannot serve %s", sync.ErrRedacted, key)
+	}
+	return sync.DecodeValue(value, encoding)
+}
+
+// readError returns the status of a failed read, keys whose value is only stored as its hash fail the
+// precondition instead of returning the hash as their value
+func readError(operation string, err error) error {
+	if errors.Is(err, sync.ErrRedacted) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Errorf(codes.Unavailable, "failed to %s: %v", operation, err)
+}
+
+// Put is rejected, the façade is read-only
+func (s *Server) Put(context.Context, *pb.PutRequest) (*pb.PutResponse, error) {
+	return nil, errReadOnly
+}
+
+// DeleteRange is rejected, the façade is read-only
+func (s *Server) DeleteRange(context.Context, *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	return nil, errReadOnly
+}
+
+// Txn is rejected, the façade is read-only
+func (s *Server) Txn(context.Context, *pb.TxnRequest) (*pb.TxnResponse, error) {
+	return nil, errReadOnly
+}
+
+// Compact is rejected, the retained history follows --history
+func (s *Server) Compact(context.Context, *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	return nil, errReadOnly
+}
+
+// keyCondition returns the SQL condition on column selecting the etcd range of key and end, with its
+// parameters appended to args. Keys compare bytewise like in etcd.
+func keyCondition(column, key, end string, args []any) (string, []any) {
+	n := len(args) + 1
+	switch {
+	case end == "":
+		return fmt.Sprintf("%s = $%d", column, n), append(args, key)
+	case end == "\x00" && key == "\x00":
+		return "true", args
+	case end == "\x00":
+		return fmt.Sprintf(`%s COLLATE "C" >= $%d`, column, n), append(args, key)
+	case end == clientv3.GetPrefixRangeEnd(key):
+		return fmt.Sprintf("starts_with(%s, $%d)", column, n), append(args, key)
+	}
+	return fmt.Sprintf(`%[1]s COLLATE "C" >= $%[2]d AND %[1]s COLLATE "C" < $%[3]d`, column, n, n+1), append(args, key, end)
+}
+
+// inRange reports whether key is in the etcd range of start and end
+func inRange(key, start, end string) bool {
+	switch end {
+	case "":
+		return key == start
+	case "\x00":
+		return key >= start
+	}
+	return key >= start && key < end
+}
+
+// sortOrder returns the ORDER BY clause of the requested sort, ascending keys by default
+func sortOrder(req *pb.RangeRequest) string {
+	column := `key COLLATE "C"`
+	switch req.SortTarget {
+	case pb.RangeRequest_VERSION:
+		column = "version"
+	case pb.RangeRequest_CREATE:
+		column = "create_revision"
+	case pb.RangeRequest_MOD:
+		column = "revision"
+	case pb.RangeRequest_VALUE:
+		column = `value COLLATE "C"`
+	}
+	if req.SortOrder == pb.RangeRequest_DESCEND {
+		return column + ` DESC, key COLLATE "C"`
+	}
+	return column + `, key COLLATE "C"`
+}
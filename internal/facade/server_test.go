@@ -0,0 +1,207 @@
+package facade
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+const headerQuery = `SELECT coalesce\(\(SELECT min\(revision\) FROM etcd_sync_state\)`
+
+const compactQuery = `SELECT coalesce\(\(SELECT revision FROM etcd_compaction\), 0\)`
+
+// TestRange tests reading current and historical ranges of the mirror
+func TestRange(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	server := NewServer(":0", mock)
+	ctx := context.Background()
+	header := func(revision int64) {
+		mock.ExpectQuery(headerQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(revision))
+	}
+	columns := []string{"key", "value", "encoding", "revision", "create_revision", "version", "lease"}
+
+	// Prefix ranges count all keys beyond the limit
+	header(10)
+	mock.ExpectQuery(`WHERE starts_with\(key, \$2\) AND revision > 0 AND revision <= \$1`).WithArgs(int64(10), "/config/", int64(2)).
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow("/config/a", "1", "", int64(8), int64(3), int64(2), int64(0)).
+			AddRow("/config/b", "2", "", int64(9), int64(9), int64(1), int64(0)))
+	mock.ExpectQuery(`SELECT count\(\*\) FROM`).WithArgs(int64(10), "/config/").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(3)))
+	resp, err := server.Range(ctx, &pb.RangeRequest{Key: []byte("/config/"), RangeEnd: []byte("/config0"), Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), resp.Header.Revision)
+	assert.Equal(t, int64(3), resp.Count)
+	assert.True(t, resp.More)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, &mvccpb.KeyValue{Key: []byte("/config/a"), Value: []byte("1"), ModRevision: 8, CreateRevision: 3, Version: 2}, resp.Kvs[0])
+
+	// Historical reads of a single key
+	header(10)
+	mock.ExpectQuery(compactQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(5)))
+	mock.ExpectQuery(`WHERE key = \$2 AND revision > 0 AND revision <= \$1`).WithArgs(int64(7), "/config/a").
+		WillReturnRows(pgxmock.NewRows(columns).AddRow("/config/a", "0", "", int64(3), int64(3), int64(1), int64(0)))
+	resp, err = server.Range(ctx, &pb.RangeRequest{Key: []byte("/config/a"), Revision: 7})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resp.Count)
+	assert.Equal(t, []byte("0"), resp.Kvs[0].Value)
+
+	header(10)
+	_, err = server.Range(ctx, &pb.RangeRequest{Key: []byte("/config/a"), Revision: 11})
+	assert.Equal(t, rpctypes.ErrGRPCFutureRev, err)
+
+	// Revisions below the pruned history are compacted
+	header(10)
+	mock.ExpectQuery(compactQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(8)))
+	_, err = server.Range(ctx, &pb.RangeRequest{Key: []byte("/config/a"), Revision: 7})
+	assert.Equal(t, rpctypes.ErrGRPCCompacted, err)
+
+	// Values only stored as their hash are not served as values
+	header(10)
+	mock.ExpectQuery(`WHERE key = \$2 AND revision > 0 AND revision <= \$1`).WithArgs(int64(10), "/secrets/token").
+		WillReturnRows(pgxmock.NewRows(columns).AddRow("/secrets/token", "f52fbd32", sync.EncodingSHA256, int64(9), int64(9), int64(1), int64(0)))
+	_, err = server.Range(ctx, &pb.RangeRequest{Key: []byte("/secrets/token")})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = server.Put(ctx, &pb.PutRequest{Key: []byte("/config/a")})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestKeyCondition tests the translation of etcd key ranges
+func TestKeyCondition(t *testing.T) {
+	for _, tc := range []struct {
+		key, end  string
+		condition string
+		args      []any
+		match     string
+		noMatch   string
+	}{
+		{"/a", "", "key = $1", []any{"/a"}, "/a", "/ab"},
+		{"/a/", "/a0", "starts_with(key, $1)", []any{"/a/"}, "/a/b", "/a0"},
+		{"\x00", "\x00", "true", nil, "/", ""},
+		{"/b", "\x00", `key COLLATE "C" >= $1`, []any{"/b"}, "/c", "/a"},
+		{"/a", "/c", `key COLLATE "C" >= $1 AND key COLLATE "C" < $2`, []any{"/a", "/c"}, "/b", "/c"},
+	} {
+		condition, args := keyCondition("key", tc.key, tc.end, nil)
+		assert.Equal(t, tc.condition, condition)
+		assert.Equal(t, tc.args, args)
+		if tc.match != "" {
+			assert.True(t, inRange(tc.match, tc.key, tc.end), tc.match)
+		}
+		if tc.noMatch != "" {
+			assert.False(t, inRange(tc.noMatch, tc.key, tc.end), tc.noMatch)
+		}
+	}
+}
+
+// TestWatch tests replaying the history and following change notifications
+func TestWatch(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	server := NewServer(":0", mock)
+
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.server.Serve(listener) }()
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	columns := []string{"key", "value", "encoding", "revision", "tombstone", "create_revision", "version", "lease",
+		"prev_value", "prev_encoding", "prev_revision", "prev_create_revision", "prev_version", "prev_lease"}
+	mock.ExpectQuery(headerQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(10)))
+	mock.ExpectQuery(compactQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(0)))
+	mock.ExpectQuery(`FROM etcd e\s+WHERE starts_with\(e.key, \$3\) AND e.revision > \$1`).WithArgs(int64(4), watchBatch, "/config/").
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow("/config/a", "1", "", int64(5), false, int64(5), int64(1), int64(0), nil, nil, nil, nil, nil, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := pb.NewWatchClient(conn).Watch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &pb.WatchCreateRequest{
+		Key: []byte("/config/"), RangeEnd: []byte("/config0"), StartRevision: 5,
+	}}}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Created)
+	assert.Equal(t, int64(10), resp.Header.Revision)
+
+	// The history is replayed from the start revision
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, resp.Events, 1)
+	assert.Equal(t, mvccpb.PUT, resp.Events[0].Type)
+	assert.Equal(t, int64(5), resp.Events[0].Kv.ModRevision)
+
+	// Notified changes are read after the last sent revision
+	mock.ExpectQuery(`FROM etcd e`).WithArgs(int64(5), watchBatch, "/config/").
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow("/config/a", "", "", int64(11), true, int64(0), int64(0), int64(0), nil, nil, nil, nil, nil, nil))
+	server.Notify(&sync.ChangeNotification{Key: "/other", Revision: 11})
+	server.Notify(&sync.ChangeNotification{Key: "/config/a", Revision: 11, Tombstone: true})
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, resp.Events, 1)
+	assert.Equal(t, mvccpb.DELETE, resp.Events[0].Type)
+	assert.Equal(t, int64(11), resp.Header.Revision)
+
+	mock.ExpectQuery(headerQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(11)))
+	require.NoError(t, stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_ProgressRequest{ProgressRequest: &pb.WatchProgressRequest{}}}))
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(progressWatchID), resp.WatchId)
+	assert.Equal(t, int64(11), resp.Header.Revision)
+
+	require.NoError(t, stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CancelRequest{CancelRequest: &pb.WatchCancelRequest{WatchId: 0}}}))
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Canceled)
+
+	// Watches starting below the pruned history are canceled as compacted
+	mock.ExpectQuery(headerQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(11)))
+	mock.ExpectQuery(compactQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(8)))
+	require.NoError(t, stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &pb.WatchCreateRequest{
+		Key: []byte("/config/"), RangeEnd: []byte("/config0"), StartRevision: 5,
+	}}}))
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Canceled)
+	assert.Equal(t, int64(8), resp.CompactRevision)
+
+	// Events of keys whose value is only stored as its hash fail the stream
+	mock.ExpectQuery(headerQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(11)))
+	mock.ExpectQuery(compactQuery).WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(8)))
+	mock.ExpectQuery(`FROM etcd e`).WithArgs(int64(9), watchBatch, "/secrets/").
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow("/secrets/token", "f52fbd32", sync.EncodingSHA256, int64(10), false, int64(10), int64(1), int64(0), nil, nil, nil, nil, nil, nil))
+	require.NoError(t, stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &pb.WatchCreateRequest{
+		Key: []byte("/secrets/"), RangeEnd: []byte("/secrets0"), StartRevision: 10,
+	}}}))
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Created)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,339 @@
+package facade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	stdsync "sync"
+
+	"github.com/jackc/pgx/v5"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// watchBatch is the maximum number of events read and sent at once
+const watchBatch = 1000
+
+// progressWatchID is the watch ID of progress responses for the whole stream, as in etcd
+const progressWatchID = -1
+
+// watcher follows a key range from the last sent revision. It is woken by the change notifications
+// and reads the mirrored rows after that revision, so missed notifications only delay events.
+type watcher struct {
+	id       int64
+	key, end string
+	prevKV   bool
+	noPut    bool
+	noDelete bool
+	last     int64
+	wakeup   chan struct{}
+}
+
+// matches reports whether key is in the watched range
+func (w *watcher) matches(key string) bool {
+	return inRange(key, w.key, w.end)
+}
+
+// wake signals the watcher without blocking, a pending signal covers later changes
+func (w *watcher) wake() {
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// watchStream serializes the responses of the watchers of one Watch call, nothing is sent once it
+// is closed as the call returned
+type watchStream struct {
+	mu       stdsync.Mutex
+	stream   pb.Watch_WatchServer
+	cancels  map[int64]context.CancelFunc
+	nextID   int64
+	closed   bool
+	watchers stdsync.WaitGroup
+}
+
+func (ws *watchStream) send(resp *pb.WatchResponse) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return context.Canceled
+	}
+	return ws.stream.Send(resp)
+}
+
+// Watch serves a watch stream. Events are read from the history after the start revision, then after
+// every change notification of the watched range.
+func (s *Server) Watch(stream pb.Watch_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	ws := &watchStream{stream: stream, cancels: make(map[int64]context.CancelFunc)}
+	errc := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+	// Recv only returns with the call, the requests are received in the background
+	go func() { fail(s.receive(ctx, ws, fail)) }()
+
+	err := <-errc
+	cancel()
+	ws.mu.Lock()
+	ws.closed = true
+	ws.mu.Unlock()
+	ws.watchers.Wait()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// receive handles the requests of a watch stream until it fails, watchers report errors to fail
+func (s *Server) receive(ctx context.Context, ws *watchStream, fail func(error)) error {
+	for {
+		req, err := ws.stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch r := req.RequestUnion.(type) {
+		case *pb.WatchRequest_CreateRequest:
+			w, err := s.createWatcher(ctx, ws, r.CreateRequest)
+			if err != nil {
+				return err
+			}
+			if w == nil {
+				continue
+			}
+			watchCtx, watchCancel := context.WithCancel(ctx)
+			ws.mu.Lock()
+			if ws.closed {
+				ws.mu.Unlock()
+				watchCancel()
+				return context.Canceled
+			}
+			ws.cancels[w.id] = watchCancel
+			ws.watchers.Add(1)
+			ws.mu.Unlock()
+			go func() {
+				defer ws.watchers.Done()
+				// Ends the stream, the client resumes from its last received revision
+				if err := s.runWatcher(watchCtx, ws, w); err != nil {
+					fail(err)
+				}
+			}()
+		case *pb.WatchRequest_CancelRequest:
+			id := r.CancelRequest.WatchId
+			ws.mu.Lock()
+			watchCancel, ok := ws.cancels[id]
+			delete(ws.cancels, id)
+			ws.mu.Unlock()
+			if ok {
+				watchCancel()
+				if err := ws.send(&pb.WatchResponse{WatchId: id, Canceled: true}); err != nil {
+					return err
+				}
+			}
+		case *pb.WatchRequest_ProgressRequest:
+			header, err := s.header(ctx)
+			if err != nil {
+				return err
+			}
+			if err := ws.send(&pb.WatchResponse{Header: header, WatchId: progressWatchID}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// createWatcher confirms a watch request, nil if it was rejected
+func (s *Server) createWatcher(ctx context.Context, ws *watchStream, req *pb.WatchCreateRequest) (*watcher, error) {
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ws.mu.Lock()
+	id := req.WatchId
+	if id == 0 {
+		for _, ok := ws.cancels[ws.nextID]; ok; _, ok = ws.cancels[ws.nextID] {
+			ws.nextID++
+		}
+		id = ws.nextID
+		ws.nextID++
+	}
+	_, duplicate := ws.cancels[id]
+	ws.mu.Unlock()
+	if duplicate || req.Fragment {
+		reason := fmt.Sprintf("watch ID %d is in use", id)
+		if req.Fragment {
+			reason = "fragmented watch responses are not supported"
+		}
+		return nil, ws.send(&pb.WatchResponse{Header: header, WatchId: id, Created: true, Canceled: true, CancelReason: reason})
+	}
+
+	w := &watcher{
+		id:     id,
+		key:    string(req.Key),
+		end:    string(req.RangeEnd),
+		prevKV: req.PrevKv,
+		last:   header.Revision,
+		wakeup: make(chan struct{}, 1),
+	}
+	if req.StartRevision > 0 {
+		compact, err := s.compactRevision(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if req.StartRevision < compact {
+			// Canceled with the compact revision like etcd, the client reports ErrCompacted
+			return nil, ws.send(&pb.WatchResponse{
+				Header: header, WatchId: id, Created: true, Canceled: true, CompactRevision: compact,
+				CancelReason: rpctypes.ErrCompacted.Error(),
+			})
+		}
+		w.last = req.StartRevision - 1
+	}
+	for _, filter := range req.Filters {
+		switch filter {
+		case pb.WatchCreateRequest_NOPUT:
+			w.noPut = true
+		case pb.WatchCreateRequest_NODELETE:
+			w.noDelete = true
+		}
+	}
+	return w, ws.send(&pb.WatchResponse{Header: header, WatchId: id, Created: true})
+}
+
+// runWatcher sends the events of the watcher until ctx is done
+func (s *Server) runWatcher(ctx context.Context, ws *watchStream, w *watcher) error {
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+
+	w.wake()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.wakeup:
+		}
+		for more := true; more; {
+			var events []*mvccpb.Event
+			var err error
+			events, more, err = s.readEvents(ctx, w)
+			if err != nil {
+				return err
+			}
+			if len(events) == 0 {
+				break
+			}
+			w.last = events[len(events)-1].Kv.ModRevision
+			events = slices.DeleteFunc(events, func(event *mvccpb.Event) bool {
+				return event.Type == mvccpb.PUT && w.noPut || event.Type == mvccpb.DELETE && w.noDelete
+			})
+			if len(events) == 0 {
+				continue
+			}
+			resp := &pb.WatchResponse{Header: &pb.ResponseHeader{Revision: w.last}, WatchId: w.id, Events: events}
+			if err := ws.send(resp); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readEvents reads the next events of the watcher after its last revision in revision order, more
+// reports that the batch was full. Events of a revision are never split across batches.
+func (s *Server) readEvents(ctx context.Context, w *watcher) (events []*mvccpb.Event, more bool, err error) {
+	condition, args := keyCondition("e.key", w.key, w.end, []any{w.last, watchBatch})
+	prev := "NULL::text, NULL::text, NULL::bigint, NULL::bigint, NULL::bigint, NULL::bigint"
+	join := ""
+	if w.prevKV {
+		prev = "prev.value, prev.encoding, prev.revision, prev.create_revision, prev.version, prev.lease"
+		join = `LEFT JOIN LATERAL (
+				SELECT coalesce(p.value, '') AS value, coalesce(p.encoding, '') AS encoding, p.revision, p.tombstone, coalesce(p.create_revision, 0) AS create_revision,
+					coalesce(p.version, 0) AS version, coalesce(p.lease, 0) AS lease
+				FROM etcd p
+				WHERE p.key = e.key AND p.revision > 0 AND p.revision < e.revision
+				ORDER BY p.revision DESC
+				LIMIT 1
+			) prev ON NOT prev.tombstone`
+	}
+	query := `SELECT e.key, coalesce(e.value, ''), coalesce(e.encoding, ''), e.revision, e.tombstone, coalesce(e.create_revision, 0),
+			coalesce(e.version, 0), coalesce(e.lease, 0), ` + prev + `
+		FROM etcd e ` + join + `
+		WHERE ` + condition + ` AND e.revision > $1
+		ORDER BY e.revision, e.key
+		LIMIT $2`
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, false, status.Errorf(codes.Unavailable, "failed to read events: %v", err)
+	}
+	events, err = pgx.CollectRows(rows, scanEvent)
+	if err != nil {
+		return nil, false, readError("read events", err)
+	}
+
+	if len(events) < watchBatch {
+		return events, false, nil
+	}
+	// Keep the last revision for the next batch unless it fills the whole batch
+	last := events[len(events)-1].Kv.ModRevision
+	complete := slices.IndexFunc(events, func(event *mvccpb.Event) bool { return event.Kv.ModRevision == last })
+	if complete > 0 {
+		events = events[:complete]
+	}
+	return events, true, nil
+}
+
+// scanEvent scans an event row with its optional previous key value
+func scanEvent(row pgx.CollectableRow) (*mvccpb.Event, error) {
+	var key, value, encoding string
+	var tombstone bool
+	var prevValue, prevEncoding *string
+	var prevRevision, prevCreate, prevVersion, prevLease *int64
+	kv := &mvccpb.KeyValue{}
+	err := row.Scan(&key, &value, &encoding, &kv.ModRevision, &tombstone, &kv.CreateRevision, &kv.Version, &kv.Lease,
+		&prevValue, &prevEncoding, &prevRevision, &prevCreate, &prevVersion, &prevLease)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = decodeValue(key, value, encoding); err != nil {
+		return nil, err
+	}
+	kv.Key = []byte(key)
+	event := &mvccpb.Event{Type: mvccpb.PUT, Kv: kv}
+	if tombstone {
+		// Deletions carry only the key and revision like in etcd
+		event.Type = mvccpb.DELETE
+		event.Kv = &mvccpb.KeyValue{Key: kv.Key, ModRevision: kv.ModRevision}
+	} else {
+		kv.Value = []byte(value)
+	}
+	if prevRevision != nil {
+		prev, err := decodeValue(key, *prevValue, *prevEncoding)
+		if err != nil {
+			return nil, err
+		}
+		event.PrevKv = &mvccpb.KeyValue{
+			Key:            kv.Key,
+			Value:          []byte(prev),
+			ModRevision:    *prevRevision,
+			CreateRevision: *prevCreate,
+			Version:        *prevVersion,
+			Lease:          *prevLease,
+		}
+	}
+	return event, nil
+}
@@ -0,0 +1,152 @@
+// Package failpoint injects failures at named points of the sync pipeline for resilience testing.
+// Failpoints are disabled unless enabled by the Env environment variable or Enable, evaluating a
+// disabled failpoint costs a single atomic load.
+package failpoint
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Env is the environment variable enabling failpoints, e.g.
+// pg_etcd_FAILPOINTS="push-after-etcd=1*exit;etcd-request=3*error"
+const Env = "pg_etcd_FAILPOINTS"
+
+// Actions of a failpoint
+const (
+	ActionError = "error" // Eval returns ErrInjected
+	ActionPanic = "panic" // Eval panics
+	ActionExit  = "exit"  // the process exits with status 2 without any clean up, like a crash
+	ActionSleep = "sleep" // Eval blocks, e.g. sleep(5s)
+)
+
+// ErrInjected is the error returned by failpoints with ActionError
+var ErrInjected = errors.New("injected failure")
+
+// failpoint is an enabled failpoint
+type failpoint struct {
+	action string
+	delay  time.Duration // ActionSleep
+	count  int           // remaining evaluations triggering the action, negative triggers forever
+}
+
+var (
+	enabled atomic.Bool
+	mu      sync.Mutex
+	points  map[string]*failpoint
+)
+
+// LoadEnv enables the failpoints of the Env environment variable, it reports whether any are enabled
+func LoadEnv() (bool, error) {
+	spec := os.Getenv(Env)
+	if spec == "" {
+		return false, nil
+	}
+	if err := Enable(spec); err != nil {
+		return false, fmt.Errorf("invalid %s: %w", Env, err)
+	}
+	return true, nil
+}
+
+// Enable replaces the enabled failpoints by spec, a semicolon separated list of name=[count*]action,
+// where action is error, panic, exit or sleep(duration). Without count the action triggers on every evaluation.
+func Enable(spec string) error {
+	parsed := make(map[string]*failpoint)
+	for term := range strings.SplitSeq(spec, ";") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(term, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("failpoint %q: expected name=action", term)
+		}
+		fp, err := parse(action)
+		if err != nil {
+			return fmt.Errorf("failpoint %s: %w", name, err)
+		}
+		parsed[name] = fp
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	points = parsed
+	enabled.Store(len(points) > 0)
+	return nil
+}
+
+// Enabled reports whether any failpoint is enabled
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Disable disables all failpoints
+func Disable() {
+	mu.Lock()
+	defer mu.Unlock()
+	points = nil
+	enabled.Store(false)
+}
+
+func parse(action string) (*failpoint, error) {
+	fp := &failpoint{count: -1}
+	if count, rest, ok := strings.Cut(action, "*"); ok {
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid count %q", count)
+		}
+		fp.count, action = n, rest
+	}
+	if delay, ok := strings.CutPrefix(action, ActionSleep+"("); ok {
+		d, err := time.ParseDuration(strings.TrimSuffix(delay, ")"))
+		if err != nil || !strings.HasSuffix(delay, ")") {
+			return nil, fmt.Errorf("invalid sleep %q", action)
+		}
+		fp.action, fp.delay = ActionSleep, d
+		return fp, nil
+	}
+	switch action {
+	case ActionError, ActionPanic, ActionExit:
+		fp.action = action
+		return fp, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", action)
+}
+
+// Eval triggers the failpoint name if it is enabled, it returns an error wrapping ErrInjected for ActionError
+func Eval(name string) error {
+	if !enabled.Load() {
+		return nil
+	}
+
+	mu.Lock()
+	fp, ok := points[name]
+	if !ok || fp.count == 0 {
+		mu.Unlock()
+		return nil
+	}
+	if fp.count > 0 {
+		fp.count--
+	}
+	action, delay := fp.action, fp.delay
+	mu.Unlock()
+
+	switch action {
+	case ActionError:
+		return fmt.Errorf("failpoint %s: %w", name, ErrInjected)
+	case ActionPanic:
+		panic("failpoint " + name)
+	case ActionExit:
+		fmt.Fprintf(os.Stderr, "failpoint %s: exiting\n", name)
+		os.Exit(2)
+	case ActionSleep:
+		time.Sleep(delay)
+	}
+	return nil
+}
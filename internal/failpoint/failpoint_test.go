@@ -0,0 +1,41 @@
+package failpoint
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEval(t *testing.T) {
+	t.Cleanup(Disable)
+
+	assert.NoError(t, Eval("push-after-etcd"), "disabled")
+
+	require.NoError(t, Enable("push-after-etcd=2*error; etcd-request=sleep(1ms)"))
+	assert.ErrorIs(t, Eval("push-after-etcd"), ErrInjected)
+	assert.ErrorIs(t, Eval("push-after-etcd"), ErrInjected)
+	assert.NoError(t, Eval("push-after-etcd"), "count exhausted")
+	assert.NoError(t, Eval("initial-sync"), "not enabled")
+
+	start := time.Now()
+	assert.NoError(t, Eval("etcd-request"))
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond)
+
+	require.NoError(t, Enable("initial-sync=panic"))
+	assert.Panics(t, func() { _ = Eval("initial-sync") })
+	assert.Panics(t, func() { _ = Eval("initial-sync") }, "without count on every evaluation")
+	assert.NoError(t, Eval("etcd-request"), "replaced by Enable")
+
+	Disable()
+	assert.NoError(t, Eval("initial-sync"))
+}
+
+func TestEnableInvalid(t *testing.T) {
+	t.Cleanup(Disable)
+
+	for _, spec := range []string{"push-after-etcd", "=error", "a=crash", "a=0*error", "a=x*error", "a=sleep(1s", "a=sleep(x)"} {
+		assert.Error(t, Enable(spec), spec)
+	}
+}
@@ -0,0 +1,49 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/sirupsen/logrus"
+)
+
+type correlationKey struct{}
+
+// NewCorrelationID returns a random id identifying one batch of changes across the logs of the daemon,
+// PostgreSQL and etcd
+func NewCorrelationID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id) // never fails, see crypto/rand.Read
+	return hex.EncodeToString(id)
+}
+
+// WithCorrelationID returns a context carrying the correlation id
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation id carried by ctx, empty if none
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// CorrelationHook adds the correlation id of entries logged WithContext as FieldTraceID
+type CorrelationHook struct{}
+
+// Levels returns all levels, every entry of a batch is correlated
+func (CorrelationHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire adds the correlation id of the entry context, if any
+func (CorrelationHook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if id := CorrelationID(entry.Context); id != "" {
+		entry.Data[FieldTraceID] = id
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCorrelationHook tests that entries logged with a correlated context carry its id
+func TestCorrelationHook(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(NewJSONFormatter())
+	logger.AddHook(CorrelationHook{})
+
+	id := NewCorrelationID()
+	assert.Len(t, id, 16)
+	assert.NotEqual(t, id, NewCorrelationID())
+
+	logger.WithContext(WithCorrelationID(context.Background(), id)).Info("correlated")
+	assert.Contains(t, out.String(), `"trace_id":"`+id+`"`)
+
+	out.Reset()
+	logger.WithContext(context.Background()).Info("uncorrelated")
+	logger.Info("without context")
+	assert.NotContains(t, out.String(), FieldTraceID)
+}
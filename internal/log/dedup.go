@@ -0,0 +1,119 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DedupFormatter collapses repeating warnings and errors, e.g. one failure per retry and key while etcd
+// is down. The first occurrence within the window is written, repetitions are counted and written as a
+// single entry with FieldRepeated once the window ends. Entries are the same if their level, message
+// and error are.
+type DedupFormatter struct {
+	logrus.Formatter
+	window time.Duration
+
+	mu      sync.Mutex
+	repeats map[string]*repeat
+}
+
+// repeat is a message seen within the current window
+type repeat struct {
+	entry *logrus.Entry // first occurrence
+	count int           // suppressed repetitions
+}
+
+// NewDedupFormatter wraps formatter, collapsing repetitions within window
+func NewDedupFormatter(formatter logrus.Formatter, window time.Duration) *DedupFormatter {
+	return &DedupFormatter{
+		Formatter: formatter,
+		window:    window,
+		repeats:   make(map[string]*repeat),
+	}
+}
+
+// Format writes entry unless it repeats an entry of the current window
+func (f *DedupFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if _, summary := entry.Data[FieldRepeated]; summary || entry.Level > logrus.WarnLevel {
+		return f.Formatter.Format(entry)
+	}
+
+	key := fmt.Sprintf("%d\x00%s\x00%v", entry.Level, entry.Message, entry.Data[logrus.ErrorKey])
+	f.mu.Lock()
+	r, ok := f.repeats[key]
+	if ok && entry.Time.Sub(r.entry.Time) < f.window {
+		r.count++
+		f.mu.Unlock()
+		return nil, nil
+	}
+	first := entry.Dup() // without level and message
+	first.Level = entry.Level
+	first.Message = entry.Message
+	f.repeats[key] = &repeat{entry: first}
+	f.mu.Unlock()
+
+	// The window of the previous occurrence ended, summarize it before starting a new one
+	var out []byte
+	if ok && r.count > 0 {
+		summary, err := f.Formatter.Format(f.summary(r))
+		if err != nil {
+			return nil, err
+		}
+		out = summary
+	}
+	line, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, line...), nil
+}
+
+// summary is the entry reporting the suppressed repetitions of r
+func (f *DedupFormatter) summary(r *repeat) *logrus.Entry {
+	entry := r.entry.WithFields(logrus.Fields{
+		FieldRepeated:     r.count,
+		FieldRepeatWindow: f.window.String(),
+	})
+	entry.Time = r.entry.Time.Add(f.window)
+	entry.Level = r.entry.Level
+	entry.Message = r.entry.Message
+	return entry
+}
+
+// expired removes the repeats whose window ended before now and returns the summaries of those repeated
+func (f *DedupFormatter) expired(now time.Time) []*logrus.Entry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var summaries []*logrus.Entry
+	for key, r := range f.repeats {
+		if now.Sub(r.entry.Time) < f.window {
+			continue
+		}
+		delete(f.repeats, key)
+		if r.count > 0 {
+			summaries = append(summaries, f.summary(r))
+		}
+	}
+	return summaries
+}
+
+// FlushEvery writes the summaries of ended windows to logger every window until ctx is done,
+// so repetitions are reported even if the message doesn't occur again
+func (f *DedupFormatter) FlushEvery(ctx context.Context, logger *logrus.Logger) {
+	ticker := time.NewTicker(f.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, summary := range f.expired(now) {
+				logger.WithFields(summary.Data).Log(summary.Level, summary.Message)
+			}
+		}
+	}
+}
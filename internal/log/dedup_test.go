@@ -0,0 +1,48 @@
+package log
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDedupFormatter tests collapsing repeated warnings and errors into one summary per window
+func TestDedupFormatter(t *testing.T) {
+	f := NewDedupFormatter(&logrus.TextFormatter{DisableTimestamp: true}, time.Minute)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	format := func(level logrus.Level, msg string, err error, at time.Duration) string {
+		entry := logrus.NewEntry(logrus.New()).WithError(err)
+		entry.Level = level
+		entry.Message = msg
+		entry.Time = start.Add(at)
+		out, formatErr := f.Format(entry)
+		require.NoError(t, formatErr)
+		return string(out)
+	}
+	unavailable := errors.New("etcdserver: unavailable")
+
+	assert.Contains(t, format(logrus.ErrorLevel, "Failed to put key", unavailable, 0), "Failed to put key")
+	assert.Empty(t, format(logrus.ErrorLevel, "Failed to put key", unavailable, time.Second))
+	assert.Empty(t, format(logrus.ErrorLevel, "Failed to put key", unavailable, 2*time.Second))
+	assert.NotEmpty(t, format(logrus.ErrorLevel, "Failed to put key", errors.New("permission denied"), 3*time.Second),
+		"different errors are not collapsed")
+	assert.NotEmpty(t, format(logrus.InfoLevel, "Synced key", nil, 0))
+	assert.NotEmpty(t, format(logrus.InfoLevel, "Synced key", nil, time.Second), "info messages are not collapsed")
+
+	// The next occurrence after the window summarizes the previous one
+	out := format(logrus.ErrorLevel, "Failed to put key", unavailable, time.Minute)
+	assert.Contains(t, out, "repeated=2")
+	assert.Contains(t, out, "repeat_window=1m0s")
+
+	// Repetitions of ended windows are summarized without a new occurrence
+	assert.Empty(t, format(logrus.ErrorLevel, "Failed to put key", unavailable, time.Minute+time.Second))
+	summaries := f.expired(start.Add(3 * time.Minute))
+	require.Len(t, summaries, 1)
+	assert.Equal(t, 1, summaries[0].Data[FieldRepeated])
+	assert.Equal(t, logrus.ErrorLevel, summaries[0].Level)
+	assert.Empty(t, f.expired(start.Add(3*time.Minute)), "expired repeats are removed")
+}
@@ -0,0 +1,52 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileOptions configures the log file and its rotation
+type FileOptions struct {
+	Filename   string
+	MaxSizeMB  int // size in megabytes the file is rotated at, 100 if zero
+	MaxAgeDays int // days rotated files are kept, forever if zero
+	MaxBackups int // number of rotated files kept, all if zero
+}
+
+// NewFile opens the log file for appending, rotated files are named after the time of rotation
+func NewFile(opts FileOptions) (*lumberjack.Logger, error) {
+	// lumberjack opens the file on the first write, fail early if it can't be written
+	f, err := os.OpenFile(opts.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	_ = f.Close()
+
+	return &lumberjack.Logger{
+		Filename:   opts.Filename,
+		MaxSize:    opts.MaxSizeMB,
+		MaxAge:     opts.MaxAgeDays,
+		MaxBackups: opts.MaxBackups,
+		LocalTime:  true,
+	}, nil
+}
+
+// RotateEvery rotates file at every interval until ctx is done
+func RotateEvery(ctx context.Context, file *lumberjack.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := file.Rotate(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to rotate log file: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileRotation tests writing to the log file and rotating it by time
+func TestFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "pg_etcd.log")
+
+	file, err := NewFile(FileOptions{Filename: name, MaxBackups: 1})
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	_, err = file.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RotateEvery(ctx, file, 10*time.Millisecond)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(dir)
+		return len(entries) == 2
+	}, 5*time.Second, 10*time.Millisecond, "the file is rotated into a backup")
+	cancel()
+	<-done
+
+	_, err = file.Write([]byte("second\n"))
+	require.NoError(t, err)
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(data))
+
+	_, err = NewFile(FileOptions{Filename: filepath.Join(dir, "missing", "pg_etcd.log")})
+	assert.Error(t, err, "an unwritable log file fails at startup")
+}
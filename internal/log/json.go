@@ -0,0 +1,39 @@
+package log
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JSONFormatter writes one JSON object per line following the versioned log schema
+type JSONFormatter struct {
+	logrus.JSONFormatter
+}
+
+// NewJSONFormatter creates a new JSON Lines formatter
+func NewJSONFormatter() *JSONFormatter {
+	return &JSONFormatter{
+		JSONFormatter: logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime:  FieldTime,
+				logrus.FieldKeyLevel: FieldLevel,
+				logrus.FieldKeyMsg:   FieldMessage,
+			},
+		},
+	}
+}
+
+// Format adds the schema version to the entry and renders it as a JSON line
+func (f *JSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	data[FieldSchemaVersion] = SchemaVersion
+
+	e := *entry
+	e.Data = data
+	return f.JSONFormatter.Format(&e)
+}
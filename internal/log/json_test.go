@@ -0,0 +1,50 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJSONSchema guards the versioned JSON log schema, changing it requires bumping SchemaVersion
+func TestJSONSchema(t *testing.T) {
+	assert.Equal(t, 1, SchemaVersion, "Update this test and the changelog when bumping the schema")
+
+	entry := logrus.NewEntry(logrus.New()).WithFields(logrus.Fields{
+		FieldDirection: DirectionEtcdToPg,
+		FieldKey:       "/config/a",
+		FieldRevision:  int64(42),
+		FieldLatencyMs: 1.5,
+		FieldTraceID:   "abc123",
+	}).WithError(errors.New("boom"))
+	entry.Time = time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	entry.Level = logrus.InfoLevel
+	entry.Message = "Synced etcd event to PostgreSQL"
+
+	out, err := NewJSONFormatter().Format(entry)
+	require.NoError(t, err)
+	assert.Equal(t, byte('\n'), out[len(out)-1], "Each entry must be a single JSON line")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(out, &line))
+	assert.Equal(t, map[string]any{
+		"schema_version": float64(1),
+		"time":           "2024-01-02T03:04:05.000000006Z",
+		"level":          "info",
+		"msg":            "Synced etcd event to PostgreSQL",
+		"error":          "boom",
+		"direction":      "etcd_to_pg",
+		"key":            "/config/a",
+		"revision":       float64(42),
+		"latency_ms":     1.5,
+		"trace_id":       "abc123",
+	}, line)
+
+	// Formatting must not modify the entry shared with other hooks and formatters
+	assert.NotContains(t, entry.Data, FieldSchemaVersion)
+}
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is the structured logger the synchronization writes to. Fields accumulate on the returned
+// loggers, a context logged WithContext carries the correlation id of its batch.
+type Logger interface {
+	WithContext(ctx context.Context) Logger
+	WithField(key string, value any) Logger
+	WithFields(fields Fields) Logger
+	WithError(err error) Logger
+	Debug(msg string)
+	Info(msg string)
+	Warn(msg string)
+	Error(msg string)
+}
+
+// Fields are the fields added by WithFields
+type Fields = map[string]any
+
+// defaultLogger holds the Logger set by SetDefault
+var defaultLogger atomic.Pointer[Logger]
+
+// Default returns the logger of messages not bound to a service, the global logrus logger unless
+// SetDefault was called
+func Default() Logger {
+	if l := defaultLogger.Load(); l != nil {
+		return *l
+	}
+	return NewLogrus(logrus.NewEntry(logrus.StandardLogger()))
+}
+
+// SetDefault replaces the logger returned by Default, nil restores the global logrus logger
+func SetDefault(l Logger) {
+	if l == nil {
+		defaultLogger.Store(nil)
+		return
+	}
+	defaultLogger.Store(&l)
+}
+
+// logrusLogger writes to a logrus entry, the correlation id is added by CorrelationHook
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+// NewLogrus returns a Logger writing to entry
+func NewLogrus(entry *logrus.Entry) Logger {
+	return logrusLogger{entry: entry}
+}
+
+func (l logrusLogger) WithContext(ctx context.Context) Logger {
+	return logrusLogger{entry: l.entry.WithContext(ctx)}
+}
+
+func (l logrusLogger) WithField(key string, value any) Logger {
+	return logrusLogger{entry: l.entry.WithField(key, value)}
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{entry: l.entry.WithFields(fields)}
+}
+
+func (l logrusLogger) WithError(err error) Logger {
+	return logrusLogger{entry: l.entry.WithError(err)}
+}
+
+func (l logrusLogger) Debug(msg string) { l.entry.Debug(msg) }
+func (l logrusLogger) Info(msg string)  { l.entry.Info(msg) }
+func (l logrusLogger) Warn(msg string)  { l.entry.Warn(msg) }
+func (l logrusLogger) Error(msg string) { l.entry.Error(msg) }
+
+// slogLogger writes to a slog logger, the context is passed to its handler
+type slogLogger struct {
+	logger *slog.Logger
+	ctx    context.Context
+}
+
+// NewSlog returns a Logger writing to logger. The correlation id is added as FieldTraceID.
+func NewSlog(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger, ctx: context.Background()}
+}
+
+func (l slogLogger) WithContext(ctx context.Context) Logger {
+	logger := l.logger
+	if id := CorrelationID(ctx); id != "" {
+		logger = logger.With(FieldTraceID, id)
+	}
+	return slogLogger{logger: logger, ctx: ctx}
+}
+
+func (l slogLogger) WithField(key string, value any) Logger {
+	return slogLogger{logger: l.logger.With(key, value), ctx: l.ctx}
+}
+
+// WithFields adds the fields in key order, so the output does not depend on the map order
+func (l slogLogger) WithFields(fields Fields) Logger {
+	args := make([]any, 0, 2*len(fields))
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		args = append(args, key, fields[key])
+	}
+	return slogLogger{logger: l.logger.With(args...), ctx: l.ctx}
+}
+
+func (l slogLogger) WithError(err error) Logger {
+	return l.WithField(FieldError, err)
+}
+
+func (l slogLogger) Debug(msg string) { l.logger.DebugContext(l.ctx, msg) }
+func (l slogLogger) Info(msg string)  { l.logger.InfoContext(l.ctx, msg) }
+func (l slogLogger) Warn(msg string)  { l.logger.WarnContext(l.ctx, msg) }
+func (l slogLogger) Error(msg string) { l.logger.ErrorContext(l.ctx, msg) }
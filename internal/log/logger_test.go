@@ -0,0 +1,42 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSlogLogger tests that fields, errors and correlation ids reach the slog handler in a stable order
+func TestSlogLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewSlog(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	ctx := WithCorrelationID(context.Background(), "0123456789abcdef")
+	logger.WithContext(ctx).WithFields(Fields{"b": 2, "a": 1}).WithError(errors.New("failed")).Warn("Slow operation")
+	assert.Contains(t, out.String(), `level=WARN msg="Slow operation" trace_id=0123456789abcdef a=1 b=2 error=failed`)
+
+	out.Reset()
+	logger.WithField(FieldKey, "/config/a").Debug("Applied")
+	assert.Contains(t, out.String(), `level=DEBUG msg=Applied key=/config/a`)
+	assert.NotContains(t, out.String(), FieldTraceID)
+}
+
+// TestDefault tests replacing the logger of messages not bound to a service
+func TestDefault(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	SetDefault(NewLogrus(logrus.NewEntry(logger)))
+	defer SetDefault(nil)
+
+	Default().WithField("prefix", "/config/").Info("Acquired instance lock")
+	assert.Contains(t, out.String(), `msg="Acquired instance lock" prefix=/config/`)
+
+	SetDefault(nil)
+	assert.Equal(t, NewLogrus(logrus.NewEntry(logrus.StandardLogger())), Default())
+}
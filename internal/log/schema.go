@@ -0,0 +1,34 @@
+package log
+
+import "time"
+
+// SchemaVersion is the version of the structured log schema. It is emitted with every JSON
+// log line and must be bumped whenever a field listed below is renamed, removed or changes type.
+const SchemaVersion = 1
+
+// Structured log field names, part of the versioned schema
+const (
+	FieldSchemaVersion = "schema_version" // int: SchemaVersion
+	FieldTime          = "time"           // string: RFC 3339 timestamp with nanoseconds
+	FieldLevel         = "level"          // string: debug|info|warning|error|fatal|panic
+	FieldMessage       = "msg"            // string: human readable message
+	FieldError         = "error"          // string: error message, if any
+	FieldDirection     = "direction"      // string: DirectionEtcdToPg or DirectionPgToEtcd
+	FieldKey           = "key"            // string: etcd key
+	FieldRevision      = "revision"       // int: etcd revision
+	FieldLatencyMs     = "latency_ms"     // float: operation latency in milliseconds
+	FieldTraceID       = "trace_id"       // string: correlation id of the operation
+	FieldRepeated      = "repeated"       // int: suppressed repetitions of the message, see DedupFormatter
+	FieldRepeatWindow  = "repeat_window"  // string: duration the repetitions were collapsed over
+)
+
+// Values of FieldDirection
+const (
+	DirectionEtcdToPg = "etcd_to_pg"
+	DirectionPgToEtcd = "pg_to_etcd"
+)
+
+// LatencyMs converts a duration into the FieldLatencyMs representation
+func LatencyMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,354 @@
+// Package metrics provides Prometheus metrics for pg_etcd and pushes them to StatsD agents.
+package metrics
+
+import (
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "pg_etcd"
+
+// Registry holds all pg_etcd metrics together with the Go runtime collectors
+var Registry = prometheus.NewRegistry()
+
+// QuarantinedRecords counts etcd records moved to the quarantine table
+var QuarantinedRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "quarantined_records_total",
+	Help:      "Number of etcd records stored in the quarantine table instead of the etcd table",
+}, []string{"reason"})
+
+// RejectedKeys counts etcd records left out because their keys cannot be stored, see --key-policy=reject
+var RejectedKeys = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "rejected_keys_total",
+	Help:      "Number of etcd records left out because their keys cannot be stored in the etcd table",
+}, []string{"reason"})
+
+// SchemaViolations counts values violating the JSON Schema of their prefix by direction, rejected
+// towards etcd and mirrored anyway from etcd
+var SchemaViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "schema_violations_total",
+	Help:      "Number of values violating the JSON Schema of their prefix by direction: pg_to_etcd or etcd_to_pg",
+}, []string{"direction"})
+
+// RevisionGaps counts differences between etcd and the mirror found by the revision audit
+var RevisionGaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "revision_gaps_total",
+	Help:      "Number of etcd revisions or deletions found missing in PostgreSQL by the revision audit",
+}, []string{"kind"})
+
+// AutoResyncs counts full resynchronizations of a prefix started because of detected divergence
+var AutoResyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "auto_resyncs_total",
+	Help:      "Number of automatic full resynchronizations of a prefix by reason: audit, compaction or watch_gap",
+}, []string{"reason"})
+
+// SpillBytes is the size of the etcd watch events buffered on disk while PostgreSQL is unreachable
+var SpillBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "spill_bytes",
+	Help:      "Size in bytes of the etcd watch events spilled to disk while PostgreSQL is unreachable",
+})
+
+// SpilledEvents counts etcd watch events spilled to disk while PostgreSQL is unreachable
+var SpilledEvents = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "spilled_events_total",
+	Help:      "Number of etcd watch events spilled to disk while PostgreSQL is unreachable",
+})
+
+// WorkerRestarts counts restarts of background goroutines after a panic
+var WorkerRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "worker_restarts_total",
+	Help:      "Number of restarts of a background worker after a panic",
+}, []string{"worker"})
+
+// EtcdDBSize is the backend database size reported by every etcd endpoint
+var EtcdDBSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "etcd_db_size_bytes",
+	Help:      "Size of the etcd backend database physically allocated, per endpoint",
+}, []string{"endpoint"})
+
+// EtcdAlarms is set to 1 for every active etcd cluster alarm
+var EtcdAlarms = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "etcd_alarm_active",
+	Help:      "Whether an etcd cluster alarm of the type is active (1) or not (0)",
+}, []string{"alarm"})
+
+// WritesHeld is set to 1 for the reason PostgreSQL changes are held back because etcd can't accept writes
+var WritesHeld = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "writes_held",
+	Help:      "Whether PostgreSQL changes are held back (1) or not (0) because the etcd cluster has no leader (no_leader) or an active alarm (nospace_alarm, corrupt_alarm)",
+}, []string{"reason"})
+
+// EtcdLeaderChanges counts etcd leader changes observed by the cluster health check
+var EtcdLeaderChanges = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "etcd_leader_changes_total",
+	Help:      "Number of etcd leader changes observed by the cluster health check",
+})
+
+// ReplicationErrors counts failed attempts to apply changes to secondary etcd clusters
+var ReplicationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "replication_errors_total",
+	Help:      "Number of changes that failed to apply to a secondary etcd cluster",
+}, []string{"replica"})
+
+// Leader is 1 while the instance holds the leadership with --leader-election
+var Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "leader",
+	Help:      "Whether this instance is the elected active instance (1) or a standby (0)",
+})
+
+// Errors counts failed operations by category, e.g. to alert on permission failures separately
+var Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "errors_total",
+	Help:      "Number of failed sync operations by category: connection, conflict, validation, compaction, permission or other",
+}, []string{"category"})
+
+// SlowOperations counts single PostgreSQL and etcd operations exceeding the slow operation threshold
+var SlowOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "slow_operations_total",
+	Help:      "Number of single PostgreSQL or etcd operations slower than the slow operation threshold",
+}, []string{"backend"})
+
+// WatchGaps counts resumed etcd watches that skipped events and triggered a resynchronization
+var WatchGaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "watch_gaps_total",
+	Help:      "Number of resumed etcd watches per key prefix whose first event didn't follow the last received revision while keys changed in between",
+}, []string{"prefix"})
+
+// SyncedChanges counts the changes synced per direction and key prefix
+var SyncedChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "synced_changes_total",
+	Help:      "Number of changes synced, by direction and metric key prefix (other for keys outside all prefixes)",
+}, []string{"direction", "prefix"})
+
+// SyncLatency measures how long syncing a single change took per direction and key prefix
+var SyncLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "sync_latency_seconds",
+	Help:      "Time taken to apply a change to the other side, by direction and metric key prefix",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+}, []string{"direction", "prefix"})
+
+// BacklogRecords is the number of PostgreSQL changes waiting to be pushed to etcd
+var BacklogRecords = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "backlog_records",
+	Help:      "Number of PostgreSQL rows pending to be pushed to etcd (revision = -1)",
+})
+
+// BacklogAge is the age of the oldest PostgreSQL change waiting to be pushed to etcd
+var BacklogAge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "backlog_oldest_age_seconds",
+	Help:      "Age of the oldest PostgreSQL row pending to be pushed to etcd, 0 if none is pending",
+})
+
+// FailedRecords is the number of PostgreSQL changes that reached the maximum number of sync attempts
+var FailedRecords = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "failed_records",
+	Help:      "Number of pending PostgreSQL rows marked failed after too many sync attempts, see etcd_requeue_failed()",
+})
+
+// PendingRecords is the number of PostgreSQL changes waiting to be pushed to etcd per key prefix
+var PendingRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "pending_records",
+	Help:      "Number of pending PostgreSQL changes found by the last poll, by metric key prefix",
+}, []string{"prefix"})
+
+// ReplicationLagRevisions is the number of etcd revisions the slowest prefix is behind in PostgreSQL
+var ReplicationLagRevisions = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "replication_lag_revisions",
+	Help:      "Difference between the etcd header revision and the revision applied to PostgreSQL by the slowest prefix",
+})
+
+// TenantBacklogRecords is BacklogRecords per tenant schema, the unlabeled gauges report one of the tenants
+var TenantBacklogRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "tenant_backlog_records",
+	Help:      "Number of PostgreSQL rows pending to be pushed to etcd in the schema of a tenant",
+}, []string{"tenant"})
+
+// TenantBacklogAge is BacklogAge per tenant schema
+var TenantBacklogAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "tenant_backlog_oldest_age_seconds",
+	Help:      "Age of the oldest PostgreSQL row pending to be pushed to etcd in the schema of a tenant, 0 if none is pending",
+}, []string{"tenant"})
+
+// TenantLagSeconds is ReplicationLagSeconds per tenant schema
+var TenantLagSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "tenant_replication_lag_seconds",
+	Help:      "Time since the oldest etcd event of a tenant not applied to its schema yet was observed, 0 if caught up",
+}, []string{"tenant"})
+
+// ReplicationLagSeconds is the age of the oldest etcd event not applied to PostgreSQL yet
+var ReplicationLagSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "replication_lag_seconds",
+	Help:      "Time since the oldest etcd event not applied to PostgreSQL yet was observed, 0 if caught up",
+})
+
+// EtcdGRPC measures the gRPC requests and streams toward etcd, every retry of a request is counted.
+// The metrics are named grpc_client_* like in other gRPC clients.
+var EtcdGRPC = newEtcdGRPC()
+
+func newEtcdGRPC() *grpc_prometheus.ClientMetrics {
+	m := grpc_prometheus.NewClientMetrics()
+	m.EnableClientHandlingTimeHistogram()
+	return m
+}
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		QuarantinedRecords,
+		RejectedKeys,
+		SchemaViolations,
+		RevisionGaps,
+		AutoResyncs,
+		SpillBytes,
+		SpilledEvents,
+		WorkerRestarts,
+		EtcdDBSize,
+		EtcdAlarms,
+		WritesHeld,
+		EtcdLeaderChanges,
+		ReplicationErrors,
+		Leader,
+		Errors,
+		SlowOperations,
+		WatchGaps,
+		SyncedChanges,
+		SyncLatency,
+		PendingRecords,
+		BacklogRecords,
+		BacklogAge,
+		FailedRecords,
+		ReplicationLagRevisions,
+		ReplicationLagSeconds,
+		TenantBacklogRecords,
+		TenantBacklogAge,
+		TenantLagSeconds,
+		EtcdGRPC,
+	)
+}
+
+// poolCollector exports pgxpool statistics on every scrape
+type poolCollector struct {
+	stat func() *pgxpool.Stat
+
+	acquiredConns        *prometheus.Desc
+	idleConns            *prometheus.Desc
+	totalConns           *prometheus.Desc
+	maxConns             *prometheus.Desc
+	acquireCount         *prometheus.Desc
+	acquireDuration      *prometheus.Desc
+	emptyAcquireCount    *prometheus.Desc
+	canceledAcquireCount *prometheus.Desc
+}
+
+// RegisterPoolStats registers a collector exporting the statistics returned by stat
+func RegisterPoolStats(stat func() *pgxpool.Stat) error {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "pg_pool", name), help, nil, nil)
+	}
+	return Registry.Register(&poolCollector{
+		stat:                 stat,
+		acquiredConns:        desc("acquired_conns", "Number of currently acquired connections in the pool"),
+		idleConns:            desc("idle_conns", "Number of currently idle connections in the pool"),
+		totalConns:           desc("total_conns", "Total number of connections currently in the pool"),
+		maxConns:             desc("max_conns", "Maximum size of the pool"),
+		acquireCount:         desc("acquire_total", "Cumulative count of successful acquires from the pool"),
+		acquireDuration:      desc("acquire_duration_seconds_total", "Total time spent waiting for a connection from the pool"),
+		emptyAcquireCount:    desc("empty_acquire_total", "Cumulative count of acquires that had to wait for a connection"),
+		canceledAcquireCount: desc("canceled_acquire_total", "Cumulative count of acquires canceled by a context"),
+	})
+}
+
+// Describe implements prometheus.Collector
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.totalConns
+	ch <- c.maxConns
+	ch <- c.acquireCount
+	ch <- c.acquireDuration
+	ch <- c.emptyAcquireCount
+	ch <- c.canceledAcquireCount
+}
+
+// Collect implements prometheus.Collector
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stat()
+	if s == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, s.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquireCount, prometheus.CounterValue, float64(s.CanceledAcquireCount()))
+}
+
+// EtcdConnectionStates lists the gRPC connectivity states reported for the etcd client
+var EtcdConnectionStates = []string{"IDLE", "CONNECTING", "READY", "TRANSIENT_FAILURE", "SHUTDOWN"}
+
+// RegisterEtcdConnectionState registers a gauge set to 1 for the current etcd connection state
+func RegisterEtcdConnectionState(state func() string) error {
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "etcd", "connection_state"),
+		"Current gRPC connectivity state of the etcd client (1 for the active state)",
+		[]string{"state"}, nil,
+	)
+	return Registry.Register(&stateCollector{desc: desc, state: state})
+}
+
+// stateCollector exports one gauge per known connectivity state
+type stateCollector struct {
+	desc  *prometheus.Desc
+	state func() string
+}
+
+// Describe implements prometheus.Collector
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	current := c.state()
+	for _, state := range EtcdConnectionStates {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, state)
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestEtcdConnectionState tests that only the current state gauge is set
+func TestEtcdConnectionState(t *testing.T) {
+	require.NoError(t, RegisterEtcdConnectionState(func() string { return "READY" }))
+
+	expected := `
+# HELP pg_etcd_etcd_connection_state Current gRPC connectivity state of the etcd client (1 for the active state)
+# TYPE pg_etcd_etcd_connection_state gauge
+pg_etcd_etcd_connection_state{state="CONNECTING"} 0
+pg_etcd_etcd_connection_state{state="IDLE"} 0
+pg_etcd_etcd_connection_state{state="READY"} 1
+pg_etcd_etcd_connection_state{state="SHUTDOWN"} 0
+pg_etcd_etcd_connection_state{state="TRANSIENT_FAILURE"} 0
+`
+	err := testutil.GatherAndCompare(Registry, strings.NewReader(expected), "pg_etcd_etcd_connection_state")
+	assert.NoError(t, err)
+}
+
+// TestEtcdGRPC tests that requests through the etcd client interceptor are counted by method and code
+func TestEtcdGRPC(t *testing.T) {
+	interceptor := EtcdGRPC.UnaryClientInterceptor()
+	invoker := func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "etcdserver: leader changed")
+	}
+	err := interceptor(context.Background(), "/etcdserverpb.KV/Put", nil, nil, nil, invoker)
+	require.Error(t, err)
+
+	expected := `
+# HELP grpc_client_handled_total Total number of RPCs completed by the client, regardless of success or failure.
+# TYPE grpc_client_handled_total counter
+grpc_client_handled_total{grpc_code="Unavailable",grpc_method="Put",grpc_service="etcdserverpb.KV",grpc_type="unary"} 1
+`
+	err = testutil.GatherAndCompare(Registry, strings.NewReader(expected), "grpc_client_handled_total")
+	assert.NoError(t, err)
+}
+
+// TestStatsD tests that counters are pushed as increases and labels as tags or name suffixes
+func TestStatsD(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "test"}, []string{"prefix"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "test"})
+	registry.MustRegister(counter, gauge)
+
+	receive := func() string {
+		buf := make([]byte, maxStatsDPacket)
+		require.NoError(t, listener.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := listener.ReadFrom(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	for _, sink := range []string{SinkStatsD, SinkDogStatsD} {
+		statsd, err := NewStatsD(listener.LocalAddr().String(), sink)
+		require.NoError(t, err)
+		statsd.gatherer = registry
+		counter.Reset()
+
+		counter.WithLabelValues("/config/").Add(3)
+		gauge.Set(7)
+		require.NoError(t, statsd.Push())
+		first := receive()
+
+		counter.WithLabelValues("/config/").Add(2)
+		require.NoError(t, statsd.Push())
+		second := receive()
+
+		if sink == SinkDogStatsD {
+			assert.Equal(t, "test_gauge:7|g\ntest_total:3|c|#prefix:/config/", first)
+			assert.Equal(t, "test_gauge:7|g\ntest_total:2|c|#prefix:/config/", second)
+		} else {
+			assert.Equal(t, "test_gauge:7|g\ntest_total./config/:3|c", first)
+			assert.Equal(t, "test_gauge:7|g\ntest_total./config/:2|c", second)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// Metric sinks
+const (
+	SinkPrometheus = "prometheus"
+	SinkStatsD     = "statsd"
+	SinkDogStatsD  = "dogstatsd"
+)
+
+// StatsDInterval is how often the metrics are pushed, the default flush interval of the Datadog agent
+const StatsDInterval = 10 * time.Second
+
+// maxStatsDPacket keeps a UDP packet within the Ethernet MTU
+const maxStatsDPacket = 1432
+
+// StatsD pushes the metrics of Registry to a StatsD agent such as Telegraf, or a DogStatsD agent of Datadog,
+// for environments aggregating metrics instead of scraping them. Counters are sent as the increase since the
+// previous push, gauges as their value and histograms and summaries as the increase of their count and sum.
+type StatsD struct {
+	conn     net.Conn
+	tags     bool // DogStatsD tags, otherwise label values are appended to the metric name
+	gatherer prometheus.Gatherer
+	last     map[string]float64 // counter values sent by the previous push
+}
+
+// NewStatsD creates a StatsD sink sending to the UDP address, with DogStatsD tags if sink is SinkDogStatsD
+func NewStatsD(address, sink string) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd agent: %w", err)
+	}
+	return &StatsD{
+		conn:     conn,
+		tags:     sink == SinkDogStatsD,
+		gatherer: Registry,
+		last:     make(map[string]float64),
+	}, nil
+}
+
+// Run pushes the metrics every StatsDInterval and once more when ctx is done, then closes the connection
+func (s *StatsD) Run(ctx context.Context) {
+	defer func() { _ = s.conn.Close() }()
+	ticker := time.NewTicker(StatsDInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Push(); err != nil {
+				logrus.WithError(err).Debug("Failed to push final metrics to statsd")
+			}
+			return
+		case <-ticker.C:
+			if err := s.Push(); err != nil {
+				logrus.WithError(err).Warn("Failed to push metrics to statsd")
+			}
+		}
+	}
+}
+
+// Push sends the current metrics, batched into packets of at most maxStatsDPacket bytes
+func (s *StatsD) Push() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	var packet []byte
+	for _, line := range s.lines(families) {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxStatsDPacket {
+			if _, err := s.conn.Write(packet); err != nil {
+				return fmt.Errorf("failed to send metrics: %w", err)
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		if _, err := s.conn.Write(packet); err != nil {
+			return fmt.Errorf("failed to send metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// lines converts the gathered metric families into StatsD lines
+func (s *StatsD) lines(families []*dto.MetricFamily) []string {
+	var lines []string
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			labels := m.GetLabel()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				lines = s.appendCounter(lines, name, labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				lines = append(lines, s.line(name, labels, m.GetGauge().GetValue(), "g"))
+			case dto.MetricType_UNTYPED:
+				lines = append(lines, s.line(name, labels, m.GetUntyped().GetValue(), "g"))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				lines = s.appendCounter(lines, name+".count", labels, float64(m.GetHistogram().GetSampleCount()))
+				lines = s.appendCounter(lines, name+".sum", labels, m.GetHistogram().GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				lines = s.appendCounter(lines, name+".count", labels, float64(m.GetSummary().GetSampleCount()))
+				lines = s.appendCounter(lines, name+".sum", labels, m.GetSummary().GetSampleSum())
+			}
+		}
+	}
+	return lines
+}
+
+// appendCounter appends the increase of a counter since the previous push, nothing if it didn't change.
+// A counter lower than before was reset and is sent as a whole.
+func (s *StatsD) appendCounter(lines []string, name string, labels []*dto.LabelPair, value float64) []string {
+	key := seriesKey(name, labels)
+	delta := value - s.last[key]
+	if delta < 0 {
+		delta = value
+	}
+	s.last[key] = value
+	if delta == 0 {
+		return lines
+	}
+	return append(lines, s.line(name, labels, delta, "c"))
+}
+
+// line formats a single metric, e.g. pg_etcd_errors_total:1|c|#category:connection
+func (s *StatsD) line(name string, labels []*dto.LabelPair, value float64, kind string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if !s.tags {
+		for _, label := range labels {
+			b.WriteByte('.')
+			b.WriteString(sanitizeStatsD(label.GetValue(), ":|@#,"))
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if s.tags && len(labels) > 0 {
+		b.WriteString("|#")
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(label.GetName())
+			b.WriteByte(':')
+			b.WriteString(sanitizeStatsD(label.GetValue(), "|#,"))
+		}
+	}
+	return b.String()
+}
+
+// seriesKey identifies a metric series across pushes, gathered labels are sorted by name
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, label := range labels {
+		b.WriteByte(0)
+		b.WriteString(label.GetName())
+		b.WriteByte('=')
+		b.WriteString(label.GetValue())
+	}
+	return b.String()
+}
+
+// sanitizeStatsD replaces whitespace and the reserved characters of the StatsD protocol, an empty value becomes "none"
+func sanitizeStatsD(value, reserved string) string {
+	if value == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || strings.ContainsRune(reserved, r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
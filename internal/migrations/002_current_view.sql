@@ -0,0 +1,30 @@
+-- View: Latest non-tombstoned value per key
+CREATE VIEW etcd_current AS
+	SELECT l.key, l.value, l.revision, l.ts
+	FROM (
+		SELECT DISTINCT ON (e.key) e.key, e.value, e.revision, e.tombstone, e.ts
+		FROM etcd e
+		ORDER BY e.key, e.revision DESC
+	) l
+	WHERE NOT l.tombstone;
+
+-- Function: Get latest values for all keys starting with prefix
+CREATE OR REPLACE FUNCTION etcd_get_prefix(p_prefix text)
+RETURNS TABLE(key text, value text, revision bigint, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT c.key, c.value, c.revision, c.ts
+	FROM etcd_current c
+	WHERE starts_with(c.key, p_prefix)
+	ORDER BY c.key;
+$$;
+
+-- Function: Page through latest values for keys starting with prefix
+CREATE OR REPLACE FUNCTION etcd_list(p_prefix text, p_limit integer DEFAULT 100, p_offset integer DEFAULT 0)
+RETURNS TABLE(key text, value text, revision bigint, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT c.key, c.value, c.revision, c.ts
+	FROM etcd_current c
+	WHERE starts_with(c.key, p_prefix)
+	ORDER BY c.key
+	LIMIT p_limit OFFSET p_offset;
+$$;
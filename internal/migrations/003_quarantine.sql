@@ -0,0 +1,11 @@
+-- Quarantine table for etcd records that cannot be stored in the etcd table
+-- Raw key and value bytes are kept as-is together with the reason of rejection
+CREATE TABLE etcd_quarantine (
+	ts timestamp with time zone NOT NULL DEFAULT now(),
+	key bytea NOT NULL,
+	value bytea,
+	revision bigint NOT NULL,
+	tombstone boolean NOT NULL DEFAULT false,
+	reason text NOT NULL,
+	PRIMARY KEY(key, revision)
+);
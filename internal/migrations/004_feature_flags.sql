@@ -0,0 +1,29 @@
+-- Feature flag helpers over the conventional /flags/ prefix, e.g. /flags/new_checkout = 'true'
+-- Functions are STABLE and PARALLEL SAFE: a flag is read once per statement when called with
+-- constant arguments, so flags can be used in WHERE clauses without per-row lookups.
+
+-- Function: Get the raw value of a feature flag, p_default if the flag is unset
+CREATE OR REPLACE FUNCTION etcd_flag(p_name text, p_default text DEFAULT NULL)
+RETURNS text
+LANGUAGE sql STABLE PARALLEL SAFE AS $$
+	SELECT coalesce((SELECT c.value FROM etcd_current c WHERE c.key = '/flags/' || p_name), p_default);
+$$;
+
+-- Function: Get a boolean feature flag, p_default if the flag is unset or not a boolean
+CREATE OR REPLACE FUNCTION etcd_flag_bool(p_name text, p_default boolean DEFAULT false)
+RETURNS boolean
+LANGUAGE sql STABLE PARALLEL SAFE AS $$
+	SELECT CASE lower(btrim(etcd_flag(p_name)))
+		WHEN 'true' THEN true WHEN 't' THEN true WHEN 'yes' THEN true WHEN 'on' THEN true WHEN '1' THEN true
+		WHEN 'false' THEN false WHEN 'f' THEN false WHEN 'no' THEN false WHEN 'off' THEN false WHEN '0' THEN false
+		ELSE p_default
+	END;
+$$;
+
+-- Function: Get an integer feature flag, p_default if the flag is unset or not an integer
+CREATE OR REPLACE FUNCTION etcd_flag_int(p_name text, p_default bigint DEFAULT 0)
+RETURNS bigint
+LANGUAGE sql STABLE PARALLEL SAFE AS $$
+	SELECT CASE WHEN v ~ '^\s*[-+]?[0-9]{1,18}\s*$' THEN v::bigint ELSE p_default END
+	FROM etcd_flag(p_name) AS v;
+$$;
@@ -0,0 +1,13 @@
+-- Monotonic sequence for deterministic ordering of pending records created within the same
+-- timestamp tick, e.g. several etcd_put() calls in one transaction share the same now()
+ALTER TABLE etcd ADD COLUMN seq bigint GENERATED BY DEFAULT AS IDENTITY;
+
+-- Function: Get pending records for sync to etcd in insertion order
+CREATE OR REPLACE FUNCTION etcd_get_pending()
+RETURNS TABLE(key text, value text, ts timestamp with time zone, tombstone boolean)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, e.value, e.ts, e.tombstone
+	FROM etcd e
+	WHERE e.revision = -1
+	ORDER BY e.ts ASC, e.seq ASC;
+$$;
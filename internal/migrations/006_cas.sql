@@ -0,0 +1,64 @@
+-- Expected etcd mod revision of a pending row created by etcd_cas(), NULL for unconditional changes.
+-- The daemon pushes such rows with an etcd transaction comparing the key's mod revision,
+-- 0 meaning the key must not exist.
+ALTER TABLE etcd ADD COLUMN expected_revision bigint;
+
+-- Function: Enqueue a change only if the latest synced revision of the key matches.
+-- Returns false if the revision differs or another change for the key is still pending.
+-- A NULL value deletes the key.
+CREATE OR REPLACE FUNCTION etcd_cas(p_key text, p_expected_revision bigint, p_value text)
+RETURNS boolean
+LANGUAGE plpgsql AS $$
+DECLARE
+	current_revision bigint;
+BEGIN
+	IF EXISTS (SELECT 1 FROM etcd e WHERE e.key = p_key AND e.revision = -1) THEN
+		RETURN false;
+	END IF;
+
+	SELECT CASE WHEN e.tombstone THEN 0 ELSE e.revision END INTO current_revision
+	FROM etcd e
+	WHERE e.key = p_key AND e.revision > 0
+	ORDER BY e.revision DESC
+	LIMIT 1;
+
+	IF coalesce(current_revision, 0) <> p_expected_revision THEN
+		RETURN false;
+	END IF;
+
+	INSERT INTO etcd (key, value, revision, tombstone, expected_revision)
+	VALUES (p_key, p_value, -1, p_value IS NULL, coalesce(current_revision, 0));
+	RETURN true;
+EXCEPTION WHEN unique_violation THEN
+	-- a concurrent change for the key was enqueued first
+	RETURN false;
+END;
+$$;
+
+-- Function: Enqueue a change only if the latest synced value of the key matches.
+-- A NULL expected value requires the key not to exist, a NULL value deletes the key.
+CREATE OR REPLACE FUNCTION etcd_cas(p_key text, p_expected_value text, p_value text)
+RETURNS boolean
+LANGUAGE plpgsql AS $$
+DECLARE
+	latest record;
+BEGIN
+	SELECT e.revision, e.value, e.tombstone INTO latest
+	FROM etcd e
+	WHERE e.key = p_key AND e.revision > 0
+	ORDER BY e.revision DESC
+	LIMIT 1;
+
+	IF NOT FOUND OR latest.tombstone THEN
+		IF p_expected_value IS NOT NULL THEN
+			RETURN false;
+		END IF;
+		RETURN etcd_cas(p_key, 0::bigint, p_value);
+	END IF;
+
+	IF latest.value IS DISTINCT FROM p_expected_value THEN
+		RETURN false;
+	END IF;
+	RETURN etcd_cas(p_key, latest.revision, p_value);
+END;
+$$;
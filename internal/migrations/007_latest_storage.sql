@@ -0,0 +1,43 @@
+-- Latest-only storage: exactly one row per key without revision history, used with --storage=latest.
+-- Pending changes (revision = -1) replace the row of the key, deleted keys are removed once synced.
+CREATE TABLE etcd_latest (
+	ts timestamp with time zone NOT NULL DEFAULT now(),
+	key text PRIMARY KEY,
+	value text,
+	revision bigint NOT NULL,
+	tombstone boolean NOT NULL DEFAULT false,
+	seq bigint GENERATED BY DEFAULT AS IDENTITY
+);
+
+CREATE INDEX idx_etcd_latest_pending ON etcd_latest(ts, seq) WHERE revision = -1;
+
+-- Function: Get the value of a key from the latest-only table
+CREATE OR REPLACE FUNCTION etcd_latest_get(p_key text)
+RETURNS TABLE(key text, value text, revision bigint, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, e.value, e.revision, e.ts
+	FROM etcd_latest e
+	WHERE e.key = p_key AND NOT e.tombstone;
+$$;
+
+-- Function: Set a key in the latest-only table with pending status
+CREATE OR REPLACE FUNCTION etcd_latest_put(p_key text, p_value text)
+RETURNS timestamp with time zone
+LANGUAGE sql AS $$
+	INSERT INTO etcd_latest (key, value, revision, tombstone)
+	VALUES (p_key, p_value, -1, false)
+	ON CONFLICT (key) DO UPDATE
+	SET value = EXCLUDED.value, revision = -1, tombstone = false, ts = now(), seq = DEFAULT
+	RETURNING ts;
+$$;
+
+-- Function: Mark a key of the latest-only table for deletion with pending status
+CREATE OR REPLACE FUNCTION etcd_latest_delete(p_key text)
+RETURNS timestamp with time zone
+LANGUAGE sql AS $$
+	INSERT INTO etcd_latest (key, value, revision, tombstone)
+	VALUES (p_key, NULL, -1, true)
+	ON CONFLICT (key) DO UPDATE
+	SET value = NULL, revision = -1, tombstone = true, ts = now(), seq = DEFAULT
+	RETURNING ts;
+$$;
@@ -0,0 +1,24 @@
+-- Function: Compare an etcd snapshot of a prefix with the mirrored history.
+-- p_keys and p_revisions are the keys and mod revisions returned by etcd at p_header_revision.
+-- Reports snapshot revisions missing although newer revisions of the prefix were already synced
+-- (missing_revision) and keys still alive in PostgreSQL that etcd deleted (missing_delete).
+CREATE OR REPLACE FUNCTION etcd_revision_gaps(p_prefix text, p_keys text[], p_revisions bigint[], p_header_revision bigint)
+RETURNS TABLE(key text, revision bigint, kind text)
+LANGUAGE sql STABLE AS $$
+	WITH synced AS (
+		SELECT DISTINCT ON (e.key) e.key, e.revision, e.tombstone
+		FROM etcd e
+		WHERE starts_with(e.key, p_prefix) AND e.revision > 0
+		ORDER BY e.key, e.revision DESC
+	), watermark AS (
+		SELECT coalesce(max(s.revision), 0) AS revision FROM synced s
+	)
+	SELECT k.key, k.revision, 'missing_revision'
+	FROM unnest(p_keys, p_revisions) AS k(key, revision), watermark w
+	WHERE k.revision <= w.revision
+		AND NOT EXISTS (SELECT 1 FROM etcd e WHERE e.key = k.key AND e.revision = k.revision)
+	UNION ALL
+	SELECT s.key, s.revision, 'missing_delete'
+	FROM synced s
+	WHERE NOT s.tombstone AND s.revision <= p_header_revision AND s.key <> ALL (p_keys);
+$$;
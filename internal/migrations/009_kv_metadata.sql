@@ -0,0 +1,12 @@
+-- etcd key metadata of synced revisions, NULL for pending rows.
+-- create_revision and version distinguish re-creations from updates (version restarts at 1),
+-- lease is the ID of the lease attached to the key, 0 if none.
+ALTER TABLE etcd
+	ADD COLUMN create_revision bigint,
+	ADD COLUMN version bigint,
+	ADD COLUMN lease bigint;
+
+ALTER TABLE etcd_latest
+	ADD COLUMN create_revision bigint,
+	ADD COLUMN version bigint,
+	ADD COLUMN lease bigint;
@@ -0,0 +1,17 @@
+-- Unlogged staging table for --ingest-mode=staging. Every batch is COPYed with its own batch ID,
+-- merged into etcd with a single INSERT ... ON CONFLICT and removed in the same transaction.
+CREATE UNLOGGED TABLE etcd_staging (
+	batch bigint NOT NULL,
+	ts timestamp with time zone NOT NULL,
+	key text NOT NULL,
+	value text,
+	revision bigint NOT NULL,
+	tombstone boolean NOT NULL,
+	create_revision bigint,
+	version bigint,
+	lease bigint
+);
+
+CREATE INDEX idx_etcd_staging_batch ON etcd_staging(batch);
+
+CREATE SEQUENCE etcd_staging_batch_seq;
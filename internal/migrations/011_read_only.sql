@@ -0,0 +1,40 @@
+-- Read-only mirror: triggers rejecting pending rows (revision = -1), so nothing is ever pushed to etcd.
+-- They are installed disabled, etcd_set_read_only() switches them, pg_etcd --read-only enables them.
+CREATE OR REPLACE FUNCTION etcd_reject_pending()
+RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+	RAISE EXCEPTION 'pg_etcd mirror is read-only, changes must be written to etcd'
+		USING ERRCODE = 'read_only_sql_transaction', HINT = 'disable with SELECT etcd_set_read_only(false)';
+END;
+$$;
+
+CREATE TRIGGER etcd_read_only BEFORE INSERT OR UPDATE ON etcd
+	FOR EACH ROW WHEN (NEW.revision = -1) EXECUTE FUNCTION etcd_reject_pending();
+ALTER TABLE etcd DISABLE TRIGGER etcd_read_only;
+
+CREATE TRIGGER etcd_latest_read_only BEFORE INSERT OR UPDATE ON etcd_latest
+	FOR EACH ROW WHEN (NEW.revision = -1) EXECUTE FUNCTION etcd_reject_pending();
+ALTER TABLE etcd_latest DISABLE TRIGGER etcd_latest_read_only;
+
+-- Function: Enable or disable the read-only mirror triggers
+CREATE OR REPLACE FUNCTION etcd_set_read_only(p_read_only boolean)
+RETURNS void
+LANGUAGE plpgsql AS $$
+BEGIN
+	IF p_read_only THEN
+		ALTER TABLE etcd ENABLE TRIGGER etcd_read_only;
+		ALTER TABLE etcd_latest ENABLE TRIGGER etcd_latest_read_only;
+	ELSE
+		ALTER TABLE etcd DISABLE TRIGGER etcd_read_only;
+		ALTER TABLE etcd_latest DISABLE TRIGGER etcd_latest_read_only;
+	END IF;
+END;
+$$;
+
+-- Function: Report whether the read-only mirror triggers are enabled
+CREATE OR REPLACE FUNCTION etcd_is_read_only()
+RETURNS boolean
+LANGUAGE sql STABLE AS $$
+	SELECT tgenabled <> 'D' FROM pg_trigger WHERE tgrelid = 'etcd'::regclass AND tgname = 'etcd_read_only';
+$$;
@@ -0,0 +1,7 @@
+-- Per-prefix synchronization state: the etcd revision the initial snapshot was taken at.
+-- It is written in the same transaction as the snapshot, the watch resumes at revision + 1.
+CREATE TABLE IF NOT EXISTS etcd_sync_state (
+	prefix text PRIMARY KEY,
+	revision bigint NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,17 @@
+-- Fan-out to secondary etcd clusters: the latest change of every key acknowledged by the primary,
+-- per replica. replica_revision is NULL until the change is applied to the replica.
+CREATE TABLE IF NOT EXISTS etcd_replica_status (
+	replica text NOT NULL,
+	key text NOT NULL,
+	value text,
+	tombstone boolean NOT NULL DEFAULT false,
+	revision bigint NOT NULL,
+	replica_revision bigint,
+	error text,
+	queued_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	replicated_at timestamptz,
+	PRIMARY KEY (replica, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_etcd_replica_status_pending
+	ON etcd_replica_status (replica, revision) WHERE replica_revision IS NULL;
@@ -0,0 +1,28 @@
+-- Append-only audit log of every change pg_etcd applies in either direction, written with --audit-log-table.
+-- prev_revision is the etcd mod revision the key had before the change, 0 if it did not exist.
+CREATE TABLE IF NOT EXISTS etcd_audit_log (
+	id bigserial PRIMARY KEY,
+	ts timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	direction text NOT NULL,
+	origin text NOT NULL,
+	operation text NOT NULL,
+	key text NOT NULL,
+	prev_revision bigint NOT NULL,
+	revision bigint NOT NULL,
+	instance text NOT NULL,
+	applied_by text NOT NULL DEFAULT current_user
+);
+
+CREATE INDEX IF NOT EXISTS idx_etcd_audit_log_key ON etcd_audit_log (key, ts);
+
+CREATE OR REPLACE FUNCTION etcd_audit_log_append_only()
+RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+	RAISE EXCEPTION 'etcd_audit_log is append-only'
+		USING ERRCODE = 'insufficient_privilege';
+END;
+$$;
+
+CREATE TRIGGER etcd_audit_log_append_only BEFORE UPDATE OR DELETE ON etcd_audit_log
+	FOR EACH ROW EXECUTE FUNCTION etcd_audit_log_append_only();
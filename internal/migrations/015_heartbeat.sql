@@ -0,0 +1,10 @@
+-- Heartbeat of the running daemons for monitoring with SQL access only, written with --heartbeat-interval.
+-- There is one row per synchronized keyspace, a stalled daemon stops advancing updated_at and last_loop.
+CREATE TABLE IF NOT EXISTS etcd_sync_heartbeat (
+	name text PRIMARY KEY,
+	instance text NOT NULL,
+	last_loop timestamptz,
+	checkpoint bigint NOT NULL,
+	backlog bigint NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
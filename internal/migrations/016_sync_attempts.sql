@@ -0,0 +1,60 @@
+-- Poison records: the daemon counts failed pushes of a pending row (revision = -1) to etcd and keeps the last
+-- error. A row reaching --max-sync-attempts gets the status 'failed' and is no longer selected for syncing,
+-- etcd_requeue_failed() retries it after the cause is fixed. Connection failures are not counted.
+ALTER TABLE etcd ADD COLUMN sync_attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE etcd ADD COLUMN last_error text;
+ALTER TABLE etcd ADD COLUMN status text CHECK (status = 'failed');
+
+ALTER TABLE etcd_latest ADD COLUMN sync_attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE etcd_latest ADD COLUMN last_error text;
+ALTER TABLE etcd_latest ADD COLUMN status text CHECK (status = 'failed');
+
+-- Function: Get pending records for sync to etcd in insertion order, failed ones are skipped like by the daemon
+CREATE OR REPLACE FUNCTION etcd_get_pending()
+RETURNS TABLE(key text, value text, ts timestamp with time zone, tombstone boolean)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, e.value, e.ts, e.tombstone
+	FROM etcd e
+	WHERE e.revision = -1 AND e.status IS NULL
+	ORDER BY e.ts ASC, e.seq ASC;
+$$;
+
+-- Function: Set a key in the latest-only table with pending status, a new change clears a failed one
+CREATE OR REPLACE FUNCTION etcd_latest_put(p_key text, p_value text)
+RETURNS timestamp with time zone
+LANGUAGE sql AS $$
+	INSERT INTO etcd_latest (key, value, revision, tombstone)
+	VALUES (p_key, p_value, -1, false)
+	ON CONFLICT (key) DO UPDATE
+	SET value = EXCLUDED.value, revision = -1, tombstone = false, ts = now(), seq = DEFAULT,
+		sync_attempts = 0, last_error = NULL, status = NULL
+	RETURNING ts;
+$$;
+
+-- Function: Mark a key of the latest-only table for deletion with pending status, a new change clears a failed one
+CREATE OR REPLACE FUNCTION etcd_latest_delete(p_key text)
+RETURNS timestamp with time zone
+LANGUAGE sql AS $$
+	INSERT INTO etcd_latest (key, value, revision, tombstone)
+	VALUES (p_key, NULL, -1, true)
+	ON CONFLICT (key) DO UPDATE
+	SET value = NULL, revision = -1, tombstone = true, ts = now(), seq = DEFAULT,
+		sync_attempts = 0, last_error = NULL, status = NULL
+	RETURNING ts;
+$$;
+
+-- Function: Retry failed pending rows of a key, or all keys if NULL, returns the number of requeued rows
+CREATE OR REPLACE FUNCTION etcd_requeue_failed(p_key text DEFAULT NULL)
+RETURNS bigint
+LANGUAGE sql AS $$
+	WITH history AS (
+		UPDATE etcd SET sync_attempts = 0, last_error = NULL, status = NULL
+		WHERE revision = -1 AND status = 'failed' AND (p_key IS NULL OR key = p_key)
+		RETURNING 1
+	), latest AS (
+		UPDATE etcd_latest SET sync_attempts = 0, last_error = NULL, status = NULL
+		WHERE revision = -1 AND status = 'failed' AND (p_key IS NULL OR key = p_key)
+		RETURNING 1
+	)
+	SELECT (SELECT count(*) FROM history) + (SELECT count(*) FROM latest);
+$$;
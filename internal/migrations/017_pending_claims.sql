@@ -0,0 +1,34 @@
+-- Claims of pending rows (revision = -1): the daemon marks rows in-progress before pushing them to etcd and
+-- acks them by setting the etcd revision afterwards. Rows still claimed by another, crashed daemon are
+-- reconciled with etcd on startup, so a crash between the etcd write and the ack neither leaves the row
+-- pending forever nor applies it twice.
+ALTER TABLE etcd ADD COLUMN claimed_by text;
+ALTER TABLE etcd ADD COLUMN claimed_at timestamptz;
+
+ALTER TABLE etcd_latest ADD COLUMN claimed_by text;
+ALTER TABLE etcd_latest ADD COLUMN claimed_at timestamptz;
+
+-- Function: Set a key in the latest-only table with pending status, a new change clears a failed or claimed one
+CREATE OR REPLACE FUNCTION etcd_latest_put(p_key text, p_value text)
+RETURNS timestamp with time zone
+LANGUAGE sql AS $$
+	INSERT INTO etcd_latest (key, value, revision, tombstone)
+	VALUES (p_key, p_value, -1, false)
+	ON CONFLICT (key) DO UPDATE
+	SET value = EXCLUDED.value, revision = -1, tombstone = false, ts = now(), seq = DEFAULT,
+		sync_attempts = 0, last_error = NULL, status = NULL, claimed_by = NULL, claimed_at = NULL
+	RETURNING ts;
+$$;
+
+-- Function: Mark a key of the latest-only table for deletion with pending status, a new change clears a failed
+-- or claimed one
+CREATE OR REPLACE FUNCTION etcd_latest_delete(p_key text)
+RETURNS timestamp with time zone
+LANGUAGE sql AS $$
+	INSERT INTO etcd_latest (key, value, revision, tombstone)
+	VALUES (p_key, NULL, -1, true)
+	ON CONFLICT (key) DO UPDATE
+	SET value = NULL, revision = -1, tombstone = true, ts = now(), seq = DEFAULT,
+		sync_attempts = 0, last_error = NULL, status = NULL, claimed_by = NULL, claimed_at = NULL
+	RETURNING ts;
+$$;
@@ -0,0 +1,53 @@
+-- Backlog limit: while the backlog of pending rows exceeds the hard limit, e.g. because etcd is unreachable,
+-- pg_etcd --backlog-reject rejects new pending rows so writers learn the forwarding path is broken.
+-- The triggers are installed disabled, etcd_set_backlog_rejected() switches them and records the reason.
+CREATE TABLE IF NOT EXISTS etcd_backlog_rejection (
+	id boolean PRIMARY KEY DEFAULT true CHECK (id),
+	reason text NOT NULL,
+	since timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE OR REPLACE FUNCTION etcd_reject_backlog()
+RETURNS trigger
+LANGUAGE plpgsql AS $$
+DECLARE
+	v_reason text;
+	v_since timestamptz;
+BEGIN
+	SELECT reason, since INTO v_reason, v_since FROM etcd_backlog_rejection;
+	IF NOT FOUND THEN
+		RETURN NEW;
+	END IF;
+	RAISE EXCEPTION 'pg_etcd backlog exceeds its hard limit, changes are not forwarded to etcd'
+		USING ERRCODE = 'program_limit_exceeded', DETAIL = format('%s since %s', v_reason, v_since),
+		HINT = 'check etcd and pg_etcd, SELECT etcd_set_backlog_rejected(NULL) accepts changes right away';
+END;
+$$;
+
+-- BEFORE INSERT triggers also fire for the upserts of etcd_put() and etcd_delete(), claims and acks of the
+-- daemon are updates and pass
+CREATE TRIGGER etcd_backlog_limit BEFORE INSERT ON etcd
+	FOR EACH ROW WHEN (NEW.revision = -1) EXECUTE FUNCTION etcd_reject_backlog();
+ALTER TABLE etcd DISABLE TRIGGER etcd_backlog_limit;
+
+CREATE TRIGGER etcd_latest_backlog_limit BEFORE INSERT ON etcd_latest
+	FOR EACH ROW WHEN (NEW.revision = -1) EXECUTE FUNCTION etcd_reject_backlog();
+ALTER TABLE etcd_latest DISABLE TRIGGER etcd_latest_backlog_limit;
+
+-- Function: Reject new pending rows for p_reason, accept them again if p_reason is NULL
+CREATE OR REPLACE FUNCTION etcd_set_backlog_rejected(p_reason text)
+RETURNS void
+LANGUAGE plpgsql AS $$
+BEGIN
+	IF p_reason IS NOT NULL THEN
+		INSERT INTO etcd_backlog_rejection (reason) VALUES (p_reason)
+		ON CONFLICT (id) DO UPDATE SET reason = EXCLUDED.reason;
+		ALTER TABLE etcd ENABLE TRIGGER etcd_backlog_limit;
+		ALTER TABLE etcd_latest ENABLE TRIGGER etcd_latest_backlog_limit;
+	ELSE
+		DELETE FROM etcd_backlog_rejection;
+		ALTER TABLE etcd DISABLE TRIGGER etcd_backlog_limit;
+		ALTER TABLE etcd_latest DISABLE TRIGGER etcd_latest_backlog_limit;
+	END IF;
+END;
+$$;
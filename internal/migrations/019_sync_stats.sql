@@ -0,0 +1,20 @@
+-- Statistics of the running daemons, written with the heartbeat row of --heartbeat-interval.
+-- The counters are totals since the daemon started, they restart at 0 with a new instance.
+ALTER TABLE etcd_sync_heartbeat
+	ADD COLUMN events_applied bigint NOT NULL DEFAULT 0,
+	ADD COLUMN pendings_flushed bigint NOT NULL DEFAULT 0,
+	ADD COLUMN conflicts bigint NOT NULL DEFAULT 0,
+	ADD COLUMN retries bigint NOT NULL DEFAULT 0,
+	ADD COLUMN lag_revisions bigint NOT NULL DEFAULT 0,
+	ADD COLUMN lag_seconds double precision NOT NULL DEFAULT 0;
+
+-- Function: Statistics of every synchronized keyspace as of the last heartbeat
+CREATE OR REPLACE FUNCTION etcd_sync_stats()
+RETURNS TABLE(name text, instance text, events_applied bigint, pendings_flushed bigint, conflicts bigint,
+	retries bigint, lag_revisions bigint, lag_seconds double precision, updated_at timestamptz)
+LANGUAGE sql STABLE AS $$
+	SELECT h.name, h.instance, h.events_applied, h.pendings_flushed, h.conflicts,
+		h.retries, h.lag_revisions, h.lag_seconds, h.updated_at
+	FROM etcd_sync_heartbeat h
+	ORDER BY h.name;
+$$;
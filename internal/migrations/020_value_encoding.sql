@@ -0,0 +1,89 @@
+-- Encoding of the value column, NULL for plain values. With --compress-threshold the daemon stores
+-- larger values received from etcd as 'zstd', the base64 encoded zstd frame of the value.
+ALTER TABLE etcd ADD COLUMN encoding text;
+ALTER TABLE etcd_latest ADD COLUMN encoding text;
+ALTER TABLE etcd_staging ADD COLUMN encoding text;
+
+-- Function: Decode a stored value. zstd values are decompressed by zstd_decompress(bytea) of an
+-- installed extension, e.g. pg_zstd, plain values are returned as is.
+CREATE OR REPLACE FUNCTION etcd_decode(p_value text, p_encoding text)
+RETURNS text
+LANGUAGE plpgsql STABLE PARALLEL SAFE AS $$
+DECLARE
+	decoded text;
+BEGIN
+	IF p_encoding IS NULL OR p_value IS NULL THEN
+		RETURN p_value;
+	END IF;
+	IF p_encoding <> 'zstd' THEN
+		RAISE EXCEPTION 'unknown value encoding %', p_encoding;
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM pg_proc WHERE proname = 'zstd_decompress') THEN
+		RAISE EXCEPTION 'value is zstd compressed, install an extension providing zstd_decompress(bytea)';
+	END IF;
+	EXECUTE 'SELECT convert_from(zstd_decompress($1), ''UTF8'')' INTO decoded USING decode(p_value, 'base64');
+	RETURN decoded;
+END;
+$$;
+
+CREATE OR REPLACE VIEW etcd_current AS
+	SELECT l.key, etcd_decode(l.value, l.encoding) AS value, l.revision, l.ts
+	FROM (
+		SELECT DISTINCT ON (e.key) e.key, e.value, e.encoding, e.revision, e.tombstone, e.ts
+		FROM etcd e
+		ORDER BY e.key, e.revision DESC
+	) l
+	WHERE NOT l.tombstone;
+
+CREATE OR REPLACE FUNCTION etcd_get(p_key text)
+RETURNS TABLE(key text, value text, revision bigint, tombstone boolean, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, etcd_decode(e.value, e.encoding), e.revision, e.tombstone, e.ts
+	FROM etcd e
+	WHERE e.key = p_key
+	ORDER BY e.revision DESC
+	LIMIT 1;
+$$;
+
+CREATE OR REPLACE FUNCTION etcd_get_all(p_key text, p_min_revision bigint DEFAULT 0)
+RETURNS TABLE(key text, value text, revision bigint, tombstone boolean, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, etcd_decode(e.value, e.encoding), e.revision, e.tombstone, e.ts
+	FROM etcd e
+	WHERE e.key = p_key AND e.revision > p_min_revision
+	ORDER BY e.revision ASC;
+$$;
+
+CREATE OR REPLACE FUNCTION etcd_latest_get(p_key text)
+RETURNS TABLE(key text, value text, revision bigint, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, etcd_decode(e.value, e.encoding), e.revision, e.ts
+	FROM etcd_latest e
+	WHERE e.key = p_key AND NOT e.tombstone;
+$$;
+
+CREATE OR REPLACE FUNCTION etcd_cas(p_key text, p_expected_value text, p_value text)
+RETURNS boolean
+LANGUAGE plpgsql AS $$
+DECLARE
+	latest record;
+BEGIN
+	SELECT e.revision, etcd_decode(e.value, e.encoding) AS value, e.tombstone INTO latest
+	FROM etcd e
+	WHERE e.key = p_key AND e.revision > 0
+	ORDER BY e.revision DESC
+	LIMIT 1;
+
+	IF NOT FOUND OR latest.tombstone THEN
+		IF p_expected_value IS NOT NULL THEN
+			RETURN false;
+		END IF;
+		RETURN etcd_cas(p_key, 0::bigint, p_value);
+	END IF;
+
+	IF latest.value IS DISTINCT FROM p_expected_value THEN
+		RETURN false;
+	END IF;
+	RETURN etcd_cas(p_key, latest.revision, p_value);
+END;
+$$;
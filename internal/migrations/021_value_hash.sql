@@ -0,0 +1,32 @@
+-- SHA-256 of the plain value of every row, NULL for tombstones. The triggers hash plain values, the
+-- daemon supplies the hash of values it stores compressed. With --dedup a change whose value equals the
+-- latest row of its key moves the revision of that row instead of adding one, and resynchronizations skip
+-- rows mirrored with the same revision and hash.
+ALTER TABLE etcd ADD COLUMN value_hash bytea;
+ALTER TABLE etcd_latest ADD COLUMN value_hash bytea;
+ALTER TABLE etcd_staging ADD COLUMN value_hash bytea;
+
+CREATE OR REPLACE FUNCTION etcd_hash_value()
+RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+	IF NEW.tombstone OR NEW.value IS NULL THEN
+		NEW.value_hash := NULL;
+	ELSIF NEW.encoding IS NULL THEN
+		NEW.value_hash := sha256(convert_to(NEW.value, 'UTF8'));
+	END IF;
+	RETURN NEW;
+END;
+$$;
+
+CREATE TRIGGER etcd_value_hash BEFORE INSERT OR UPDATE OF value, encoding, tombstone ON etcd
+	FOR EACH ROW EXECUTE FUNCTION etcd_hash_value();
+
+CREATE TRIGGER etcd_latest_value_hash BEFORE INSERT OR UPDATE OF value, encoding, tombstone ON etcd_latest
+	FOR EACH ROW EXECUTE FUNCTION etcd_hash_value();
+
+-- Existing plain rows, compressed ones stay without hash until their key changes
+UPDATE etcd SET value_hash = sha256(convert_to(value, 'UTF8'))
+WHERE NOT tombstone AND value IS NOT NULL AND encoding IS NULL;
+UPDATE etcd_latest SET value_hash = sha256(convert_to(value, 'UTF8'))
+WHERE NOT tombstone AND value IS NOT NULL AND encoding IS NULL;
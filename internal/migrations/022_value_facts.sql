@@ -0,0 +1,16 @@
+-- Facts extracted from values by the decoders configured with --decoder, e.g. the state of Patroni members
+-- or the kind and name of Kubernetes objects, NULL if no decoder applies. Kubernetes protobuf objects are
+-- no valid text and keep their facts in etcd_quarantine.
+ALTER TABLE etcd ADD COLUMN facts jsonb;
+ALTER TABLE etcd_latest ADD COLUMN facts jsonb;
+ALTER TABLE etcd_staging ADD COLUMN facts jsonb;
+ALTER TABLE etcd_quarantine ADD COLUMN facts jsonb;
+
+CREATE OR REPLACE VIEW etcd_current AS
+	SELECT l.key, etcd_decode(l.value, l.encoding) AS value, l.revision, l.ts, l.facts
+	FROM (
+		SELECT DISTINCT ON (e.key) e.key, e.value, e.encoding, e.revision, e.tombstone, e.ts, e.facts
+		FROM etcd e
+		ORDER BY e.key, e.revision DESC
+	) l
+	WHERE NOT l.tombstone;
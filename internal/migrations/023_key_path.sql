@@ -0,0 +1,74 @@
+-- Key paths: the segments of every key split on '/', e.g. {registry,pods,default,web} for
+-- /registry/pods/default/web, so prefix analytics and per-service retention can be written in plain SQL.
+-- The triggers maintaining them are installed disabled, etcd_set_key_path() switches them and fills the
+-- paths of existing rows, pg_etcd --key-path enables them.
+ALTER TABLE etcd ADD COLUMN key_path text[];
+ALTER TABLE etcd_latest ADD COLUMN key_path text[];
+
+-- Function: Segments of a key without empty ones from leading, trailing or doubled slashes
+CREATE OR REPLACE FUNCTION etcd_key_path(p_key text)
+RETURNS text[]
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+	SELECT array_remove(string_to_array(p_key, '/'), '');
+$$;
+
+CREATE OR REPLACE FUNCTION etcd_split_key()
+RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+	NEW.key_path := etcd_key_path(NEW.key);
+	RETURN NEW;
+END;
+$$;
+
+CREATE TRIGGER etcd_key_path BEFORE INSERT OR UPDATE OF key ON etcd
+	FOR EACH ROW EXECUTE FUNCTION etcd_split_key();
+ALTER TABLE etcd DISABLE TRIGGER etcd_key_path;
+
+CREATE TRIGGER etcd_latest_key_path BEFORE INSERT OR UPDATE OF key ON etcd_latest
+	FOR EACH ROW EXECUTE FUNCTION etcd_split_key();
+ALTER TABLE etcd_latest DISABLE TRIGGER etcd_latest_key_path;
+
+-- The first two segments, namespace and service, e.g. WHERE key_path[1] = 'registry' AND key_path[2] = 'pods'
+CREATE INDEX IF NOT EXISTS idx_etcd_key_path ON etcd ((key_path[1]), (key_path[2]));
+CREATE INDEX IF NOT EXISTS idx_etcd_latest_key_path ON etcd_latest ((key_path[1]), (key_path[2]));
+
+-- Function: Report whether the key path triggers are enabled
+CREATE OR REPLACE FUNCTION etcd_has_key_path()
+RETURNS boolean
+LANGUAGE sql STABLE AS $$
+	SELECT tgenabled <> 'D' FROM pg_trigger WHERE tgrelid = 'etcd'::regclass AND tgname = 'etcd_key_path';
+$$;
+
+-- Function: Enable or disable the key path triggers. Enabling fills the paths of the rows written while
+-- they were disabled, disabling keeps the paths already stored.
+CREATE OR REPLACE FUNCTION etcd_set_key_path(p_enabled boolean)
+RETURNS void
+LANGUAGE plpgsql AS $$
+BEGIN
+	IF p_enabled THEN
+		IF etcd_has_key_path() THEN
+			RETURN;
+		END IF;
+		ALTER TABLE etcd ENABLE TRIGGER etcd_key_path;
+		ALTER TABLE etcd_latest ENABLE TRIGGER etcd_latest_key_path;
+		UPDATE etcd SET key_path = etcd_key_path(key) WHERE key_path IS NULL;
+		UPDATE etcd_latest SET key_path = etcd_key_path(key) WHERE key_path IS NULL;
+	ELSE
+		ALTER TABLE etcd DISABLE TRIGGER etcd_key_path;
+		ALTER TABLE etcd_latest DISABLE TRIGGER etcd_latest_key_path;
+	END IF;
+END;
+$$;
+
+-- Current values with the key split into namespace, service and the remaining item, NULL while key paths
+-- are disabled
+CREATE OR REPLACE VIEW etcd_current AS
+	SELECT l.key, etcd_decode(l.value, l.encoding) AS value, l.revision, l.ts, l.facts,
+		l.key_path[1] AS namespace, l.key_path[2] AS service, NULLIF(array_to_string(l.key_path[3:], '/'), '') AS item
+	FROM (
+		SELECT DISTINCT ON (e.key) e.key, e.value, e.encoding, e.revision, e.tombstone, e.ts, e.facts, e.key_path
+		FROM etcd e
+		ORDER BY e.key, e.revision DESC
+	) l
+	WHERE NOT l.tombstone;
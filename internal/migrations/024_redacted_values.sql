@@ -0,0 +1,35 @@
+-- Values of secret keys stored with --secret PATTERN:hash are the hex encoded SHA-256 of the value with
+-- encoding 'sha256', value_hash holds the same hash. They decode to the hash, the value itself is never
+-- stored in PostgreSQL.
+CREATE OR REPLACE FUNCTION etcd_decode(p_value text, p_encoding text)
+RETURNS text
+LANGUAGE plpgsql STABLE PARALLEL SAFE AS $$
+DECLARE
+	decoded text;
+BEGIN
+	IF p_encoding IS NULL OR p_value IS NULL OR p_encoding = 'sha256' THEN
+		RETURN p_value;
+	END IF;
+	IF p_encoding <> 'zstd' THEN
+		RAISE EXCEPTION 'unknown value encoding %', p_encoding;
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM pg_proc WHERE proname = 'zstd_decompress') THEN
+		RAISE EXCEPTION 'value is zstd compressed, install an extension providing zstd_decompress(bytea)';
+	END IF;
+	EXECUTE 'SELECT convert_from(zstd_decompress($1), ''UTF8'')' INTO decoded USING decode(p_value, 'base64');
+	RETURN decoded;
+END;
+$$;
+
+-- Function: Report whether the value of the latest row of a key is redacted
+CREATE OR REPLACE FUNCTION etcd_is_redacted(p_key text)
+RETURNS boolean
+LANGUAGE sql STABLE AS $$
+	SELECT coalesce((
+		SELECT e.encoding = 'sha256'
+		FROM etcd e
+		WHERE e.key = p_key
+		ORDER BY e.revision DESC
+		LIMIT 1
+	), false);
+$$;
@@ -0,0 +1,57 @@
+-- Time travel: the state of keys as of an etcd revision or a point in time, reconstructed from the history.
+-- Points in time refer to ts, when the revision was mirrored. Pending rows are not part of any revision and
+-- left out. The single key functions return a key deleted at that point with tombstone set, the prefix
+-- functions only the keys that existed. With --history=prune revisions before the last etcd compaction are
+-- incomplete, with --dedup a key rewritten with its value only has the latest of those revisions.
+
+-- Function: Get the value of a key as of an etcd revision
+CREATE OR REPLACE FUNCTION etcd_get_at_revision(p_key text, p_revision bigint)
+RETURNS TABLE(key text, value text, revision bigint, tombstone boolean, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, etcd_decode(e.value, e.encoding), e.revision, e.tombstone, e.ts
+	FROM etcd e
+	WHERE e.key = p_key AND e.revision > 0 AND e.revision <= p_revision
+	ORDER BY e.revision DESC
+	LIMIT 1;
+$$;
+
+-- Function: Get the value of a key as of a point in time
+CREATE OR REPLACE FUNCTION etcd_get_at(p_key text, p_ts timestamp with time zone)
+RETURNS TABLE(key text, value text, revision bigint, tombstone boolean, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT e.key, etcd_decode(e.value, e.encoding), e.revision, e.tombstone, e.ts
+	FROM etcd e
+	WHERE e.key = p_key AND e.revision > 0 AND e.ts <= p_ts
+	ORDER BY e.revision DESC
+	LIMIT 1;
+$$;
+
+-- Function: Get the keys below a prefix with their values as of an etcd revision
+CREATE OR REPLACE FUNCTION etcd_get_prefix_at_revision(p_prefix text, p_revision bigint)
+RETURNS TABLE(key text, value text, revision bigint, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT l.key, etcd_decode(l.value, l.encoding), l.revision, l.ts
+	FROM (
+		SELECT DISTINCT ON (e.key) e.key, e.value, e.encoding, e.revision, e.tombstone, e.ts
+		FROM etcd e
+		WHERE starts_with(e.key, p_prefix) AND e.revision > 0 AND e.revision <= p_revision
+		ORDER BY e.key, e.revision DESC
+	) l
+	WHERE NOT l.tombstone
+	ORDER BY l.key;
+$$;
+
+-- Function: Get the keys below a prefix with their values as of a point in time
+CREATE OR REPLACE FUNCTION etcd_get_prefix_at(p_prefix text, p_ts timestamp with time zone)
+RETURNS TABLE(key text, value text, revision bigint, ts timestamp with time zone)
+LANGUAGE sql STABLE AS $$
+	SELECT l.key, etcd_decode(l.value, l.encoding), l.revision, l.ts
+	FROM (
+		SELECT DISTINCT ON (e.key) e.key, e.value, e.encoding, e.revision, e.tombstone, e.ts
+		FROM etcd e
+		WHERE starts_with(e.key, p_prefix) AND e.revision > 0 AND e.ts <= p_ts
+		ORDER BY e.key, e.revision DESC
+	) l
+	WHERE NOT l.tombstone
+	ORDER BY l.key;
+$$;
@@ -0,0 +1,7 @@
+-- Revision the history in PostgreSQL is complete from, raised when revisions are pruned by --history=prune
+-- or --retention. The façade rejects reads and watches below it as compacted, like etcd.
+CREATE TABLE IF NOT EXISTS etcd_compaction (
+	id boolean PRIMARY KEY DEFAULT true CHECK (id),
+	revision bigint NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,4 @@
+-- Quarantined keys are often too large for a btree entry, key the quarantine on their hash instead
+ALTER TABLE etcd_quarantine ADD COLUMN key_hash bytea GENERATED ALWAYS AS (sha256(key)) STORED;
+ALTER TABLE etcd_quarantine DROP CONSTRAINT etcd_quarantine_pkey;
+ALTER TABLE etcd_quarantine ADD PRIMARY KEY (key_hash, revision);
@@ -4,19 +4,105 @@ package migrations
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"sync"
 
 	migrator "github.com/cybertec-postgresql/pgx-migrator"
 	"github.com/jackc/pgx/v5"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
 )
 
 //go:embed 001_create_tables.sql
 var createTablesSQL string
 
+//go:embed 002_current_view.sql
+var currentViewSQL string
+
+//go:embed 003_quarantine.sql
+var quarantineSQL string
+
+//go:embed 004_feature_flags.sql
+var featureFlagsSQL string
+
+//go:embed 005_pending_seq.sql
+var pendingSeqSQL string
+
+//go:embed 006_cas.sql
+var casSQL string
+
+//go:embed 007_latest_storage.sql
+var latestStorageSQL string
+
+//go:embed 008_revision_gaps.sql
+var revisionGapsSQL string
+
+//go:embed 009_kv_metadata.sql
+var kvMetadataSQL string
+
+//go:embed 010_staging.sql
+var stagingSQL string
+
+//go:embed 011_read_only.sql
+var readOnlySQL string
+
+//go:embed 012_sync_state.sql
+var syncStateSQL string
+
+//go:embed 013_replicas.sql
+var replicasSQL string
+
+//go:embed 014_audit_log.sql
+var auditLogSQL string
+
+//go:embed 015_heartbeat.sql
+var heartbeatSQL string
+
+//go:embed 016_sync_attempts.sql
+var syncAttemptsSQL string
+
+//go:embed 017_pending_claims.sql
+var pendingClaimsSQL string
+
+//go:embed 018_backlog_limit.sql
+var backlogLimitSQL string
+
+//go:embed 019_sync_stats.sql
+var syncStatsSQL string
+
+//go:embed 020_value_encoding.sql
+var valueEncodingSQL string
+
+//go:embed 021_value_hash.sql
+var valueHashSQL string
+
+//go:embed 022_value_facts.sql
+var valueFactsSQL string
+
+//go:embed 023_key_path.sql
+var keyPathSQL string
+
+//go:embed 024_redacted_values.sql
+var redactedValuesSQL string
+
+//go:embed 025_time_travel.sql
+var timeTravelSQL string
+
+//go:embed 026_compaction.sql
+var compactionSQL string
+
+//go:embed 027_quarantine_key_hash.sql
+var quarantineKeyHashSQL string
+
 // migrations holds function returning all upgrade migrations needed
 var migrations func() migrator.Option = func() migrator.Option {
-	return migrator.Migrations(
+	return migrator.Migrations(migrationList()...)
+}
+
+// migrationList returns all upgrade migrations in the order they are applied
+func migrationList() []any {
+	return []any{
 		&migrator.Migration{
 			Name: "001_create_tables",
 			Func: func(ctx context.Context, tx pgx.Tx) error {
@@ -25,6 +111,188 @@ var migrations func() migrator.Option = func() migrator.Option {
 				return err
 			},
 		},
+		&migrator.Migration{
+			Name: "002_current_view",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, currentViewSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "003_quarantine",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, quarantineSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "004_feature_flags",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, featureFlagsSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "005_pending_seq",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, pendingSeqSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "006_cas",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, casSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "007_latest_storage",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, latestStorageSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "008_revision_gaps",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, revisionGapsSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "009_kv_metadata",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, kvMetadataSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "010_staging",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, stagingSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "011_read_only",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, readOnlySQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "012_sync_state",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, syncStateSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "013_replicas",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, replicasSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "014_audit_log",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, auditLogSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "015_heartbeat",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, heartbeatSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "016_sync_attempts",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, syncAttemptsSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "017_pending_claims",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, pendingClaimsSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "018_backlog_limit",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, backlogLimitSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "019_sync_stats",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, syncStatsSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "020_value_encoding",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, valueEncodingSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "021_value_hash",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, valueHashSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "022_value_facts",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, valueFactsSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "023_key_path",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, keyPathSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "024_redacted_values",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, redactedValuesSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "025_time_travel",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, timeTravelSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "026_compaction",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, compactionSQL)
+				return err
+			},
+		},
+		&migrator.Migration{
+			Name: "027_quarantine_key_hash",
+			Func: func(ctx context.Context, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, quarantineKeyHashSQL)
+				return err
+			},
+		},
 		// adding new migration here
 
 		// &migrator.Migration{
@@ -33,7 +301,7 @@ var migrations func() migrator.Option = func() migrator.Option {
 		// 		...
 		// 	},
 		// },
-	)
+	}
 }
 
 var (
@@ -83,3 +351,76 @@ func NeedsUpgrade(ctx context.Context, conn *pgx.Conn) (bool, error) {
 
 	return needUpgrade, nil
 }
+
+// RequiredVersion is the oldest schema version the current binary can run against.
+// Bump it only when a query starts depending on objects created by a newer migration.
+const RequiredVersion = 27
+
+// ErrSchemaTooOld is returned when the database schema lacks objects the binary relies on
+var ErrSchemaTooOld = errors.New("database schema is too old")
+
+// Querier is the subset of pgx connection and pool methods needed to inspect the schema
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// LatestVersion returns the schema version produced by applying all known migrations
+func LatestVersion() int {
+	return len(migrationList())
+}
+
+// AppliedVersion returns the number of migrations applied to the database, 0 for an empty database
+func AppliedVersion(ctx context.Context, db Querier) (int, error) {
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass('pg_etcd_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check migrations table: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	if err := db.QueryRow(ctx, "SELECT count(*) FROM pg_etcd_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// CheckCompatibility verifies the binary can run against the applied schema. Newer schemas
+// are accepted because migrations are additive, so an old binary keeps working while the
+// database is migrated ahead of a rolling upgrade.
+func CheckCompatibility(ctx context.Context, db Querier) error {
+	version, err := AppliedVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if version < RequiredVersion {
+		return fmt.Errorf("%w: version %d applied, at least %d required (run with --migrate)",
+			ErrSchemaTooOld, version, RequiredVersion)
+	}
+	if latest := LatestVersion(); version > latest {
+		log.Default().WithFields(log.Fields{
+			"schema_version": version,
+			"latest_known":   latest,
+		}).Warn("Database schema is newer than this binary, continuing in compatibility mode")
+	}
+	return nil
+}
+
+// ApplyUpTo applies the first version migrations only, used to pin older schema versions
+func ApplyUpTo(ctx context.Context, conn *pgx.Conn, version int) error {
+	list := migrationList()
+	if version < 0 || version > len(list) {
+		return fmt.Errorf("unknown schema version %d", version)
+	}
+	m, err := migrator.New(
+		migrator.Migrations(list[:version]...),
+		migrator.TableName("pg_etcd_migrations"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create migrator: %w", err)
+	}
+	if err := m.Migrate(ctx, conn); err != nil {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+	return nil
+}
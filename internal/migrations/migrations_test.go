@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
@@ -54,6 +55,148 @@ func TestMigrationContent(t *testing.T) {
 
 	// Test revision encoding comments
 	assert.Contains(t, createTablesSQL, "revision = -1", "Should document revision encoding")
+
+	// Test current state view and prefix functions
+	assert.Contains(t, currentViewSQL, "CREATE VIEW etcd_current", "Should create etcd_current view")
+	assert.Contains(t, currentViewSQL, "CREATE OR REPLACE FUNCTION etcd_get_prefix", "Should create etcd_get_prefix function")
+	assert.Contains(t, currentViewSQL, "CREATE OR REPLACE FUNCTION etcd_list", "Should create etcd_list function")
+
+	// Test quarantine table
+	assert.Contains(t, quarantineSQL, "CREATE TABLE etcd_quarantine", "Should create etcd_quarantine table")
+
+	// Test feature flag helpers
+	assert.Contains(t, featureFlagsSQL, "CREATE OR REPLACE FUNCTION etcd_flag(", "Should create etcd_flag function")
+	assert.Contains(t, featureFlagsSQL, "CREATE OR REPLACE FUNCTION etcd_flag_bool", "Should create etcd_flag_bool function")
+	assert.Contains(t, featureFlagsSQL, "CREATE OR REPLACE FUNCTION etcd_flag_int", "Should create etcd_flag_int function")
+
+	// Test deterministic pending order
+	assert.Contains(t, pendingSeqSQL, "ADD COLUMN seq", "Should add seq column")
+	assert.Contains(t, pendingSeqSQL, "ORDER BY e.ts ASC, e.seq ASC", "Should order pending records by seq")
+
+	// Test compare-and-swap
+	assert.Contains(t, casSQL, "ADD COLUMN expected_revision", "Should add expected_revision column")
+	assert.Contains(t, casSQL, "CREATE OR REPLACE FUNCTION etcd_cas(p_key text, p_expected_revision bigint", "Should create revision based etcd_cas")
+	assert.Contains(t, casSQL, "CREATE OR REPLACE FUNCTION etcd_cas(p_key text, p_expected_value text", "Should create value based etcd_cas")
+
+	// Test latest-only storage
+	assert.Contains(t, latestStorageSQL, "CREATE TABLE etcd_latest", "Should create etcd_latest table")
+	assert.Contains(t, latestStorageSQL, "key text PRIMARY KEY", "Should keep one row per key")
+	assert.Contains(t, latestStorageSQL, "CREATE OR REPLACE FUNCTION etcd_latest_put", "Should create etcd_latest_put function")
+	assert.Contains(t, latestStorageSQL, "CREATE OR REPLACE FUNCTION etcd_latest_delete", "Should create etcd_latest_delete function")
+
+	// Test revision gap detection
+	assert.Contains(t, revisionGapsSQL, "CREATE OR REPLACE FUNCTION etcd_revision_gaps", "Should create etcd_revision_gaps function")
+	assert.Contains(t, revisionGapsSQL, "'missing_revision'", "Should report missing revisions")
+	assert.Contains(t, revisionGapsSQL, "'missing_delete'", "Should report missing deletions")
+
+	// Test key metadata columns
+	for _, column := range []string{"create_revision", "version", "lease"} {
+		assert.Contains(t, kvMetadataSQL, "ADD COLUMN "+column+" bigint", "Should add %s column", column)
+	}
+
+	// Test staging table
+	assert.Contains(t, stagingSQL, "CREATE UNLOGGED TABLE etcd_staging", "Should create unlogged etcd_staging table")
+	assert.Contains(t, stagingSQL, "CREATE SEQUENCE etcd_staging_batch_seq", "Should create batch sequence")
+
+	// Test read-only mirror triggers
+	assert.Contains(t, readOnlySQL, "CREATE TRIGGER etcd_read_only", "Should create etcd_read_only trigger")
+	assert.Contains(t, readOnlySQL, "DISABLE TRIGGER etcd_read_only", "Should install the trigger disabled")
+	assert.Contains(t, readOnlySQL, "CREATE OR REPLACE FUNCTION etcd_set_read_only", "Should create etcd_set_read_only function")
+
+	// Test sync state migration content
+	assert.Contains(t, syncStateSQL, "CREATE TABLE IF NOT EXISTS etcd_sync_state", "Should create etcd_sync_state table")
+	assert.Contains(t, syncStateSQL, "prefix text PRIMARY KEY", "Should keep one state row per prefix")
+
+	// Test replica status migration content
+	assert.Contains(t, replicasSQL, "CREATE TABLE IF NOT EXISTS etcd_replica_status", "Should create etcd_replica_status table")
+	assert.Contains(t, replicasSQL, "PRIMARY KEY (replica, key)", "Should keep the latest change per replica and key")
+
+	// Test audit log migration content
+	assert.Contains(t, auditLogSQL, "CREATE TABLE IF NOT EXISTS etcd_audit_log", "Should create etcd_audit_log table")
+	assert.Contains(t, auditLogSQL, "BEFORE UPDATE OR DELETE ON etcd_audit_log", "Should keep the audit log append-only")
+
+	// Test heartbeat migration content
+	assert.Contains(t, heartbeatSQL, "CREATE TABLE IF NOT EXISTS etcd_sync_heartbeat", "Should create etcd_sync_heartbeat table")
+	assert.Contains(t, heartbeatSQL, "name text PRIMARY KEY", "Should keep one heartbeat row per synchronized keyspace")
+
+	// Test sync attempts migration content
+	assert.Contains(t, syncAttemptsSQL, "ALTER TABLE etcd ADD COLUMN sync_attempts", "Should count sync attempts of pending rows")
+	assert.Contains(t, syncAttemptsSQL, "ALTER TABLE etcd_latest ADD COLUMN status", "Should mark failed rows of the latest-only table")
+	assert.Contains(t, syncAttemptsSQL, "CREATE OR REPLACE FUNCTION etcd_requeue_failed", "Should create etcd_requeue_failed function")
+
+	// Test pending claims migration content
+	assert.Contains(t, pendingClaimsSQL, "ALTER TABLE etcd ADD COLUMN claimed_by", "Should claim pending rows")
+	assert.Contains(t, pendingClaimsSQL, "ALTER TABLE etcd_latest ADD COLUMN claimed_at", "Should claim pending rows of the latest-only table")
+	assert.Contains(t, pendingClaimsSQL, "claimed_by = NULL", "Should clear the claim of a replaced latest-only row")
+
+	// Test sync stats migration content
+	assert.Contains(t, syncStatsSQL, "ALTER TABLE etcd_sync_heartbeat", "Should store the stats with the heartbeat")
+	assert.Contains(t, syncStatsSQL, "CREATE OR REPLACE FUNCTION etcd_sync_stats", "Should create etcd_sync_stats function")
+
+	// Test value encoding migration content
+	assert.Contains(t, valueEncodingSQL, "ALTER TABLE etcd ADD COLUMN encoding", "Should track the encoding of values")
+	assert.Contains(t, valueEncodingSQL, "CREATE OR REPLACE FUNCTION etcd_decode", "Should create etcd_decode function")
+	assert.Contains(t, valueEncodingSQL, "CREATE OR REPLACE VIEW etcd_current", "Should decode values of the current view")
+
+	// Test value hash migration content
+	assert.Contains(t, valueHashSQL, "ALTER TABLE etcd ADD COLUMN value_hash", "Should store the hash of values")
+	assert.Contains(t, valueHashSQL, "CREATE TRIGGER etcd_latest_value_hash", "Should hash the values of the latest-only table")
+	assert.Contains(t, valueHashSQL, "sha256(convert_to(", "Should hash the plain value")
+
+	// Test value facts migration content
+	assert.Contains(t, valueFactsSQL, "ALTER TABLE etcd ADD COLUMN facts jsonb", "Should store the facts of values")
+	assert.Contains(t, valueFactsSQL, "ALTER TABLE etcd_quarantine ADD COLUMN facts jsonb", "Should store the facts of quarantined values")
+	assert.Contains(t, valueFactsSQL, "l.facts", "Should expose the facts in the current view")
+
+	// Test key path migration content
+	assert.Contains(t, keyPathSQL, "ALTER TABLE etcd ADD COLUMN key_path text[]", "Should store the key paths")
+	assert.Contains(t, keyPathSQL, "ALTER TABLE etcd DISABLE TRIGGER etcd_key_path", "Should install the key path triggers disabled")
+	assert.Contains(t, keyPathSQL, "CREATE OR REPLACE FUNCTION etcd_set_key_path", "Should switch the key path triggers")
+	assert.Contains(t, keyPathSQL, "AS namespace", "Should expose the namespace in the current view")
+	assert.Contains(t, redactedValuesSQL, "p_encoding = 'sha256'", "Should decode redacted values to their hash")
+	assert.Contains(t, redactedValuesSQL, "CREATE OR REPLACE FUNCTION etcd_is_redacted", "Should report redacted keys")
+	assert.Contains(t, timeTravelSQL, "CREATE OR REPLACE FUNCTION etcd_get_at(p_key text, p_ts timestamp with time zone)", "Should get keys as of a point in time")
+	assert.Contains(t, timeTravelSQL, "CREATE OR REPLACE FUNCTION etcd_get_at_revision", "Should get keys as of a revision")
+	assert.Contains(t, timeTravelSQL, "CREATE OR REPLACE FUNCTION etcd_get_prefix_at", "Should get prefixes as of a point in time")
+	assert.Contains(t, compactionSQL, "CREATE TABLE IF NOT EXISTS etcd_compaction", "Should keep the compact revision of the history")
+	assert.Contains(t, quarantineKeyHashSQL, "ADD PRIMARY KEY (key_hash, revision)", "Should key the quarantine on the key hash")
+}
+
+// TestCheckCompatibility tests the schema version guard for older, current and newer schemas
+func TestCheckCompatibility(t *testing.T) {
+	assert.GreaterOrEqual(t, LatestVersion(), RequiredVersion, "Binary must ship the migrations it requires")
+
+	tests := []struct {
+		name    string
+		exists  bool
+		version int
+		wantErr bool
+	}{
+		{"empty database", false, 0, true},
+		{"previous schema", true, RequiredVersion - 1, true},
+		{"required schema", true, RequiredVersion, false},
+		{"next schema", true, LatestVersion() + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			require.NoError(t, err)
+			defer mock.Close()
+
+			mock.ExpectQuery("to_regclass").WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+			if tt.exists {
+				mock.ExpectQuery("SELECT count").WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(tt.version))
+			}
+
+			err = CheckCompatibility(context.Background(), mock)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrSchemaTooOld)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
 }
 
 // TestMigrationWithRealDatabase tests migration against a real database
@@ -81,8 +224,15 @@ func TestMigrationWithRealDatabase(t *testing.T) {
 	require.NoError(t, err, "Should check if etcd table exists")
 	assert.True(t, tableExists, "etcd table should exist after migration")
 
+	err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT FROM information_schema.tables WHERE table_name = 'etcd_sync_state')").Scan(&tableExists)
+	require.NoError(t, err, "Should check if etcd_sync_state table exists")
+	assert.True(t, tableExists, "etcd_sync_state table should exist after migration")
+
 	// Verify functions exist (updated for single table architecture)
-	functions := []string{"etcd_get", "etcd_get_all", "etcd_put", "etcd_delete", "etcd_get_pending", "etcd_update_revision"}
+	functions := []string{"etcd_get", "etcd_get_all", "etcd_put", "etcd_delete", "etcd_get_pending", "etcd_update_revision",
+		"etcd_get_prefix", "etcd_list", "etcd_cas",
+		"etcd_latest_get", "etcd_latest_put", "etcd_latest_delete", "etcd_revision_gaps",
+		"etcd_set_read_only", "etcd_is_read_only"}
 	for _, funcName := range functions {
 		var funcExists bool
 		err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT FROM pg_proc WHERE proname = $1)", funcName).Scan(&funcExists)
@@ -142,6 +292,51 @@ func TestMigrationFunctions(t *testing.T) {
 	err = conn.QueryRow(ctx, "SELECT etcd_delete($1)", "test-key-delete").Scan(&deleteResult)
 	require.NoError(t, err, "Should call etcd_delete function")
 	assert.False(t, deleteResult.IsZero(), "etcd_delete should return valid timestamp")
+
+	// Test etcd_get_prefix function (tombstoned keys are not part of the current state)
+	var prefixCount int
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM etcd_get_prefix($1)", "test-").Scan(&prefixCount)
+	require.NoError(t, err, "Should call etcd_get_prefix function")
+	assert.Equal(t, 1, prefixCount, "Should return only the non-tombstoned key")
+
+	// Test feature flag helpers with defaults for unset and malformed flags
+	_, err = conn.Exec(ctx, "SELECT etcd_put('/flags/enabled', 'on'), etcd_put('/flags/limit', '42'), etcd_put('/flags/bad', 'x')")
+	require.NoError(t, err, "Should store feature flags")
+	var enabled, missing, malformed bool
+	var limit int64
+	err = conn.QueryRow(ctx, "SELECT etcd_flag_bool('enabled'), etcd_flag_bool('missing', true), etcd_flag_bool('bad'), etcd_flag_int('limit')").
+		Scan(&enabled, &missing, &malformed, &limit)
+	require.NoError(t, err, "Should read feature flags")
+	assert.True(t, enabled)
+	assert.True(t, missing, "Unset flag should return the default")
+	assert.False(t, malformed, "Malformed flag should return the default")
+	assert.Equal(t, int64(42), limit)
+
+	// Test etcd_cas refuses to enqueue while a change is pending or the expectation differs
+	var swapped bool
+	err = conn.QueryRow(ctx, "SELECT etcd_cas('test-key', 0, 'cas')").Scan(&swapped)
+	require.NoError(t, err, "Should call etcd_cas function")
+	assert.False(t, swapped, "Pending change should block CAS")
+	_, err = conn.Exec(ctx, "INSERT INTO etcd (key, value, revision) VALUES ('cas-key', 'v1', 7)")
+	require.NoError(t, err)
+	err = conn.QueryRow(ctx, "SELECT etcd_cas('cas-key', 6, 'v2')").Scan(&swapped)
+	require.NoError(t, err)
+	assert.False(t, swapped, "Revision mismatch should fail")
+	err = conn.QueryRow(ctx, "SELECT etcd_cas('cas-key', 'v1', 'v2')").Scan(&swapped)
+	require.NoError(t, err)
+	assert.True(t, swapped, "Matching value should enqueue the change")
+	var expected int64
+	err = conn.QueryRow(ctx, "SELECT expected_revision FROM etcd WHERE key = 'cas-key' AND revision = -1").Scan(&expected)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), expected)
+
+	// Test read-only mirror rejects pending rows but accepts synced ones
+	_, err = conn.Exec(ctx, "SELECT etcd_set_read_only(true)")
+	require.NoError(t, err, "Should enable read-only mode")
+	_, err = conn.Exec(ctx, "SELECT etcd_put('read-only-key', 'value')")
+	assert.Error(t, err, "Pending rows should be rejected in read-only mode")
+	_, err = conn.Exec(ctx, "INSERT INTO etcd (key, value, revision) VALUES ('read-only-key', 'value', 8)")
+	assert.NoError(t, err, "Synced rows should be accepted in read-only mode")
 }
 
 // getTestDSN returns a test database connection string
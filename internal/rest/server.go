@@ -0,0 +1,302 @@
+// Package rest provides the HTTP key API reading from and writing to the PostgreSQL mirror.
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/httpapi"
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// Limits of a request
+const (
+	maxValueSize     = 3 << 19 // 1.5 MiB, the etcd default request limit
+	defaultListLimit = 100
+	maxListLimit     = 10000
+)
+
+// Key is a key as returned by the API
+type Key struct {
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	Revision int64     `json:"revision"` // etcd mod revision, -1 for a pending change of latest-only storage
+	Ts       time.Time `json:"ts"`
+}
+
+// List is the result of a prefix listing
+type List struct {
+	Keys []Key `json:"keys"`
+	More bool  `json:"more"` // the listing was truncated at the limit, continue with after
+}
+
+// Pending is the result of an enqueued change
+type Pending struct {
+	Key string    `json:"key"`
+	Ts  time.Time `json:"ts"`
+}
+
+// Server serves GET, PUT and DELETE on /v1/keys/<key>. Reads return the state mirrored in PostgreSQL,
+// writes enqueue pending rows pushed to etcd by the daemon.
+type Server struct {
+	httpServer *http.Server
+	pool       sync.PgxIface
+	storage    string
+}
+
+// NewServer creates a key API server listening on addr for the PostgreSQL storage mode. If token is not empty,
+// requests must send it as bearer token.
+func NewServer(addr string, pool sync.PgxIface, storage, token string) *Server {
+	s := &Server{pool: pool, storage: storage}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/keys/{key...}", s.get)
+	mux.HandleFunc("PUT /v1/keys/{key...}", s.put)
+	mux.HandleFunc("DELETE /v1/keys/{key...}", s.delete)
+
+	var handler http.Handler = mux
+	if token != "" {
+		handler = httpapi.Authorize(token, mux)
+	}
+	s.httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// Start serves requests in the background until Shutdown is called
+func (s *Server) Start() {
+	go func() {
+		logrus.WithField("address", s.httpServer.Addr).Info("Key API listener started")
+		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Error("Key API listener failed")
+		}
+	}()
+}
+
+// Shutdown gracefully stops the listener
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// get returns a key, or the keys below it with the prefix parameter. The revision parameter reads the state
+// at an earlier etcd revision from the history.
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	key := "/" + r.PathValue("key")
+	query := r.URL.Query()
+	revision, err := intParam(query.Get("revision"), 0)
+	if err != nil || revision < 0 {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+	if revision > 0 && s.storage == sync.StorageLatest {
+		http.Error(w, "revision history is not retained with latest-only storage", http.StatusBadRequest)
+		return
+	}
+
+	if !query.Has("prefix") {
+		record, err := s.getKey(r.Context(), key, revision)
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		httpapi.WriteJSON(w, http.StatusOK, record)
+		return
+	}
+
+	limit, err := intParam(query.Get("limit"), defaultListLimit)
+	if err != nil || limit <= 0 || limit > maxListLimit {
+		http.Error(w, fmt.Sprintf("invalid limit, at most %d", maxListLimit), http.StatusBadRequest)
+		return
+	}
+	list, err := s.listKeys(r.Context(), key, query.Get("after"), revision, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	httpapi.WriteJSON(w, http.StatusOK, list)
+}
+
+// getKey reads the latest mirrored value of key up to revision, unbounded if zero
+func (s *Server) getKey(ctx context.Context, key string, revision int64) (Key, error) {
+	query := `SELECT key, value, revision, ts, encoding
+		FROM (
+			SELECT key, coalesce(value, '') AS value, revision, ts, tombstone, coalesce(encoding, '') AS encoding
+			FROM etcd
+			WHERE key = $1 AND revision > 0 AND ($2 = 0 OR revision <= $2)
+			ORDER BY revision DESC
+			LIMIT 1
+		) latest
+		WHERE NOT tombstone`
+	args := []any{key, revision}
+	if s.storage == sync.StorageLatest {
+		query = `SELECT key, coalesce(value, ''), revision, ts, coalesce(encoding, '')
+			FROM etcd_latest WHERE key = $1 AND NOT tombstone`
+		args = args[:1]
+	}
+	var record Key
+	var encoding string
+	err := s.pool.QueryRow(ctx, query, args...).Scan(&record.Key, &record.Value, &record.Revision, &record.Ts, &encoding)
+	if err != nil {
+		return record, err
+	}
+	record.Value, err = sync.DecodeValue(record.Value, encoding)
+	return record, err
+}
+
+// listKeys reads the latest mirrored values of the keys below prefix after the key after, in key order
+func (s *Server) listKeys(ctx context.Context, prefix, after string, revision int64, limit int64) (List, error) {
+	query := `SELECT key, value, revision, ts, encoding
+		FROM (
+			SELECT DISTINCT ON (key) key, coalesce(value, '') AS value, revision, ts, tombstone,
+				coalesce(encoding, '') AS encoding
+			FROM etcd
+			WHERE starts_with(key, $1) AND key > $2 AND revision > 0 AND ($3 = 0 OR revision <= $3)
+			ORDER BY key, revision DESC
+		) latest
+		WHERE NOT tombstone
+		ORDER BY key
+		LIMIT $4`
+	args := []any{prefix, after, revision, limit + 1}
+	if s.storage == sync.StorageLatest {
+		query = `SELECT key, coalesce(value, ''), revision, ts, coalesce(encoding, '')
+			FROM etcd_latest
+			WHERE starts_with(key, $1) AND key > $2 AND NOT tombstone
+			ORDER BY key
+			LIMIT $3`
+		args = []any{prefix, after, limit + 1}
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return List{}, fmt.Errorf("failed to list keys: %w", err)
+	}
+	keys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Key, error) {
+		var record Key
+		var encoding string
+		if err := row.Scan(&record.Key, &record.Value, &record.Revision, &record.Ts, &encoding); err != nil {
+			return record, err
+		}
+		var err error
+		record.Value, err = sync.DecodeValue(record.Value, encoding)
+		return record, err
+	})
+	if err != nil {
+		return List{}, fmt.Errorf("failed to list keys: %w", err)
+	}
+	list := List{Keys: keys}
+	if int64(len(keys)) > limit {
+		list.Keys, list.More = keys[:limit], true
+	}
+	if list.Keys == nil {
+		list.Keys = []Key{}
+	}
+	return list, nil
+}
+
+// put enqueues the request body as the new value of the key. With the prev_revision parameter the change
+// is enqueued by etcd_cas() only if the key is still at that revision, 0 meaning it must not exist.
+func (s *Server) put(w http.ResponseWriter, r *http.Request) {
+	key := "/" + r.PathValue("key")
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.enqueue(w, r, key, &value)
+}
+
+// delete enqueues the deletion of the key, conditional like put with prev_revision
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	s.enqueue(w, r, "/"+r.PathValue("key"), nil)
+}
+
+// enqueue stores a pending change of key, a nil value deletes it
+func (s *Server) enqueue(w http.ResponseWriter, r *http.Request, key string, value *[]byte) {
+	var text *string
+	if value != nil {
+		v := string(*value)
+		text = &v
+	}
+
+	if param := r.URL.Query().Get("prev_revision"); param != "" {
+		expected, err := intParam(param, 0)
+		if err != nil || expected < 0 {
+			http.Error(w, "invalid prev_revision", http.StatusBadRequest)
+			return
+		}
+		if s.storage == sync.StorageLatest {
+			http.Error(w, "conditional changes require history storage", http.StatusBadRequest)
+			return
+		}
+		var applied bool
+		if err := s.pool.QueryRow(r.Context(), `SELECT etcd_cas($1, $2::bigint, $3)`, key, expected, text).Scan(&applied); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !applied {
+			http.Error(w, "key changed since prev_revision or has a pending change", http.StatusPreconditionFailed)
+			return
+		}
+		httpapi.WriteJSON(w, http.StatusAccepted, Pending{Key: key, Ts: time.Now()})
+		return
+	}
+
+	function := "etcd_put($1, $2)"
+	args := []any{key, text}
+	if value == nil {
+		function, args = "etcd_delete($1)", args[:1]
+	}
+	if s.storage == sync.StorageLatest {
+		function = "etcd_latest_" + function[len("etcd_"):]
+	}
+	pending := Pending{Key: key}
+	if err := s.pool.QueryRow(r.Context(), "SELECT "+function, args...).Scan(&pending.Ts); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	httpapi.WriteJSON(w, http.StatusAccepted, pending)
+}
+
+// writeError responds with the status of a PostgreSQL error, the changes rejected by the read-only mirror,
+// the backlog limit or a pending change of the key are client errors
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "25006": // read_only_sql_transaction
+			http.Error(w, pgErr.Message, http.StatusForbidden)
+			return
+		case "54000": // program_limit_exceeded
+			http.Error(w, pgErr.Message, http.StatusServiceUnavailable)
+			return
+		case "23505": // unique_violation
+			http.Error(w, "the key has a pending change", http.StatusConflict)
+			return
+		}
+	}
+	logrus.WithError(err).WithField("path", r.URL.Path).Error("Key API request failed")
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// intParam parses an integer query parameter, fallback if empty
+func intParam(param string, fallback int64) (int64, error) {
+	if param == "" {
+		return fallback, nil
+	}
+	return strconv.ParseInt(param, 10, 64)
+}
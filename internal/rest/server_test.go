@@ -0,0 +1,100 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// TestServer tests reading keys from the mirror and enqueueing changes
+func TestServer(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	server := NewServer(":0", mock, sync.StorageHistory, "secret")
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, r)
+		return w
+	}
+	ts := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/keys/config/a", nil)
+	w := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	mock.ExpectQuery(`FROM etcd\s+WHERE key = \$1 AND revision > 0`).WithArgs("/config/a", int64(0)).
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "revision", "ts", "encoding"}).AddRow("/config/a", "1", int64(42), ts, ""))
+	w = request(http.MethodGet, "/v1/keys/config/a", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"/config/a","value":"1","revision":42,"ts":"2026-10-18T09:00:00Z"}`, w.Body.String())
+
+	// Compressed values are returned decompressed
+	large := strings.Repeat("1", 1000)
+	stored, encoding := sync.CompressValue(large, 100)
+	mock.ExpectQuery(`FROM etcd\s+WHERE key = \$1 AND revision > 0`).WithArgs("/config/large", int64(0)).
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "revision", "ts", "encoding"}).AddRow("/config/large", stored, int64(42), ts, encoding))
+	w = request(http.MethodGet, "/v1/keys/config/large", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"/config/large","value":"`+large+`","revision":42,"ts":"2026-10-18T09:00:00Z"}`, w.Body.String())
+
+	mock.ExpectQuery(`FROM etcd`).WithArgs("/config/b", int64(40)).WillReturnError(pgx.ErrNoRows)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/keys/config/b?revision=40", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/v1/keys/config/b?revision=x", "").Code)
+
+	// Listings are truncated at the limit
+	mock.ExpectQuery(`SELECT DISTINCT ON \(key\)`).WithArgs("/config/", "/config/a", int64(0), int64(2)).
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "revision", "ts", "encoding"}).
+			AddRow("/config/b", "2", int64(43), ts, "").
+			AddRow("/config/c", "3", int64(44), ts, ""))
+	w = request(http.MethodGet, "/v1/keys/config/?prefix&limit=1&after=/config/a", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"keys":[{"key":"/config/b","value":"2","revision":43,"ts":"2026-10-18T09:00:00Z"}],"more":true}`, w.Body.String())
+
+	mock.ExpectQuery(`SELECT etcd_put\(\$1, \$2\)`).WithArgs("/config/a", pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"etcd_put"}).AddRow(ts))
+	w = request(http.MethodPut, "/v1/keys/config/a", "5")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.JSONEq(t, `{"key":"/config/a","ts":"2026-10-18T09:00:00Z"}`, w.Body.String())
+
+	mock.ExpectQuery(`SELECT etcd_delete\(\$1\)`).WithArgs("/config/a").WillReturnError(&pgconn.PgError{Code: "23505"})
+	assert.Equal(t, http.StatusConflict, request(http.MethodDelete, "/v1/keys/config/a", "").Code)
+
+	mock.ExpectQuery(`SELECT etcd_put`).WithArgs("/config/a", pgxmock.AnyArg()).WillReturnError(&pgconn.PgError{Code: "25006", Message: "pg_etcd mirror is read-only"})
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPut, "/v1/keys/config/a", "6").Code)
+
+	// Conditional changes are enqueued by etcd_cas()
+	mock.ExpectQuery(`SELECT etcd_cas\(\$1, \$2::bigint, \$3\)`).WithArgs("/config/a", int64(42), pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"etcd_cas"}).AddRow(false))
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodPut, "/v1/keys/config/a?prev_revision=42", "7").Code)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// Latest-only storage keeps no history
+	latest := NewServer(":0", mock, sync.StorageLatest, "")
+	r = httptest.NewRequest(http.MethodGet, "/v1/keys/config/a?revision=40", nil)
+	w = httptest.NewRecorder()
+	latest.httpServer.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	mock.ExpectQuery(`SELECT etcd_latest_delete\(\$1\)`).WithArgs("/config/a").
+		WillReturnRows(pgxmock.NewRows([]string{"etcd_latest_delete"}).AddRow(ts))
+	r = httptest.NewRequest(http.MethodDelete, "/v1/keys/config/a", nil)
+	w = httptest.NewRecorder()
+	latest.httpServer.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
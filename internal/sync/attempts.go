@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// StatusFailed is the status of a pending row that reached the maximum number of sync attempts
+const StatusFailed = "failed"
+
+// RecordSyncAttempt counts a failed push of the pending row of key in table and keeps cause as its last error.
+// Reaching maxAttempts sets the status of the row to StatusFailed, it is no longer selected until
+// etcd_requeue_failed() is called. It reports whether the row failed, never if maxAttempts is zero.
+func RecordSyncAttempt(ctx context.Context, pool PgxIface, table, key string, cause error, maxAttempts int) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s
+		SET sync_attempts = sync_attempts + 1, last_error = $2,
+			status = CASE WHEN $3 > 0 AND sync_attempts + 1 >= $3 THEN 'failed' END
+		WHERE key = $1 AND revision = -1 AND status IS NULL
+		RETURNING status IS NOT NULL`, table)
+
+	var failed bool
+	err := pool.QueryRow(ctx, query, key, cause.Error(), maxAttempts).Scan(&failed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil // pushed or replaced meanwhile
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record sync attempt: %w", err)
+	}
+	return failed, nil
+}
+
+// recordAttempt counts a failed push of the pending row of key, connection failures are not the fault of
+// the row and not counted
+func (s *Service) recordAttempt(ctx context.Context, key string, cause error) {
+	if ctx.Err() != nil || ErrorCategory(cause) == CategoryConnection {
+		return
+	}
+	var failed bool
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		failed, err = s.store.RecordAttempt(ctx, s.pgPool, key, cause, s.maxSyncAttempts)
+		return err
+	})
+	if err != nil {
+		s.logger().WithContext(ctx).WithError(err).WithField(log.FieldKey, key).Warn("Failed to record sync attempt")
+		return
+	}
+	if failed {
+		s.logger().WithContext(ctx).WithError(cause).WithFields(log.Fields{
+			log.FieldDirection: log.DirectionPgToEtcd,
+			log.FieldKey:       key,
+			"attempts":         s.maxSyncAttempts,
+		}).Error("Pending record failed too often, skipping it until etcd_requeue_failed() is called")
+	}
+}
@@ -0,0 +1,170 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Kinds of differences reported by the revision audit
+const (
+	// GapMissingRevision is an etcd revision absent from PostgreSQL although newer ones were synced
+	GapMissingRevision = "missing_revision"
+	// GapMissingDelete is a key alive in PostgreSQL that etcd has deleted
+	GapMissingDelete = "missing_delete"
+)
+
+// RevisionGap is a single difference between an etcd snapshot and the mirror
+type RevisionGap struct {
+	Key      string
+	Revision int64
+	Kind     string
+}
+
+// FindRevisionGaps compares an etcd snapshot of prefix taken at header with the etcd table
+func FindRevisionGaps(ctx context.Context, pool PgxIface, prefix string, keys []string, revisions []int64, header int64) ([]RevisionGap, error) {
+	query := `SELECT key, revision, kind FROM etcd_revision_gaps($1, $2, $3, $4)`
+	return queryRevisionGaps(ctx, pool, query, prefix, keys, revisions, header)
+}
+
+// queryRevisionGaps runs a gap query taking the prefix, snapshot keys, revisions and header revision
+func queryRevisionGaps(ctx context.Context, pool PgxIface, query, prefix string, keys []string, revisions []int64, header int64) ([]RevisionGap, error) {
+	rows, err := pool.Query(ctx, query, prefix, keys, revisions, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revision gaps: %w", err)
+	}
+	defer rows.Close()
+
+	var gaps []RevisionGap
+	for rows.Next() {
+		var gap RevisionGap
+		if err := rows.Scan(&gap.Key, &gap.Revision, &gap.Kind); err != nil {
+			return nil, fmt.Errorf("error scanning revision gap: %w", err)
+		}
+		gaps = append(gaps, gap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating revision gaps: %w", err)
+	}
+
+	return gaps, nil
+}
+
+// auditRevisions periodically looks for lost etcd events in every prefix and reconciles affected prefixes
+func (s *Service) auditRevisions(ctx context.Context) {
+	s.logger().WithField("interval", s.auditInterval).Info("Starting revision audit")
+
+	ticker := time.NewTicker(s.auditInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, prefix := range s.prefixes {
+				if err := s.auditPrefix(ctx, prefix); err != nil && ctx.Err() == nil {
+					s.logger().WithError(err).WithField("prefix", prefix).Error("Revision audit failed")
+				}
+			}
+		}
+	}
+}
+
+// auditPrefix compares the current etcd snapshot of prefix with PostgreSQL. Differences beyond the resync
+// threshold schedule a full resynchronization of the prefix, fewer or rate-limited ones are repaired key by key.
+func (s *Service) auditPrefix(ctx context.Context, prefix string) error {
+	gaps, header, err := s.findGaps(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(gaps) == 0 {
+		s.logger().WithFields(log.Fields{"prefix": prefix, "revision": header}).Debug("Revision audit found no gaps")
+		return nil
+	}
+
+	for _, gap := range gaps {
+		metrics.RevisionGaps.WithLabelValues(gap.Kind).Inc()
+	}
+	s.logger().WithFields(log.Fields{
+		"prefix":   prefix,
+		"revision": header,
+		"gaps":     len(gaps),
+		"first":    gaps[0].Key,
+	}).Warn("Detected lost etcd events, reconciling prefix")
+
+	if len(gaps) >= s.autoResync.threshold() && s.scheduleResync(prefix, ResyncAudit) {
+		return nil
+	}
+	return s.repairGaps(ctx, prefix, gaps, header)
+}
+
+// findGaps compares the current etcd snapshot of prefix with PostgreSQL, it returns the differences and
+// the revision of the snapshot
+func (s *Service) findGaps(ctx context.Context, prefix string) ([]RevisionGap, int64, error) {
+	keys, revisions, header, err := s.etcdClient.GetKeyRevisions(ctx, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Keys set aside and internal keys are never stored in the etcd table, don't report them as lost
+	validKeys, validRevisions := keys[:0], revisions[:0]
+	for i, key := range keys {
+		if stored, reason := s.admit(KeyValueRecord{Key: key}); reason == "" && !isInternalKey(key) {
+			validKeys = append(validKeys, stored.Key)
+			validRevisions = append(validRevisions, revisions[i])
+		}
+	}
+
+	var gaps []RevisionGap
+	err = s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		gaps, err = s.store.RevisionGaps(ctx, s.pgPool, prefix, validKeys, validRevisions, header)
+		return err
+	})
+	return gaps, header, err
+}
+
+// repairGaps copies the current etcd state of keys with missing revisions and records missing deletions
+// at the snapshot revision header
+func (s *Service) repairGaps(ctx context.Context, prefix string, gaps []RevisionGap, header int64) error {
+	var records []KeyValueRecord
+	for _, gap := range gaps {
+		if gap.Kind == GapMissingDelete {
+			records = append(records, KeyValueRecord{Key: gap.Key, Revision: header, Ts: s.now(), Tombstone: true})
+			continue
+		}
+		var resp *clientv3.GetResponse
+		err := RetryEtcdOperation(ctx, func() (err error) {
+			resp, err = s.etcdClient.Get(ctx, s.etcdKey(gap.Key))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to reconcile prefix %s: %w", prefix, err)
+		}
+		if len(resp.Kvs) == 0 {
+			continue // deleted meanwhile, found by the next audit
+		}
+		kv := resp.Kvs[0]
+		records = append(records, KeyValueRecord{
+			Key:            gap.Key,
+			Value:          string(kv.Value),
+			Revision:       kv.ModRevision,
+			Ts:             s.now(),
+			CreateRevision: kv.CreateRevision,
+			Version:        kv.Version,
+			Lease:          kv.Lease,
+		})
+	}
+	if err := s.assembleChunks(ctx, records); err != nil {
+		return fmt.Errorf("failed to reconcile prefix %s: %w", prefix, err)
+	}
+	s.decodeRecords(ctx, records)
+	return s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		return s.store.BulkInsert(ctx, s.pgPool, compressRecords(s.redactRecords(records), s.compressThreshold), s.notifyChannel)
+	})
+}
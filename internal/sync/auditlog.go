@@ -0,0 +1,180 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Origins of audited changes
+const (
+	// AuditOriginEtcdEvent is a change received by the etcd watch
+	AuditOriginEtcdEvent = "etcd_event"
+	// AuditOriginSQL is a pending row written with SQL and pushed to etcd
+	AuditOriginSQL = "sql_pending"
+)
+
+// Operations of audited changes
+const (
+	AuditOperationPut       = "put"
+	AuditOperationDelete    = "delete"
+	AuditOperationCASPut    = "cas_put"    // put by etcd_cas()
+	AuditOperationCASDelete = "cas_delete" // delete by etcd_cas()
+)
+
+// auditOperation returns the audited operation of a record
+func auditOperation(record KeyValueRecord) string {
+	switch {
+	case record.ExpectedRevision != nil && record.Tombstone:
+		return AuditOperationCASDelete
+	case record.ExpectedRevision != nil:
+		return AuditOperationCASPut
+	case record.Tombstone:
+		return AuditOperationDelete
+	default:
+		return AuditOperationPut
+	}
+}
+
+// AuditLogEntry is a single change applied by the daemon
+type AuditLogEntry struct {
+	Time         time.Time `json:"time"`
+	Direction    string    `json:"direction"` // log.DirectionEtcdToPg or log.DirectionPgToEtcd
+	Origin       string    `json:"origin"`
+	Operation    string    `json:"operation"`
+	Key          string    `json:"key"`
+	PrevRevision int64     `json:"prev_revision"` // etcd mod revision before the change, 0 if the key did not exist
+	Revision     int64     `json:"revision"`
+	Instance     string    `json:"instance"`
+}
+
+// AuditLog is an append-only sink receiving every change applied by the daemon
+type AuditLog interface {
+	Record(ctx context.Context, entries []AuditLogEntry) error
+	Close() error
+}
+
+// auditLogColumns are the etcd_audit_log columns filled by TableAuditLog
+var auditLogColumns = []string{"ts", "direction", "origin", "operation", "key", "prev_revision", "revision", "instance"}
+
+// TableAuditLog appends entries to the etcd_audit_log table, applied_by is the PostgreSQL user of the daemon
+type TableAuditLog struct {
+	db PgxIface
+}
+
+// NewTableAuditLog creates an audit log writing to the etcd_audit_log table
+func NewTableAuditLog(db PgxIface) *TableAuditLog {
+	return &TableAuditLog{db: db}
+}
+
+// Record appends entries to etcd_audit_log
+func (l *TableAuditLog) Record(ctx context.Context, entries []AuditLogEntry) error {
+	_, err := l.db.CopyFrom(ctx, pgx.Identifier{"etcd_audit_log"}, auditLogColumns, pgx.CopyFromSlice(len(entries), func(i int) ([]any, error) {
+		e := entries[i]
+		return []any{e.Time, e.Direction, e.Origin, e.Operation, e.Key, e.PrevRevision, e.Revision, e.Instance}, nil
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// Close does nothing, the connection pool is owned by the caller
+func (l *TableAuditLog) Close() error {
+	return nil
+}
+
+// FileAuditLog appends entries as JSON lines to a file
+type FileAuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditLog opens name for appending audit log entries
+func NewFileAuditLog(name string) (*FileAuditLog, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &FileAuditLog{file: file}, nil
+}
+
+// Record appends entries to the file, one JSON object per line
+func (l *FileAuditLog) Record(_ context.Context, entries []AuditLogEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit log entry: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file
+func (l *FileAuditLog) Close() error {
+	return l.file.Close()
+}
+
+// prevRevision returns the mod revision of the previous value of a key, 0 if the key did not exist
+func prevRevision(kv *mvccpb.KeyValue) int64 {
+	if kv == nil {
+		return 0
+	}
+	return kv.ModRevision
+}
+
+// prevKVOptions requests the previous values of changed keys if they are audited
+func (s *Service) prevKVOptions() []clientv3.OpOption {
+	if s.auditLog == nil {
+		return nil
+	}
+	return []clientv3.OpOption{clientv3.WithPrevKV()}
+}
+
+// audit keeps applied changes for Recent, passes them to the OnApplied hook and the subscribers and records
+// them in the audit log if one is configured.
+// Failures are logged, they never hold up the synchronization.
+func (s *Service) audit(ctx context.Context, entries ...AuditLogEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	now := s.now()
+	instance := instanceID()
+	for i := range entries {
+		entries[i].Time = now
+		entries[i].Instance = instance
+	}
+	s.recentApplied.add(entries...)
+	s.subscribers.publish(entries)
+	if s.onApplied != nil {
+		for _, entry := range entries {
+			s.onApplied(entry)
+		}
+	}
+	if s.auditLog == nil {
+		return
+	}
+	if err := s.auditLog.Record(ctx, entries); err != nil {
+		s.logger().WithError(err).WithFields(log.Fields{
+			log.FieldKey: entries[0].Key,
+			"count":      len(entries),
+		}).Error("Failed to record changes in the audit log")
+	}
+}
@@ -0,0 +1,73 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// IsAuthError reports whether err is caused by an expired or rejected etcd auth token or by wrong credentials
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	err = rpctypes.Error(err)
+	return errors.Is(err, rpctypes.ErrInvalidAuthToken) ||
+		errors.Is(err, rpctypes.ErrUserEmpty) ||
+		errors.Is(err, rpctypes.ErrAuthOldRevision) ||
+		errors.Is(err, rpctypes.ErrAuthFailed)
+}
+
+// readPasswordFile returns the etcd password stored in name without the trailing newline
+func readPasswordFile(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read etcd password file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// getPasswordFile extracts the password_file parameter from the etcd DSN
+func getPasswordFile(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("password_file")
+}
+
+// refreshCredentials re-reads a rotated password from the password file.
+// The client authenticates with it when etcd rejects the current token.
+func (c *EtcdClient) refreshCredentials() error {
+	if c.passwordFile == "" {
+		return nil
+	}
+	password, err := readPasswordFile(c.passwordFile)
+	if err != nil {
+		return err
+	}
+	c.Client.Password = password
+	return nil
+}
+
+// WithReauth runs an etcd operation and repeats it once with refreshed credentials if etcd rejected
+// the authentication, so an expired token or a rotated password doesn't use up the retry budget
+func (c *EtcdClient) WithReauth(ctx context.Context, operation func() error) error {
+	err := operation()
+	if !IsAuthError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	log.Default().WithError(err).Info("etcd rejected the authentication, re-authenticating")
+	if err := c.refreshCredentials(); err != nil {
+		return err
+	}
+	return operation()
+}
@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// errTxnRejected is returned when a transaction is not applied because a key is not at its expected revision
+var errTxnRejected = &ConflictError{Err: errors.New("transaction rejected, a key changed since its expected revision")}
+
+// KVWatchResponse is a batch of changes below a watched prefix
+type KVWatchResponse struct {
+	Records  []KeyValueRecord // changes in revision order, deletions as tombstones
+	Revision int64            // revision the prefix is complete up to after the records
+	Err      error            // the watch failed, it is retried by the backend until its context is done
+}
+
+// KVBackend is a key-value store mirrored in PostgreSQL. Revisions are the store's global, increasing
+// change index, e.g. the etcd mod revision or the Consul modify index.
+type KVBackend interface {
+	// Range returns the keys below prefix and the revision of the snapshot
+	Range(ctx context.Context, prefix string) ([]KeyValueRecord, int64, error)
+	// Watch reports the changes below prefix after revision until ctx is done
+	Watch(ctx context.Context, prefix string, revision int64) <-chan KVWatchResponse
+	// Put sets the value of key and returns the revision of the change
+	Put(ctx context.Context, key, value string) (int64, error)
+	// Delete removes key and returns the revision of the change, 0 if the backend doesn't report it
+	Delete(ctx context.Context, key string) (int64, error)
+	// Txn applies all records or none and returns the revision of the change, 0 if it only deletes and
+	// the backend doesn't report it. A record with an ExpectedRevision is applied only if its key is still
+	// at that revision, errTxnRejected otherwise.
+	Txn(ctx context.Context, records []KeyValueRecord) (int64, error)
+}
+
+// etcdBackend implements KVBackend by an etcd client
+type etcdBackend struct {
+	client *EtcdClient
+}
+
+// NewEtcdBackend returns the KVBackend of an etcd client
+func NewEtcdBackend(client *EtcdClient) KVBackend {
+	return etcdBackend{client: client}
+}
+
+func (b etcdBackend) Range(ctx context.Context, prefix string) ([]KeyValueRecord, int64, error) {
+	return b.client.GetAllKeys(ctx, prefix)
+}
+
+func (b etcdBackend) Watch(ctx context.Context, prefix string, revision int64) <-chan KVWatchResponse {
+	responses := make(chan KVWatchResponse)
+	go func() {
+		defer close(responses)
+		for resp := range b.client.WatchWithRecovery(ctx, prefix, revision+1) {
+			response := KVWatchResponse{Revision: resp.Header.Revision, Err: resp.Err()}
+			for _, event := range resp.Events {
+				record, err := eventRecord(ctx, event)
+				if err != nil {
+					response.Err = err
+					break
+				}
+				response.Records = append(response.Records, record)
+			}
+			select {
+			case responses <- response:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return responses
+}
+
+func (b etcdBackend) Put(ctx context.Context, key, value string) (int64, error) {
+	resp, err := b.client.Put(ctx, key, value)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+func (b etcdBackend) Delete(ctx context.Context, key string) (int64, error) {
+	resp, err := b.client.Delete(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+func (b etcdBackend) Txn(ctx context.Context, records []KeyValueRecord) (int64, error) {
+	var compares []clientv3.Cmp
+	ops := make([]clientv3.Op, len(records))
+	for i, record := range records {
+		if record.ExpectedRevision != nil {
+			compares = append(compares, clientv3.Compare(clientv3.ModRevision(record.Key), "=", *record.ExpectedRevision))
+		}
+		ops[i] = clientv3.OpPut(record.Key, record.Value)
+		if record.Tombstone {
+			ops[i] = clientv3.OpDelete(record.Key)
+		}
+	}
+	resp, err := b.client.Txn(ctx).If(compares...).Then(ops...).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, errTxnRejected
+	}
+	return resp.Header.Revision, nil
+}
+
+// applyKV pushes records to a KV backend, several in one transaction, and returns the revision
+func applyKV(ctx context.Context, kv KVBackend, records []KeyValueRecord) (int64, error) {
+	if len(records) == 1 && records[0].ExpectedRevision == nil {
+		if records[0].Tombstone {
+			return kv.Delete(ctx, records[0].Key)
+		}
+		return kv.Put(ctx, records[0].Key, records[0].Value)
+	}
+	revision, err := kv.Txn(ctx, records)
+	if err != nil && !errors.Is(err, errTxnRejected) {
+		return 0, fmt.Errorf("failed to apply transaction: %w", err)
+	}
+	return revision, err
+}
+
+// snapshotRecords stamps the records of a KV snapshot with the time they are stored
+func snapshotRecords(records []KeyValueRecord) []KeyValueRecord {
+	now := time.Now()
+	for i := range records {
+		records[i].Ts = now
+	}
+	return records
+}
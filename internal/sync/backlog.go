@@ -0,0 +1,251 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// backlogCheckInterval is how often the depth and age of the PostgreSQL backlog are checked
+const backlogCheckInterval = 10 * time.Second
+
+// webhookTimeout bounds a single backlog alert request
+const webhookTimeout = 10 * time.Second
+
+// Backlog alert states sent to the webhook
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Backlog limits breached, sent to the webhook
+const (
+	LimitSoft = "soft"
+	LimitHard = "hard"
+)
+
+// Backlog is the state of the PostgreSQL changes waiting to be pushed to etcd
+type Backlog struct {
+	Records   int64         // pending rows, except failed ones
+	OldestAge time.Duration // age of the oldest pending row, zero if none
+	Failed    int64         // pending rows that reached the maximum number of sync attempts
+}
+
+// BacklogAlert configures when the backlog breaches its objective, breaches are logged and sent to Webhook.
+// The soft limits warn, the hard limits mean the forwarding to etcd is broken and optionally reject new changes.
+type BacklogAlert struct {
+	MaxAge         time.Duration // soft limit of the age of the oldest pending row, disabled if zero
+	MaxRecords     int64         // soft limit of the number of pending rows, disabled if zero
+	HardMaxAge     time.Duration // hard limit of the age of the oldest pending row, disabled if zero
+	HardMaxRecords int64         // hard limit of the number of pending rows, disabled if zero
+	Reject         bool          // reject new pending rows in PostgreSQL while a hard limit is breached
+	Webhook        string        // URL receiving a JSON POST when the backlog breaches and recovers, disabled if empty
+}
+
+// enabled reports whether any threshold is configured
+func (a BacklogAlert) enabled() bool {
+	return a.MaxAge > 0 || a.MaxRecords > 0 || a.HardMaxAge > 0 || a.HardMaxRecords > 0
+}
+
+// breached reports whether backlog exceeds a soft limit
+func (a BacklogAlert) breached(backlog Backlog) bool {
+	return (a.MaxAge > 0 && backlog.OldestAge >= a.MaxAge) || (a.MaxRecords > 0 && backlog.Records >= a.MaxRecords)
+}
+
+// hardBreached reports whether backlog exceeds a hard limit
+func (a BacklogAlert) hardBreached(backlog Backlog) bool {
+	return (a.HardMaxAge > 0 && backlog.OldestAge >= a.HardMaxAge) ||
+		(a.HardMaxRecords > 0 && backlog.Records >= a.HardMaxRecords)
+}
+
+// limit returns the highest limit backlog breaches, LimitHard or LimitSoft, empty if none
+func (a BacklogAlert) limit(backlog Backlog) string {
+	switch {
+	case a.hardBreached(backlog):
+		return LimitHard
+	case a.breached(backlog):
+		return LimitSoft
+	}
+	return ""
+}
+
+// BacklogAlertEvent is the JSON body POSTed to the backlog webhook
+type BacklogAlertEvent struct {
+	Status            string    `json:"status"`          // AlertFiring or AlertResolved
+	Limit             string    `json:"limit,omitempty"` // LimitSoft or LimitHard while firing
+	Instance          string    `json:"instance"`
+	Time              time.Time `json:"time"`
+	Records           int64     `json:"backlog_records"`
+	OldestAgeSeconds  float64   `json:"backlog_age_seconds"`
+	MaxRecords        int64     `json:"max_records,omitempty"`
+	MaxAgeSeconds     float64   `json:"max_age_seconds,omitempty"`
+	HardMaxRecords    int64     `json:"hard_max_records,omitempty"`
+	HardMaxAgeSeconds float64   `json:"hard_max_age_seconds,omitempty"`
+	Rejecting         bool      `json:"rejecting,omitempty"` // new pending rows are rejected
+}
+
+// GetBacklog returns the number and the age of the oldest pending rows of table, measured by the
+// PostgreSQL clock the rows are stamped with, and the number of failed rows
+func GetBacklog(ctx context.Context, pool PgxIface, table string) (Backlog, error) {
+	query := fmt.Sprintf(`SELECT count(*) FILTER (WHERE status IS NULL),
+			COALESCE(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - min(ts) FILTER (WHERE status IS NULL)), 0)::float8,
+			count(*) FILTER (WHERE status = 'failed')
+		FROM %s
+		WHERE revision = -1`, table)
+
+	var backlog Backlog
+	var age float64
+	if err := pool.QueryRow(ctx, query).Scan(&backlog.Records, &age, &backlog.Failed); err != nil {
+		return Backlog{}, fmt.Errorf("failed to query backlog: %w", err)
+	}
+	if age > 0 {
+		backlog.OldestAge = time.Duration(age * float64(time.Second))
+	}
+	return backlog, nil
+}
+
+// SetBacklogRejected enables the triggers rejecting new pending rows in the etcd tables for reason,
+// an empty reason disables them
+func SetBacklogRejected(ctx context.Context, pool PgxIface, reason string) error {
+	if _, err := pool.Exec(ctx, `SELECT etcd_set_backlog_rejected(NULLIF($1, ''))`, reason); err != nil {
+		return fmt.Errorf("failed to set backlog rejection: %w", err)
+	}
+	return nil
+}
+
+// monitorBacklog periodically exports the depth and age of the backlog and reports threshold breaches
+func (s *Service) monitorBacklog(ctx context.Context) {
+	ticker := time.NewTicker(backlogCheckInterval)
+	defer ticker.Stop()
+	limit := ""
+	rejecting, rejectKnown := false, false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var backlog Backlog
+		err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+			backlog, err = s.store.Backlog(ctx, s.pgPool)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger().WithError(err).Warn("Failed to check the backlog")
+			}
+			continue
+		}
+		metrics.BacklogRecords.Set(float64(backlog.Records))
+		metrics.BacklogAge.Set(backlog.OldestAge.Seconds())
+		metrics.FailedRecords.Set(float64(backlog.Failed))
+		if s.tenant != "" {
+			metrics.TenantBacklogRecords.WithLabelValues(s.tenant).Set(float64(backlog.Records))
+			metrics.TenantBacklogAge.WithLabelValues(s.tenant).Set(backlog.OldestAge.Seconds())
+		}
+
+		if !s.backlogAlert.enabled() {
+			continue
+		}
+		// A rejection left behind by a previous daemon is lifted by the first check
+		if reject := s.backlogAlert.hardBreached(backlog); s.backlogAlert.Reject && (reject != rejecting || !rejectKnown) {
+			if err := s.rejectBacklog(ctx, backlog, reject); err != nil {
+				countError(err)
+				s.logger().WithError(err).Error("Failed to switch the rejection of new changes")
+			} else {
+				rejecting, rejectKnown = reject, true
+			}
+		}
+		if current := s.backlogAlert.limit(backlog); current != limit {
+			limit = current
+			s.alertBacklog(ctx, backlog, limit, rejecting)
+		}
+	}
+}
+
+// rejectBacklog switches the rejection of new pending rows while backlog exceeds a hard limit
+func (s *Service) rejectBacklog(ctx context.Context, backlog Backlog, reject bool) error {
+	reason := ""
+	if reject {
+		reason = fmt.Sprintf("%d changes pending, the oldest for %s", backlog.Records, backlog.OldestAge.Round(time.Second))
+	}
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		return SetBacklogRejected(ctx, s.pgPool, reason)
+	})
+	if err != nil {
+		return err
+	}
+	if reject {
+		s.logger().WithField("reason", reason).Error("Rejecting new PostgreSQL changes until the backlog is below its hard limit")
+	}
+	return nil
+}
+
+// alertBacklog logs a backlog breach of limit or the recovery if limit is empty and sends it to the webhook
+func (s *Service) alertBacklog(ctx context.Context, backlog Backlog, limit string, rejecting bool) {
+	event := BacklogAlertEvent{
+		Status:            AlertResolved,
+		Instance:          s.InstanceName(),
+		Time:              s.now(),
+		Records:           backlog.Records,
+		OldestAgeSeconds:  backlog.OldestAge.Seconds(),
+		MaxRecords:        s.backlogAlert.MaxRecords,
+		MaxAgeSeconds:     s.backlogAlert.MaxAge.Seconds(),
+		HardMaxRecords:    s.backlogAlert.HardMaxRecords,
+		HardMaxAgeSeconds: s.backlogAlert.HardMaxAge.Seconds(),
+		Rejecting:         rejecting,
+	}
+	entry := s.logger().WithFields(log.Fields{
+		"backlog_records":     event.Records,
+		"backlog_age_seconds": event.OldestAgeSeconds,
+	})
+	switch limit {
+	case LimitHard:
+		event.Status, event.Limit = AlertFiring, limit
+		entry.Error("PostgreSQL backlog exceeds its hard limit, changes are not forwarded to etcd")
+	case LimitSoft:
+		event.Status, event.Limit = AlertFiring, limit
+		entry.Warn("PostgreSQL backlog exceeds its threshold")
+	default:
+		entry.Info("PostgreSQL backlog is back below its threshold")
+	}
+
+	if s.backlogAlert.Webhook == "" {
+		return
+	}
+	if err := postWebhook(ctx, s.backlogAlert.Webhook, event); err != nil && ctx.Err() == nil {
+		s.logger().WithError(err).Warn("Failed to send backlog alert")
+	}
+}
+
+// postWebhook POSTs event as JSON to url, any status but 2xx is an error
+func postWebhook(ctx context.Context, url string, event any) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call webhook: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
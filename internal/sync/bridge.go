@@ -0,0 +1,323 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// kvTxnOps is the operation limit of a transaction pushed to a KV backend, the Consul maximum
+const kvTxnOps = 64
+
+// startBridge synchronizes PostgreSQL with the KV backend instead of etcd. Only the watchers and the poller
+// run, features built on etcd leases, compaction and cluster status are not available.
+func (s *Service) startBridge(ctx context.Context) error {
+	if len(s.prefixes) == 0 {
+		return errors.New("no key prefixes to synchronize")
+	}
+	s.logger().WithField("prefixes", s.prefixes).Info("Starting pg_etcd bidirectional synchronization with KV backend")
+
+	errChan := make(chan error, len(s.prefixes)+1)
+	for _, prefix := range s.prefixes {
+		if s.pushOnly {
+			break
+		}
+		go func() {
+			errChan <- supervise(ctx, "watcher", func(ctx context.Context) error {
+				return s.bridgeWatch(ctx, prefix)
+			})
+		}()
+	}
+
+	if s.readOnly {
+		s.logger().Info("Running as read-only mirror, PostgreSQL changes are not synced to the KV backend")
+	} else {
+		spawn(ctx, "backlog_monitor", s.monitorBacklog)
+		go func() {
+			errChan <- supervise(ctx, "poller", s.bridgePush)
+		}()
+	}
+
+	select {
+	case err := <-errChan:
+		return fmt.Errorf("sync error: %w", err)
+	case <-ctx.Done():
+		s.logger().Info("Synchronization stopped due to context cancellation")
+		return ctx.Err()
+	}
+}
+
+// bridgeWatch mirrors the changes below prefix in PostgreSQL. The prefix is reconciled with a snapshot
+// before watching and again after every failure, so no change is lost while the watch is down.
+func (s *Service) bridgeWatch(ctx context.Context, prefix string) error {
+	s.logger().WithField("prefix", prefix).Info("Starting KV backend to PostgreSQL sync watcher")
+
+	for {
+		if err := s.pause.wait(ctx); err != nil {
+			return err
+		}
+		revision, err := s.reconcileKV(ctx, prefix)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			countError(err)
+			s.logger().WithError(err).WithField("prefix", prefix).Error("Failed to reconcile prefix with the KV backend")
+			sleepCtx(ctx, s.pollingInterval)
+			continue
+		}
+		s.watchKV(ctx, prefix, revision)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// reconcileKV stores the changes of a snapshot of prefix missing in PostgreSQL and returns its revision
+func (s *Service) reconcileKV(ctx context.Context, prefix string) (int64, error) {
+	var snapshot []KeyValueRecord
+	var header int64
+	err := RetryEtcdOperation(ctx, func() (err error) {
+		snapshot, header, err = s.kv.Range(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	checkpoint, err := s.store.LoadCheckpoint(ctx, s.pgPool, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	// Changes after the checkpoint are new, older ones are only missing if the gap query reports them.
+	// Quarantined keys are never stored, don't report them as lost.
+	var records []KeyValueRecord
+	keys := make([]string, 0, len(snapshot))
+	revisions := make([]int64, 0, len(snapshot))
+	byKey := make(map[string]KeyValueRecord, len(snapshot))
+	for _, record := range snapshotRecords(snapshot) {
+		if isInternalKey(record.Key) {
+			continue
+		}
+		stored, reason := s.admit(record)
+		byKey[stored.Key] = record
+		if record.Revision > checkpoint {
+			records = append(records, record)
+		}
+		if reason == "" {
+			keys = append(keys, stored.Key)
+			revisions = append(revisions, record.Revision)
+		}
+	}
+
+	var gaps []RevisionGap
+	err = s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		gaps, err = s.store.RevisionGaps(ctx, s.pgPool, prefix, keys, revisions, header)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, gap := range gaps {
+		if gap.Kind == GapMissingDelete {
+			records = append(records, KeyValueRecord{Key: gap.Key, Revision: header, Ts: s.now(), Tombstone: true})
+		} else if record, ok := byKey[gap.Key]; ok && record.Revision <= checkpoint {
+			records = append(records, record)
+		}
+	}
+
+	if len(records) > 0 || header > checkpoint {
+		start := s.now()
+		mirrored, err := s.commitRecords(ctx, prefix, records, header)
+		if err != nil {
+			return 0, err
+		}
+		for i, record := range records {
+			if mirrored[i] {
+				s.completeRecord(ctx, record, 0, start)
+			}
+		}
+	}
+	s.logger().WithFields(log.Fields{"prefix": prefix, "revision": header, "changes": len(records)}).Info("Reconciled prefix with the KV backend")
+	return header, nil
+}
+
+// watchKV applies the changes below prefix after revision until the watch fails to be applied, the service
+// is paused or a resynchronization is requested
+func (s *Service) watchKV(ctx context.Context, prefix string, revision int64) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.lag.observe(prefix, revision)
+
+	watchChan := s.kv.Watch(watchCtx, prefix, revision)
+	for {
+		var resp KVWatchResponse
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.resync[prefix]:
+			s.logger().WithField("prefix", prefix).Info("Resynchronizing prefix")
+			return
+		case resp, ok = <-watchChan:
+			if !ok {
+				return
+			}
+		}
+		s.markLoop()
+		if resp.Err != nil {
+			// The backend retries the watch
+			countError(resp.Err)
+			s.logger().WithError(resp.Err).WithField("prefix", prefix).Warn("KV backend watch failed")
+			continue
+		}
+		if s.Paused() {
+			return // reconciled again after resuming
+		}
+
+		var records []KeyValueRecord
+		for _, record := range resp.Records {
+			if !isInternalKey(record.Key) {
+				record.Ts = s.now()
+				records = append(records, record)
+			}
+		}
+
+		batchCtx := correlate(ctx)
+		start := s.now()
+		var mirrored []bool
+		err := RetryWithBackoff(batchCtx, DefaultRetryConfig(), func() (err error) {
+			mirrored, err = s.commitRecords(batchCtx, prefix, records, resp.Revision)
+			return err
+		})
+		if err != nil {
+			countError(err)
+			s.logger().WithContext(batchCtx).WithError(err).WithField("prefix", prefix).Error("Failed to apply KV backend changes, reconciling prefix")
+			return
+		}
+		s.lag.observe(prefix, resp.Revision)
+		for i, record := range records {
+			if mirrored[i] {
+				s.completeRecord(batchCtx, record, 0, start)
+			}
+		}
+	}
+}
+
+// bridgePush pushes the pending PostgreSQL changes to the KV backend every polling interval
+func (s *Service) bridgePush(ctx context.Context) error {
+	s.logger().Info("Starting PostgreSQL to KV backend sync poller")
+
+	ticker := time.NewTicker(s.pollingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := s.pushPendingKV(ctx); err != nil {
+				countError(err)
+				s.logger().WithError(err).Error("Failed to poll and process pending records")
+			}
+			s.markLoop()
+		}
+	}
+}
+
+// pushPendingKV claims the pending records and pushes them to the KV backend in transactions
+func (s *Service) pushPendingKV(ctx context.Context) error {
+	if s.Paused() {
+		return nil
+	}
+
+	var pendingRecords []KeyValueRecord
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		pendingRecords, err = s.store.ClaimPending(ctx, s.pgPool, instanceID())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get pending records: %w", err)
+	}
+	s.observeBacklog(pendingRecords)
+	pendingRecords = s.rejectInvalid(ctx, pendingRecords)
+
+	if err := s.pinBaseRevisions(ctx, pendingRecords); err != nil {
+		return err
+	}
+	for _, batch := range batchPendingRecords(pendingRecords, s.batchSize, nil) {
+		for len(batch) > 0 {
+			n := min(len(batch), kvTxnOps)
+			s.pushKV(correlate(ctx), batch[:n])
+			batch = batch[n:]
+		}
+	}
+	return nil
+}
+
+// pushKV applies records in one transaction of the KV backend and acknowledges them. A rejected conditional
+// change is discarded, the watch delivers the winning value.
+func (s *Service) pushKV(ctx context.Context, records []KeyValueRecord) {
+	start := s.now()
+	config := EtcdRetryConfig()
+	config.Retryable = func(err error) bool {
+		return !errors.Is(err, errTxnRejected) && IsRetryableEtcdError(err)
+	}
+	var revision int64
+	err := RetryWithBackoff(ctx, config, func() (err error) {
+		revision, err = applyKV(ctx, s.kv, s.etcdRecords(records))
+		return err
+	})
+	if errors.Is(err, errTxnRejected) {
+		record := records[0]
+		s.recordFailure(log.DirectionPgToEtcd, record.Key, 0, err)
+		s.notifyConflict(ctx, record, err)
+		s.logger().WithContext(ctx).WithError(err).WithField(log.FieldKey, record.Key).Warn("Conditional change rejected by the KV backend, discarding pending change")
+		err = s.withStatementTimeout(ctx, func(ctx context.Context) error {
+			return s.store.DiscardPending(ctx, s.pgPool, record.Key)
+		})
+	}
+	if err != nil {
+		s.recordFailure(log.DirectionPgToEtcd, records[0].Key, 0, err)
+		s.recordAttempt(ctx, records[0].Key, err)
+		s.logger().WithContext(ctx).WithError(err).WithField(log.FieldKey, records[0].Key).Error("Failed to process pending record after retries")
+		return
+	}
+	if revision == 0 {
+		// The backend reports no revision of deletions, the watch mirrors them
+		for _, record := range records {
+			err := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+				return s.store.DiscardPending(ctx, s.pgPool, record.Key)
+			})
+			if err != nil {
+				s.logger().WithContext(ctx).WithError(err).WithField(log.FieldKey, record.Key).Warn("Failed to discard pushed deletion")
+			}
+		}
+		return
+	}
+
+	for _, record := range records {
+		s.ownWrites.add(record.Key, revision)
+		if err := s.ackPending(ctx, record, revision); err != nil {
+			s.logger().WithContext(ctx).WithError(err).WithField(log.FieldKey, record.Key).Warn("Failed to acknowledge pushed record")
+			continue
+		}
+		s.observeSynced(log.DirectionPgToEtcd, record.Key, start)
+		s.audit(ctx, AuditLogEntry{
+			Direction: log.DirectionPgToEtcd,
+			Origin:    AuditOriginSQL,
+			Operation: auditOperation(record),
+			Key:       record.Key,
+			Revision:  revision,
+		})
+		s.notifyApplied(ctx, log.DirectionPgToEtcd, syncedRecord(record, revision))
+	}
+	s.logger().WithContext(ctx).WithFields(log.Fields{
+		log.FieldDirection: log.DirectionPgToEtcd,
+		log.FieldRevision:  revision,
+		log.FieldLatencyMs: log.LatencyMs(s.now().Sub(start)),
+		"count":            len(records),
+	}).Info("Synced PostgreSQL changes to KV backend")
+}
@@ -0,0 +1,177 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Chunking of values exceeding the etcd request size limit in the prefixes of Config.ChunkPrefixes. Such a
+// value is written to the sub-keys <key>/.chunks/NNN, one request each, and the key itself receives a
+// manifest describing them. The manifest starts with NUL, which never starts a value mirrored in PostgreSQL.
+const (
+	chunkDir            = ".chunks/"
+	chunkSize           = maxTxnBytes
+	maxChunks           = 1000
+	chunkManifestMarker = "\x00pg_etcd-chunks:"
+)
+
+// chunkManifest is the value of a chunked key
+type chunkManifest struct {
+	Chunks int    `json:"chunks"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// chunkPrefix returns the prefix of the chunk keys of key
+func chunkPrefix(key string) string {
+	return key + "/" + chunkDir
+}
+
+// chunkKey returns the key of chunk i of key
+func chunkKey(key string, i int) string {
+	return fmt.Sprintf("%s%03d", chunkPrefix(key), i)
+}
+
+// isChunkKey reports whether key holds a chunk of another key
+func isChunkKey(key string) bool {
+	return strings.Contains(key, "/"+chunkDir)
+}
+
+// parseChunkManifest returns the manifest value holds, false if it is a plain value
+func parseChunkManifest(value string) (chunkManifest, bool) {
+	var manifest chunkManifest
+	payload, ok := strings.CutPrefix(value, chunkManifestMarker)
+	if !ok || json.Unmarshal([]byte(payload), &manifest) != nil {
+		return chunkManifest{}, false
+	}
+	return manifest, true
+}
+
+// PutChunked puts value to key, split into chunks if key and value exceed the transaction size limit, and
+// removes the chunks of an earlier value. opts apply to the put of key. It returns the revision of the
+// change and the previous mod revision of key if opts request it.
+func (c *EtcdClient) PutChunked(ctx context.Context, key, value string, opts ...clientv3.OpOption) (revision, prevRev int64, err error) {
+	stored, chunks := value, 0
+	if len(key)+len(value) > maxTxnBytes {
+		chunks = (len(value) + chunkSize - 1) / chunkSize
+		if chunks > maxChunks {
+			return 0, 0, &ValidationError{Err: fmt.Errorf("value of %d bytes exceeds %d chunks", len(value), maxChunks)}
+		}
+		// The chunks are written before the manifest, so readers of the manifest revision see all of them
+		for i := range chunks {
+			chunk := value[i*chunkSize : min((i+1)*chunkSize, len(value))]
+			if _, err := c.Put(ctx, chunkKey(key, i), chunk); err != nil {
+				return 0, 0, fmt.Errorf("failed to put chunk %d: %w", i, err)
+			}
+		}
+		sum := sha256.Sum256([]byte(value))
+		manifest, err := json.Marshal(chunkManifest{Chunks: chunks, Size: len(value), SHA256: hex.EncodeToString(sum[:])})
+		if err != nil {
+			return 0, 0, err
+		}
+		stored = chunkManifestMarker + string(manifest)
+	}
+
+	resp, err := c.Txn(ctx).Then(
+		clientv3.OpPut(key, stored, opts...),
+		clientv3.OpDelete(chunkKey(key, chunks), clientv3.WithRange(clientv3.GetPrefixRangeEnd(chunkPrefix(key)))),
+	).Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.Header.Revision, txnPrevRevision(resp.Responses[0]), nil
+}
+
+// DeleteChunked deletes key and its chunks in one transaction, opts apply to the deletion of key
+func (c *EtcdClient) DeleteChunked(ctx context.Context, key string, opts ...clientv3.OpOption) (revision, prevRev int64, err error) {
+	resp, err := c.Txn(ctx).Then(
+		clientv3.OpDelete(key, opts...),
+		clientv3.OpDelete(chunkPrefix(key), clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.Header.Revision, txnPrevRevision(resp.Responses[0]), nil
+}
+
+// errChunksInconsistent is returned by ReadChunks if the chunks do not match the manifest
+var errChunksInconsistent = errors.New("chunks do not match the manifest")
+
+// ReadChunks reassembles the value of a chunked key from its chunks at revision, the mod revision of the manifest
+func (c *EtcdClient) ReadChunks(ctx context.Context, key string, manifest chunkManifest, revision int64) (string, error) {
+	var value strings.Builder
+	value.Grow(manifest.Size)
+	for i := range manifest.Chunks {
+		resp, err := c.Get(ctx, chunkKey(key, i), clientv3.WithRev(revision))
+		if err != nil {
+			return "", fmt.Errorf("failed to get chunk %d: %w", i, err)
+		}
+		if len(resp.Kvs) == 0 {
+			return "", fmt.Errorf("%w: chunk %d is missing", errChunksInconsistent, i)
+		}
+		value.Write(resp.Kvs[0].Value)
+	}
+	if err := manifest.verify(value.String()); err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
+
+// verify checks the size and checksum of the value reassembled from the chunks of the manifest
+func (m chunkManifest) verify(value string) error {
+	sum := sha256.Sum256([]byte(value))
+	if len(value) != m.Size || hex.EncodeToString(sum[:]) != m.SHA256 {
+		return fmt.Errorf("%w: checksum mismatch", errChunksInconsistent)
+	}
+	return nil
+}
+
+// chunked reports whether the values of key are chunked, see Config.ChunkPrefixes
+func (s *Service) chunked(key string) bool {
+	for _, prefix := range s.chunkPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// assembleChunks replaces the manifests of chunked keys among records read from etcd with their values.
+// Manifests whose chunks were compacted or do not match are left alone and end up in quarantine.
+func (s *Service) assembleChunks(ctx context.Context, records []KeyValueRecord) error {
+	for i, record := range records {
+		if record.Tombstone || !s.chunked(record.Key) {
+			continue
+		}
+		manifest, ok := parseChunkManifest(record.Value)
+		if !ok {
+			continue
+		}
+		var value string
+		err := RetryEtcdOperation(ctx, func() (err error) {
+			value, err = s.etcdClient.ReadChunks(ctx, record.Key, manifest, record.Revision)
+			return err
+		})
+		if IsCompacted(err) || errors.Is(err, errChunksInconsistent) {
+			s.logger().WithContext(ctx).WithError(err).WithFields(log.Fields{
+				log.FieldKey:      record.Key,
+				log.FieldRevision: record.Revision,
+			}).Warn("Failed to reassemble chunked value")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reassemble chunked value: %w", err)
+		}
+		records[i].Value = value
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// pendingColumns returns the columns of a pending record in table, scanned by scanPendingRecord
+func pendingColumns(table string) string {
+	if table == "etcd_latest" {
+		return "key, value, revision, ts, tombstone, NULL::bigint" // no conditional changes
+	}
+	return "key, value, revision, ts, tombstone, expected_revision"
+}
+
+func scanPendingRecord(row pgx.Row) (KeyValueRecord, error) {
+	var record KeyValueRecord
+	var value *string
+	err := row.Scan(&record.Key, &value, &record.Revision, &record.Ts, &record.Tombstone, &record.ExpectedRevision)
+	if value != nil {
+		record.Value = *value
+	}
+	return record, err
+}
+
+func collectPendingRecords(rows pgx.Rows, err error) ([]KeyValueRecord, error) {
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending records: %w", err)
+	}
+	defer rows.Close()
+
+	var records []KeyValueRecord
+	for rows.Next() {
+		record, err := scanPendingRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning pending record: %w", err)
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pending records: %w", err)
+	}
+	return records, nil
+}
+
+// claimTimeout is how long a claim of another daemon is respected, a live daemon renews its claims
+// every time it claims the pending rows again
+const claimTimeout = 5 * time.Minute
+
+// claimable is the condition of the pending rows instance may claim: unclaimed ones, its own and those
+// whose claim of another daemon timed out
+const claimable = `revision = -1 AND status IS NULL
+	AND (claimed_by IS NULL OR claimed_by = $1 OR claimed_at < CURRENT_TIMESTAMP - make_interval(secs => $2))`
+
+// ClaimPendingRecords marks the claimable pending rows of table in-progress by instance and returns them in
+// insertion order, except failed ones. The claim is committed before the rows are pushed to etcd, a crashed
+// daemon leaves its claims behind for recoverClaims. Rows claimed by another live daemon are left to it.
+func ClaimPendingRecords(ctx context.Context, pool PgxIface, table, instance string) ([]KeyValueRecord, error) {
+	query := fmt.Sprintf(`WITH claimed AS (
+			UPDATE %[1]s SET claimed_by = $1, claimed_at = CURRENT_TIMESTAMP
+			WHERE %[3]s
+			RETURNING seq, %[2]s
+		)
+		SELECT %[2]s
+		FROM claimed
+		ORDER BY ts ASC, seq ASC`, table, pendingColumns(table), claimable)
+
+	return collectPendingRecords(pool.Query(ctx, query, instance, claimTimeout.Seconds()))
+}
+
+// ClaimPendingRecord marks the pending row of key in table in-progress by instance and returns it,
+// nil if the key has none, it failed or another live daemon claimed it
+func ClaimPendingRecord(ctx context.Context, pool PgxIface, table, key, instance string) (*KeyValueRecord, error) {
+	query := fmt.Sprintf(`UPDATE %s SET claimed_by = $1, claimed_at = CURRENT_TIMESTAMP
+		WHERE key = $3 AND %s
+		RETURNING %s`, table, claimable, pendingColumns(table))
+
+	record, err := scanPendingRecord(pool.QueryRow(ctx, query, instance, claimTimeout.Seconds(), key))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pending record: %w", err)
+	}
+	return &record, nil
+}
+
+// GetStaleClaims returns the pending rows of table claimed by another daemon than instance
+func GetStaleClaims(ctx context.Context, pool PgxIface, table, instance string) ([]KeyValueRecord, error) {
+	query := fmt.Sprintf(`SELECT %[2]s
+		FROM %[1]s
+		WHERE revision = -1 AND status IS NULL AND claimed_by IS NOT NULL AND claimed_by <> $1
+		ORDER BY ts ASC, seq ASC`, table, pendingColumns(table))
+
+	return collectPendingRecords(pool.Query(ctx, query, instance))
+}
+
+// ReleaseClaim makes the pending row of key in table available for pushing again
+func ReleaseClaim(ctx context.Context, pool PgxIface, table, key string) error {
+	query := fmt.Sprintf(`UPDATE %s SET claimed_by = NULL, claimed_at = NULL WHERE key = $1 AND revision = -1`, table)
+
+	if _, err := pool.Exec(ctx, query, key); err != nil {
+		return fmt.Errorf("failed to release claim: %w", err)
+	}
+	return nil
+}
+
+// recoverClaims reconciles the pending rows a crashed daemon claimed with etcd before they are pushed again.
+// A change etcd already holds was written before the crash and is acked instead of applied twice,
+// any other claim is released.
+func (s *Service) recoverClaims(ctx context.Context) error {
+	var records []KeyValueRecord
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		records, err = s.store.StaleClaims(ctx, s.pgPool, instanceID())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get stale claims: %w", err)
+	}
+
+	for _, record := range records {
+		if err := s.recoverClaim(ctx, record); err != nil {
+			return fmt.Errorf("failed to recover claim of key %s: %w", record.Key, err)
+		}
+	}
+	return nil
+}
+
+// appliedInEtcd reports whether etcd holds the change of record, a write whose acknowledgement was lost,
+// with the mod revision of the key, 0 for deletions
+func (s *Service) appliedInEtcd(ctx context.Context, record KeyValueRecord) (bool, int64, error) {
+	var resp *clientv3.GetResponse
+	err := RetryEtcdOperation(ctx, func() (err error) {
+		resp, err = s.etcdClient.Get(ctx, s.etcdKey(record.Key))
+		return err
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return record.Tombstone, 0, nil
+	}
+	return !record.Tombstone && string(resp.Kvs[0].Value) == record.Value, resp.Kvs[0].ModRevision, nil
+}
+
+func (s *Service) recoverClaim(ctx context.Context, record KeyValueRecord) error {
+	applied, revision, err := s.appliedInEtcd(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	entry := s.logger().WithContext(ctx).WithFields(log.Fields{log.FieldDirection: log.DirectionPgToEtcd, log.FieldKey: record.Key})
+	if !applied {
+		entry.Info("Releasing pending record claimed by a previous daemon")
+		return s.withStatementTimeout(ctx, func(ctx context.Context) error {
+			return s.store.ReleaseClaim(ctx, s.pgPool, record.Key)
+		})
+	}
+
+	entry.Info("Acknowledging pending record a previous daemon wrote to etcd before stopping")
+	if record.Tombstone {
+		// The deletion revision is unknown, the watch mirrors the deletion
+		return s.withStatementTimeout(ctx, func(ctx context.Context) error {
+			return s.store.DiscardPending(ctx, s.pgPool, record.Key)
+		})
+	}
+	return s.ackPending(ctx, record, revision)
+}
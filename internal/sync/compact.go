@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"context"
+	"time"
+)
+
+// compactRevision returns the highest revision every prefix is persisted up to in PostgreSQL, 0 if unknown
+func (s *Service) compactRevision(ctx context.Context) (int64, error) {
+	var revision int64
+	for i, prefix := range s.prefixes {
+		var synced int64
+		err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+			synced, err = s.store.LoadCheckpoint(ctx, s.pgPool, prefix)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || synced < revision {
+			revision = synced
+		}
+	}
+	return revision, nil
+}
+
+// compactEtcd compacts etcd up to the revision persisted in PostgreSQL for all prefixes, so the
+// history lives on in PostgreSQL while etcd stays small. Compaction applies to the whole keyspace.
+func (s *Service) compactEtcd(ctx context.Context) {
+	s.logger().WithField("interval", s.compactInterval).Info("Compacting etcd up to the revision persisted in PostgreSQL")
+
+	ticker := time.NewTicker(s.compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		revision, err := s.compactRevision(ctx)
+		if err != nil {
+			s.logger().WithError(err).Error("Failed to get the persisted revision for etcd compaction")
+			continue
+		}
+		if revision <= s.etcdClient.CompactRevision() {
+			continue // nothing new persisted since the last compaction
+		}
+
+		if _, err := s.etcdClient.Compact(ctx, revision); err != nil {
+			if IsCompacted(err) {
+				// compacted further by someone else, e.g. the etcd auto-compaction
+				s.logger().WithError(err).WithField("revision", revision).Debug("etcd already compacted")
+			} else {
+				s.logger().WithError(err).WithField("revision", revision).Error("Failed to compact etcd")
+			}
+			continue
+		}
+		s.etcdClient.observeCompaction(revision)
+		s.logger().WithField("revision", revision).Info("Compacted etcd")
+	}
+}
@@ -0,0 +1,387 @@
+package sync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/migrations"
+)
+
+// setupSchemaVersion starts an empty PostgreSQL container and applies the first version migrations
+func setupSchemaVersion(ctx context.Context, t *testing.T, version int) (*pgxpool.Pool, func()) {
+	pgConnStr := StartPostgreSQL(t)
+
+	conn, err := pgx.Connect(ctx, pgConnStr)
+	require.NoError(t, err)
+	require.NoError(t, migrations.ApplyUpTo(ctx, conn, version))
+	require.NoError(t, conn.Close(ctx))
+
+	pool, err := pgxpool.New(ctx, pgConnStr)
+	require.NoError(t, err)
+
+	return pool, pool.Close
+}
+
+// TestCompatibilityNewBinaryOldSchema verifies the guard refuses a schema missing required objects
+// and that migrating in place makes it usable without recreating the database
+func TestCompatibilityNewBinaryOldSchema(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping compatibility test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.RequiredVersion-1)
+	defer cleanup()
+
+	err := migrations.CheckCompatibility(ctx, pool)
+	require.ErrorIs(t, err, migrations.ErrSchemaTooOld)
+
+	// Rows written by the previous release survive the upgrade and keep their order
+	_, err = pool.Exec(ctx, "SELECT etcd_put('/compat/a', '1'), etcd_put('/compat/b', '2')")
+	require.NoError(t, err)
+
+	require.NoError(t, MigrateSchema(ctx, pool))
+	require.NoError(t, migrations.CheckCompatibility(ctx, pool))
+
+	records, err := GetPendingRecords(ctx, pool)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "/compat/a", records[0].Key)
+	assert.Equal(t, "/compat/b", records[1].Key)
+}
+
+// TestCompatibilityOldBinaryNewSchema verifies queries of the previous release and the
+// current binary keep working once the schema is migrated ahead of the binary
+func TestCompatibilityOldBinaryNewSchema(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping compatibility test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	// Simulate the next, not yet known migration being applied by a newer binary
+	_, err := pool.Exec(ctx, `ALTER TABLE etcd ADD COLUMN future_column text;
+		INSERT INTO pg_etcd_migrations (id, version) SELECT count(*), 'future' FROM pg_etcd_migrations`)
+	require.NoError(t, err)
+	require.NoError(t, migrations.CheckCompatibility(ctx, pool))
+
+	// Previous release statements without the seq column
+	_, err = pool.Exec(ctx, `INSERT INTO etcd (key, value, revision, tombstone)
+		VALUES ($1, $2, -1, false)
+		ON CONFLICT (key, revision) DO UPDATE
+		SET value = EXCLUDED.value, ts = CURRENT_TIMESTAMP, tombstone = EXCLUDED.tombstone`, "/compat/old", "v1")
+	require.NoError(t, err)
+	rows, err := pool.Query(ctx, `SELECT key, value, revision, ts, tombstone
+		FROM etcd WHERE revision = -1 ORDER BY ts ASC`)
+	require.NoError(t, err)
+	rows.Close()
+	require.NoError(t, rows.Err())
+
+	// Current binary statements
+	require.NoError(t, InsertPendingRecord(ctx, pool, "/compat/new", "v2", false))
+	records, err := GetPendingRecords(ctx, pool)
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+	require.NoError(t, BulkInsert(ctx, pool, []KeyValueRecord{{Key: "/compat/new", Value: "v2", Revision: 10}}))
+	revision, err := GetLatestRevision(ctx, pool)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), revision)
+}
+
+// TestValueHashDedup tests the value hashes of migration 021, deduplicating unchanged values and skipping
+// mirrored records on resynchronization
+func TestValueHashDedup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	s := NewService(pool, nil, WithConfig(Config{Prefixes: []string{"/dedup/"}, Dedup: true}))
+	now := time.Now()
+	_, err := s.applyRecords(ctx, pool, []KeyValueRecord{{Key: "/dedup/a", Value: "1", Revision: 10, Ts: now}})
+	require.NoError(t, err)
+	var hash []byte
+	require.NoError(t, pool.QueryRow(ctx, `SELECT value_hash FROM etcd WHERE key = '/dedup/a'`).Scan(&hash))
+	assert.Equal(t, valueHash("1"), hash, "PostgreSQL hashes plain values")
+
+	// The unchanged value moves the revision of the row, the changed one adds a row
+	_, err = s.applyRecords(ctx, pool, []KeyValueRecord{
+		{Key: "/dedup/a", Value: "1", Revision: 12, Ts: now},
+		{Key: "/dedup/a", Value: "2", Revision: 13, Ts: now},
+	})
+	require.NoError(t, err)
+	rows, err := pool.Query(ctx, `SELECT revision FROM etcd WHERE key = '/dedup/a' ORDER BY revision`)
+	require.NoError(t, err)
+	revisions, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	require.NoError(t, err)
+	assert.Equal(t, []int64{12, 13}, revisions)
+
+	changed, err := s.skipMirrored(ctx, pool, []KeyValueRecord{
+		{Key: "/dedup/a", Value: "2", Revision: 13},
+		{Key: "/dedup/b", Value: "3", Revision: 14},
+	})
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	assert.Equal(t, "/dedup/b", changed[0].Key)
+}
+
+// TestKeyPath checks the key paths are filled when enabled and maintained for new rows
+func TestKeyPath(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	_, err := pool.Exec(ctx, `SELECT etcd_put('/registry/pods/default/web', 'a')`)
+	require.NoError(t, err)
+	require.NoError(t, SetKeyPath(ctx, pool, true))
+	_, err = pool.Exec(ctx, `SELECT etcd_put('//registry/services/', 'b')`)
+	require.NoError(t, err)
+
+	rows, err := pool.Query(ctx, `SELECT key_path FROM etcd ORDER BY key COLLATE "C"`)
+	require.NoError(t, err)
+	paths, err := pgx.CollectRows(rows, pgx.RowTo[[]string])
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"registry", "services"}, {"registry", "pods", "default", "web"}}, paths)
+
+	var namespace, service, item *string
+	require.NoError(t, pool.QueryRow(ctx, `SELECT namespace, service, item FROM etcd_current WHERE key = '/registry/pods/default/web'`).
+		Scan(&namespace, &service, &item))
+	assert.Equal(t, "registry", *namespace)
+	assert.Equal(t, "pods", *service)
+	assert.Equal(t, "default/web", *item)
+}
+
+// TestPruneRetention prunes old revisions by prefix while keeping current values and exempt prefixes
+func TestPruneRetention(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	old := time.Now().Add(-48 * time.Hour)
+	_, err := pool.Exec(ctx, `INSERT INTO etcd (ts, key, value, revision, tombstone) VALUES
+		($1, '/telemetry/a', '1', 1, false), ($1, '/telemetry/a', '2', 2, false), (now(), '/telemetry/a', '3', 3, false),
+		($1, '/telemetry/b', '1', 4, false), ($1, '/telemetry/b', NULL, 5, true),
+		($1, '/telemetry/c', '1', 6, false), ($1, '/telemetry/c', '2', 7, false),
+		($1, '/telemetry/keep/d', '1', 8, false), ($1, '/telemetry/keep/d', '2', 9, false)`, old)
+	require.NoError(t, err)
+
+	deleted, err := PruneRetention(ctx, pool, "/telemetry/", []string{"/telemetry/keep/"}, time.Now().Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), deleted)
+
+	rows, err := pool.Query(ctx, `SELECT key || '@' || revision FROM etcd ORDER BY key, revision`)
+	require.NoError(t, err)
+	remaining, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/telemetry/a@3", "/telemetry/c@7", "/telemetry/keep/d@8", "/telemetry/keep/d@9"}, remaining)
+
+	var compacted int64
+	require.NoError(t, pool.QueryRow(ctx, `SELECT revision FROM etcd_compaction`).Scan(&compacted))
+	assert.Equal(t, int64(7), compacted, "history of /telemetry/c is complete from revision 7")
+}
+
+// TestClaimPendingRecords claims unclaimed, own and timed out rows, leaving those of other live daemons alone
+func TestClaimPendingRecords(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	old := time.Now().Add(-time.Hour)
+	_, err := pool.Exec(ctx, `INSERT INTO etcd (key, value, revision, claimed_by, claimed_at) VALUES
+		('/claim/free', '1', -1, NULL, NULL), ('/claim/own', '2', -1, 'me', $1),
+		('/claim/live', '3', -1, 'other', now()), ('/claim/stale', '4', -1, 'crashed', $1)`, old)
+	require.NoError(t, err)
+
+	records, err := ClaimPendingRecords(ctx, pool, "etcd", "me")
+	require.NoError(t, err)
+	keys := make([]string, len(records))
+	for i, record := range records {
+		keys[i] = record.Key
+	}
+	assert.Equal(t, []string{"/claim/free", "/claim/own", "/claim/stale"}, keys)
+
+	var claimedBy string
+	var claimedAt time.Time
+	require.NoError(t, pool.QueryRow(ctx, `SELECT claimed_by FROM etcd WHERE key = '/claim/live'`).Scan(&claimedBy))
+	assert.Equal(t, "other", claimedBy)
+	require.NoError(t, pool.QueryRow(ctx, `SELECT claimed_at FROM etcd WHERE key = '/claim/own'`).Scan(&claimedAt))
+	assert.True(t, claimedAt.After(old), "own claims are renewed")
+
+	record, err := ClaimPendingRecord(ctx, pool, "etcd", "/claim/live", "me")
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+// TestQuarantineLargeKey quarantines a key too large for a btree index entry, twice without failing
+func TestQuarantineLargeKey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	// Hex of random bytes does not compress below the btree limit of about 2.7 KB
+	random := make([]byte, 4096)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	key := "/quarantine/" + hex.EncodeToString(random)
+
+	s := NewService(pool, nil, WithPrefix("/quarantine/"))
+	record := KeyValueRecord{Key: key, Value: "v", Revision: 10, Ts: time.Now()}
+	for range 2 {
+		valid, err := s.quarantineInvalid(ctx, pool, []KeyValueRecord{record})
+		require.NoError(t, err)
+		assert.Empty(t, valid)
+	}
+
+	var reason string
+	var count int
+	require.NoError(t, pool.QueryRow(ctx, `SELECT reason, count(*) OVER () FROM etcd_quarantine WHERE key = $1`,
+		[]byte(key)).Scan(&reason, &count))
+	assert.Equal(t, ReasonKeyTooLarge, reason)
+	assert.Equal(t, 1, count, "the redelivered record is quarantined once")
+}
+
+// TestRedactedValues stores the values of secret keys as their hash and keeps the hash of the value
+func TestRedactedValues(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	s := NewService(pool, nil, WithConfig(Config{Secrets: []SecretRule{{Pattern: "/secrets", Hash: true}}}))
+	_, err := s.applyRecords(ctx, pool, []KeyValueRecord{
+		{Key: "/secrets/token", Value: "hunter2", Revision: 2, Ts: time.Now()},
+		{Key: "/config/a", Value: "plain", Revision: 3, Ts: time.Now()},
+	})
+	require.NoError(t, err)
+
+	var value, current string
+	var hash []byte
+	var redacted bool
+	require.NoError(t, pool.QueryRow(ctx, `SELECT value, value_hash, etcd_is_redacted(key) FROM etcd WHERE key = '/secrets/token'`).
+		Scan(&value, &hash, &redacted))
+	require.NoError(t, pool.QueryRow(ctx, `SELECT value FROM etcd_current WHERE key = '/secrets/token'`).Scan(&current))
+	assert.Equal(t, hex.EncodeToString(valueHash("hunter2")), value)
+	assert.Equal(t, value, current, "etcd_decode returns the hash")
+	assert.Equal(t, valueHash("hunter2"), hash)
+	assert.True(t, redacted)
+	require.NoError(t, pool.QueryRow(ctx, `SELECT etcd_is_redacted('/config/a')`).Scan(&redacted))
+	assert.False(t, redacted)
+}
+
+// TestTimeTravel reads keys and prefixes as of a revision and a point in time
+func TestTimeTravel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	t1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2, t3 := t1.Add(time.Hour), t1.Add(2*time.Hour)
+	_, err := pool.Exec(ctx, `INSERT INTO etcd (ts, key, value, revision, tombstone) VALUES
+		($1, '/tt/a', '1', 1, false), ($1, '/tt/b', '1', 2, false),
+		($2, '/tt/a', '2', 3, false), ($2, '/tt/b', NULL, 4, true),
+		($3, '/tt/a', '3', 5, false), ($3, '/tt/c', '1', 6, false),
+		(now(), '/tt/a', 'pending', -1, false)`, t1, t2, t3)
+	require.NoError(t, err)
+
+	var value *string
+	var revision int64
+	var tombstone bool
+	require.NoError(t, pool.QueryRow(ctx, `SELECT value, revision, tombstone FROM etcd_get_at_revision('/tt/a', 4)`).
+		Scan(&value, &revision, &tombstone))
+	assert.Equal(t, "2", *value)
+	assert.Equal(t, int64(3), revision)
+	require.NoError(t, pool.QueryRow(ctx, `SELECT value, revision, tombstone FROM etcd_get_at('/tt/b', $1)`, t2.Add(time.Minute)).
+		Scan(&value, &revision, &tombstone))
+	assert.True(t, tombstone)
+	assert.Nil(t, value)
+	err = pool.QueryRow(ctx, `SELECT revision FROM etcd_get_at('/tt/c', $1)`, t2).Scan(&revision)
+	assert.ErrorIs(t, err, pgx.ErrNoRows, "key created later")
+
+	prefixAt := func(query string, arg any) []string {
+		rows, err := pool.Query(ctx, `SELECT key || '=' || value FROM `+query, arg)
+		require.NoError(t, err)
+		state, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		return state
+	}
+	assert.Equal(t, []string{"/tt/a=1", "/tt/b=1"}, prefixAt(`etcd_get_prefix_at_revision('/tt/', $1)`, int64(2)))
+	assert.Equal(t, []string{"/tt/a=2"}, prefixAt(`etcd_get_prefix_at('/tt/', $1)`, t2))
+	assert.Equal(t, []string{"/tt/a=3", "/tt/c=1"}, prefixAt(`etcd_get_prefix_at('/tt/', $1)`, time.Now()))
+}
+
+// TestImportSnapshot loads an etcd snapshot file and records its revision as checkpoint of the prefix
+func TestImportSnapshot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	pool, cleanup := setupSchemaVersion(ctx, t, migrations.LatestVersion())
+	defer cleanup()
+
+	path := writeSnapshot(t, 0,
+		mvccpb.KeyValue{Key: []byte("/import/a"), Value: []byte("1"), CreateRevision: 2, ModRevision: 2, Version: 1},
+		mvccpb.KeyValue{Key: []byte("/import/a"), Value: []byte("2"), CreateRevision: 2, ModRevision: 3, Version: 2},
+		mvccpb.KeyValue{Key: []byte("/other/b"), Value: []byte("3"), CreateRevision: 4, ModRevision: 4, Version: 1},
+		mvccpb.KeyValue{Key: []byte("/import/a"), ModRevision: 5},
+	)
+	s := NewService(pool, nil, WithConfig(Config{Prefixes: []string{"/import/"}}))
+	count, revision, err := s.ImportSnapshot(ctx, path, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, int64(5), revision)
+
+	rows, err := pool.Query(ctx, `SELECT revision FROM etcd WHERE key = '/import/a' ORDER BY revision`)
+	require.NoError(t, err)
+	revisions, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	require.NoError(t, err)
+	assert.Equal(t, []int64{2, 3, 5}, revisions)
+	checkpoint, err := GetSyncState(ctx, pool, "/import/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), checkpoint)
+
+	// Importing again is idempotent and keeps a newer checkpoint
+	require.NoError(t, SaveSyncState(ctx, pool, "/import/", 10))
+	_, _, err = s.ImportSnapshot(ctx, path, "")
+	require.NoError(t, err)
+	checkpoint, err = GetSyncState(ctx, pool, "/import/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), checkpoint)
+}
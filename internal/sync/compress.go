@@ -0,0 +1,78 @@
+package sync
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingZstd is the encoding of values stored as the base64 encoded zstd frame of the value, an empty
+// encoding is a plain value
+const EncodingZstd = "zstd"
+
+// zstd encoder and decoder shared by all services, both are safe for concurrent EncodeAll and DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// CompressValue returns the stored form of value and its encoding: the zstd encoding if value has at least
+// threshold bytes and compressing shrinks it, value itself otherwise. A threshold of 0 disables compression.
+func CompressValue(value string, threshold int) (stored, encoding string) {
+	if threshold <= 0 || len(value) < threshold {
+		return value, ""
+	}
+	compressed := base64.StdEncoding.EncodeToString(zstdEncoder.EncodeAll([]byte(value), nil))
+	if len(compressed) >= len(value) {
+		return value, ""
+	}
+	return compressed, EncodingZstd
+}
+
+// DecodeValue returns the value of a stored value with encoding, the inverse of CompressValue. Redacted values
+// are returned as their hash.
+func DecodeValue(stored, encoding string) (string, error) {
+	switch encoding {
+	case "", EncodingSHA256:
+		return stored, nil
+	case EncodingZstd:
+		frame, err := base64.StdEncoding.DecodeString(stored)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode zstd value: %w", err)
+		}
+		value, err := zstdDecoder.DecodeAll(frame, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress zstd value: %w", err)
+		}
+		return string(value), nil
+	default:
+		return "", fmt.Errorf("unknown value encoding %q", encoding)
+	}
+}
+
+// compressRecords returns records with the values of at least threshold bytes compressed together with the
+// hash of their plain value, records itself if none is
+func compressRecords(records []KeyValueRecord, threshold int) []KeyValueRecord {
+	if threshold <= 0 {
+		return records
+	}
+	var compressed []KeyValueRecord
+	for i, record := range records {
+		if record.Tombstone || record.Encoding != "" {
+			continue
+		}
+		stored, encoding := CompressValue(record.Value, threshold)
+		if encoding == "" {
+			continue
+		}
+		if compressed == nil {
+			compressed = append([]KeyValueRecord(nil), records...)
+		}
+		compressed[i].Value, compressed[i].Encoding, compressed[i].Hash = stored, encoding, valueHash(record.Value)
+	}
+	if compressed == nil {
+		return records
+	}
+	return compressed
+}
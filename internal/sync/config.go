@@ -3,14 +3,67 @@ package sync
 
 import (
 	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
 )
 
 // Config represents the main application configuration from command line
 type Config struct {
-	PostgresDSN     string
-	EtcdDSN         string
-	LogLevel        string
-	PollingInterval time.Duration
+	PostgresDSN       string
+	EtcdDSN           string
+	LogLevel          string
+	PollingInterval   time.Duration
+	CaptureMode       string        // CapturePoll or CaptureLogical
+	NotifyChannel     string        // channel notified for every applied etcd event, disabled if empty
+	StatementTimeout  time.Duration // deadline of a single PostgreSQL operation, disabled if zero
+	HistoryMode       string        // HistoryRetain or HistoryPrune
+	StorageMode       string        // StorageHistory or StorageLatest
+	IngestMode        string        // IngestBatch or IngestStaging, StorageHistory only
+	AuditInterval     time.Duration // interval of the revision gap audit, disabled if zero
+	AutoResync        AutoResync    // when differences found by the audit resynchronize a whole prefix
+	CompactInterval   time.Duration // interval of compacting etcd up to the persisted revision, disabled if zero
+	LagThreshold      time.Duration // replication lag logged as a warning, disabled if zero
+	HeartbeatInterval time.Duration // interval of writing the etcd_sync_heartbeat row, disabled if zero
+	BacklogAlert      BacklogAlert  // thresholds of the PostgreSQL backlog
+	MaxSyncAttempts   int           // failed pushes after which a pending row is marked failed, never if zero
+	ReadOnly          bool          // sync etcd to PostgreSQL only
+	Replicas          []*Replica    // secondary etcd clusters receiving the PostgreSQL changes
+	AuditLog          AuditLog      // sink recording every applied change, disabled if nil
+	Spill             *SpillQueue   // buffers watch events while PostgreSQL is unreachable, disabled if nil
+	RecentEvents      int           // number of applied changes and failures kept for Recent, 100 if zero
+	Version           string        // daemon version published in the instance liveness key
+
+	Prefixes               []string // etcd key prefixes to sync, the DSN prefix if empty
+	MetricPrefixes         []string // key prefixes metrics are broken down by, the synced prefixes if empty
+	InitialSyncConcurrency int      // maximum number of prefixes bootstrapped in parallel
+
+	Store     Store               // relational layout of the mirror, the built-in one of StorageMode if nil
+	OnApplied func(AuditLogEntry) // called for every applied change, must not block
+	OnFailure func(RecentFailure) // called for every change that could not be applied, must not block
+
+	Backend KVBackend // key-value store mirrored instead of the etcd client, e.g. a ConsulBackend
+
+	Direction        string           // DirectionBoth, DirectionEtcdToPg like ReadOnly or DirectionPgToEtcd
+	BatchSize        int              // pending changes pushed per etcd transaction, 128 if zero
+	ConflictStrategy string           // ConflictPostgreSQLWins or ConflictEtcdWins
+	Logger           log.Logger       // logger of the service messages, log.Default() if nil
+	Clock            func() time.Time // current time, time.Now if nil
+	Tenant           string           // schema of the tenant synced, labels the tenant metrics, see Tenant
+
+	CompressThreshold int      // values of at least this many bytes are stored zstd compressed, disabled if zero
+	ChunkPrefixes     []string // prefixes whose values exceeding the etcd request limit are chunked, see PutChunked
+
+	Dedup    bool            // changes of a key to its latest value move the revision of its row instead of adding one, history storage only
+	Decoders []PrefixDecoder // decoders storing facts of the values of prefixes in the facts column
+	KeyPath  bool            // maintain the key_path column of the etcd tables, enabled by the caller with SetKeyPath
+	Schemas  []KeySchema     // JSON Schemas of the values of prefixes, violations are rejected towards etcd and flagged from etcd
+
+	KeyPolicy   string // handling of keys that are no valid UTF-8 or too long: KeyPolicyQuarantine by default, KeyPolicyReject or KeyPolicyHex
+	MaxKeyBytes int    // longest key stored in the etcd table, MaxKeyBytes if zero, see CheckMaxKeyBytes
+
+	Retention []RetentionPolicy // age of the history kept per prefix, the longest matching prefix applies, history storage only
+
+	Secrets []SecretRule // keys whose values are masked in logs and failures, optionally stored as their hash
 }
 
 // KeyValueRecord represents a unified key-value record used throughout the system
@@ -21,4 +74,17 @@ type KeyValueRecord struct {
 	Revision  int64  // -1 for pending sync to etcd, >0 for real etcd revision
 	Ts        time.Time
 	Tombstone bool
+	// etcd key metadata, zero for pending records
+	CreateRevision int64 // revision of the key's creation, changes when a deleted key is re-created
+	Version        int64 // number of modifications since creation
+	Lease          int64 // ID of the lease attached to the key, 0 if none
+	// ExpectedRevision is the etcd mod revision a pending change created by etcd_cas() requires, nil if unconditional
+	ExpectedRevision *int64
+	// Encoding of Value as stored in PostgreSQL, EncodingZstd for compressed values, EncodingSHA256 for
+	// redacted ones, empty for plain ones
+	Encoding string
+	// Hash is the SHA-256 of the plain value of compressed values, PostgreSQL hashes plain values itself
+	Hash []byte
+	// Facts are the JSON encoded facts of the value extracted by Config.Decoders, nil if none
+	Facts []byte
 }
@@ -0,0 +1,73 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Conflict strategies for pending changes of keys changed in etcd after the change was written to
+// PostgreSQL, see WithConflictStrategy
+const (
+	ConflictPostgreSQLWins = "postgresql_wins" // pending changes overwrite etcd
+	ConflictEtcdWins       = "etcd_wins"       // pending changes are discarded and reported like a rejected etcd_cas()
+)
+
+// BaseRevisions returns the etcd mod revision every pending record was written on top of: the latest
+// revision of its key mirrored before the record, 0 if the key did not exist. History storage only.
+func BaseRevisions(ctx context.Context, db PgxIface, records []KeyValueRecord) (map[string]int64, error) {
+	keys := make([]string, len(records))
+	times := make([]time.Time, len(records))
+	for i, record := range records {
+		keys[i], times[i] = record.Key, record.Ts
+	}
+	query := `SELECT p.key, coalesce(b.revision, 0)
+		FROM unnest($1::text[], $2::timestamptz[]) AS p(key, ts)
+		LEFT JOIN LATERAL (
+			SELECT CASE WHEN e.tombstone THEN 0 ELSE e.revision END AS revision
+			FROM etcd e
+			WHERE e.key = p.key AND e.revision > 0 AND e.ts <= p.ts
+			ORDER BY e.revision DESC
+			LIMIT 1
+		) b ON true`
+	rows, err := db.Query(ctx, query, keys, times)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get base revisions: %w", err)
+	}
+	revisions := make(map[string]int64, len(records))
+	var key string
+	var revision int64
+	_, err = pgx.ForEachRow(rows, []any{&key, &revision}, func() error {
+		revisions[key] = revision
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get base revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+// pinBaseRevisions makes the unconditional records conditional on their base revision with ConflictEtcdWins,
+// so etcd rejects them if the key changed meanwhile
+func (s *Service) pinBaseRevisions(ctx context.Context, records []KeyValueRecord) error {
+	if s.conflictStrategy != ConflictEtcdWins || len(records) == 0 {
+		return nil
+	}
+	var revisions map[string]int64
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		revisions, err = BaseRevisions(ctx, s.pgPool, records)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		if records[i].ExpectedRevision == nil {
+			revision := revisions[records[i].Key]
+			records[i].ExpectedRevision = &revision
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// consulWaitTime bounds a blocking query of the Consul watch
+const consulWaitTime = 5 * time.Minute
+
+// consulRetryDelay is the pause of the Consul watch after a failed query
+const consulRetryDelay = time.Second
+
+// ConsulBackend implements KVBackend by the Consul KV store. Consul keeps no history, the watch compares
+// the listings of blocking queries: changed keys carry their modify index, deleted keys the index of the
+// listing that misses them.
+type ConsulBackend struct {
+	kv     *consul.KV
+	prefix string
+
+	mu        sync.Mutex
+	snapshots map[string]consulSnapshot // listing of the last Range by prefix, the baseline of Watch
+}
+
+// consulSnapshot is a listing of a prefix, the modify index by key at index
+type consulSnapshot struct {
+	index uint64
+	keys  map[string]uint64
+}
+
+// NewConsulBackend connects to the Consul agent of dsn, e.g. consul://localhost:8500/config/?token=secret.
+// The scheme consuls uses HTTPS, the path is the key prefix without leading slash and the parameters token
+// and datacenter are optional. Unset settings are taken from the CONSUL_HTTP_* environment variables.
+func NewConsulBackend(dsn string) (*ConsulBackend, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Consul DSN: %w", err)
+	}
+	config := consul.DefaultConfig()
+	switch u.Scheme {
+	case "consul":
+		config.Scheme = "http"
+	case "consuls":
+		config.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("invalid Consul DSN: unsupported scheme %q, use consul:// or consuls://", u.Scheme)
+	}
+	if u.Host != "" {
+		config.Address = u.Host
+	}
+	if token := u.Query().Get("token"); token != "" {
+		config.Token = token
+	}
+	if datacenter := u.Query().Get("datacenter"); datacenter != "" {
+		config.Datacenter = datacenter
+	}
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %w", err)
+	}
+	return &ConsulBackend{
+		kv:        client.KV(),
+		prefix:    strings.TrimPrefix(u.Path, "/"),
+		snapshots: make(map[string]consulSnapshot),
+	}, nil
+}
+
+// Prefix returns the key prefix of the DSN
+func (c *ConsulBackend) Prefix() string {
+	return c.prefix
+}
+
+// consulRecord converts a Consul key-value pair
+func consulRecord(pair *consul.KVPair) KeyValueRecord {
+	return KeyValueRecord{
+		Key:            pair.Key,
+		Value:          string(pair.Value),
+		Revision:       int64(pair.ModifyIndex),
+		CreateRevision: int64(pair.CreateIndex),
+	}
+}
+
+// list returns the keys below prefix, blocking until the index of the prefix exceeds waitIndex unless zero
+func (c *ConsulBackend) list(ctx context.Context, prefix string, waitIndex uint64) (consul.KVPairs, uint64, error) {
+	options := &consul.QueryOptions{WaitIndex: waitIndex, WaitTime: consulWaitTime}
+	pairs, meta, err := c.kv.List(prefix, options.WithContext(ctx))
+	if err != nil {
+		return nil, 0, &ConnectionError{Err: fmt.Errorf("failed to list Consul keys: %w", err)}
+	}
+	return pairs, meta.LastIndex, nil
+}
+
+func (c *ConsulBackend) Range(ctx context.Context, prefix string) ([]KeyValueRecord, int64, error) {
+	pairs, index, err := c.list(ctx, prefix, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]KeyValueRecord, len(pairs))
+	snapshot := consulSnapshot{index: index, keys: make(map[string]uint64, len(pairs))}
+	for i, pair := range pairs {
+		records[i] = consulRecord(pair)
+		snapshot.keys[pair.Key] = pair.ModifyIndex
+	}
+	c.mu.Lock()
+	c.snapshots[prefix] = snapshot
+	c.mu.Unlock()
+	return records, int64(index), nil
+}
+
+// Watch continues from the listing of the last Range of prefix if it was taken at revision. Otherwise the
+// keys are listed again, changes after revision are reported but keys deleted before are not.
+func (c *ConsulBackend) Watch(ctx context.Context, prefix string, revision int64) <-chan KVWatchResponse {
+	responses := make(chan KVWatchResponse)
+	go func() {
+		defer close(responses)
+		send := func(response KVWatchResponse) bool {
+			select {
+			case responses <- response:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		c.mu.Lock()
+		snapshot, ok := c.snapshots[prefix]
+		delete(c.snapshots, prefix)
+		c.mu.Unlock()
+		if !ok || snapshot.index != uint64(revision) {
+			snapshot = consulSnapshot{index: uint64(revision)}
+		}
+
+		for ctx.Err() == nil {
+			if snapshot.keys == nil {
+				pairs, index, err := c.list(ctx, prefix, 0)
+				if err != nil {
+					if !send(KVWatchResponse{Err: err}) {
+						return
+					}
+					sleepCtx(ctx, consulRetryDelay)
+					continue
+				}
+				current := consulSnapshot{index: index, keys: make(map[string]uint64, len(pairs))}
+				for _, pair := range pairs {
+					current.keys[pair.Key] = pair.ModifyIndex
+				}
+				if changes := consulChanges(snapshot, current, pairs); len(changes) > 0 && !send(KVWatchResponse{Records: changes, Revision: int64(index)}) {
+					return
+				}
+				snapshot = current
+				continue
+			}
+
+			pairs, index, err := c.list(ctx, prefix, snapshot.index)
+			if err != nil {
+				if ctx.Err() == nil && !send(KVWatchResponse{Err: err}) {
+					return
+				}
+				sleepCtx(ctx, consulRetryDelay)
+				continue
+			}
+			if index < snapshot.index {
+				// The index went backwards, e.g. after a restore, compare with a fresh listing
+				log.Default().WithField("prefix", prefix).Warn("Consul index went backwards, listing keys again")
+				snapshot = consulSnapshot{index: index}
+				continue
+			}
+			if index == snapshot.index {
+				continue // wait time elapsed without changes
+			}
+			current := consulSnapshot{index: index, keys: make(map[string]uint64, len(pairs))}
+			for _, pair := range pairs {
+				current.keys[pair.Key] = pair.ModifyIndex
+			}
+			if !send(KVWatchResponse{Records: consulChanges(snapshot, current, pairs), Revision: int64(index)}) {
+				return
+			}
+			snapshot = current
+		}
+	}()
+	return responses
+}
+
+// consulChanges returns the changes between two listings in index order, pairs are the keys of current.
+// Without keys, previous is only the index changes are reported after and no deletions are known.
+func consulChanges(previous, current consulSnapshot, pairs consul.KVPairs) []KeyValueRecord {
+	var changes []KeyValueRecord
+	for _, pair := range pairs {
+		index, known := previous.keys[pair.Key]
+		if pair.ModifyIndex > previous.index || (previous.keys != nil && (!known || index != pair.ModifyIndex)) {
+			changes = append(changes, consulRecord(pair))
+		}
+	}
+	slices.SortStableFunc(changes, func(a, b KeyValueRecord) int { return int(a.Revision - b.Revision) })
+	var deleted []string
+	for key := range previous.keys {
+		if _, ok := current.keys[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	slices.Sort(deleted)
+	for _, key := range deleted {
+		changes = append(changes, KeyValueRecord{Key: key, Revision: int64(current.index), Tombstone: true})
+	}
+	return changes
+}
+
+func (c *ConsulBackend) Put(ctx context.Context, key, value string) (int64, error) {
+	return c.Txn(ctx, []KeyValueRecord{{Key: key, Value: value}})
+}
+
+func (c *ConsulBackend) Delete(ctx context.Context, key string) (int64, error) {
+	return c.Txn(ctx, []KeyValueRecord{{Key: key, Tombstone: true}})
+}
+
+// Txn applies the records in a Consul transaction. Consul returns no index for deletions, a transaction
+// of deletions only returns 0.
+func (c *ConsulBackend) Txn(ctx context.Context, records []KeyValueRecord) (int64, error) {
+	ops := make(consul.KVTxnOps, len(records))
+	for i, record := range records {
+		op := &consul.KVTxnOp{Verb: consul.KVSet, Key: record.Key, Value: []byte(record.Value)}
+		if record.Tombstone {
+			op.Verb = consul.KVDelete
+		}
+		if record.ExpectedRevision != nil {
+			op.Index = uint64(*record.ExpectedRevision)
+			op.Verb = consul.KVCAS
+			if record.Tombstone {
+				op.Verb = consul.KVDeleteCAS
+			}
+		}
+		ops[i] = op
+	}
+
+	ok, resp, _, err := c.kv.Txn(ops, (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return 0, &ConnectionError{Err: fmt.Errorf("failed to apply Consul transaction: %w", err)}
+	}
+	if !ok {
+		messages := make([]string, len(resp.Errors))
+		for i, txnErr := range resp.Errors {
+			messages[i] = txnErr.What
+		}
+		return 0, fmt.Errorf("%w: %s", errTxnRejected, strings.Join(messages, ", "))
+	}
+
+	var index uint64
+	for _, pair := range resp.Results {
+		index = max(index, pair.ModifyIndex)
+	}
+	return int64(index), nil
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,19 @@
+package sync_test
+
+import (
+	"testing"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+	"github.com/cybertec-postgresql/pg_etcd/pkg/pgetcdtest"
+)
+
+func init() {
+	sync.StartPostgreSQL = func(t testing.TB) string {
+		dsn, _ := pgetcdtest.StartPostgreSQL(t, pgetcdtest.WithoutMigrations())
+		return dsn
+	}
+	sync.StartEtcd = func(t testing.TB, env map[string]string) string {
+		_, client := pgetcdtest.StartEtcd(t, pgetcdtest.WithEtcdEnv(env))
+		return client.Endpoints()[0]
+	}
+}
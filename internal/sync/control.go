@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownPrefix is returned for prefixes the service doesn't synchronize
+var ErrUnknownPrefix = errors.New("prefix is not synchronized")
+
+// pauseState holds whether the synchronization is paused by an operator, the zero value is running
+type pauseState struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed on resume, nil while running
+}
+
+func (p *pauseState) paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// wait blocks while the synchronization is paused
+func (p *pauseState) wait(ctx context.Context) error {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause stops the propagation in both directions until Resume is called, e.g. during a maintenance window.
+// Pending PostgreSQL rows stay pending and etcd events are watched again from the last applied revision.
+func (s *Service) Pause() {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+	if s.pause.resumed == nil {
+		s.pause.resumed = make(chan struct{})
+		s.logger().Warn("Synchronization paused")
+	}
+}
+
+// Resume continues the synchronization stopped by Pause
+func (s *Service) Resume() {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+	if s.pause.resumed != nil {
+		close(s.pause.resumed)
+		s.pause.resumed = nil
+		s.logger().Info("Synchronization resumed")
+	}
+}
+
+// Paused reports whether the synchronization is paused by an operator
+func (s *Service) Paused() bool {
+	return s.pause.paused()
+}
+
+// Resync requests a full reconciliation of prefix with etcd, all prefixes if empty. The watcher of the prefix
+// copies the current etcd state, removes keys deleted meanwhile and watches again from the new snapshot.
+func (s *Service) Resync(prefix string) error {
+	prefixes := s.prefixes
+	if prefix != "" {
+		prefixes = []string{prefix}
+	}
+	for _, prefix := range prefixes {
+		requests, ok := s.resync[prefix]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownPrefix, prefix)
+		}
+		select {
+		case requests <- struct{}{}:
+			s.logger().WithField("prefix", prefix).Info("Resynchronization requested")
+		default: // already requested
+		}
+	}
+	return nil
+}
+
+// PrefixCheckpoint is the synchronization progress of a prefix
+type PrefixCheckpoint struct {
+	Prefix          string `json:"prefix"`
+	StoredRevision  int64  `json:"stored_revision"`  // persisted in PostgreSQL, a restart resumes from it
+	AppliedRevision int64  `json:"applied_revision"` // applied by the running watcher
+}
+
+// Checkpoints returns the synchronization progress of every prefix
+func (s *Service) Checkpoints(ctx context.Context) ([]PrefixCheckpoint, error) {
+	checkpoints := make([]PrefixCheckpoint, 0, len(s.prefixes))
+	for _, prefix := range s.prefixes {
+		var stored int64
+		err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+			stored, err = s.store.LoadCheckpoint(ctx, s.pgPool, prefix)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, PrefixCheckpoint{
+			Prefix:          prefix,
+			StoredRevision:  stored,
+			AppliedRevision: s.lag.appliedRevision(prefix),
+		})
+	}
+	return checkpoints, nil
+}
@@ -0,0 +1,91 @@
+package sync
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// correlationHeader is the gRPC metadata carrying the correlation id of etcd requests
+const correlationHeader = "x-pg-etcd-trace-id"
+
+// correlate starts a batch identified by a new correlation id in ctx. Log entries written WithContext(ctx)
+// carry it as trace_id, PostgreSQL statements as a leading comment and etcd requests as gRPC metadata.
+func correlate(ctx context.Context) context.Context {
+	id := log.NewCorrelationID()
+	ctx = log.WithCorrelationID(ctx, id)
+	return metadata.AppendToOutgoingContext(ctx, correlationHeader, id)
+}
+
+// correlationComment prefixes sql with the correlation id of ctx, visible in pg_stat_activity and the
+// PostgreSQL log. Statements without id or already commented are returned unchanged.
+func correlationComment(ctx context.Context, sql string) string {
+	id := log.CorrelationID(ctx)
+	if id == "" || strings.HasPrefix(sql, "/* trace_id=") {
+		return sql
+	}
+	return "/* trace_id=" + id + " */ " + sql
+}
+
+// correlatedPool comments the statements of correlated batches with their id
+type correlatedPool struct {
+	PgxIface
+}
+
+func (p correlatedPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := p.PgxIface.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return correlatedTx{tx}, nil
+}
+
+func (p correlatedPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return p.PgxIface.Exec(ctx, correlationComment(ctx, sql), args...)
+}
+
+func (p correlatedPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return p.PgxIface.QueryRow(ctx, correlationComment(ctx, sql), args...)
+}
+
+func (p correlatedPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return p.PgxIface.Query(ctx, correlationComment(ctx, sql), args...)
+}
+
+func (p correlatedPool) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	commentBatch(ctx, b)
+	return p.PgxIface.SendBatch(ctx, b)
+}
+
+// correlatedTx comments the statements of a transaction of a correlated batch
+type correlatedTx struct {
+	pgx.Tx
+}
+
+func (tx correlatedTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return tx.Tx.Exec(ctx, correlationComment(ctx, sql), args...)
+}
+
+func (tx correlatedTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return tx.Tx.QueryRow(ctx, correlationComment(ctx, sql), args...)
+}
+
+func (tx correlatedTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return tx.Tx.Query(ctx, correlationComment(ctx, sql), args...)
+}
+
+func (tx correlatedTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	commentBatch(ctx, b)
+	return tx.Tx.SendBatch(ctx, b)
+}
+
+func commentBatch(ctx context.Context, b *pgx.Batch) {
+	for _, query := range b.QueuedQueries {
+		query.SQL = correlationComment(ctx, query.SQL)
+	}
+}
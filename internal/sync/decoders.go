@@ -0,0 +1,356 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/yaml.v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// ValueDecoder extracts structured facts from the values of a prefix, they are stored as JSON in the facts
+// column next to the value when syncing etcd to PostgreSQL, see Config.Decoders
+type ValueDecoder interface {
+	// Decode returns the facts of the value of key, nil to store none
+	Decode(key, value string) (map[string]any, error)
+}
+
+// DecoderFunc adapts a function to a ValueDecoder
+type DecoderFunc func(key, value string) (map[string]any, error)
+
+// Decode calls f(key, value)
+func (f DecoderFunc) Decode(key, value string) (map[string]any, error) {
+	return f(key, value)
+}
+
+// PrefixDecoder decodes the values of the keys below Prefix. Fields are the dot separated paths of the facts
+// stored, e.g. metadata.name, all facts if empty.
+type PrefixDecoder struct {
+	Prefix  string
+	Decoder ValueDecoder
+	Fields  []string
+}
+
+// Built-in decoders by the name used in --decoder
+var builtinDecoders = map[string]ValueDecoder{
+	"json":       DecoderFunc(decodeJSON),
+	"yaml":       DecoderFunc(decodeYAML),
+	"patroni":    DecoderFunc(decodePatroni),
+	"kubernetes": DecoderFunc(decodeKubernetes),
+}
+
+// BuiltinDecoder returns the built-in decoder of name: json, yaml, patroni or kubernetes
+func BuiltinDecoder(name string) (ValueDecoder, error) {
+	decoder, ok := builtinDecoders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown decoder %q, expected json, yaml, patroni or kubernetes", name)
+	}
+	return decoder, nil
+}
+
+// ParseDecoder parses a PREFIX=DECODER[:FIELD,...] specification of a built-in decoder
+func ParseDecoder(spec string) (PrefixDecoder, error) {
+	prefix, rest, ok := strings.Cut(spec, "=")
+	if !ok || prefix == "" || rest == "" {
+		return PrefixDecoder{}, fmt.Errorf("invalid decoder %q, expected PREFIX=DECODER[:FIELD,...]", spec)
+	}
+	name, fields, _ := strings.Cut(rest, ":")
+	decoder, err := BuiltinDecoder(name)
+	if err != nil {
+		return PrefixDecoder{}, err
+	}
+	pd := PrefixDecoder{Prefix: prefix, Decoder: decoder}
+	if fields != "" {
+		pd.Fields = strings.Split(fields, ",")
+	}
+	return pd, nil
+}
+
+// decodeFacts returns the facts of a value as JSON for the decoder of the longest prefix of key, nil if no
+// decoder applies or it found none
+func decodeFacts(decoders []PrefixDecoder, key, value string) ([]byte, error) {
+	var match *PrefixDecoder
+	for i, decoder := range decoders {
+		if strings.HasPrefix(key, decoder.Prefix) && (match == nil || len(decoder.Prefix) > len(match.Prefix)) {
+			match = &decoders[i]
+		}
+	}
+	if match == nil {
+		return nil, nil
+	}
+	facts, err := match.Decoder.Decode(key, value)
+	if err != nil || facts == nil {
+		return nil, err
+	}
+	if len(match.Fields) > 0 {
+		facts = selectFields(facts, match.Fields)
+	}
+	encoded, err := json.Marshal(facts)
+	if err != nil {
+		return nil, err
+	}
+	if !validFacts(encoded) {
+		return nil, errors.New("facts contain NUL characters")
+	}
+	return encoded, nil
+}
+
+// selectFields returns the facts at the dot separated paths fields, keyed by the path
+func selectFields(facts map[string]any, fields []string) map[string]any {
+	selected := make(map[string]any, len(fields))
+	for _, field := range fields {
+		var current any = facts
+		for _, name := range strings.Split(field, ".") {
+			object, ok := current.(map[string]any)
+			if !ok {
+				current = nil
+				break
+			}
+			current = object[name]
+		}
+		if current != nil {
+			selected[field] = current
+		}
+	}
+	return selected
+}
+
+// decodeRecords stores the facts of the values of records decoded by Config.Decoders in the records.
+// Values that fail to decode are mirrored without facts.
+func (s *Service) decodeRecords(ctx context.Context, records []KeyValueRecord) {
+	if len(s.decoders) == 0 {
+		return
+	}
+	for i, record := range records {
+		// Facts of values stored as their hash would reveal them
+		if _, hash := s.secret(record.Key); record.Tombstone || hash {
+			continue
+		}
+		facts, err := decodeFacts(s.decoders, record.Key, record.Value)
+		if err != nil {
+			s.logger().WithContext(ctx).WithError(s.redactError(record.Key, err)).WithFields(log.Fields{
+				log.FieldKey:      record.Key,
+				log.FieldRevision: record.Revision,
+			}).Warn("Failed to decode value, mirroring it without facts")
+			continue
+		}
+		records[i].Facts = facts
+	}
+}
+
+// objectFacts returns a decoded JSON or YAML document as facts, documents other than objects as value
+func objectFacts(document any) map[string]any {
+	if object, ok := document.(map[string]any); ok {
+		return object
+	}
+	return map[string]any{"value": document}
+}
+
+// decodeJSON decodes JSON values, numbers keep their precision
+func decodeJSON(_, value string) (map[string]any, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return objectFacts(document), nil
+}
+
+// decodeYAML decodes YAML values, mappings with other than string keys are rejected
+func decodeYAML(_, value string) (map[string]any, error) {
+	var document any
+	if err := yaml.Unmarshal([]byte(value), &document); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+	if document == nil {
+		return nil, nil
+	}
+	return objectFacts(document), nil
+}
+
+// decodePatroni decodes the keys of a Patroni cluster: the member name of leader, the system ID of
+// initialize, the JSON state of members/<name> with the member name and the other keys as JSON
+func decodePatroni(key, value string) (map[string]any, error) {
+	name := path.Base(key)
+	switch {
+	case name == "leader" && !strings.HasSuffix(key, "/optime/leader"):
+		return map[string]any{"leader": value}, nil
+	case name == "initialize":
+		return map[string]any{"sysid": value}, nil
+	}
+	facts, err := decodeJSON(key, value)
+	if err != nil {
+		// Patroni writes some keys as plain strings
+		facts = map[string]any{"value": value}
+	}
+	if path.Base(path.Dir(key)) == "members" {
+		facts["member"] = name
+	}
+	return facts, nil
+}
+
+// kubernetesMagic starts the protobuf encoding of Kubernetes objects in etcd
+const kubernetesMagic = "k8s\x00"
+
+// errProtobuf is returned for malformed Kubernetes protobuf values
+var errProtobuf = errors.New("malformed Kubernetes protobuf value")
+
+// decodeKubernetes decodes the Kubernetes objects of the API server registry. Objects stored as JSON, e.g.
+// custom resources, are decoded whole, protobuf objects into apiVersion, kind and the common metadata.
+// Protobuf values are not valid text, they are mirrored into etcd_quarantine together with their facts.
+func decodeKubernetes(key, value string) (map[string]any, error) {
+	envelope, ok := strings.CutPrefix(value, kubernetesMagic)
+	if !ok {
+		return decodeJSON(key, value)
+	}
+
+	// runtime.Unknown: typeMeta = 1 (apiVersion = 1, kind = 2), raw = 2
+	facts := map[string]any{}
+	var raw []byte
+	err := protoFields([]byte(envelope), func(num protowire.Number, data []byte) error {
+		switch num {
+		case 1:
+			return protoFields(data, func(num protowire.Number, data []byte) error {
+				switch num {
+				case 1:
+					facts["apiVersion"] = string(data)
+				case 2:
+					facts["kind"] = string(data)
+				}
+				return nil
+			})
+		case 2:
+			raw = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Every object has its ObjectMeta in field 1
+	metadata := map[string]any{}
+	err = protoFields(raw, func(num protowire.Number, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+		labels, annotations := map[string]any{}, map[string]any{}
+		err := protoFields(data, func(num protowire.Number, data []byte) error {
+			switch num {
+			case 1:
+				metadata["name"] = string(data)
+			case 3:
+				metadata["namespace"] = string(data)
+			case 5:
+				metadata["uid"] = string(data)
+			case 6:
+				metadata["resourceVersion"] = string(data)
+			case 8:
+				ts, err := protoTime(data)
+				if err != nil {
+					return err
+				}
+				metadata["creationTimestamp"] = ts
+			case 11, 12:
+				entries := labels
+				if num == 12 {
+					entries = annotations
+				}
+				var k, v string
+				err := protoFields(data, func(num protowire.Number, data []byte) error {
+					if num == 1 {
+						k = string(data)
+					} else if num == 2 {
+						v = string(data)
+					}
+					return nil
+				})
+				entries[k] = v
+				return err
+			}
+			return nil
+		})
+		if len(labels) > 0 {
+			metadata["labels"] = labels
+		}
+		if len(annotations) > 0 {
+			metadata["annotations"] = annotations
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	facts["metadata"] = metadata
+	return facts, nil
+}
+
+// protoFields calls fn with the number and content of every length-delimited field of a protobuf message,
+// other fields are skipped
+func protoFields(message []byte, fn func(num protowire.Number, data []byte) error) error {
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return errProtobuf
+		}
+		message = message[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, message)
+			if n < 0 {
+				return errProtobuf
+			}
+			message = message[n:]
+			continue
+		}
+		data, n := protowire.ConsumeBytes(message)
+		if n < 0 {
+			return errProtobuf
+		}
+		message = message[n:]
+		if err := fn(num, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoTime decodes a Kubernetes Time message (seconds = 1, nanos = 2) in RFC 3339 format
+func protoTime(message []byte) (string, error) {
+	var seconds int64
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return "", errProtobuf
+		}
+		message = message[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(message)
+			if n < 0 {
+				return "", errProtobuf
+			}
+			seconds = int64(v)
+			message = message[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, message)
+		if n < 0 {
+			return "", errProtobuf
+		}
+		message = message[n:]
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339), nil
+}
+
+// validFacts reports whether facts can be stored in a jsonb column, which rejects NUL characters
+func validFacts(facts []byte) bool {
+	return !bytes.Contains(facts, []byte(`\u0000`))
+}
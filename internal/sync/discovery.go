@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// etcd DSN schemes
+const (
+	// SchemeEtcd connects to the listed endpoints, TLS is enabled by DSN parameters
+	SchemeEtcd = "etcd"
+	// SchemeEtcdHTTPS connects to the listed endpoints with TLS
+	SchemeEtcdHTTPS = "etcd+https"
+	// SchemeEtcdSRV discovers the endpoints from DNS SRV records of the domain given as host
+	SchemeEtcdSRV = "etcd+srv"
+)
+
+// lookupSRV resolves SRV records, replaced in tests
+var lookupSRV = net.LookupSRV
+
+// isEtcdDSN reports whether dsn uses one of the supported schemes
+func isEtcdDSN(dsn string) bool {
+	for _, scheme := range []string{SchemeEtcd, SchemeEtcdHTTPS, SchemeEtcdSRV} {
+		if strings.HasPrefix(dsn, scheme+"://") {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverSRV returns the client endpoints of domain like etcdctl --discovery-srv: the records of
+// _etcd-client-ssl._tcp.<domain> are used with TLS, otherwise those of _etcd-client._tcp.<domain>.
+// serviceName selects the _etcd-client-ssl-<name> and _etcd-client-<name> services instead.
+func discoverSRV(domain, serviceName string) (endpoints []string, secure bool, err error) {
+	suffix := ""
+	if serviceName != "" {
+		suffix = "-" + serviceName
+	}
+
+	endpoints, errHTTPS := lookupEndpoints("etcd-client-ssl"+suffix, domain)
+	if errHTTPS == nil && len(endpoints) > 0 {
+		return endpoints, true, nil
+	}
+	endpoints, errHTTP := lookupEndpoints("etcd-client"+suffix, domain)
+	if errHTTP == nil && len(endpoints) > 0 {
+		return endpoints, false, nil
+	}
+	return nil, false, fmt.Errorf("no etcd SRV records found for %s: %v, %v", domain, errHTTPS, errHTTP)
+}
+
+// lookupEndpoints resolves the SRV records of service to host:port endpoints
+func lookupEndpoints(service, domain string) ([]string, error) {
+	_, records, err := lookupSRV(service, "tcp", domain)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, len(records))
+	for i, record := range records {
+		// Without the trailing dot of the DNS name, so it matches the server certificate
+		endpoints[i] = net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+	}
+	return endpoints, nil
+}
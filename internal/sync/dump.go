@@ -0,0 +1,45 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// HistoryRow is one revision of a key in the history dumped by DumpHistory, Value is empty for deletions
+type HistoryRow struct {
+	Ts        time.Time `json:"ts" parquet:"ts,timestamp(microsecond)"`
+	Key       string    `json:"key" parquet:"key,dict"`
+	Value     string    `json:"value" parquet:"value,zstd"`
+	Revision  int64     `json:"revision" parquet:"revision,delta"`
+	Tombstone bool      `json:"tombstone" parquet:"tombstone"`
+}
+
+// DumpHistory calls fn with every mirrored revision of the keys below prefix after fromRevision, ordered by key
+// and revision. Rows are streamed from a single query, so the history is read once without being held in memory.
+// Pending rows are left out, compressed values are decoded.
+func DumpHistory(ctx context.Context, db PgxIface, prefix string, fromRevision int64, fn func(HistoryRow) error) error {
+	rows, err := db.Query(ctx, `SELECT ts, key, coalesce(value, ''), coalesce(encoding, ''), revision, tombstone
+		FROM etcd
+		WHERE starts_with(key, $1) AND revision > $2
+		ORDER BY key, revision`, prefix, max(fromRevision, 0))
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+	var row HistoryRow
+	var encoding string
+	_, err = pgx.ForEachRow(rows, []any{&row.Ts, &row.Key, &row.Value, &encoding, &row.Revision, &row.Tombstone}, func() error {
+		value, err := DecodeValue(row.Value, encoding)
+		if err != nil {
+			return fmt.Errorf("failed to decode value of %s at revision %d: %w", row.Key, row.Revision, err)
+		}
+		row.Value = value
+		return fn(row)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+	return nil
+}
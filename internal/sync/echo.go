@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// maxOwnWrites bounds the writes remembered until their watch event arrives, beyond it they are forgotten
+// and their events mirrored like foreign changes
+const maxOwnWrites = 10000
+
+// ownWrites remembers the revision the daemon last pushed per key, so the watch event it causes is
+// recognized as an echo instead of a new change
+type ownWrites struct {
+	mu        sync.Mutex
+	revisions map[string]int64
+}
+
+func newOwnWrites() *ownWrites {
+	return &ownWrites{revisions: make(map[string]int64)}
+}
+
+// add remembers that the daemon wrote key at revision, a nil ownWrites remembers nothing
+func (w *ownWrites) add(key string, revision int64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.revisions) >= maxOwnWrites {
+		clear(w.revisions)
+	}
+	w.revisions[key] = revision
+}
+
+// take reports whether the daemon wrote key at revision and forgets it
+func (w *ownWrites) take(key string, revision int64) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.revisions[key] != revision {
+		return false
+	}
+	delete(w.revisions, key)
+	return true
+}
+
+// UpdateMetadata stores the etcd key metadata of a watch event in the row of its key and revision in table,
+// it reports false if there is no such row
+func UpdateMetadata(ctx context.Context, pool PgxIface, table string, record KeyValueRecord) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET create_revision = $3, version = $4, lease = $5
+		WHERE key = $1 AND revision = $2`, table)
+
+	result, err := pool.Exec(ctx, query, record.Key, record.Revision, record.CreateRevision, record.Version, record.Lease)
+	if err != nil {
+		return false, fmt.Errorf("failed to update key metadata: %w", err)
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// ackPending stores the etcd revision of a pushed record. Its watch event may have been mirrored first,
+// then the pending row is a duplicate of the mirrored row and discarded.
+func (s *Service) ackPending(ctx context.Context, record KeyValueRecord, revision int64) error {
+	return s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		err := s.store.MarkSynced(ctx, s.pgPool, record, revision)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return s.store.DiscardPending(ctx, s.pgPool, record.Key)
+		}
+		return err
+	})
+}
+
+// applyEcho completes the row of a change the daemon pushed itself with the metadata of its watch event,
+// without notifying, auditing or counting it a second time. It reports false if the pushed row isn't
+// acknowledged yet, the event is then mirrored like any other.
+func (s *Service) applyEcho(ctx context.Context, db PgxIface, record KeyValueRecord) (bool, error) {
+	updated, err := s.store.UpdateMetadata(ctx, db, record)
+	if err != nil || !updated {
+		return false, err
+	}
+	s.logger().WithContext(ctx).WithFields(log.Fields{
+		log.FieldDirection: log.DirectionEtcdToPg,
+		log.FieldKey:       record.Key,
+		log.FieldRevision:  record.Revision,
+	}).Debug("Skipped echo of a change pushed by this daemon")
+	return true, nil
+}
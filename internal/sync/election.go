@@ -0,0 +1,97 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// electionPrefix is the etcd key prefix of the leader elections, these keys are never mirrored
+const electionPrefix = "/pg_etcd/election/"
+
+// ElectionStatus describes the leadership of the instance
+type ElectionStatus struct {
+	Key      string `json:"key"`
+	Identity string `json:"identity"`
+	Leader   bool   `json:"leader"`
+}
+
+// Election elects a single active instance among daemons syncing the same prefixes.
+// The leadership is bound to an etcd lease, standbys take over within the session TTL once it expires.
+type Election struct {
+	session  *concurrency.Session
+	election *concurrency.Election
+	key      string
+	identity string
+	leader   atomic.Bool
+}
+
+// NewElection creates a session with the given TTL for the election identified by name
+func NewElection(client *EtcdClient, name string, ttl time.Duration) (*Election, error) {
+	session, err := concurrency.NewSession(client.Client, concurrency.WithTTL(max(int(ttl.Seconds()), 1)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create election session: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	key := electionPrefix + name
+	return &Election{
+		session:  session,
+		election: concurrency.NewElection(session, key),
+		key:      key,
+		identity: fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+	}, nil
+}
+
+// Campaign blocks until the instance is elected leader or ctx is done
+func (e *Election) Campaign(ctx context.Context) error {
+	log.Default().WithFields(log.Fields{"key": e.key, "identity": e.identity}).Info("Campaigning for leadership, running as standby")
+	if err := e.election.Campaign(ctx, e.identity); err != nil {
+		return fmt.Errorf("failed to campaign for leadership: %w", err)
+	}
+
+	e.leader.Store(true)
+	metrics.Leader.Set(1)
+	log.Default().WithField("key", e.key).Info("Elected leader")
+	return nil
+}
+
+// Monitor calls lost once the session expires, e.g. after etcd was unreachable for the TTL
+func (e *Election) Monitor(ctx context.Context, lost func()) {
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-e.session.Done():
+			e.leader.Store(false)
+			metrics.Leader.Set(0)
+			log.Default().WithField("key", e.key).Error("Lost leadership, etcd session expired")
+			lost()
+		}
+	}()
+}
+
+// Resign gives up the leadership so a standby takes over immediately, and closes the session
+func (e *Election) Resign(ctx context.Context) {
+	if e.leader.Swap(false) {
+		metrics.Leader.Set(0)
+		if err := e.election.Resign(ctx); err != nil {
+			log.Default().WithError(err).Warn("Failed to resign leadership")
+		}
+	}
+	if err := e.session.Close(); err != nil {
+		log.Default().WithError(err).Warn("Failed to close election session")
+	}
+}
+
+// Status returns the leadership state of the instance
+func (e *Election) Status() ElectionStatus {
+	return ElectionStatus{Key: e.key, Identity: e.identity, Leader: e.leader.Load()}
+}
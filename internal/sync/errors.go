@@ -0,0 +1,182 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+)
+
+// Error categories, kept as a fixed set to be usable as metric labels
+const (
+	CategoryConnection = "connection"
+	CategoryConflict   = "conflict"
+	CategoryValidation = "validation"
+	CategoryCompaction = "compaction"
+	CategoryPermission = "permission"
+	CategoryOther      = "other"
+)
+
+// errorCategories lists every category exported by the errors metric
+var errorCategories = []string{
+	CategoryConnection, CategoryConflict, CategoryValidation, CategoryCompaction, CategoryPermission, CategoryOther,
+}
+
+func init() {
+	// Export every category from the start, so rates can be computed and alerted on
+	for _, category := range errorCategories {
+		metrics.Errors.WithLabelValues(category)
+	}
+}
+
+// ConnectionError is a failure to reach etcd or PostgreSQL in time, usually transient
+type ConnectionError struct{ Err error }
+
+func (e *ConnectionError) Error() string { return e.Err.Error() }
+func (e *ConnectionError) Unwrap() error { return e.Err }
+
+// ConflictError is a change rejected because of a concurrent change, e.g. a failed compare-and-swap
+type ConflictError struct{ Err error }
+
+func (e *ConflictError) Error() string { return e.Err.Error() }
+func (e *ConflictError) Unwrap() error { return e.Err }
+
+// ValidationError is a change the other side cannot store, e.g. a key that is not valid UTF-8
+type ValidationError struct{ Err error }
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// CompactionError is a revision etcd has compacted away, it requires resynchronizing instead of retrying
+type CompactionError struct{ Err error }
+
+func (e *CompactionError) Error() string { return e.Err.Error() }
+func (e *CompactionError) Unwrap() error { return e.Err }
+
+// PermissionError is an operation rejected by authentication or authorization of etcd or PostgreSQL
+type PermissionError struct{ Err error }
+
+func (e *PermissionError) Error() string { return e.Err.Error() }
+func (e *PermissionError) Unwrap() error { return e.Err }
+
+// ClassifyError wraps err into the typed error of its category. Typed errors and errors
+// of no known category are returned unchanged.
+func ClassifyError(err error) error {
+	if err == nil || typedCategory(err) != "" {
+		return err
+	}
+	switch categorize(err) {
+	case CategoryConnection:
+		return &ConnectionError{Err: err}
+	case CategoryConflict:
+		return &ConflictError{Err: err}
+	case CategoryValidation:
+		return &ValidationError{Err: err}
+	case CategoryCompaction:
+		return &CompactionError{Err: err}
+	case CategoryPermission:
+		return &PermissionError{Err: err}
+	}
+	return err
+}
+
+// ErrorCategory returns the category of err, CategoryOther if unknown
+func ErrorCategory(err error) string {
+	if category := typedCategory(err); category != "" {
+		return category
+	}
+	return categorize(err)
+}
+
+// countError counts a failed operation by its category, shutting down is no failure
+func countError(err error) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	metrics.Errors.WithLabelValues(ErrorCategory(err)).Inc()
+}
+
+// typedCategory returns the category of the outermost typed error in the chain of err, empty if none
+func typedCategory(err error) string {
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch err.(type) {
+		case *ConnectionError:
+			return CategoryConnection
+		case *ConflictError:
+			return CategoryConflict
+		case *ValidationError:
+			return CategoryValidation
+		case *CompactionError:
+			return CategoryCompaction
+		case *PermissionError:
+			return CategoryPermission
+		}
+	}
+	return ""
+}
+
+// categorize derives the category of an untyped etcd, PostgreSQL or network error
+func categorize(err error) string {
+	if IsCompacted(err) {
+		return CategoryCompaction
+	}
+	if IsAuthError(err) || errors.Is(rpctypes.Error(err), rpctypes.ErrPermissionDenied) {
+		return CategoryPermission
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErrorCategory(pgErr.Code)
+	}
+	if IsTimeout(err) {
+		return CategoryConnection
+	}
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &netErr) || errors.As(err, &connectErr) {
+		return CategoryConnection
+	}
+
+	var code codes.Code
+	var etcdErr rpctypes.EtcdError
+	if errors.As(err, &etcdErr) {
+		code = etcdErr.Code()
+	} else if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	}
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return CategoryConnection
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return CategoryPermission
+	case codes.InvalidArgument, codes.OutOfRange:
+		return CategoryValidation
+	case codes.Aborted:
+		return CategoryConflict
+	}
+	return CategoryOther
+}
+
+// pgErrorCategory maps a PostgreSQL SQLSTATE to its category
+func pgErrorCategory(code string) string {
+	switch {
+	case code == "42501" || strings.HasPrefix(code, "28"): // insufficient_privilege, invalid authorization
+		return CategoryPermission
+	case code == "23505" || code == "23P01" || code == "40001" || code == "40P01" || code == "55P03":
+		// unique and exclusion violations, serialization failures, deadlocks and lock timeouts
+		return CategoryConflict
+	case strings.HasPrefix(code, "22") || strings.HasPrefix(code, "23"): // data exceptions, constraint violations
+		return CategoryValidation
+	case code == "57014" || strings.HasPrefix(code, "08") || code == "57P01" || code == "57P03":
+		// query canceled, connection exceptions, shutdown and startup
+		return CategoryConnection
+	}
+	return CategoryOther
+}
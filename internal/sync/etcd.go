@@ -4,38 +4,91 @@ package sync
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
 )
 
 // EtcdClient handles all etcd operations for PostgreSQL synchronization
 type EtcdClient struct {
 	*clientv3.Client
-	prefix string
+	prefix           string
+	namespace        string        // DSN path all keys are scoped to, empty if not namespaced
+	passwordFile     string        // file the password is re-read from on authentication failures
+	autoSyncInterval time.Duration // endpoint refresh interval from cluster membership, 0 if disabled
+	compactRevision  atomic.Int64  // highest compact revision reported by etcd
 }
 
-// NewEtcdClient creates a new etcd client with DSN parsing
-func NewEtcdClient(dsn string) (*EtcdClient, error) {
+// compactProbeTimeout bounds the watch used to discover the compact revision
+const compactProbeTimeout = 5 * time.Second
+
+// NewEtcdClient creates a new etcd client with DSN parsing, callbacks may adjust the parsed configuration
+func NewEtcdClient(dsn string, callbacks ...func(*clientv3.Config) error) (*EtcdClient, error) {
 	config, err := parseEtcdDSN(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse etcd DSN: %w", err)
 	}
+	ns, err := getNamespace(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse etcd DSN: %w", err)
+	}
+	for _, cb := range callbacks {
+		if err := cb(config); err != nil {
+			return nil, fmt.Errorf("failed to configure etcd client: %w", err)
+		}
+	}
+
+	// Chained interceptors run inside the retry interceptor of the client, so each attempt is measured
+	config.DialOptions = append(config.DialOptions,
+		grpc.WithChainUnaryInterceptor(metrics.EtcdGRPC.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(metrics.EtcdGRPC.StreamClientInterceptor()),
+	)
 
 	client, err := clientv3.New(*config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to etcd: %w", err)
 	}
 
-	logrus.WithField("endpoints", config.Endpoints).Info("Connected to etcd successfully")
+	prefix := getPrefix(dsn)
+	if ns != "" {
+		// Scope every operation to the namespace, keys are relative to it from here on
+		client.KV = namespace.NewKV(client.KV, ns)
+		client.Watcher = namespace.NewWatcher(client.Watcher, ns)
+		client.Lease = namespace.NewLease(client.Lease, ns)
+		prefix = ""
+	}
+	// clientv3.Config has no request timeout, bound each request instead
+	requestTimeout := getRequestTimeout(dsn)
+	client.KV = newTimeoutKV(client.KV, requestTimeout)
+
+	log.Default().WithFields(log.Fields{
+		"endpoints":       config.Endpoints,
+		"namespace":       ns,
+		"request_timeout": requestTimeout,
+	}).Info("Connected to etcd successfully")
 
 	return &EtcdClient{
-		Client: client,
-		prefix: getPrefix(dsn),
+		Client:           client,
+		prefix:           prefix,
+		namespace:        ns,
+		passwordFile:     getPasswordFile(dsn),
+		autoSyncInterval: config.AutoSyncInterval,
 	}, nil
 }
 
@@ -47,57 +100,271 @@ func (c *EtcdClient) Close() error {
 	return nil
 }
 
-// WatchPrefix sets up a watch for all keys with the given prefix
-func (c *EtcdClient) WatchPrefix(ctx context.Context, startRevision int64) clientv3.WatchChan {
-	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+// Prefix returns the key prefix configured in the DSN
+func (c *EtcdClient) Prefix() string {
+	return c.prefix
+}
+
+// Namespace returns the key namespace all operations are scoped to, empty if the client is not namespaced
+func (c *EtcdClient) Namespace() string {
+	return c.namespace
+}
+
+// ConnectionState returns the gRPC connectivity state of the active etcd connection
+func (c *EtcdClient) ConnectionState() string {
+	if c.Client == nil || c.ActiveConnection() == nil {
+		return "SHUTDOWN"
+	}
+	return c.ActiveConnection().GetState().String()
+}
+
+// LogEndpointChanges logs changes of the endpoint list made by endpoint auto-sync until ctx is done
+func (c *EtcdClient) LogEndpointChanges(ctx context.Context) {
+	if c.autoSyncInterval <= 0 {
+		return
+	}
+	log.Default().WithField("interval", c.autoSyncInterval).Info("Syncing etcd endpoints from cluster membership")
+
+	endpoints := c.Endpoints()
+	ticker := time.NewTicker(c.autoSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := c.Endpoints()
+			added, removed := endpointChanges(endpoints, current)
+			if len(added) > 0 || len(removed) > 0 {
+				log.Default().WithFields(log.Fields{
+					"added":     added,
+					"removed":   removed,
+					"endpoints": current,
+				}).Info("etcd cluster membership changed")
+			}
+			endpoints = current
+		}
+	}
+}
+
+// endpointChanges returns the endpoints only present in current and those only present in previous
+func endpointChanges(previous, current []string) (added, removed []string) {
+	for _, endpoint := range current {
+		if !slices.Contains(previous, endpoint) {
+			added = append(added, endpoint)
+		}
+	}
+	for _, endpoint := range previous {
+		if !slices.Contains(current, endpoint) {
+			removed = append(removed, endpoint)
+		}
+	}
+	return added, removed
+}
+
+// CompactRevision returns the highest compact revision observed so far, 0 if none
+func (c *EtcdClient) CompactRevision() int64 {
+	return c.compactRevision.Load()
+}
+
+// observeCompaction records a compact revision reported by etcd
+func (c *EtcdClient) observeCompaction(revision int64) {
+	for {
+		current := c.compactRevision.Load()
+		if revision <= current || c.compactRevision.CompareAndSwap(current, revision) {
+			return
+		}
+	}
+}
+
+// ProbeCompactRevision discovers the compact revision by watching prefix from revision 1,
+// which etcd cancels with the compact revision if that history is gone
+func (c *EtcdClient) ProbeCompactRevision(ctx context.Context, prefix string) (int64, error) {
+	probeCtx, cancel := context.WithTimeout(clientv3.WithRequireLeader(ctx), compactProbeTimeout)
+	defer cancel()
+
+	select {
+	case resp, ok := <-c.Watch(probeCtx, prefix, clientv3.WithPrefix(), clientv3.WithRev(1), clientv3.WithFragment()):
+		if ok && resp.CompactRevision > 0 {
+			c.observeCompaction(resp.CompactRevision)
+		} else if ok && resp.Err() != nil {
+			return 0, fmt.Errorf("failed to probe compact revision: %w", resp.Err())
+		}
+	case <-probeCtx.Done():
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		// no history to replay within the timeout, nothing newer was compacted
+	}
+	return c.CompactRevision(), nil
+}
+
+// CheckResumeRevision reports whether a watch of prefix can resume right after revision, i.e. etcd hasn't
+// compacted the revisions in between, and returns the current revision of the cluster
+func (c *EtcdClient) CheckResumeRevision(ctx context.Context, prefix string, revision int64) (int64, bool, error) {
+	resp, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	current := resp.Header.Revision
+	if revision >= current {
+		return current, true, nil // nothing happened since, the watch starts at the next revision
+	}
+
+	_, err = c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly(), clientv3.WithRev(revision+1))
+	if IsCompacted(err) {
+		return current, false, nil
+	}
+	if err != nil {
+		return current, false, fmt.Errorf("failed to check resume revision: %w", err)
+	}
+	return current, true, nil
+}
+
+// WatchPrefix sets up a watch for all keys with the given prefix.
+// Responses larger than the server request size limit are sent in fragments and reassembled
+// by the client, so large values or event bursts don't cancel the watch.
+// extraOpts are added to the watch options, e.g. clientv3.WithPrevKV().
+func (c *EtcdClient) WatchPrefix(ctx context.Context, prefix string, startRevision int64, extraOpts ...clientv3.OpOption) clientv3.WatchChan {
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithFragment(), clientv3.WithProgressNotify()}
+	opts = append(opts, extraOpts...)
 	if startRevision > 0 {
 		opts = append(opts, clientv3.WithRev(startRevision+1))
 	}
 
-	watchChan := c.Watch(ctx, c.prefix, opts...)
-	logrus.WithFields(logrus.Fields{
-		"prefix":   c.prefix,
+	watchChan := c.Watch(ctx, prefix, opts...)
+	log.Default().WithFields(log.Fields{
+		"prefix":   prefix,
 		"revision": startRevision,
 	}).Info("Started etcd watch")
 
 	return watchChan
 }
 
-// GetAllKeys retrieves all key-value pairs with the given prefix for initial sync
-func (c *EtcdClient) GetAllKeys(ctx context.Context, prefix string) ([]KeyValueRecord, error) {
-	resp, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
-	if err != nil {
-		return nil, fmt.Errorf("failed to get all keys: %w", err)
+// snapshotPageSize is the number of keys read per request by GetAllKeys
+const snapshotPageSize = 1000
+
+// GetAllKeys retrieves all key-value pairs with the given prefix for initial sync and the revision of the snapshot.
+// The first page determines the revision, further pages are read at exactly that revision,
+// so the result is consistent and a watch starting at revision + 1 misses and repeats nothing.
+func (c *EtcdClient) GetAllKeys(ctx context.Context, prefix string) ([]KeyValueRecord, int64, error) {
+	return c.getKeys(ctx, prefix, 0)
+}
+
+// GetKeysAt retrieves all key-value pairs with the given prefix as of revision, in pages read at that
+// revision. It fails with rpctypes.ErrCompacted if etcd compacted the revision before the last page.
+func (c *EtcdClient) GetKeysAt(ctx context.Context, prefix string, revision int64) ([]KeyValueRecord, error) {
+	pairs, _, err := c.getKeys(ctx, prefix, revision)
+	return pairs, err
+}
+
+// getKeys reads all key-value pairs with the given prefix at pinned, at the revision of the first page if 0
+func (c *EtcdClient) getKeys(ctx context.Context, prefix string, pinned int64) ([]KeyValueRecord, int64, error) {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	key := prefix
+	if key == "" {
+		key = "\x00" // the whole (namespaced) keyspace, empty keys are rejected without WithPrefix
 	}
 
-	pairs := make([]KeyValueRecord, len(resp.Kvs))
-	for i, kv := range resp.Kvs {
-		value := string(kv.Value)
-		pairs[i] = KeyValueRecord{
-			Key:       string(kv.Key),
-			Value:     value,
-			Revision:  kv.ModRevision,
-			Tombstone: false,
+	var pairs []KeyValueRecord
+	revision := pinned
+	for {
+		opts := []clientv3.OpOption{
+			clientv3.WithRange(end),
+			clientv3.WithLimit(snapshotPageSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
 		}
+		if revision > 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		resp, err := c.Get(ctx, key, opts...)
+		if err != nil && revision > 0 && pinned == 0 && IsCompacted(err) {
+			// The snapshot revision was compacted between two pages, start over at the current revision
+			log.Default().WithFields(log.Fields{
+				"prefix":   prefix,
+				"revision": revision,
+			}).Warn("Snapshot revision compacted while reading keys, restarting snapshot")
+			pairs, revision, key = nil, 0, prefix
+			if key == "" {
+				key = "\x00"
+			}
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get all keys: %w", err)
+		}
+		if revision == 0 {
+			revision = resp.Header.Revision
+		}
+
+		for _, kv := range resp.Kvs {
+			pairs = append(pairs, KeyValueRecord{
+				Key:            string(kv.Key),
+				Value:          string(kv.Value),
+				Revision:       kv.ModRevision,
+				Tombstone:      false,
+				CreateRevision: kv.CreateRevision,
+				Version:        kv.Version,
+				Lease:          kv.Lease,
+			})
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00" // continue after the last key
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"prefix":          prefix,
-		"count":           len(pairs),
-		"header_revision": resp.Header.Revision,
+	log.Default().WithFields(log.Fields{
+		"prefix":   prefix,
+		"count":    len(pairs),
+		"revision": revision,
 	}).Info("Retrieved all keys from etcd")
 
-	return pairs, nil
+	return pairs, revision, nil
+}
+
+// CompareAndSwap applies the record only if the key's mod revision equals expectedRevision,
+// 0 meaning the key must not exist. It reports whether the change was applied and the new revision.
+func (c *EtcdClient) CompareAndSwap(ctx context.Context, record KeyValueRecord, expectedRevision int64) (bool, int64, error) {
+	op := clientv3.OpPut(record.Key, record.Value)
+	if record.Tombstone {
+		op = clientv3.OpDelete(record.Key)
+	}
+
+	resp, err := c.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(record.Key), "=", expectedRevision)).
+		Then(op).
+		Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+// GetKeyRevisions returns the keys below prefix with their mod revisions and the header revision of the snapshot
+func (c *EtcdClient) GetKeyRevisions(ctx context.Context, prefix string) (keys []string, revisions []int64, header int64, err error) {
+	resp, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to get key revisions: %w", err)
+	}
+
+	keys = make([]string, len(resp.Kvs))
+	revisions = make([]int64, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		keys[i] = string(kv.Key)
+		revisions[i] = kv.ModRevision
+	}
+	return keys, revisions, resp.Header.Revision, nil
 }
 
 // NewEtcdClientWithRetry creates a new etcd client with retry logic
-func NewEtcdClientWithRetry(ctx context.Context, dsn string) (*EtcdClient, error) {
+func NewEtcdClientWithRetry(ctx context.Context, dsn string, callbacks ...func(*clientv3.Config) error) (*EtcdClient, error) {
 	config := DefaultRetryConfig()
 
 	var client *EtcdClient
 	err := RetryWithBackoff(ctx, config, func() error {
 		var attemptErr error
-		client, attemptErr = NewEtcdClient(dsn)
+		client, attemptErr = NewEtcdClient(dsn, callbacks...)
 		if attemptErr != nil {
 			return attemptErr
 		}
@@ -114,15 +381,15 @@ func NewEtcdClientWithRetry(ctx context.Context, dsn string) (*EtcdClient, error
 	})
 
 	if err != nil {
-		logrus.WithError(err).Error("Failed to establish etcd connection after all retries")
+		log.Default().WithError(err).Error("Failed to establish etcd connection after all retries")
 		return nil, err
 	}
 
 	return client, nil
 }
 
-// WatchWithRecovery wraps the etcd watch functionality with automatic recovery
-func (c *EtcdClient) WatchWithRecovery(ctx context.Context, startRevision int64) <-chan clientv3.WatchResponse {
+// WatchWithRecovery wraps the etcd watch functionality with automatic recovery, opts are passed to WatchPrefix
+func (c *EtcdClient) WatchWithRecovery(ctx context.Context, prefix string, startRevision int64, opts ...clientv3.OpOption) <-chan clientv3.WatchResponse {
 	watchChan := make(chan clientv3.WatchResponse)
 
 	go func() {
@@ -136,7 +403,7 @@ func (c *EtcdClient) WatchWithRecovery(ctx context.Context, startRevision int64)
 				return
 			default:
 				// Attempt to establish watch
-				innerWatchChan := c.WatchPrefix(ctx, currentRevision)
+				innerWatchChan := c.WatchPrefix(ctx, prefix, currentRevision, opts...)
 
 				for {
 					select {
@@ -145,21 +412,46 @@ func (c *EtcdClient) WatchWithRecovery(ctx context.Context, startRevision int64)
 					case watchResp, ok := <-innerWatchChan:
 						if !ok {
 							// Channel closed, need to restart
-							logrus.Warn("etcd watch channel closed, attempting to restart")
+							log.Default().Warn("etcd watch channel closed, attempting to restart")
+							forwardInterruption(ctx, watchChan, clientv3.WatchResponse{Canceled: true})
 							break
 						}
 
+						if watchResp.CompactRevision > 0 {
+							c.observeCompaction(watchResp.CompactRevision)
+						}
+
+						if IsCompacted(watchResp.Err()) {
+							// Restarting can't help, the consumer has to resynchronize and watch again
+							select {
+							case watchChan <- watchResp:
+							case <-ctx.Done():
+							}
+							return
+						}
+
 						if watchResp.Canceled {
-							logrus.Warn("etcd watch was canceled, attempting to restart")
+							log.Default().Warn("etcd watch was canceled, attempting to restart")
+							forwardInterruption(ctx, watchChan, watchResp)
 							break
 						}
 
 						if err := watchResp.Err(); err != nil {
-							logrus.WithError(err).Error("etcd watch error, attempting to restart")
+							countError(err)
+							log.Default().WithError(err).Error("etcd watch error, attempting to restart")
+							if IsAuthError(err) {
+								if err := c.refreshCredentials(); err != nil {
+									log.Default().WithError(err).Error("Failed to refresh etcd credentials")
+								}
+							}
+							forwardInterruption(ctx, watchChan, watchResp)
 							break
 						}
 
-						// Update revision from successful events
+						// Update revision from successful events and progress notifications
+						if watchResp.IsProgressNotify() && watchResp.Header.Revision > currentRevision {
+							currentRevision = watchResp.Header.Revision
+						}
 						for _, event := range watchResp.Events {
 							if event.Kv.ModRevision > currentRevision {
 								currentRevision = event.Kv.ModRevision
@@ -180,7 +472,10 @@ func (c *EtcdClient) WatchWithRecovery(ctx context.Context, startRevision int64)
 					break
 				}
 
-				logrus.WithField("revision", currentRevision).Info("Restarting etcd watch")
+				log.Default().WithFields(log.Fields{
+					"prefix":   prefix,
+					"revision": currentRevision,
+				}).Info("Restarting etcd watch")
 				time.Sleep(time.Second) // Simple delay before restart
 			}
 		}
@@ -189,21 +484,81 @@ func (c *EtcdClient) WatchWithRecovery(ctx context.Context, startRevision int64)
 	return watchChan
 }
 
-// RetryEtcdOperation retries an etcd operation with exponential backoff
+// RetryEtcdOperation retries an etcd operation with exponential backoff as long as its error is retryable,
+// the final error is classified by ClassifyError
 func RetryEtcdOperation(ctx context.Context, operation func() error) error {
-	config := DefaultRetryConfig()
-	return RetryWithBackoff(ctx, config, operation)
+	return ClassifyError(RetryWithBackoff(ctx, EtcdRetryConfig(), operation))
+}
+
+// forwardInterruption tells the consumer of WatchWithRecovery that the watch is restarted, so it can verify
+// that no events were lost when the watch resumes
+func forwardInterruption(ctx context.Context, watchChan chan<- clientv3.WatchResponse, watchResp clientv3.WatchResponse) {
+	select {
+	case watchChan <- watchResp:
+	case <-ctx.Done():
+	}
+}
+
+// CountChanged counts the keys below prefix last modified from revision from up to revision to,
+// keys deleted meanwhile are not counted
+func (c *EtcdClient) CountChanged(ctx context.Context, prefix string, from, to int64) (int64, error) {
+	resp, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(to), clientv3.WithMinModRev(from), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, fmt.Errorf("failed to count changed keys: %w", err)
+	}
+	return resp.Count, nil
+}
+
+// IsRetryableEtcdError reports whether a failed etcd operation may succeed when repeated.
+// Unavailable, DeadlineExceeded, Aborted and rate limiting are transient. Permission, argument and
+// authentication errors, compaction and a NOSPACE alarm are not, neither is a canceled context.
+// Errors that don't come from etcd, e.g. PostgreSQL errors, are retryable.
+func IsRetryableEtcdError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if IsCompacted(err) || errors.Is(err, rpctypes.ErrNoSpace) || IsAuthError(err) {
+		return false
+	}
+
+	var code codes.Code
+	var etcdErr rpctypes.EtcdError
+	if errors.As(err, &etcdErr) {
+		code = etcdErr.Code()
+	} else if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	} else {
+		return true
+	}
+
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted:
+		return true
+	case codes.PermissionDenied, codes.InvalidArgument, codes.Unauthenticated, codes.FailedPrecondition,
+		codes.OutOfRange, codes.NotFound, codes.AlreadyExists, codes.Unimplemented, codes.Canceled:
+		return false
+	default:
+		return true
+	}
+}
+
+// IsCompacted reports whether err is caused by a revision etcd has already compacted away,
+// which requires resynchronizing instead of retrying
+func IsCompacted(err error) bool {
+	return errors.Is(err, rpctypes.ErrCompacted) || errors.Is(rpctypes.Error(err), rpctypes.ErrCompacted)
 }
 
 // parseEtcdDSN parses etcd DSN format: etcd://[user:password@]host1:port1[,host2:port2]/[prefix]?param=value
+// TLS is enabled by tls=enabled or any of ca_file, cert_file, key_file, server_name and insecure_skip_verify=true.
+// etcd+https:// always uses TLS, etcd+srv://domain discovers the endpoints and TLS from DNS SRV records.
 func parseEtcdDSN(dsn string) (*clientv3.Config, error) {
 	if dsn == "" {
 		return &clientv3.Config{}, nil // Default config
 	}
 
 	// Parse the DSN if provided
-	if !strings.HasPrefix(dsn, "etcd://") {
-		return nil, fmt.Errorf("etcd DSN must start with etcd://")
+	if !isEtcdDSN(dsn) {
+		return nil, fmt.Errorf("etcd DSN must start with etcd://, etcd+https:// or etcd+srv://")
 	}
 
 	// Parse as proper URL
@@ -212,11 +567,20 @@ func parseEtcdDSN(dsn string) (*clientv3.Config, error) {
 		return nil, fmt.Errorf("failed to parse DSN: %w", err)
 	}
 
-	// Extract endpoints from host part
-	endpoints := strings.Split(u.Host, ",")
-	for i, endpoint := range endpoints {
-		if !strings.Contains(endpoint, ":") {
-			endpoints[i] = endpoint + ":2379" // Default etcd port
+	// Extract endpoints from host part or discover them
+	var endpoints []string
+	secure := u.Scheme == SchemeEtcdHTTPS
+	if u.Scheme == SchemeEtcdSRV {
+		endpoints, secure, err = discoverSRV(u.Hostname(), u.Query().Get("srv_name"))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		endpoints = strings.Split(u.Host, ",")
+		for i, endpoint := range endpoints {
+			if !strings.Contains(endpoint, ":") {
+				endpoints[i] = endpoint + ":2379" // Default etcd port
+			}
 		}
 	}
 
@@ -246,10 +610,41 @@ func parseEtcdDSN(dsn string) (*clientv3.Config, error) {
 		}
 	}
 
-	if timeout := params.Get("request_timeout"); timeout != "" {
-		// Note: clientv3.Config doesn't have a global RequestTimeout
-		// This would need to be handled per-request using context
-		logrus.WithField("request_timeout", timeout).Debug("Request timeout parameter noted")
+	// gRPC keepalive pings detect watch connections silently dropped by NAT or firewalls
+	if interval := params.Get("keepalive_time"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			config.DialKeepAliveTime = d
+		}
+	}
+
+	if timeout := params.Get("keepalive_timeout"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			config.DialKeepAliveTimeout = d
+		}
+	}
+
+	if params.Get("permit_without_stream") == "true" {
+		config.PermitWithoutStream = true
+	}
+
+	// gRPC message size limits in bytes, 0 keeps the client defaults (2 MiB send, unlimited receive)
+	if size := params.Get("max_recv_msg_size"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			config.MaxCallRecvMsgSize = n
+		}
+	}
+
+	if size := params.Get("max_send_msg_size"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			config.MaxCallSendMsgSize = n
+		}
+	}
+
+	// Refresh the endpoint list from the cluster membership, so members can be added and removed without a restart
+	if interval := params.Get("auto_sync_interval"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			config.AutoSyncInterval = d
+		}
 	}
 
 	if username := params.Get("username"); username != "" {
@@ -260,19 +655,67 @@ func parseEtcdDSN(dsn string) (*clientv3.Config, error) {
 		config.Password = password
 	}
 
-	if tlsParam := params.Get("tls"); tlsParam == "enabled" {
-		// Basic TLS config - in production this should be more sophisticated
-		config.TLS = &tls.Config{
-			InsecureSkipVerify: true, // For development - should be configurable
+	// A password file takes precedence and is re-read when etcd rejects the authentication
+	if passwordFile := params.Get("password_file"); passwordFile != "" {
+		password, err := readPasswordFile(passwordFile)
+		if err != nil {
+			return nil, err
 		}
+		config.Password = password
+	}
+
+	tlsConfig := EtcdTLS{
+		CAFile:             params.Get("ca_file"),
+		CertFile:           params.Get("cert_file"),
+		KeyFile:            params.Get("key_file"),
+		ServerName:         params.Get("server_name"),
+		InsecureSkipVerify: params.Get("insecure_skip_verify") == "true",
+	}
+	if secure || params.Get("tls") == "enabled" {
+		config.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if err := tlsConfig.Apply(config); err != nil {
+		return nil, err
 	}
 
 	return config, nil
 }
 
+// getNamespace returns the DSN path if the namespace=true parameter scopes the client to it.
+// Namespacing the whole keyspace is rejected, as it most likely is a misconfigured DSN.
+func getNamespace(dsn string) (string, error) {
+	if dsn == "" {
+		return "", nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	if u.Query().Get("namespace") != "true" {
+		return "", nil
+	}
+	if u.Path == "" || u.Path == "/" {
+		return "", fmt.Errorf("namespace=true requires a key prefix in the DSN path")
+	}
+	return u.Path, nil
+}
+
+// KeyScope returns the key prefix and namespace of an etcd DSN like NewEtcdClient, e.g. to read snapshots
+// offline. The prefix is empty if the DSN is namespaced.
+func KeyScope(dsn string) (prefix, namespace string, err error) {
+	namespace, err = getNamespace(dsn)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse etcd DSN: %w", err)
+	}
+	if namespace != "" {
+		return "", namespace, nil
+	}
+	return getPrefix(dsn), "", nil
+}
+
 // getPrefix extracts the prefix from the etcd DSN path
 func getPrefix(dsn string) string {
-	if dsn == "" || !strings.HasPrefix(dsn, "etcd://") {
+	if dsn == "" || !isEtcdDSN(dsn) {
 		return "/"
 	}
 
@@ -0,0 +1,12 @@
+package sync
+
+import "testing"
+
+// The containers come from pkg/pgetcdtest, which imports this package, so the external test package
+// containers_test.go sets these hooks for the integration tests
+var (
+	// StartPostgreSQL starts an empty PostgreSQL and returns its connection string
+	StartPostgreSQL func(t testing.TB) string
+	// StartEtcd starts etcd with additional environment settings and returns its client endpoint
+	StartEtcd func(t testing.TB, env map[string]string) string
+)
@@ -0,0 +1,42 @@
+package sync
+
+import (
+	"context"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/failpoint"
+)
+
+// Failpoints of the sync pipeline, see package failpoint
+const (
+	// FailpointEtcdRequest fails unary etcd requests as unavailable
+	FailpointEtcdRequest = "etcd-request"
+	// FailpointPostgreSQL fails PostgreSQL sync operations as connection errors
+	FailpointPostgreSQL = "pg-operation"
+	// FailpointPushAfterEtcd triggers after pending records were written to etcd, before their revision is stored
+	FailpointPushAfterEtcd = "push-after-etcd"
+	// FailpointPushMidBatch triggers after the first records of a pushed transaction were acknowledged
+	FailpointPushMidBatch = "push-mid-batch"
+	// FailpointInitialSync triggers after the snapshot of a prefix was copied, before it is committed
+	FailpointInitialSync = "initial-sync"
+)
+
+// ApplyFailpoints injects FailpointEtcdRequest into the unary etcd requests if failpoints are enabled,
+// usable as a NewEtcdClient callback
+func ApplyFailpoints(config *clientv3.Config) error {
+	if !failpoint.Enabled() {
+		return nil
+	}
+	config.DialOptions = append(config.DialOptions, grpc.WithChainUnaryInterceptor(
+		func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if err := failpoint.Eval(FailpointEtcdRequest); err != nil {
+				return status.Error(codes.Unavailable, err.Error())
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}))
+	return nil
+}
@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// changeFeedBuffer is the number of changes buffered for a receiver of Subscribe
+const changeFeedBuffer = 1024
+
+// ChangeEvent is a change durably applied to PostgreSQL in either direction, delivered by Subscribe
+type ChangeEvent struct {
+	Time           time.Time `json:"time"`
+	Direction      string    `json:"direction"` // log.DirectionEtcdToPg or log.DirectionPgToEtcd
+	Key            string    `json:"key"`
+	Value          string    `json:"value,omitempty"`
+	Tombstone      bool      `json:"tombstone"`
+	Revision       int64     `json:"revision"` // etcd revision of the change, the checkpoint of a consumer
+	CreateRevision int64     `json:"create_revision,omitempty"`
+	Version        int64     `json:"version,omitempty"`
+	Lease          int64     `json:"lease,omitempty"`
+}
+
+// changeFeed is a subscription of Subscribe
+type changeFeed struct {
+	prefix string
+	events chan ChangeEvent
+}
+
+// changeFeeds fans applied changes out to the subscriptions of Subscribe
+type changeFeeds struct {
+	mu    sync.Mutex
+	feeds map[*changeFeed]struct{}
+}
+
+// Subscribe returns a channel receiving every change of a key under prefix, of all keys if empty, once it
+// is durably applied to PostgreSQL, in the order of application. The changes of a prefix arrive in etcd
+// revision order, so the Revision of the last processed change is the checkpoint to catch up from the
+// mirror tables after a restart. cancel ends the subscription and closes the channel.
+// A receiver falling more than 1024 changes behind is unsubscribed instead of holding up the sync, its
+// channel is closed without a call of cancel and it must catch up from its checkpoint.
+func (s *Service) Subscribe(prefix string) (events <-chan ChangeEvent, cancel func()) {
+	feed := &changeFeed{prefix: prefix, events: make(chan ChangeEvent, changeFeedBuffer)}
+	s.feeds.mu.Lock()
+	if s.feeds.feeds == nil {
+		s.feeds.feeds = make(map[*changeFeed]struct{})
+	}
+	s.feeds.feeds[feed] = struct{}{}
+	s.feeds.mu.Unlock()
+	return feed.events, func() { s.feeds.remove(feed) }
+}
+
+// remove ends a subscription, later calls do nothing
+func (p *changeFeeds) remove(feed *changeFeed) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.feeds[feed]; ok {
+		delete(p.feeds, feed)
+		close(feed.events)
+	}
+}
+
+// publishChange passes a change applied in direction to the subscriptions of its key
+func (s *Service) publishChange(direction string, record KeyValueRecord) {
+	event := ChangeEvent{
+		Time:           s.now(),
+		Direction:      direction,
+		Key:            record.Key,
+		Value:          record.Value,
+		Tombstone:      record.Tombstone,
+		Revision:       record.Revision,
+		CreateRevision: record.CreateRevision,
+		Version:        record.Version,
+		Lease:          record.Lease,
+	}
+	s.feeds.mu.Lock()
+	defer s.feeds.mu.Unlock()
+	for feed := range s.feeds.feeds {
+		if !strings.HasPrefix(event.Key, feed.prefix) {
+			continue
+		}
+		select {
+		case feed.events <- event:
+		default:
+			delete(s.feeds.feeds, feed)
+			close(feed.events)
+			s.logger().WithFields(log.Fields{
+				"prefix":          feed.prefix,
+				log.FieldRevision: event.Revision,
+			}).Warn("Change subscriber fell behind, unsubscribing it")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// valueHash returns the SHA-256 of a plain value as stored in the value_hash column
+func valueHash(value string) []byte {
+	sum := sha256.Sum256([]byte(value))
+	return sum[:]
+}
+
+// hashTable returns the table whose value_hash column the store keeps, empty for stores set by Config.Store
+func (s *Service) hashTable() string {
+	switch s.store.(type) {
+	case historyStore:
+		return "etcd"
+	case latestStore:
+		return "etcd_latest"
+	}
+	return ""
+}
+
+// skipMirrored drops the records already mirrored with the same revision and value hash, so resynchronizing
+// a prefix only writes the keys that changed
+func (s *Service) skipMirrored(ctx context.Context, db PgxIface, records []KeyValueRecord) ([]KeyValueRecord, error) {
+	table := s.hashTable()
+	if table == "" || len(records) == 0 {
+		return records, nil
+	}
+	keys := make([]string, 0, len(records))
+	revisions := make([]int64, 0, len(records))
+	hashes := make([][]byte, 0, len(records))
+	for _, record := range records {
+		if !record.Tombstone {
+			keys = append(keys, record.Key)
+			revisions = append(revisions, record.Revision)
+			hashes = append(hashes, valueHash(record.Value))
+		}
+	}
+	query := fmt.Sprintf(`SELECT m.key, m.revision
+		FROM unnest($1::text[], $2::bigint[], $3::bytea[]) AS r(key, revision, hash)
+		JOIN %s m ON m.key = r.key AND m.revision = r.revision AND m.value_hash = r.hash`, table)
+	rows, err := db.Query(ctx, query, keys, revisions, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up mirrored values: %w", err)
+	}
+	type pk struct {
+		key      string
+		revision int64
+	}
+	mirrored := make(map[pk]bool)
+	var key string
+	var revision int64
+	_, err = pgx.ForEachRow(rows, []any{&key, &revision}, func() error {
+		mirrored[pk{key, revision}] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up mirrored values: %w", err)
+	}
+	if len(mirrored) == 0 {
+		return records, nil
+	}
+
+	changed := make([]KeyValueRecord, 0, len(records)-len(mirrored))
+	for _, record := range records {
+		if record.Tombstone || !mirrored[pk{record.Key, record.Revision}] {
+			changed = append(changed, record)
+		}
+	}
+	log.Default().WithFields(log.Fields{
+		"count":   len(records),
+		"skipped": len(records) - len(changed),
+	}).Debug("Skipped records mirrored with the same value")
+	return changed, nil
+}
+
+// revisionBump moves the latest row of a key from revision From to the revision of Record, whose value it has
+type revisionBump struct {
+	From   int64
+	Record KeyValueRecord
+}
+
+// deduplicate leaves out the records whose value equals the latest mirrored value of their key, see
+// Config.Dedup. It returns the records to insert and the bumps moving the latest row of a key instead.
+func (s *Service) deduplicate(ctx context.Context, db PgxIface, records []KeyValueRecord) ([]KeyValueRecord, []revisionBump, error) {
+	if !s.dedup || s.hashTable() != "etcd" || len(records) == 0 {
+		return records, nil, nil
+	}
+	keys := make([]string, len(records))
+	for i, record := range records {
+		keys[i] = record.Key
+	}
+	rows, err := db.Query(ctx, `SELECT DISTINCT ON (key) key, revision, value_hash, tombstone
+		FROM etcd
+		WHERE key = ANY($1) AND revision > 0
+		ORDER BY key, revision DESC`, keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up latest values: %w", err)
+	}
+
+	// latest value of every key, insert is the index of the record in inserts, -1 for a row in PostgreSQL
+	type current struct {
+		revision int64
+		hash     []byte
+		insert   int
+	}
+	latest := make(map[string]current, len(records))
+	var key string
+	var revision int64
+	var stored []byte
+	var tombstone bool
+	_, err = pgx.ForEachRow(rows, []any{&key, &revision, &stored, &tombstone}, func() error {
+		if !tombstone && stored != nil {
+			latest[key] = current{revision: revision, hash: bytes.Clone(stored), insert: -1}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up latest values: %w", err)
+	}
+
+	var inserts []KeyValueRecord
+	var bumps []revisionBump
+	for _, record := range records {
+		if record.Tombstone {
+			delete(latest, record.Key)
+			inserts = append(inserts, record)
+			continue
+		}
+		hash := valueHash(record.Value)
+		cur, ok := latest[record.Key]
+		if ok && record.Revision > cur.revision && bytes.Equal(cur.hash, hash) {
+			if cur.insert >= 0 {
+				inserts[cur.insert] = record
+			} else {
+				bumps = append(bumps, revisionBump{From: cur.revision, Record: record})
+			}
+			cur.revision = record.Revision
+			latest[record.Key] = cur
+			continue
+		}
+		latest[record.Key] = current{revision: record.Revision, hash: hash, insert: len(inserts)}
+		inserts = append(inserts, record)
+	}
+	return inserts, bumps, nil
+}
+
+// bumpRevisions moves the latest rows of deduplicated changes to their new revision and notifies channel of
+// each, unless empty. The values of the rows are left alone.
+func bumpRevisions(ctx context.Context, db PgxIface, bumps []revisionBump, channel string) error {
+	if len(bumps) == 0 {
+		return nil
+	}
+	batch := &pgx.Batch{}
+	records := make([]KeyValueRecord, len(bumps))
+	for i, bump := range bumps {
+		record := bump.Record
+		batch.Queue(`UPDATE etcd SET revision = $3, ts = $4, create_revision = $5, version = $6, lease = $7
+			WHERE key = $1 AND revision = $2`,
+			record.Key, bump.From, record.Revision, record.Ts, record.CreateRevision, record.Version, record.Lease)
+		records[i] = record
+	}
+	if err := queueNotifications(batch, records, channel); err != nil {
+		return err
+	}
+	if err := db.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("failed to move revisions of unchanged values: %w", err)
+	}
+	log.Default().WithField("count", len(bumps)).Debug("Moved revisions of unchanged values in PostgreSQL")
+	return nil
+}
@@ -0,0 +1,189 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// clusterHealthInterval is how often the etcd maintenance status and alarms are checked
+const clusterHealthInterval = 30 * time.Second
+
+// dbSizeWarnRatio is the share of the etcd storage quota above which the DB size is reported
+const dbSizeWarnRatio = 0.8
+
+// Reasons PostgreSQL changes are held back because the etcd cluster can't accept writes
+const (
+	HoldNoLeader     = "no_leader"
+	HoldNoSpaceAlarm = "nospace_alarm"
+	HoldCorruptAlarm = "corrupt_alarm"
+)
+
+// holdReasons lists every reason exported by the held writes metric
+var holdReasons = []string{HoldNoLeader, HoldNoSpaceAlarm, HoldCorruptAlarm}
+
+// EndpointHealth is the maintenance status of a single etcd endpoint
+type EndpointHealth struct {
+	Endpoint    string
+	DBSize      int64
+	DBSizeQuota int64 // 0 if the server doesn't report its quota
+	Leader      uint64
+	Errors      []string
+	Err         error // the endpoint could not be queried
+}
+
+// ClusterHealth is the maintenance status of all endpoints and the active cluster alarms
+type ClusterHealth struct {
+	Endpoints []EndpointHealth
+	Alarms    []string
+}
+
+// CheckClusterHealth queries the maintenance status of every endpoint and the active alarms
+func (c *EtcdClient) CheckClusterHealth(ctx context.Context) (ClusterHealth, error) {
+	var health ClusterHealth
+	for _, endpoint := range c.Endpoints() {
+		status := EndpointHealth{Endpoint: endpoint}
+		resp, err := c.Status(ctx, endpoint)
+		if err != nil {
+			status.Err = err
+		} else {
+			status.DBSize = resp.DbSize
+			status.DBSizeQuota = resp.DbSizeQuota
+			status.Leader = resp.Leader
+			status.Errors = resp.Errors
+		}
+		health.Endpoints = append(health.Endpoints, status)
+	}
+
+	alarms, err := c.AlarmList(ctx)
+	if err != nil {
+		return health, fmt.Errorf("failed to list etcd alarms: %w", err)
+	}
+	for _, alarm := range alarms.Alarms {
+		if alarm.Alarm != etcdserverpb.AlarmType_NONE && !slices.Contains(health.Alarms, alarm.Alarm.String()) {
+			health.Alarms = append(health.Alarms, alarm.Alarm.String())
+		}
+	}
+	return health, nil
+}
+
+// NoSpaceAlarm reports whether etcd has an active NOSPACE alarm, writes to etcd are paused meanwhile
+func (s *Service) NoSpaceAlarm() bool {
+	return s.noSpace.Load()
+}
+
+// ClusterHold returns why PostgreSQL changes are held back instead of pushed to etcd, empty if they aren't
+func (s *Service) ClusterHold() string {
+	reason, _ := s.clusterHold.Load().(string)
+	return reason
+}
+
+// holdReason returns why health prevents writes to etcd, empty if it doesn't. A cluster without leader is only
+// reported if an endpoint answered, unreachable endpoints are retried like any connection failure.
+func holdReason(health ClusterHealth) string {
+	switch {
+	case slices.Contains(health.Alarms, etcdserverpb.AlarmType_CORRUPT.String()):
+		return HoldCorruptAlarm
+	case slices.Contains(health.Alarms, etcdserverpb.AlarmType_NOSPACE.String()):
+		return HoldNoSpaceAlarm
+	}
+	reachable := false
+	for _, endpoint := range health.Endpoints {
+		if endpoint.Err == nil {
+			if endpoint.Leader != 0 {
+				return ""
+			}
+			reachable = true
+		}
+	}
+	if reachable {
+		return HoldNoLeader
+	}
+	return ""
+}
+
+// monitorCluster periodically checks the etcd cluster health
+func (s *Service) monitorCluster(ctx context.Context) {
+	ticker := time.NewTicker(clusterHealthInterval)
+	defer ticker.Stop()
+	for {
+		// Without the alarm list the previous alarm state is kept
+		health, err := s.etcdClient.CheckClusterHealth(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger().WithError(err).Warn("Failed to check etcd cluster health")
+			}
+		} else {
+			s.applyClusterHealth(health)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyClusterHealth exports a health check as metrics, logs noteworthy changes and holds writes back while the
+// cluster has no leader or a NOSPACE or CORRUPT alarm
+func (s *Service) applyClusterHealth(health ClusterHealth) {
+	var leader uint64
+	for _, endpoint := range health.Endpoints {
+		if endpoint.Err != nil {
+			s.logger().WithError(endpoint.Err).WithField("endpoint", endpoint.Endpoint).Warn("Failed to get etcd endpoint status")
+			continue
+		}
+		metrics.EtcdDBSize.WithLabelValues(endpoint.Endpoint).Set(float64(endpoint.DBSize))
+		if endpoint.DBSizeQuota > 0 && float64(endpoint.DBSize) >= dbSizeWarnRatio*float64(endpoint.DBSizeQuota) {
+			s.logger().WithFields(log.Fields{
+				"endpoint": endpoint.Endpoint,
+				"db_size":  endpoint.DBSize,
+				"quota":    endpoint.DBSizeQuota,
+			}).Warn("etcd database is close to its storage quota, compact and defragment the cluster")
+		}
+		if leader == 0 {
+			leader = endpoint.Leader
+		}
+	}
+
+	if leader != 0 {
+		if previous := s.etcdLeader.Swap(leader); previous != 0 && previous != leader {
+			metrics.EtcdLeaderChanges.Inc()
+			s.logger().WithFields(log.Fields{"previous": previous, "leader": leader}).Warn("etcd leader changed")
+		}
+	}
+
+	for _, alarm := range etcdserverpb.AlarmType_name {
+		active := 0.0
+		if slices.Contains(health.Alarms, alarm) {
+			active = 1
+		}
+		metrics.EtcdAlarms.WithLabelValues(alarm).Set(active)
+	}
+
+	s.noSpace.Store(slices.Contains(health.Alarms, etcdserverpb.AlarmType_NOSPACE.String()))
+	hold := holdReason(health)
+	for _, reason := range holdReasons {
+		held := 0.0
+		if reason == hold {
+			held = 1
+		}
+		metrics.WritesHeld.WithLabelValues(reason).Set(held)
+	}
+	if previous := s.ClusterHold(); previous != hold {
+		s.clusterHold.Store(hold)
+		if hold != "" {
+			s.logger().WithField("reason", hold).Warn("etcd cluster can't accept writes, pausing PostgreSQL to etcd sync")
+		} else {
+			s.logger().WithField("reason", previous).Info("etcd cluster accepts writes again, resuming PostgreSQL to etcd sync")
+		}
+	}
+}
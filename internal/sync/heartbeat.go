@@ -0,0 +1,77 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Heartbeat is the liveness of the daemon synchronizing a keyspace, stored in etcd_sync_heartbeat
+type Heartbeat struct {
+	Name       string    // synchronized prefixes, see Service.InstanceName
+	Instance   string    // host name and process ID of the daemon
+	LastLoop   time.Time // last iteration of a sync loop, zero if none yet
+	Checkpoint int64     // latest etcd revision applied to PostgreSQL
+	Backlog    int64     // pending PostgreSQL changes found by the last poll
+	Stats      Stats     // counters of the service, see Service.Stats
+}
+
+// SaveHeartbeat records heartbeat, replacing the one of a previous daemon of the same keyspace
+func SaveHeartbeat(ctx context.Context, db PgxIface, heartbeat Heartbeat) error {
+	query := `INSERT INTO etcd_sync_heartbeat (name, instance, last_loop, checkpoint, backlog, events_applied,
+			pendings_flushed, conflicts, retries, lag_revisions, lag_seconds, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO UPDATE SET instance = EXCLUDED.instance, last_loop = EXCLUDED.last_loop,
+			checkpoint = EXCLUDED.checkpoint, backlog = EXCLUDED.backlog, events_applied = EXCLUDED.events_applied,
+			pendings_flushed = EXCLUDED.pendings_flushed, conflicts = EXCLUDED.conflicts, retries = EXCLUDED.retries,
+			lag_revisions = EXCLUDED.lag_revisions, lag_seconds = EXCLUDED.lag_seconds, updated_at = EXCLUDED.updated_at`
+
+	var lastLoop *time.Time
+	if !heartbeat.LastLoop.IsZero() {
+		lastLoop = &heartbeat.LastLoop
+	}
+	stats := heartbeat.Stats
+	_, err := db.Exec(ctx, query, heartbeat.Name, heartbeat.Instance, lastLoop, heartbeat.Checkpoint, heartbeat.Backlog,
+		stats.EventsApplied, stats.PendingsFlushed, stats.Conflicts, stats.Retries, stats.LagRevisions, stats.LagSeconds)
+	if err != nil {
+		return fmt.Errorf("failed to save heartbeat: %w", err)
+	}
+	return nil
+}
+
+// markLoop records an iteration of a sync loop for the heartbeat
+func (s *Service) markLoop() {
+	s.lastLoop.Store(s.now().UnixNano())
+}
+
+// heartbeat writes the heartbeat row every heartbeat interval until ctx is done
+func (s *Service) heartbeat(ctx context.Context) {
+	s.logger().WithField("interval", s.heartbeatInterval).Info("Writing heartbeat to etcd_sync_heartbeat")
+
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		heartbeat := Heartbeat{
+			Name:       s.InstanceName(),
+			Instance:   instanceID(),
+			Checkpoint: s.checkpoint.Load(),
+			Backlog:    s.backlog.Load(),
+			Stats:      s.Stats(),
+		}
+		if lastLoop := s.lastLoop.Load(); lastLoop > 0 {
+			heartbeat.LastLoop = time.Unix(0, lastLoop)
+		}
+		err := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+			return SaveHeartbeat(ctx, s.pgPool, heartbeat)
+		})
+		if err != nil && ctx.Err() == nil {
+			s.logger().WithError(err).Warn("Failed to write heartbeat")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// History retention modes for revisions older than the etcd compact revision
+const (
+	// HistoryRetain keeps all revisions, PostgreSQL becomes the long-term history of etcd
+	HistoryRetain = "retain"
+	// HistoryPrune deletes revisions etcd has compacted away, keeping the value each key had at compaction
+	HistoryPrune = "prune"
+)
+
+// historyCheckInterval is how often the etcd compact revision is checked in HistoryPrune mode
+const historyCheckInterval = 5 * time.Minute
+
+// PruneHistory deletes synced revisions superseded at or before compactRevision, mirroring etcd compaction.
+// The latest revision of every key up to compactRevision is kept, so current values stay intact.
+// compactRevision becomes the compact revision in etcd_compaction.
+func PruneHistory(ctx context.Context, pool PgxIface, compactRevision int64) (int64, error) {
+	query := `WITH pruned AS (
+			DELETE FROM etcd e
+			WHERE e.revision > 0 AND e.revision < $1
+			AND EXISTS (
+				SELECT 1 FROM etcd n
+				WHERE n.key = e.key AND n.revision > e.revision AND n.revision <= $1
+			)
+			RETURNING 1
+		), compacted AS (
+			INSERT INTO etcd_compaction (revision) VALUES ($1)
+			ON CONFLICT (id) DO UPDATE SET revision = greatest(etcd_compaction.revision, excluded.revision),
+				updated_at = CURRENT_TIMESTAMP
+		)
+		SELECT count(*) FROM pruned`
+
+	var deleted int64
+	if err := pool.QueryRow(ctx, query, compactRevision).Scan(&deleted); err != nil {
+		return 0, fmt.Errorf("failed to prune history: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// pruneHistory prunes PostgreSQL history whenever etcd reports a newer compact revision
+func (s *Service) pruneHistory(ctx context.Context) {
+	s.logger().Info("Pruning PostgreSQL history older than the etcd compact revision")
+
+	var pruned int64
+	ticker := time.NewTicker(historyCheckInterval)
+	defer ticker.Stop()
+	for {
+		compactRevision := s.etcdClient.CompactRevision()
+		for _, prefix := range s.prefixes {
+			revision, err := s.etcdClient.ProbeCompactRevision(ctx, prefix)
+			if err != nil {
+				s.logger().WithError(err).WithField("prefix", prefix).Warn("Failed to probe etcd compact revision")
+				continue
+			}
+			compactRevision = max(compactRevision, revision)
+		}
+
+		if compactRevision > pruned {
+			var deleted int64
+			err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+				deleted, err = PruneHistory(ctx, s.pgPool, compactRevision)
+				return err
+			})
+			if err != nil {
+				s.logger().WithError(err).WithField("compact_revision", compactRevision).Error("Failed to prune history")
+			} else {
+				pruned = compactRevision
+				s.logger().WithFields(log.Fields{
+					"compact_revision": compactRevision,
+					"deleted":          deleted,
+				}).Info("Pruned PostgreSQL history")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package sync
+
+import (
+	"context"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Hook receives the changes applied by the service, e.g. to invalidate caches, publish changes to a message
+// bus or check them against a policy. The callbacks run synchronously on the sync path and must not block,
+// a panic is recovered and logged.
+type Hook interface {
+	// OnPut is called after a put was applied in direction, log.DirectionEtcdToPg or log.DirectionPgToEtcd.
+	// Revision is the etcd revision of the change.
+	OnPut(ctx context.Context, direction string, record KeyValueRecord)
+	// OnDelete is called after a delete was applied in direction
+	OnDelete(ctx context.Context, direction string, record KeyValueRecord)
+	// OnConflict is called when etcd rejected a compare-and-swap created by etcd_cas() and the pending
+	// change was discarded, record.ExpectedRevision is the revision it required
+	OnConflict(ctx context.Context, record KeyValueRecord, err error)
+}
+
+// HookFuncs implements Hook by functions, nil functions are skipped
+type HookFuncs struct {
+	Put      func(ctx context.Context, direction string, record KeyValueRecord)
+	Delete   func(ctx context.Context, direction string, record KeyValueRecord)
+	Conflict func(ctx context.Context, record KeyValueRecord, err error)
+}
+
+// OnPut calls Put
+func (h HookFuncs) OnPut(ctx context.Context, direction string, record KeyValueRecord) {
+	if h.Put != nil {
+		h.Put(ctx, direction, record)
+	}
+}
+
+// OnDelete calls Delete
+func (h HookFuncs) OnDelete(ctx context.Context, direction string, record KeyValueRecord) {
+	if h.Delete != nil {
+		h.Delete(ctx, direction, record)
+	}
+}
+
+// OnConflict calls Conflict
+func (h HookFuncs) OnConflict(ctx context.Context, record KeyValueRecord, err error) {
+	if h.Conflict != nil {
+		h.Conflict(ctx, record, err)
+	}
+}
+
+// RegisterHook adds hook to the receivers of applied changes, hooks are called in the order they were added.
+// It is safe to call while the service runs.
+func (s *Service) RegisterHook(hook Hook) {
+	for {
+		previous := s.hooks.Load()
+		var hooks []Hook
+		if previous != nil {
+			hooks = append(hooks, *previous...)
+		}
+		hooks = append(hooks, hook)
+		if s.hooks.CompareAndSwap(previous, &hooks) {
+			return
+		}
+	}
+}
+
+// registeredHooks returns the hooks added so far, the slice is never modified
+func (s *Service) registeredHooks() []Hook {
+	if hooks := s.hooks.Load(); hooks != nil {
+		return *hooks
+	}
+	return nil
+}
+
+// notifyApplied passes a change applied in direction to the hooks and the subscriptions
+func (s *Service) notifyApplied(ctx context.Context, direction string, record KeyValueRecord) {
+	s.publishChange(direction, record)
+	for _, hook := range s.registeredHooks() {
+		callHook(ctx, record.Key, func() {
+			if record.Tombstone {
+				hook.OnDelete(ctx, direction, record)
+			} else {
+				hook.OnPut(ctx, direction, record)
+			}
+		})
+	}
+}
+
+// syncedRecord returns a pending record as pushed to etcd at revision
+func syncedRecord(record KeyValueRecord, revision int64) KeyValueRecord {
+	record.Revision = revision
+	return record
+}
+
+// notifyConflict counts a rejected compare-and-swap and passes it to the hooks
+func (s *Service) notifyConflict(ctx context.Context, record KeyValueRecord, err error) {
+	s.stats.conflicts.Add(1)
+	for _, hook := range s.registeredHooks() {
+		callHook(ctx, record.Key, func() { hook.OnConflict(ctx, record, err) })
+	}
+}
+
+// callHook runs a callback of a hook, a panicking hook never stops the synchronization
+func callHook(ctx context.Context, key string, callback func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Default().WithContext(ctx).WithField(log.FieldKey, key).WithField("panic", r).Error("Hook panicked")
+		}
+	}()
+	callback()
+}
@@ -0,0 +1,210 @@
+package sync
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// etcd keeps every revision of every key in the key bucket of its bbolt database, keyed by the big endian
+// main and sub revision separated by '_' and followed by 't' for deletions. The meta bucket holds the
+// revision of the last compaction.
+const (
+	snapshotKeyBucket     = "key"
+	snapshotMetaBucket    = "meta"
+	snapshotCompactKey    = "finishedCompactRev"
+	snapshotRevisionLen   = 17
+	snapshotTombstoneMark = 't'
+)
+
+// importBatchSize is the number of records of a snapshot imported per transaction
+const importBatchSize = 1000
+
+// ReadSnapshotFile calls fn with every revision in the etcd snapshot file path in revision order, e.g. a backup
+// written by etcdctl snapshot save, and returns the revision of the snapshot. The file is read offline without
+// contacting the cluster. Keys outside namespace are skipped, the others made relative to it, and chunked values
+// are reassembled from the chunks in the snapshot. Ts of the records is the modification time of the file.
+func ReadSnapshotFile(path, namespace string, fn func(KeyValueRecord) error) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open etcd snapshot: %w", err)
+	}
+	db, err := bolt.Open(path, 0o400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return 0, fmt.Errorf("failed to open etcd snapshot: %w", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	var revision int64
+	err = db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(snapshotMetaBucket)); meta != nil {
+			if compacted := meta.Get([]byte(snapshotCompactKey)); len(compacted) >= snapshotRevisionLen {
+				revision = int64(binary.BigEndian.Uint64(compacted))
+			}
+		}
+		bucket := tx.Bucket([]byte(snapshotKeyBucket))
+		if bucket == nil {
+			return errors.New("no key bucket, not an etcd snapshot")
+		}
+		chunks := make(map[string]string)
+		return bucket.ForEach(func(rev, data []byte) error {
+			if len(rev) < snapshotRevisionLen || rev[8] != '_' {
+				return fmt.Errorf("invalid revision %x", rev)
+			}
+			main := int64(binary.BigEndian.Uint64(rev))
+			revision = max(revision, main)
+			var kv mvccpb.KeyValue
+			if err := kv.Unmarshal(data); err != nil {
+				return fmt.Errorf("invalid key at revision %d: %w", main, err)
+			}
+			key, ok := strings.CutPrefix(string(kv.Key), namespace)
+			if !ok {
+				return nil
+			}
+			tombstone := len(rev) > snapshotRevisionLen && rev[snapshotRevisionLen] == snapshotTombstoneMark
+			if isChunkKey(key) {
+				if tombstone {
+					delete(chunks, key)
+				} else {
+					chunks[key] = string(kv.Value)
+				}
+				return nil
+			}
+			record := KeyValueRecord{
+				Key:            key,
+				Value:          string(kv.Value),
+				Revision:       main,
+				Ts:             info.ModTime(),
+				Tombstone:      tombstone,
+				CreateRevision: kv.CreateRevision,
+				Version:        kv.Version,
+				Lease:          kv.Lease,
+			}
+			if manifest, ok := parseChunkManifest(record.Value); ok && !tombstone {
+				record.Value = assembleSnapshotChunks(chunks, key, manifest, record.Value)
+			}
+			return fn(record)
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read etcd snapshot: %w", err)
+	}
+	return revision, nil
+}
+
+// assembleSnapshotChunks returns the value of a chunked key from the latest chunks read from a snapshot,
+// the manifest if they are missing or do not match it
+func assembleSnapshotChunks(chunks map[string]string, key string, manifest chunkManifest, stored string) string {
+	var value strings.Builder
+	value.Grow(manifest.Size)
+	for i := range manifest.Chunks {
+		chunk, ok := chunks[chunkKey(key, i)]
+		if !ok {
+			return stored
+		}
+		value.WriteString(chunk)
+	}
+	if manifest.verify(value.String()) != nil {
+		return stored
+	}
+	return value.String()
+}
+
+// ImportSnapshot loads the revisions of the synced prefixes in the etcd snapshot file path into PostgreSQL, see
+// ReadSnapshotFile, and returns the number of records stored and the revision of the snapshot. The revision
+// becomes the checkpoint of every prefix not synced beyond it, so a daemon started afterwards resumes watching
+// from there, or resynchronizes the prefix if etcd compacted it in the meantime.
+func (s *Service) ImportSnapshot(ctx context.Context, path, namespace string) (int, int64, error) {
+	var count int
+	batch := make([]KeyValueRecord, 0, importBatchSize)
+	flush := func() error {
+		n, err := s.importRecords(ctx, batch)
+		count += n
+		batch = batch[:0]
+		return err
+	}
+	revision, err := ReadSnapshotFile(path, namespace, func(record KeyValueRecord) error {
+		if len(s.prefixes) > 0 && !slices.ContainsFunc(s.prefixes, func(prefix string) bool {
+			return strings.HasPrefix(record.Key, prefix)
+		}) {
+			return nil
+		}
+		batch = append(batch, record)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return count, 0, err
+	}
+
+	for _, prefix := range s.prefixes {
+		checkpoint, err := s.store.LoadCheckpoint(ctx, s.pgPool, prefix)
+		if err != nil {
+			return count, revision, err
+		}
+		if checkpoint >= revision {
+			s.logger().WithFields(log.Fields{
+				"prefix":   prefix,
+				"revision": checkpoint,
+			}).Info("Prefix synced beyond the snapshot, keeping its checkpoint")
+			continue
+		}
+		if err := s.store.SaveCheckpoint(ctx, s.pgPool, prefix, revision); err != nil {
+			return count, revision, err
+		}
+	}
+	return count, revision, nil
+}
+
+// importRecords stores records read from a snapshot in one transaction and returns the number stored
+func (s *Service) importRecords(ctx context.Context, records []KeyValueRecord) (int, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	s.decodeRecords(ctx, records)
+	records, err := s.quarantineInvalid(ctx, s.pgPool, records)
+	if err != nil {
+		return 0, fmt.Errorf("failed to quarantine records: %w", err)
+	}
+	for _, record := range records {
+		s.flagInvalid(ctx, record)
+	}
+	err = s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		tx, err := s.pgPool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		inserts, bumps, err := s.deduplicate(ctx, tx, records)
+		if err != nil {
+			return err
+		}
+		if err := bumpRevisions(ctx, tx, bumps, ""); err != nil {
+			return err
+		}
+		if err := s.store.BulkInsert(ctx, tx, compressRecords(s.redactRecords(inserts), s.compressThreshold), ""); err != nil {
+			return fmt.Errorf("failed to bulk insert records: %w", err)
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
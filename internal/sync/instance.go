@@ -0,0 +1,157 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// instanceDir is the directory below every synchronized prefix holding the liveness keys of running daemons
+const instanceDir = ".pg_etcd/instances/"
+
+// probeDir is the directory below every synchronized prefix holding the keys written by preflight checks
+const probeDir = ".pg_etcd/probe/"
+
+// instanceTTL is the lease TTL of the liveness key, it disappears this long after the daemon died
+const instanceTTL = 30 * time.Second
+
+// instanceUpdateInterval is how often the liveness key is refreshed with the current checkpoint
+const instanceUpdateInterval = 10 * time.Second
+
+// InstanceInfo is the value of the liveness key of a running daemon
+type InstanceInfo struct {
+	Version    string    `json:"version"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	Prefixes   []string  `json:"prefixes"`
+	Checkpoint int64     `json:"checkpoint"` // latest etcd revision applied to PostgreSQL
+	StartedAt  time.Time `json:"started_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// instanceKey returns the liveness key of the daemon id below prefix
+func instanceKey(prefix, id string) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + instanceDir + id
+}
+
+// probeKey returns the key written by the preflight check of the daemon id below prefix
+func probeKey(prefix, id string) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + probeDir + id
+}
+
+// instanceID identifies the running daemon by host name and process ID
+func instanceID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// isInternalKey reports whether key holds state of the daemons rather than synchronized data
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, electionPrefix) || strings.Contains("/"+key, "/"+instanceDir) ||
+		strings.Contains("/"+key, "/"+probeDir) || isChunkKey(key)
+}
+
+// advanceCheckpoint records that etcd is applied to PostgreSQL up to revision
+func (s *Service) advanceCheckpoint(revision int64) {
+	for {
+		current := s.checkpoint.Load()
+		if revision <= current || s.checkpoint.CompareAndSwap(current, revision) {
+			return
+		}
+	}
+}
+
+// registerInstance maintains the liveness key of the daemon in every prefix until ctx is done.
+// The keys are bound to a lease kept alive by the daemon, so they expire when it dies.
+func (s *Service) registerInstance(ctx context.Context) {
+	hostname, _ := os.Hostname()
+	info := InstanceInfo{
+		Version:   s.version,
+		Hostname:  hostname,
+		PID:       os.Getpid(),
+		Prefixes:  s.prefixes,
+		StartedAt: s.now(),
+	}
+	id := instanceID()
+
+	for {
+		err := s.maintainInstance(ctx, id, info)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger().WithError(err).Warn("Failed to maintain instance liveness key, registering again")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(instanceUpdateInterval):
+		}
+	}
+}
+
+// maintainInstance registers the liveness keys with a new lease and refreshes them until the lease is lost
+func (s *Service) maintainInstance(ctx context.Context, id string, info InstanceInfo) error {
+	lease, err := s.etcdClient.Grant(ctx, int64(instanceTTL.Seconds()))
+	if err != nil {
+		return fmt.Errorf("failed to grant lease: %w", err)
+	}
+	defer func() {
+		// Remove the keys right away on shutdown instead of waiting for the TTL
+		revokeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_, _ = s.etcdClient.Revoke(revokeCtx, lease.ID)
+	}()
+
+	keepAlive, err := s.etcdClient.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return fmt.Errorf("failed to keep lease alive: %w", err)
+	}
+
+	put := func() error {
+		info.Checkpoint = s.checkpoint.Load()
+		info.UpdatedAt = s.now()
+		value, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		ops := make([]clientv3.Op, len(s.prefixes))
+		for i, prefix := range s.prefixes {
+			ops[i] = clientv3.OpPut(instanceKey(prefix, id), string(value), clientv3.WithLease(lease.ID))
+		}
+		if _, err := s.etcdClient.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return fmt.Errorf("failed to put liveness key: %w", err)
+		}
+		return nil
+	}
+	if err := put(); err != nil {
+		return err
+	}
+	s.logger().WithField("key", instanceKey(s.prefixes[0], id)).Info("Registered instance liveness key")
+
+	ticker := time.NewTicker(instanceUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-keepAlive:
+			if !ok {
+				return fmt.Errorf("lease %x expired", lease.ID)
+			}
+		case <-ticker.C:
+			if err := put(); err != nil {
+				return err
+			}
+		}
+	}
+}
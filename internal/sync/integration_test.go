@@ -3,33 +3,21 @@ package sync
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/testcontainers/testcontainers-go"
-	"github.com/testcontainers/testcontainers-go/modules/postgres"
-	"github.com/testcontainers/testcontainers-go/wait"
-)
-
-func setupPostgreSQLContainer(ctx context.Context, t *testing.T) (*pgxpool.Pool, testcontainers.Container) {
-	pgContainer, err := postgres.Run(ctx,
-		"postgres:17-alpine",
-		postgres.WithDatabase("testdb"),
-		postgres.WithUsername("test"),
-		postgres.WithPassword("test"),
-		testcontainers.WithWaitStrategy(
-			wait.ForLog("database system is ready to accept connections").
-				WithOccurrence(2).WithStartupTimeout(30*time.Second)),
-	)
-	require.NoError(t, err)
+	clientv3 "go.etcd.io/etcd/client/v3"
 
-	pgConnStr, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
-	require.NoError(t, err)
+	"github.com/cybertec-postgresql/pg_etcd/internal/failpoint"
+)
 
-	pool, err := pgxpool.New(ctx, pgConnStr)
+// setupPostgreSQLContainer starts PostgreSQL with the etcd and etcd_sync_state tables
+func setupPostgreSQLContainer(ctx context.Context, t *testing.T) *pgxpool.Pool {
+	pool, err := pgxpool.New(ctx, StartPostgreSQL(t))
 	require.NoError(t, err)
 
 	// Create etcd table with single table architecture
@@ -40,61 +28,334 @@ func setupPostgreSQLContainer(ctx context.Context, t *testing.T) (*pgxpool.Pool,
 			value text NOT NULL,
 			revision bigint NOT NULL,
 			tombstone boolean NOT NULL DEFAULT false,
+			seq bigint GENERATED BY DEFAULT AS IDENTITY,
+			expected_revision bigint,
+			create_revision bigint,
+			version bigint,
+			lease bigint,
+			sync_attempts integer NOT NULL DEFAULT 0,
+			last_error text,
+			status text,
+			claimed_by text,
+			claimed_at timestamptz,
+			encoding text,
+			value_hash bytea,
+			facts jsonb,
 			PRIMARY KEY(key, revision)
 		);
 		CREATE INDEX idx_etcd_pending ON etcd(key) WHERE revision = -1;
 		CREATE INDEX idx_etcd_ts ON etcd(ts);
+
+		CREATE TABLE etcd_sync_state (
+			prefix text PRIMARY KEY,
+			revision bigint NOT NULL,
+			updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
 	`)
 	require.NoError(t, err)
 
-	return pool, pgContainer
+	return pool
 }
 
-func setupEtcdContainer(ctx context.Context, t *testing.T) (*EtcdClient, testcontainers.Container) {
-	etcdContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: testcontainers.ContainerRequest{
-			Image:        "quay.io/coreos/etcd:v3.5.9",
-			ExposedPorts: []string{"2379/tcp"},
-			Env: map[string]string{
-				"ETCD_ADVERTISE_CLIENT_URLS":       "http://0.0.0.0:2379",
-				"ETCD_LISTEN_CLIENT_URLS":          "http://0.0.0.0:2379",
-				"ETCD_LISTEN_PEER_URLS":            "http://0.0.0.0:2380",
-				"ETCD_INITIAL_ADVERTISE_PEER_URLS": "http://0.0.0.0:2380",
-				"ETCD_INITIAL_CLUSTER":             "default=http://0.0.0.0:2380",
-				"ETCD_NAME":                        "default",
-			},
-			WaitingFor: wait.ForListeningPort("2379/tcp"),
-		},
-		Started: true,
-	})
-	require.NoError(t, err)
+func setupEtcdContainer(ctx context.Context, t *testing.T) (*EtcdClient, string) {
+	return setupEtcdContainerWithEnv(ctx, t, nil)
+}
 
-	endpoint, err := etcdContainer.Endpoint(ctx, "")
-	require.NoError(t, err)
+// setupEtcdContainerWithEnv starts etcd with additional environment settings and returns its endpoint
+func setupEtcdContainerWithEnv(_ context.Context, t *testing.T, extraEnv map[string]string) (*EtcdClient, string) {
+	endpoint := StartEtcd(t, extraEnv)
 
 	dsn := "etcd://" + endpoint + "/test"
 	etcdClient, err := NewEtcdClient(dsn)
 	require.NoError(t, err)
 
-	return etcdClient, etcdContainer
+	return etcdClient, endpoint
 }
 
 func setupTestContainers(t *testing.T) (*pgxpool.Pool, *EtcdClient, func()) {
 	ctx := context.Background()
 
-	pool, pgContainer := setupPostgreSQLContainer(ctx, t)
-	etcdClient, etcdContainer := setupEtcdContainer(ctx, t)
+	pool := setupPostgreSQLContainer(ctx, t)
+	etcdClient, _ := setupEtcdContainer(ctx, t)
 
 	cleanup := func() {
 		pool.Close()
 		_ = etcdClient.Close()
-		_ = pgContainer.Terminate(ctx)
-		_ = etcdContainer.Terminate(ctx)
 	}
 
 	return pool, etcdClient, cleanup
 }
 
+// TestFragmentedWatch tests that watch responses exceeding the server request size limit are delivered completely
+func TestFragmentedWatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	etcdClient, _ := setupEtcdContainerWithEnv(ctx, t, map[string]string{
+		"ETCD_MAX_REQUEST_BYTES": "65536",
+	})
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+
+	resp, err := etcdClient.Get(ctx, "/test/fragment/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	startRevision := resp.Header.Revision
+
+	// 8 puts of 32 KiB each, replaying them from history exceeds the limit four times
+	value := strings.Repeat("x", 32*1024)
+	const count = 8
+	for i := range count {
+		_, err := etcdClient.Put(ctx, fmt.Sprintf("/test/fragment/key%d", i), value)
+		require.NoError(t, err)
+	}
+
+	received := 0
+	watchChan := etcdClient.WatchWithRecovery(ctx, "/test/fragment/", startRevision)
+	for received < count {
+		select {
+		case resp := <-watchChan:
+			require.NoError(t, resp.Err())
+			for _, event := range resp.Events {
+				assert.Len(t, event.Kv.Value, len(value))
+			}
+			received += len(resp.Events)
+		case <-ctx.Done():
+			t.Fatalf("timed out after %d of %d events", received, count)
+		}
+	}
+	assert.Equal(t, count, received)
+}
+
+// TestLeaderElection tests that a standby takes over once the leader resigns
+func TestLeaderElection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	etcdClient, _ := setupEtcdContainer(ctx, t)
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+
+	leader, err := NewElection(etcdClient, "/test", time.Second)
+	require.NoError(t, err)
+	standby, err := NewElection(etcdClient, "/test", time.Second)
+	require.NoError(t, err)
+	defer standby.Resign(ctx)
+
+	require.NoError(t, leader.Campaign(ctx))
+	assert.True(t, leader.Status().Leader)
+
+	elected := make(chan error, 1)
+	go func() { elected <- standby.Campaign(ctx) }()
+	select {
+	case <-elected:
+		t.Fatal("standby must not be elected while the leader is active")
+	case <-time.After(2 * time.Second):
+	}
+	assert.False(t, standby.Status().Leader)
+
+	leader.Resign(ctx)
+	require.NoError(t, <-elected)
+	assert.True(t, standby.Status().Leader)
+	assert.False(t, leader.Status().Leader)
+}
+
+// TestApplyBatch tests that a batch of puts and deletes is applied at a single etcd revision
+func TestApplyBatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	etcdClient, _ := setupEtcdContainer(ctx, t)
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+
+	old, err := etcdClient.Put(ctx, "/batch/deleted", "old")
+	require.NoError(t, err)
+
+	txn, err := etcdClient.ApplyBatch(ctx, []KeyValueRecord{
+		{Key: "/batch/a", Value: "1"},
+		{Key: "/batch/b", Value: "2"},
+		{Key: "/batch/deleted", Tombstone: true},
+	}, clientv3.WithPrevKV())
+	require.NoError(t, err)
+	revision := txn.Header.Revision
+	assert.Zero(t, txnPrevRevision(txn.Responses[0]), "new key")
+	assert.Equal(t, old.Header.Revision, txnPrevRevision(txn.Responses[2]))
+
+	resp, err := etcdClient.Get(ctx, "/batch/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 2)
+	for _, kv := range resp.Kvs {
+		assert.Equal(t, revision, kv.ModRevision, string(kv.Key))
+	}
+}
+
+// TestSnapshot tests reading a prefix consistently at a revision across pages
+func TestSnapshot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	etcdClient, _ := setupEtcdContainer(ctx, t)
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+
+	for i := range snapshotPageSize + 1 {
+		_, err := etcdClient.Put(ctx, fmt.Sprintf("/snapshot/%04d", i), "1")
+		require.NoError(t, err)
+	}
+	s := NewService(nil, etcdClient, WithPrefix("/snapshot/"))
+	snapshot, err := s.Snapshot(ctx, "/snapshot/")
+	require.NoError(t, err)
+	assert.Len(t, snapshot.KVs, snapshotPageSize+1)
+
+	_, err = etcdClient.Put(ctx, "/snapshot/0000", "2")
+	require.NoError(t, err)
+	pinned, err := s.SnapshotAt(ctx, "/snapshot/", snapshot.Revision)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot, pinned, "later changes are not visible at the snapshot revision")
+
+	_, err = etcdClient.Compact(ctx, snapshot.Revision+1)
+	require.NoError(t, err)
+	_, err = s.SnapshotAt(ctx, "/snapshot/", snapshot.Revision)
+	assert.True(t, IsCompacted(err))
+}
+
+// TestApplyRollback tests applying rollback changes guarded by the revisions they were planned at
+func TestApplyRollback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	etcdClient, _ := setupEtcdContainer(ctx, t)
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+
+	a, err := etcdClient.Put(ctx, "/rollback/a", "2")
+	require.NoError(t, err)
+	b, err := etcdClient.Put(ctx, "/rollback/b", "new")
+	require.NoError(t, err)
+	revision, err := etcdClient.ApplyRollback(ctx, []RollbackChange{
+		{Key: "/rollback/a", Value: "1", CurrentRevision: a.Header.Revision},
+		{Key: "/rollback/b", Delete: true, CurrentRevision: b.Header.Revision},
+		{Key: "/rollback/c", Value: "old"},
+	})
+	require.NoError(t, err)
+	resp, err := etcdClient.Get(ctx, "/rollback/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 2)
+	assert.Equal(t, "1", string(resp.Kvs[0].Value))
+	assert.Equal(t, "old", string(resp.Kvs[1].Value))
+	assert.Equal(t, revision, resp.Header.Revision)
+
+	_, err = etcdClient.ApplyRollback(ctx, []RollbackChange{{Key: "/rollback/a", Value: "0", CurrentRevision: a.Header.Revision}})
+	assert.ErrorIs(t, err, ErrRollbackConflict, "the key changed after the rollback was planned")
+}
+
+// TestChunkedValues tests writing values beyond the etcd request limit in chunks and reading them back
+func TestChunkedValues(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	etcdClient, _ := setupEtcdContainer(ctx, t)
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+
+	large := strings.Repeat("0123456789", 250_000)
+	revision, _, err := etcdClient.PutChunked(ctx, "/blobs/a", large)
+	require.NoError(t, err)
+	resp, err := etcdClient.Get(ctx, "/blobs/a/.chunks/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.Count)
+
+	s := NewService(nil, etcdClient, WithConfig(Config{Prefixes: []string{"/blobs/"}, ChunkPrefixes: []string{"/blobs/"}}))
+	resp, err = etcdClient.Get(ctx, "/blobs/a")
+	require.NoError(t, err)
+	records := []KeyValueRecord{{Key: "/blobs/a", Value: string(resp.Kvs[0].Value), Revision: revision}}
+	require.NoError(t, s.assembleChunks(ctx, records))
+	assert.Equal(t, large, records[0].Value)
+
+	// A smaller value removes the chunks of the earlier one
+	_, _, err = etcdClient.PutChunked(ctx, "/blobs/a", "small")
+	require.NoError(t, err)
+	resp, err = etcdClient.Get(ctx, "/blobs/a/.chunks/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	require.NoError(t, err)
+	assert.Zero(t, resp.Count)
+
+	_, _, err = etcdClient.PutChunked(ctx, "/blobs/a", large)
+	require.NoError(t, err)
+	_, _, err = etcdClient.DeleteChunked(ctx, "/blobs/a")
+	require.NoError(t, err)
+	resp, err = etcdClient.Get(ctx, "/blobs/a", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	require.NoError(t, err)
+	assert.Zero(t, resp.Count)
+}
+
+// TestCheckResumeRevision tests detecting a resume revision etcd has compacted away
+func TestCheckResumeRevision(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	etcdClient, _ := setupEtcdContainer(ctx, t)
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+
+	first, err := etcdClient.Put(ctx, "/resume/key", "1")
+	require.NoError(t, err)
+	_, err = etcdClient.Put(ctx, "/resume/key", "2")
+	require.NoError(t, err)
+	last, err := etcdClient.Put(ctx, "/resume/key", "3")
+	require.NoError(t, err)
+
+	current, ok, err := etcdClient.CheckResumeRevision(ctx, "/resume/", first.Header.Revision)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, last.Header.Revision, current)
+
+	_, err = etcdClient.Compact(ctx, last.Header.Revision)
+	require.NoError(t, err)
+
+	_, ok, err = etcdClient.CheckResumeRevision(ctx, "/resume/", first.Header.Revision)
+	require.NoError(t, err)
+	assert.False(t, ok, "revisions after the checkpoint were compacted")
+
+	_, ok, err = etcdClient.CheckResumeRevision(ctx, "/resume/", last.Header.Revision)
+	require.NoError(t, err)
+	assert.True(t, ok, "nothing to replay after the latest revision")
+}
+
 func TestPollingMechanism(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
@@ -465,3 +726,207 @@ func TestPerformanceSyncLatency(t *testing.T) {
 	t.Logf("Average sync latency: %v", avgLatency)
 	assert.Less(t, avgLatency, 100*time.Millisecond, "Average sync latency should be under 100ms")
 }
+
+// TestKeyPolicyHexRoundTrip tests changing and deleting a key stored hex encoded from PostgreSQL
+func TestKeyPolicyHexRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	pool, etcdClient, cleanup := setupTestContainers(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s := NewService(pool, etcdClient, WithConfig(Config{Prefixes: []string{"/hex/"}, KeyPolicy: KeyPolicyHex}))
+
+	const key = "/hex/\xff"
+	_, err := etcdClient.Put(ctx, key, "1")
+	require.NoError(t, err)
+	_, err = s.initialSyncPrefix(ctx, "/hex/")
+	require.NoError(t, err)
+	stored := s.storedKey(key)
+
+	_, err = pool.Exec(ctx, `INSERT INTO etcd (key, value, revision) VALUES ($1, '2', -1)`, stored)
+	require.NoError(t, err)
+	require.NoError(t, s.pollAndProcessPendingRecords(ctx))
+	resp, err := etcdClient.Get(ctx, "/hex/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1, "no literal hex encoded key written")
+	assert.Equal(t, key, string(resp.Kvs[0].Key))
+	assert.Equal(t, "2", string(resp.Kvs[0].Value))
+
+	_, err = pool.Exec(ctx, `INSERT INTO etcd (key, value, tombstone, revision) VALUES ($1, '', true, -1)`, stored)
+	require.NoError(t, err)
+	require.NoError(t, s.pollAndProcessPendingRecords(ctx))
+	resp, err = etcdClient.Get(ctx, "/hex/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	assert.Empty(t, resp.Kvs, "raw key deleted")
+}
+
+// TestFailpointPushAfterEtcd tests recovering a pending record written to etcd by a daemon crashing before
+// storing its revision
+func TestFailpointPushAfterEtcd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+	t.Cleanup(failpoint.Disable)
+
+	pool, etcdClient, cleanup := setupTestContainers(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s := NewService(pool, etcdClient, WithPrefix("/failpoint/"))
+
+	_, err := pool.Exec(ctx, `INSERT INTO etcd (key, value, revision) VALUES ('/failpoint/a', '1', -1)`)
+	require.NoError(t, err)
+
+	require.NoError(t, failpoint.Enable(FailpointPushAfterEtcd+"=1*error"))
+	_ = s.pollAndProcessPendingRecords(ctx)
+
+	resp, err := etcdClient.Get(ctx, "/failpoint/a")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1, "written to etcd before the failure")
+	var pending int
+	require.NoError(t, pool.QueryRow(ctx, `SELECT count(*) FROM etcd WHERE revision = -1`).Scan(&pending))
+	assert.Equal(t, 1, pending, "revision not stored")
+
+	// A restarted daemon finds the claim of the crashed one and acknowledges the write instead of repeating it
+	_, err = pool.Exec(ctx, `UPDATE etcd SET claimed_by = 'crashed' WHERE revision = -1`)
+	require.NoError(t, err)
+	require.NoError(t, s.recoverClaims(ctx))
+
+	var revision int64
+	require.NoError(t, pool.QueryRow(ctx, `SELECT revision FROM etcd WHERE key = '/failpoint/a'`).Scan(&revision))
+	assert.Equal(t, resp.Kvs[0].ModRevision, revision)
+	after, err := etcdClient.Get(ctx, "/failpoint/a")
+	require.NoError(t, err)
+	assert.Equal(t, resp.Kvs[0].ModRevision, after.Kvs[0].ModRevision, "not written twice")
+}
+
+// TestFailpointPushMidBatch tests recovering a transaction whose records were only partially acknowledged
+func TestFailpointPushMidBatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+	t.Cleanup(failpoint.Disable)
+
+	pool, etcdClient, cleanup := setupTestContainers(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s := NewService(pool, etcdClient, WithPrefix("/failpoint/"))
+
+	_, err := pool.Exec(ctx, `INSERT INTO etcd (key, value, revision) VALUES ('/failpoint/a', '1', -1), ('/failpoint/b', '2', -1)`)
+	require.NoError(t, err)
+
+	require.NoError(t, failpoint.Enable(FailpointPushMidBatch+"=1*error"))
+	_ = s.pollAndProcessPendingRecords(ctx)
+
+	var pending int
+	require.NoError(t, pool.QueryRow(ctx, `SELECT count(*) FROM etcd WHERE revision = -1`).Scan(&pending))
+	assert.Equal(t, 1, pending, "only the first record was acknowledged")
+
+	_, err = pool.Exec(ctx, `UPDATE etcd SET claimed_by = 'crashed' WHERE revision = -1`)
+	require.NoError(t, err)
+	require.NoError(t, s.recoverClaims(ctx))
+
+	var revisions int
+	require.NoError(t, pool.QueryRow(ctx, `SELECT count(DISTINCT revision) FROM etcd WHERE revision > 0`).Scan(&revisions))
+	assert.Equal(t, 1, revisions, "both records carry the revision of their transaction")
+	require.NoError(t, pool.QueryRow(ctx, `SELECT count(*) FROM etcd WHERE revision = -1`).Scan(&pending))
+	assert.Zero(t, pending)
+}
+
+// TestFailpointPushRetried tests pushing a pending record again after its push failed, without a restart
+func TestFailpointPushRetried(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+	t.Cleanup(failpoint.Disable)
+
+	pool, etcdClient, cleanup := setupTestContainers(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := NewEtcdClient("etcd://"+etcdClient.Endpoints()[0]+"/test", ApplyFailpoints)
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+	s := NewService(pool, client, WithPrefix("/failpoint/"))
+
+	_, err = pool.Exec(ctx, `INSERT INTO etcd (key, value, revision) VALUES ('/failpoint/a', '1', -1)`)
+	require.NoError(t, err)
+
+	require.NoError(t, failpoint.Enable(FailpointEtcdRequest+"=error"))
+	pending, err := s.pushPendingRecords(ctx)
+	require.NoError(t, err)
+	assert.True(t, pending, "failed push leaves the record pending")
+
+	failpoint.Disable()
+	pending, err = s.pushPendingRecords(ctx)
+	require.NoError(t, err)
+	assert.False(t, pending)
+
+	resp, err := etcdClient.Get(ctx, "/failpoint/a")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	var revision int64
+	require.NoError(t, pool.QueryRow(ctx, `SELECT revision FROM etcd WHERE key = '/failpoint/a'`).Scan(&revision))
+	assert.Equal(t, resp.Kvs[0].ModRevision, revision)
+}
+
+// TestFailpointInitialSync tests that an interrupted initial sync leaves no partial snapshot behind
+func TestFailpointInitialSync(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+	t.Cleanup(failpoint.Disable)
+
+	pool, etcdClient, cleanup := setupTestContainers(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s := NewService(pool, etcdClient, WithPrefix("/failpoint/"))
+
+	_, err := etcdClient.Put(ctx, "/failpoint/a", "1")
+	require.NoError(t, err)
+
+	require.NoError(t, failpoint.Enable(FailpointInitialSync+"=1*error"))
+	_, err = s.initialSyncPrefix(ctx, "/failpoint/")
+	require.ErrorIs(t, err, failpoint.ErrInjected)
+
+	var rows int
+	require.NoError(t, pool.QueryRow(ctx, `SELECT count(*) FROM etcd`).Scan(&rows))
+	assert.Zero(t, rows, "snapshot rolled back")
+	revision, err := GetSyncState(ctx, pool, "/failpoint/")
+	require.NoError(t, err)
+	assert.Zero(t, revision, "no checkpoint without snapshot")
+
+	count, err := s.initialSyncPrefix(ctx, "/failpoint/")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+// TestFailpointEtcdUnavailable tests that unavailable etcd requests are retried
+func TestFailpointEtcdUnavailable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+	t.Cleanup(failpoint.Disable)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	etcdClient, endpoint := setupEtcdContainer(ctx, t)
+	defer func() {
+		_ = etcdClient.Close()
+	}()
+	require.NoError(t, failpoint.Enable(FailpointEtcdRequest+"=2*error"))
+	client, err := NewEtcdClient("etcd://"+endpoint+"/test", ApplyFailpoints)
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+
+	err = RetryEtcdOperation(ctx, func() error {
+		_, err := client.Put(ctx, "/failpoint/a", "1")
+		return err
+	})
+	require.NoError(t, err, "two injected failures are retried")
+}
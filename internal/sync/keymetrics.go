@@ -0,0 +1,47 @@
+package sync
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+)
+
+// MaxMetricPrefixes bounds the number of key prefixes metrics are broken down by, every prefix is a label value
+const MaxMetricPrefixes = 50
+
+// otherKeys is the metric label of keys outside all metric prefixes
+const otherKeys = "other"
+
+// metricPrefix returns the metric label of key, the longest metric prefix it starts with
+func (s *Service) metricPrefix(key string) string {
+	label := otherKeys
+	for _, prefix := range s.metricPrefixes {
+		if strings.HasPrefix(key, prefix) && (label == otherKeys || len(prefix) > len(label)) {
+			label = prefix
+		}
+	}
+	return label
+}
+
+// observeSynced counts a change of key synced in direction and its latency since start
+func (s *Service) observeSynced(direction, key string, start time.Time) {
+	s.stats.countSynced(direction)
+	prefix := s.metricPrefix(key)
+	metrics.SyncedChanges.WithLabelValues(direction, prefix).Inc()
+	metrics.SyncLatency.WithLabelValues(direction, prefix).Observe(s.now().Sub(start).Seconds())
+}
+
+// observeBacklog exports the number of pending records per metric prefix
+func (s *Service) observeBacklog(records []KeyValueRecord) {
+	s.backlog.Store(int64(len(records)))
+	counts := make(map[string]int, len(s.metricPrefixes)+1)
+	for _, record := range records {
+		counts[s.metricPrefix(record.Key)]++
+	}
+	// Prefixes without pending records are reset, the label set never grows beyond the configured prefixes
+	for _, prefix := range s.metricPrefixes {
+		metrics.PendingRecords.WithLabelValues(prefix).Set(float64(counts[prefix]))
+	}
+	metrics.PendingRecords.WithLabelValues(otherKeys).Set(float64(counts[otherKeys]))
+}
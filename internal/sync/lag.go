@@ -0,0 +1,131 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// lagCheckInterval is how often the etcd header revision is compared with the revision applied to PostgreSQL
+const lagCheckInterval = 10 * time.Second
+
+// revisionSample is an etcd header revision and the time it was observed
+type revisionSample struct {
+	revision int64
+	seen     time.Time
+}
+
+// lagTracker follows how far every prefix is applied to PostgreSQL compared with the etcd header revision
+type lagTracker struct {
+	mu      sync.Mutex
+	applied map[string]int64 // revision each watched prefix is applied up to
+	samples []revisionSample // header revisions not applied yet, oldest first
+}
+
+func newLagTracker() *lagTracker {
+	return &lagTracker{applied: make(map[string]int64)}
+}
+
+// observe records that all events of prefix up to revision are applied
+func (t *lagTracker) observe(prefix string, revision int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if revision > t.applied[prefix] {
+		t.applied[prefix] = revision
+	}
+}
+
+// appliedRevision returns the revision prefix is applied up to, 0 if its watch didn't start yet
+func (t *lagTracker) appliedRevision(prefix string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.applied[prefix]
+}
+
+// update adds a header revision observed at now and returns the lag of the slowest prefix in revisions and
+// the age of the oldest unapplied event. The age is the time since the first header revision covering that
+// event was observed, so it is accurate to one check interval.
+func (t *lagTracker) update(header int64, now time.Time) (int64, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.applied) == 0 {
+		return 0, 0 // no watch started yet
+	}
+
+	applied := int64(-1)
+	for _, revision := range t.applied {
+		if applied < 0 || revision < applied {
+			applied = revision
+		}
+	}
+
+	if n := len(t.samples); n == 0 || header > t.samples[n-1].revision {
+		t.samples = append(t.samples, revisionSample{revision: header, seen: now})
+	}
+	i := 0
+	for i < len(t.samples) && t.samples[i].revision <= applied {
+		i++
+	}
+	t.samples = t.samples[i:]
+
+	if len(t.samples) == 0 {
+		return 0, 0
+	}
+	return header - applied, now.Sub(t.samples[0].seen)
+}
+
+// HeaderRevision returns the current revision of the etcd cluster
+func (c *EtcdClient) HeaderRevision(ctx context.Context, prefix string) (int64, error) {
+	resp, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get etcd header revision: %w", err)
+	}
+	return resp.Header.Revision, nil
+}
+
+// monitorLag periodically exports how far PostgreSQL is behind etcd and warns above the lag threshold
+func (s *Service) monitorLag(ctx context.Context) {
+	ticker := time.NewTicker(lagCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		header, err := s.etcdClient.HeaderRevision(ctx, s.prefixes[0])
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger().WithError(err).Warn("Failed to check the replication lag")
+			}
+			continue
+		}
+		// Quiet prefixes only learn about revisions of other keys from progress notifications
+		if err := s.etcdClient.RequestProgress(ctx); err != nil {
+			s.logger().WithError(err).Debug("Failed to request etcd watch progress")
+		}
+
+		revisions, age := s.lag.update(header, s.now())
+		s.stats.setLag(revisions, age)
+		metrics.ReplicationLagRevisions.Set(float64(revisions))
+		metrics.ReplicationLagSeconds.Set(age.Seconds())
+		if s.tenant != "" {
+			metrics.TenantLagSeconds.WithLabelValues(s.tenant).Set(age.Seconds())
+		}
+		if s.lagThreshold > 0 && age >= s.lagThreshold {
+			s.logger().WithFields(log.Fields{
+				"lag_revisions": revisions,
+				"lag_seconds":   age.Seconds(),
+				"threshold":     s.lagThreshold,
+			}).Warn("PostgreSQL is lagging behind etcd")
+		}
+	}
+}
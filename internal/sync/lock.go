@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Behaviors when the instance lock is held by another daemon
+const (
+	// LockBlock waits on the lock until the other instance releases it
+	LockBlock = "block"
+	// LockExit fails immediately if the lock is held
+	LockExit = "exit"
+	// LockStandby retries the lock periodically, reporting the instance as standby meanwhile
+	LockStandby = "standby"
+)
+
+// lockCheckInterval is how often the lock connection is verified to be alive
+const lockCheckInterval = 10 * time.Second
+
+// lockKeyExpr derives the advisory lock key from the current schema and the etcd prefix
+const lockKeyExpr = `hashtextextended(current_schema() || ':' || $1, 0)`
+
+// InstanceLock is a session level advisory lock guaranteeing a single writer per (schema, prefix)
+type InstanceLock struct {
+	conn   *pgxpool.Conn
+	prefix string
+}
+
+// AcquireInstanceLock takes the advisory lock for prefix on a dedicated connection, behaving according to mode
+// if another instance holds it. retryInterval is used by LockStandby.
+func AcquireInstanceLock(ctx context.Context, pool *pgxpool.Pool, prefix, mode string, retryInterval time.Duration) (*InstanceLock, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock connection: %w", err)
+	}
+	lock := &InstanceLock{conn: conn, prefix: prefix}
+
+	if err := lock.acquire(ctx, mode, retryInterval); err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	log.Default().WithField("prefix", prefix).Info("Acquired instance lock")
+	return lock, nil
+}
+
+func (l *InstanceLock) acquire(ctx context.Context, mode string, retryInterval time.Duration) error {
+	if mode == LockBlock {
+		log.Default().WithField("prefix", l.prefix).Info("Waiting for instance lock")
+		if _, err := l.conn.Exec(expectSlow(ctx), `SELECT pg_advisory_lock(`+lockKeyExpr+`)`, l.prefix); err != nil {
+			return fmt.Errorf("failed to take instance lock: %w", err)
+		}
+		return nil
+	}
+
+	for {
+		var acquired bool
+		if err := l.conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(`+lockKeyExpr+`)`, l.prefix).Scan(&acquired); err != nil {
+			return fmt.Errorf("failed to take instance lock: %w", err)
+		}
+		if acquired {
+			return nil
+		}
+		if mode == LockExit {
+			return fmt.Errorf("instance lock for prefix %q is held by another pg_etcd instance", l.prefix)
+		}
+
+		log.Default().WithField("prefix", l.prefix).Info("Another instance holds the lock, running in standby mode")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Monitor checks the lock connection periodically and calls lost if the session, and thus the lock, is gone
+func (l *InstanceLock) Monitor(ctx context.Context, lost func()) {
+	go func() {
+		ticker := time.NewTicker(lockCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := l.conn.Ping(ctx); err != nil && ctx.Err() == nil {
+					log.Default().WithError(err).Error("Lost instance lock connection")
+					lost()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Release unlocks and returns the lock connection to the pool
+func (l *InstanceLock) Release(ctx context.Context) {
+	if _, err := l.conn.Exec(ctx, `SELECT pg_advisory_unlock(`+lockKeyExpr+`)`, l.prefix); err != nil {
+		log.Default().WithError(err).Warn("Failed to release instance lock")
+	}
+	l.conn.Release()
+}
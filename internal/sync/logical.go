@@ -0,0 +1,218 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Capture methods for PostgreSQL to etcd synchronization
+const (
+	// CapturePoll polls the etcd table for pending records
+	CapturePoll = "poll"
+	// CaptureLogical consumes pending records from a wal2json logical replication slot
+	CaptureLogical = "logical"
+)
+
+const (
+	// ReplicationSlot is the name of the logical replication slot used by CaptureLogical
+	ReplicationSlot = "pg_etcd"
+	// logicalBatchSize limits the number of changes peeked from the slot at once
+	logicalBatchSize = 1000
+)
+
+// walChange is a single wal2json (format-version 2) change of the etcd or etcd_latest table
+type walChange struct {
+	Action  string `json:"action"`
+	Columns []struct {
+		Name  string          `json:"name"`
+		Value json.RawMessage `json:"value"`
+	} `json:"columns"`
+}
+
+// parseWalChange extracts the key of a pending record from a wal2json change,
+// ok is false for changes not creating or updating a pending record
+func parseWalChange(data string) (key string, ok bool, err error) {
+	var change walChange
+	if err := json.Unmarshal([]byte(data), &change); err != nil {
+		return "", false, fmt.Errorf("failed to decode wal2json change: %w", err)
+	}
+	if change.Action != "I" && change.Action != "U" {
+		return "", false, nil
+	}
+
+	var revision int64
+	for _, col := range change.Columns {
+		switch col.Name {
+		case "key":
+			err = json.Unmarshal(col.Value, &key)
+		case "revision":
+			err = json.Unmarshal(col.Value, &revision)
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("failed to decode column %s: %w", col.Name, err)
+		}
+	}
+	return key, revision == -1, nil
+}
+
+// EnsureReplicationSlot creates the wal2json logical replication slot if it doesn't exist yet
+func EnsureReplicationSlot(ctx context.Context, pool PgxIface) error {
+	query := `SELECT pg_create_logical_replication_slot($1, 'wal2json')
+		WHERE NOT EXISTS (SELECT FROM pg_replication_slots WHERE slot_name = $1)`
+	if _, err := pool.Exec(ctx, query, ReplicationSlot); err != nil {
+		return fmt.Errorf("failed to create replication slot: %w", err)
+	}
+	return nil
+}
+
+// PeekPendingKeys reads changes up to uptoLSN from the replication slot without consuming them.
+// It returns the keys of pending records, the LSN up to which the slot can be advanced and
+// whether the batch limit was reached
+func PeekPendingKeys(ctx context.Context, pool PgxIface, uptoLSN string) (keys []string, lsn string, more bool, err error) {
+	query := `SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, $2::pg_lsn, $3,
+		'format-version', '2', 'include-transaction', 'false',
+		'add-tables', '*.etcd,*.etcd_latest', 'actions', 'insert,update')`
+
+	rows, err := pool.Query(ctx, query, ReplicationSlot, uptoLSN, logicalBatchSize)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to peek replication slot: %w", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&lsn, &data); err != nil {
+			return nil, "", false, fmt.Errorf("error scanning slot change: %w", err)
+		}
+		count++
+		key, pending, err := parseWalChange(data)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if pending {
+			keys = append(keys, key)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", false, fmt.Errorf("error iterating slot changes: %w", err)
+	}
+
+	// Without hitting the limit everything up to uptoLSN was decoded, including changes of
+	// other tables filtered out by wal2json, so the slot may skip past them
+	if count < logicalBatchSize {
+		return keys, uptoLSN, false, nil
+	}
+	return keys, lsn, true, nil
+}
+
+// AdvanceReplicationSlot confirms all changes up to lsn as consumed
+func AdvanceReplicationSlot(ctx context.Context, pool PgxIface, lsn string) error {
+	if _, err := pool.Exec(ctx, `SELECT pg_replication_slot_advance($1, $2::pg_lsn)`, ReplicationSlot, lsn); err != nil {
+		return fmt.Errorf("failed to advance replication slot: %w", err)
+	}
+	return nil
+}
+
+// syncPostgreSQLToEtcdLogical consumes the replication slot and syncs pending records to etcd
+func (s *Service) syncPostgreSQLToEtcdLogical(ctx context.Context) error {
+	s.logger().Info("Starting PostgreSQL to etcd sync with logical decoding")
+
+	// Create the slot before flushing the backlog so no pending record can be missed in between
+	if err := EnsureReplicationSlot(ctx, s.pgPool); err != nil {
+		return err
+	}
+	if err := s.recoverClaims(ctx); err != nil {
+		countError(err)
+		s.logger().WithError(err).Warn("Failed to recover pending records claimed by a previous daemon, pushing them again")
+	}
+	if err := s.pollAndProcessPendingRecords(ctx); err != nil {
+		return fmt.Errorf("failed to process pending backlog: %w", err)
+	}
+
+	retry := false
+	for {
+		// Changes whose push failed are consumed from the slot, their rows stay pending until pushed again
+		if retry {
+			var err error
+			if retry, err = s.pushPendingRecords(ctx); err != nil {
+				countError(err)
+				s.logger().WithError(err).Error("Failed to push pending records again")
+			}
+		}
+		more, failed, err := s.consumeReplicationSlot(ctx)
+		if err != nil {
+			countError(err)
+			s.logger().WithError(err).Error("Failed to consume replication slot")
+		}
+		retry = retry || failed
+		s.markLoop()
+		if more {
+			continue // batch limit reached, more changes are waiting in the slot
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.pollingInterval):
+		}
+	}
+}
+
+// consumeReplicationSlot processes one batch of slot changes and reports whether more changes are waiting
+// and whether the push of a change failed
+func (s *Service) consumeReplicationSlot(ctx context.Context) (more, failed bool, err error) {
+	// etcd rejects writes without leader or with alarms, leave the changes in the slot, also while paused
+	if s.ClusterHold() != "" || s.Paused() {
+		return false, false, nil
+	}
+
+	var currentLSN string
+	if err := s.pgPool.QueryRow(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&currentLSN); err != nil {
+		return false, false, fmt.Errorf("failed to get current WAL position: %w", err)
+	}
+	keys, lsn, more, err := PeekPendingKeys(ctx, s.pgPool, currentLSN)
+	if err != nil {
+		return false, false, err
+	}
+	s.backlog.Store(int64(len(keys)))
+
+	// Changes only identify the key, the current pending row is what gets pushed,
+	// so repeated changes of the same key and rows flushed by the backlog are skipped
+	for _, key := range keys {
+		ctx := correlate(ctx)
+		record, err := s.store.ClaimPendingRecord(ctx, s.pgPool, key, instanceID())
+		if err != nil {
+			return false, false, err
+		}
+		if record == nil {
+			continue
+		}
+		records := s.rejectInvalid(ctx, []KeyValueRecord{*record})
+		if len(records) == 0 {
+			continue // violates its JSON Schema
+		}
+		if err := s.pinBaseRevisions(ctx, records); err != nil {
+			return false, false, err
+		}
+		record = &records[0]
+		err = s.retryPending(ctx, func() error {
+			return s.processPendingRecord(ctx, *record)
+		})
+		if err != nil {
+			failed = true
+			s.recordFailure(log.DirectionPgToEtcd, key, 0, err)
+			s.recordAttempt(ctx, key, err)
+			s.logger().WithContext(ctx).WithError(err).WithField("key", key).Error("Failed to process pending record after retries")
+		}
+	}
+
+	if err := AdvanceReplicationSlot(ctx, s.pgPool, lsn); err != nil {
+		return false, false, err
+	}
+	return more, failed, nil
+}
@@ -0,0 +1,71 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Directions of the synchronization, see WithDirection
+const (
+	DirectionBoth     = "both"
+	DirectionEtcdToPg = log.DirectionEtcdToPg // read-only mirror, PostgreSQL changes are not pushed to etcd
+	DirectionPgToEtcd = log.DirectionPgToEtcd // PostgreSQL is the source, etcd changes are not mirrored
+)
+
+// Option configures a Service created by NewService
+type Option func(*Config)
+
+// WithConfig applies all settings of config, options after it override single settings
+func WithConfig(config Config) Option {
+	return func(c *Config) { *c = config }
+}
+
+// WithPrefix synchronizes the etcd key prefixes, the prefix of the etcd DSN by default
+func WithPrefix(prefixes ...string) Option {
+	return func(c *Config) { c.Prefixes = prefixes }
+}
+
+// WithDirection limits the synchronization to DirectionEtcdToPg or DirectionPgToEtcd, DirectionBoth by default
+func WithDirection(direction string) Option {
+	return func(c *Config) { c.Direction = direction }
+}
+
+// WithBatchSize bounds the number of pending changes pushed in one etcd transaction, 128 by default.
+// Larger batches need a larger --max-txn-ops of etcd.
+func WithBatchSize(size int) Option {
+	return func(c *Config) { c.BatchSize = size }
+}
+
+// WithConflictStrategy decides about pending changes of keys changed in etcd meanwhile,
+// ConflictPostgreSQLWins by default. ConflictEtcdWins requires history storage and pushes every
+// change in a transaction of its own.
+func WithConflictStrategy(strategy string) Option {
+	return func(c *Config) { c.ConflictStrategy = strategy }
+}
+
+// WithLogger logs the messages of the service to logger instead of log.Default(), e.g. a log.NewSlog
+func WithLogger(logger log.Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithClock reads the time of timestamps, ages and latencies from now instead of time.Now, e.g. in tests
+func WithClock(now func() time.Time) Option {
+	return func(c *Config) { c.Clock = now }
+}
+
+// logger returns the logger of the service messages
+func (s *Service) logger() log.Logger {
+	if s.log == nil {
+		return log.Default()
+	}
+	return s.log
+}
+
+// now returns the current time of the service clock
+func (s *Service) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
@@ -3,16 +3,32 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/sirupsen/logrus"
 
 	"github.com/cybertec-postgresql/pg_etcd/internal/migrations"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
 )
 
+// ErrStatementTimeout marks PostgreSQL operations canceled by the statement timeout
+var ErrStatementTimeout = errors.New("PostgreSQL statement timeout")
+
+// IsTimeout reports whether err is caused by a statement timeout or a canceled query
+func IsTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "57014" { // query_canceled
+		return true
+	}
+	return errors.Is(err, ErrStatementTimeout) || errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err)
+}
+
 // PgxIface is common interface for every pgx class
 type PgxIface interface {
 	Begin(ctx context.Context) (pgx.Tx, error)
@@ -31,7 +47,7 @@ func New(ctx context.Context, databaseURL string, callbacks ...func(*pgxpool.Con
 	}
 
 	// Set up connection callbacks
-	logger := logrus.WithField("component", "postgresql")
+	logger := log.Default().WithField("component", "postgresql")
 	connConfig.ConnConfig.OnNotice = func(_ *pgconn.PgConn, n *pgconn.Notice) {
 		logger.WithField("severity", n.Severity).WithField("notice", n.Message).Info("Notice received")
 	}
@@ -43,6 +59,45 @@ func New(ctx context.Context, databaseURL string, callbacks ...func(*pgxpool.Con
 	return pgxpool.NewWithConfig(ctx, connConfig)
 }
 
+// PoolSettings overrides connection pool limits, zero values keep the DSN or pgxpool defaults
+type PoolSettings struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+	// SimpleProtocol disables prepared statements and their caches for PgBouncer transaction pooling
+	SimpleProtocol bool
+}
+
+// Apply sets the configured pool limits, usable as a New callback
+func (p PoolSettings) Apply(config *pgxpool.Config) error {
+	if p.MaxConns > 0 {
+		config.MaxConns = p.MaxConns
+	}
+	if p.MinConns > 0 {
+		config.MinConns = p.MinConns
+	}
+	if config.MinConns > config.MaxConns {
+		return fmt.Errorf("minimum pool size %d exceeds maximum pool size %d", config.MinConns, config.MaxConns)
+	}
+	if p.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = p.MaxConnLifetime
+	}
+	if p.MaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = p.MaxConnIdleTime
+	}
+	if p.HealthCheckPeriod > 0 {
+		config.HealthCheckPeriod = p.HealthCheckPeriod
+	}
+	if p.SimpleProtocol {
+		config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+		config.ConnConfig.StatementCacheCapacity = 0
+		config.ConnConfig.DescriptionCacheCapacity = 0
+	}
+	return nil
+}
+
 // ApplyMigrations checks and applies database migrations if needed
 func ApplyMigrations(ctx context.Context, conn *pgx.Conn) error {
 	needsMigration, err := migrations.NeedsUpgrade(ctx, conn)
@@ -51,52 +106,196 @@ func ApplyMigrations(ctx context.Context, conn *pgx.Conn) error {
 	}
 
 	if needsMigration {
-		logrus.Info("Applying database migrations...")
+		log.Default().Info("Applying database migrations...")
 		err = migrations.Apply(ctx, conn)
 		if err != nil {
 			return fmt.Errorf("failed to apply migrations: %w", err)
 		}
-		logrus.Info("Database migrations completed successfully")
+		log.Default().Info("Database migrations completed successfully")
 	} else {
-		logrus.Info("Database schema is up to date")
+		log.Default().Info("Database schema is up to date")
+	}
+
+	return nil
+}
+
+// MigrateSchema applies pending migrations on a connection acquired from the pool
+func MigrateSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection for migrations: %w", err)
+	}
+	defer conn.Release()
+	return ApplyMigrations(ctx, conn.Conn())
+}
+
+// InRecovery reports whether the connected PostgreSQL instance is a standby
+func InRecovery(ctx context.Context, pool PgxIface) (bool, error) {
+	var inRecovery bool
+	if err := pool.QueryRow(ctx, `SELECT pg_is_in_recovery()`).Scan(&inRecovery); err != nil {
+		return false, fmt.Errorf("failed to check recovery state: %w", err)
 	}
+	return inRecovery, nil
+}
 
+// WaitForPrimary blocks while the connected PostgreSQL instance is a standby, checking every interval,
+// so a daemon attached to a standby stays paused and starts syncing as soon as it is promoted
+func WaitForPrimary(ctx context.Context, pool PgxIface, interval time.Duration) error {
+	logged := false
+	for {
+		inRecovery, err := InRecovery(ctx, pool)
+		if err != nil {
+			return err
+		}
+		if !inRecovery {
+			if logged {
+				log.Default().Info("PostgreSQL was promoted, starting synchronization")
+			}
+			return nil
+		}
+		if !logged {
+			log.Default().WithField("interval", interval).Info("PostgreSQL is in recovery, waiting for promotion")
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// SetReadOnly enables or disables the triggers rejecting pending rows in the etcd tables
+func SetReadOnly(ctx context.Context, pool PgxIface, readOnly bool) error {
+	if _, err := pool.Exec(ctx, `SELECT etcd_set_read_only($1)`, readOnly); err != nil {
+		return fmt.Errorf("failed to set read-only mode: %w", err)
+	}
+	return nil
+}
+
+// SetKeyPath enables or disables the triggers splitting the keys of the etcd tables into their key_path
+// column. Enabling fills the paths of the rows written while they were disabled.
+func SetKeyPath(ctx context.Context, pool PgxIface, enabled bool) error {
+	if _, err := pool.Exec(ctx, `SELECT etcd_set_key_path($1)`, enabled); err != nil {
+		return fmt.Errorf("failed to set key paths: %w", err)
+	}
 	return nil
 }
 
+// ChangeNotification is the JSON payload sent on the notify channel for every applied etcd change.
+// Values are not included to stay below the NOTIFY payload limit, use etcd_get() to read them.
+type ChangeNotification struct {
+	Key       string    `json:"key"`
+	Revision  int64     `json:"revision"`
+	Tombstone bool      `json:"tombstone"`
+	Ts        time.Time `json:"ts"`
+}
+
 // BulkInsert performs bulk insert of key-value records using INSERT ON CONFLICT with pgx.Batch
 func BulkInsert(ctx context.Context, pool PgxIface, records []KeyValueRecord) error {
+	return BulkInsertWithNotify(ctx, pool, records, "")
+}
+
+// BulkInsertWithNotify performs BulkInsert and sends a ChangeNotification on channel for every record.
+// Notifications are part of the same implicit batch transaction, listeners only see committed changes.
+func BulkInsertWithNotify(ctx context.Context, pool PgxIface, records []KeyValueRecord, channel string) error {
 	if len(records) == 0 {
 		return nil
 	}
 
 	batch := &pgx.Batch{}
-	query := `INSERT INTO etcd (ts, key, value, revision, tombstone) 
-			  VALUES ($1, $2, $3, $4, $5) 
+	query := `INSERT INTO etcd (ts, key, value, revision, tombstone, create_revision, version, lease, encoding, value_hash, facts) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11) 
 			  ON CONFLICT (key, revision) DO UPDATE SET 
-			  ts = EXCLUDED.ts, value = EXCLUDED.value, tombstone = EXCLUDED.tombstone`
+			  ts = EXCLUDED.ts, value = EXCLUDED.value, tombstone = EXCLUDED.tombstone,
+			  create_revision = EXCLUDED.create_revision, version = EXCLUDED.version, lease = EXCLUDED.lease,
+			  encoding = EXCLUDED.encoding, value_hash = EXCLUDED.value_hash, facts = EXCLUDED.facts`
 
 	for _, record := range records {
 		if record.Tombstone {
-			record.Value = "" // Insert empty for tombstones
+			record.Value, record.Encoding, record.Hash, record.Facts = "", "", nil, nil // Insert empty for tombstones
 		}
-		batch.Queue(query, record.Ts, record.Key, record.Value, record.Revision, record.Tombstone)
+		batch.Queue(query, record.Ts, record.Key, record.Value, record.Revision, record.Tombstone,
+			record.CreateRevision, record.Version, record.Lease, record.Encoding, record.Hash, record.Facts)
+	}
+
+	if err := queueNotifications(batch, records, channel); err != nil {
+		return err
 	}
 
 	if err := pool.SendBatch(ctx, batch).Close(); err != nil {
 		return fmt.Errorf("failed to execute batch insert: %w", err)
 	}
 
-	logrus.WithField("count", len(records)).Info("Bulk inserted/updated records to PostgreSQL")
+	log.Default().WithField("count", len(records)).Info("Bulk inserted/updated records to PostgreSQL")
 	return nil
 }
 
-// GetPendingRecords retrieves records that need to be synced to etcd (revision = -1)
+// queueNotifications adds a ChangeNotification for every record to batch, nothing if channel is empty
+func queueNotifications(batch *pgx.Batch, records []KeyValueRecord, channel string) error {
+	if channel == "" {
+		return nil
+	}
+	for _, record := range records {
+		payload, err := json.Marshal(ChangeNotification{
+			Key:       record.Key,
+			Revision:  record.Revision,
+			Tombstone: record.Tombstone,
+			Ts:        record.Ts,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode notification: %w", err)
+		}
+		batch.Queue(`SELECT pg_notify($1, $2)`, channel, string(payload))
+	}
+	return nil
+}
+
+// ListenNotifications delivers the changes announced on channel to notify until ctx is done, reconnecting
+// after failures. notify is called with nil after every (re)subscription, changes may have been missed.
+func ListenNotifications(ctx context.Context, pool *pgxpool.Pool, channel string, notify func(*ChangeNotification)) {
+	for ctx.Err() == nil {
+		if err := listen(ctx, pool, channel, notify); err != nil && ctx.Err() == nil {
+			log.Default().WithError(err).WithField("channel", channel).Warn("Listening for change notifications failed, retrying")
+			sleepCtx(ctx, time.Second)
+		}
+	}
+}
+
+// listen holds a pooled connection subscribed to channel until ctx is done or the connection fails
+func listen(ctx context.Context, pool *pgxpool.Pool, channel string, notify func(*ChangeNotification)) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	// The session keeps the subscription, never return it to the pool
+	defer func() { _ = conn.Hijack().Close(context.Background()) }()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+	notify(nil)
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		var change ChangeNotification
+		if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			log.Default().WithError(err).WithField("payload", notification.Payload).Warn("Ignoring malformed change notification")
+			continue
+		}
+		notify(&change)
+	}
+}
+
+// GetPendingRecords retrieves records that need to be synced to etcd (revision = -1), except failed ones
 func GetPendingRecords(ctx context.Context, pool PgxIface) ([]KeyValueRecord, error) {
-	query := `SELECT key, value, revision, ts, tombstone
+	query := `SELECT key, value, revision, ts, tombstone, expected_revision
 		FROM etcd 
-		WHERE revision = -1
-		ORDER BY ts ASC`
+		WHERE revision = -1 AND status IS NULL
+		ORDER BY ts ASC, seq ASC`
 
 	rows, err := pool.Query(ctx, query)
 	if err != nil {
@@ -109,7 +308,7 @@ func GetPendingRecords(ctx context.Context, pool PgxIface) ([]KeyValueRecord, er
 		var record KeyValueRecord
 		var value *string
 
-		err := rows.Scan(&record.Key, &value, &record.Revision, &record.Ts, &record.Tombstone)
+		err := rows.Scan(&record.Key, &value, &record.Revision, &record.Ts, &record.Tombstone, &record.ExpectedRevision)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning pending record: %w", err)
 		}
@@ -131,6 +330,28 @@ func GetPendingRecords(ctx context.Context, pool PgxIface) ([]KeyValueRecord, er
 	return records, nil
 }
 
+// GetPendingRecord retrieves the pending record of a key, returning nil if the key has none or it failed
+func GetPendingRecord(ctx context.Context, pool PgxIface, key string) (*KeyValueRecord, error) {
+	query := `SELECT key, value, revision, ts, tombstone, expected_revision
+		FROM etcd
+		WHERE key = $1 AND revision = -1 AND status IS NULL`
+
+	var record KeyValueRecord
+	var value *string
+	err := pool.QueryRow(ctx, query, key).Scan(&record.Key, &value, &record.Revision, &record.Ts, &record.Tombstone, &record.ExpectedRevision)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending record: %w", err)
+	}
+	if value != nil {
+		record.Value = *value
+	}
+
+	return &record, nil
+}
+
 // UpdateRevision updates the revision of a record after successful sync to etcd
 func UpdateRevision(ctx context.Context, pool PgxIface, key string, revision int64) error {
 	query := `UPDATE etcd SET revision = $2 WHERE key = $1 AND revision = -1`
@@ -148,6 +369,17 @@ func UpdateRevision(ctx context.Context, pool PgxIface, key string, revision int
 	return nil
 }
 
+// DeletePendingRecord removes the pending record of a key, used when etcd rejects a conditional change
+func DeletePendingRecord(ctx context.Context, pool PgxIface, key string) error {
+	query := `DELETE FROM etcd WHERE key = $1 AND revision = -1`
+
+	if _, err := pool.Exec(ctx, query, key); err != nil {
+		return fmt.Errorf("failed to delete pending record: %w", err)
+	}
+
+	return nil
+}
+
 // GetLatestRevision returns the highest revision number in the etcd table
 func GetLatestRevision(ctx context.Context, pool PgxIface) (int64, error) {
 	var revision *int64
@@ -189,7 +421,7 @@ func NewWithRetry(ctx context.Context, databaseURL string, callbacks ...func(*pg
 	})
 
 	if err != nil {
-		logrus.WithError(err).Error("Failed to establish PostgreSQL connection after all retries")
+		log.Default().WithError(err).Error("Failed to establish PostgreSQL connection after all retries")
 		return nil, err
 	}
 
@@ -202,7 +434,7 @@ func InsertPendingRecord(ctx context.Context, pool PgxIface, key string, value s
 		INSERT INTO etcd (key, value, revision, tombstone)
 		VALUES ($1, $2, -1, $3) 
 		ON CONFLICT (key, revision) DO UPDATE 
-		SET value = EXCLUDED.value, ts = CURRENT_TIMESTAMP, tombstone = EXCLUDED.tombstone;
+		SET value = EXCLUDED.value, ts = CURRENT_TIMESTAMP, tombstone = EXCLUDED.tombstone, seq = DEFAULT, expected_revision = NULL;
 	`
 	if tombstone {
 		value = "" // Use empty string for tombstone records
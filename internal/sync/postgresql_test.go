@@ -2,12 +2,19 @@ package sync
 
 import (
 	"context"
+	"errors"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pashagolub/pgxmock/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
 )
 
 // TestBulkInsert tests bulk insert operation with pgxmock (simplified)
@@ -20,12 +27,12 @@ func TestBulkInsertMock(t *testing.T) {
 	now := time.Now()
 
 	records := []KeyValueRecord{
-		{Ts: now, Key: "key1", Value: "value1", Revision: 1, Tombstone: false},
+		{Ts: now, Key: "key1", Value: "value1", Revision: 1, Tombstone: false, CreateRevision: 1, Version: 1},
 		{Ts: now, Key: "key2", Value: "", Revision: 1, Tombstone: true},
 	}
 	b := mock.ExpectBatch()
-	b.ExpectExec("INSERT").WithArgs(pgxmock.AnyArg(), "key1", "value1", int64(1), false).WillReturnResult(pgxmock.NewResult("INSERT", 1))
-	b.ExpectExec("INSERT").WithArgs(pgxmock.AnyArg(), "key2", "", int64(1), true).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	b.ExpectExec("INSERT").WithArgs(pgxmock.AnyArg(), "key1", "value1", int64(1), false, int64(1), int64(1), int64(0), "", []byte(nil), []byte(nil)).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	b.ExpectExec("INSERT").WithArgs(pgxmock.AnyArg(), "key2", "", int64(1), true, int64(0), int64(0), int64(0), "", []byte(nil), []byte(nil)).WillReturnResult(pgxmock.NewResult("INSERT", 1))
 	err = BulkInsert(ctx, mock, records)
 	assert.NoError(t, err)
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -41,11 +48,12 @@ func TestGetPendingRecords(t *testing.T) {
 	now := time.Now()
 
 	valuePtr := "value1"
-	rows := pgxmock.NewRows([]string{"key", "value", "revision", "ts", "tombstone"}).
-		AddRow("pending1", &valuePtr, int64(-1), now, false).
-		AddRow("pending2", (*string)(nil), int64(-1), now, true)
+	expected := int64(7)
+	rows := pgxmock.NewRows([]string{"key", "value", "revision", "ts", "tombstone", "expected_revision"}).
+		AddRow("pending1", &valuePtr, int64(-1), now, false, (*int64)(nil)).
+		AddRow("pending2", (*string)(nil), int64(-1), now, true, &expected)
 
-	mock.ExpectQuery(`SELECT key, value, revision, ts, tombstone FROM etcd WHERE revision = -1 ORDER BY ts ASC`).
+	mock.ExpectQuery(`SELECT key, value, revision, ts, tombstone, expected_revision FROM etcd WHERE revision = -1 AND status IS NULL ORDER BY ts ASC, seq ASC`).
 		WillReturnRows(rows)
 
 	records, err := GetPendingRecords(ctx, mock)
@@ -56,11 +64,14 @@ func TestGetPendingRecords(t *testing.T) {
 	assert.Equal(t, "value1", records[0].Value)
 	assert.Equal(t, int64(-1), records[0].Revision)
 	assert.False(t, records[0].Tombstone)
+	assert.Nil(t, records[0].ExpectedRevision)
 
 	assert.Equal(t, "pending2", records[1].Key)
 	assert.Equal(t, "", records[1].Value) // NULL becomes empty string
 	assert.Equal(t, int64(-1), records[1].Revision)
 	assert.True(t, records[1].Tombstone)
+	require.NotNil(t, records[1].ExpectedRevision)
+	assert.Equal(t, int64(7), *records[1].ExpectedRevision)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
@@ -187,3 +198,612 @@ func TestInsertPendingRecordTombstone(t *testing.T) {
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
 }
+
+// TestQuarantineRecordMock tests storing raw bytes of an invalid record with pgxmock
+func TestQuarantineRecordMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+	record := KeyValueRecord{Key: "bad\xff", Value: "value", Revision: 7, Ts: time.Now()}
+
+	mock.ExpectExec(`INSERT INTO etcd_quarantine`).
+		WithArgs(pgxmock.AnyArg(), []byte("bad\xff"), []byte("value"), int64(7), false, ReasonKeyNotUTF8, []byte(nil)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	err = QuarantineRecord(ctx, mock, record, ReasonKeyNotUTF8)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestGetPendingRecordMock tests retrieval of a single pending record with pgxmock
+func TestGetPendingRecordMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+	value := "value1"
+
+	mock.ExpectQuery(`SELECT key, value, revision, ts, tombstone, expected_revision FROM etcd WHERE key = \$1 AND revision = -1`).
+		WithArgs("pending1").
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "revision", "ts", "tombstone", "expected_revision"}).
+			AddRow("pending1", &value, int64(-1), time.Now(), false, (*int64)(nil)))
+	mock.ExpectQuery(`SELECT key, value, revision, ts, tombstone, expected_revision FROM etcd WHERE key = \$1 AND revision = -1`).
+		WithArgs("synced").
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "revision", "ts", "tombstone", "expected_revision"}))
+
+	record, err := GetPendingRecord(ctx, mock, "pending1")
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.Equal(t, "value1", record.Value)
+
+	record, err = GetPendingRecord(ctx, mock, "synced")
+	require.NoError(t, err)
+	assert.Nil(t, record, "keys without pending record should return nil")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestBulkInsertWithNotifyMock tests that change notifications are sent in the insert batch
+func TestBulkInsertWithNotifyMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	records := []KeyValueRecord{{Ts: ts, Key: "key1", Value: "value1", Revision: 5}}
+	b := mock.ExpectBatch()
+	b.ExpectExec("INSERT").WithArgs(pgxmock.AnyArg(), "key1", "value1", int64(5), false, int64(0), int64(0), int64(0), "", []byte(nil), []byte(nil)).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	b.ExpectExec(`SELECT pg_notify\(\$1, \$2\)`).
+		WithArgs("etcd_changes", `{"key":"key1","revision":5,"tombstone":false,"ts":"2024-01-02T03:04:05Z"}`).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+
+	err = BulkInsertWithNotify(ctx, mock, records, "etcd_changes")
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestPoolSettings tests that configured pool limits override the parsed defaults
+func TestPoolSettings(t *testing.T) {
+	config, err := pgxpool.ParseConfig("postgres://localhost/db?pool_max_conns=10")
+	require.NoError(t, err)
+
+	err = PoolSettings{MinConns: 2, MaxConnIdleTime: time.Minute}.Apply(config)
+	require.NoError(t, err)
+	assert.Equal(t, int32(10), config.MaxConns, "Unset settings should keep the DSN value")
+	assert.Equal(t, int32(2), config.MinConns)
+	assert.Equal(t, time.Minute, config.MaxConnIdleTime)
+
+	err = PoolSettings{MaxConns: 1, MinConns: 5}.Apply(config)
+	assert.Error(t, err, "Minimum above maximum should be rejected")
+
+	config, err = pgxpool.ParseConfig("postgres://localhost/db")
+	require.NoError(t, err)
+	err = PoolSettings{SimpleProtocol: true}.Apply(config)
+	require.NoError(t, err)
+	assert.Equal(t, pgx.QueryExecModeSimpleProtocol, config.ConnConfig.DefaultQueryExecMode)
+	assert.Zero(t, config.ConnConfig.StatementCacheCapacity)
+	assert.Zero(t, config.ConnConfig.DescriptionCacheCapacity)
+}
+
+// TestPruneHistoryMock tests that history pruning keeps the latest revision up to the compact revision
+func TestPruneHistoryMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	mock.ExpectQuery(`DELETE FROM etcd e WHERE e.revision > 0 AND e.revision < \$1 AND EXISTS .* INSERT INTO etcd_compaction`).
+		WithArgs(int64(100)).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(3)))
+
+	deleted, err := PruneHistory(context.Background(), mock, 100)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestPruneRetentionMock tests pruning the history of a prefix by its retention policy
+func TestPruneRetentionMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	cutoff := time.Now().Add(-time.Hour)
+	mock.ExpectQuery(`DELETE FROM etcd e WHERE starts_with\(e.key, \$1\) AND e.revision > 0 AND e.ts < \$2 .* INSERT INTO etcd_compaction`).
+		WithArgs("/telemetry/", cutoff, []string{"/telemetry/keep/"}).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(4)))
+
+	deleted, err := PruneRetention(context.Background(), mock, "/telemetry/", []string{"/telemetry/keep/"}, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestParseRetention tests parsing --retention policies and the prefixes exempt from broader ones
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    RetentionPolicy
+		wantErr bool
+	}{
+		{spec: "/telemetry/=1d", want: RetentionPolicy{Prefix: "/telemetry/", Keep: 24 * time.Hour}},
+		{spec: "/metrics/=36h", want: RetentionPolicy{Prefix: "/metrics/", Keep: 36 * time.Hour}},
+		{spec: "/config/=forever", want: RetentionPolicy{Prefix: "/config/"}},
+		{spec: "/config/", wantErr: true},
+		{spec: "=1d", wantErr: true},
+		{spec: "/config/=0d", wantErr: true},
+		{spec: "/config/=-1h", wantErr: true},
+		{spec: "/config/=always", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			policy, err := ParseRetention(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, policy)
+		})
+	}
+
+	policies := []RetentionPolicy{{Prefix: "/"}, {Prefix: "/telemetry/"}, {Prefix: "/telemetry/keep/"}, {Prefix: "/config/"}}
+	assert.Equal(t, []string{"/telemetry/", "/telemetry/keep/", "/config/"}, retentionExempt(policies, policies[0]))
+	assert.Equal(t, []string{"/telemetry/keep/"}, retentionExempt(policies, policies[1]))
+	assert.Empty(t, retentionExempt(policies, policies[3]))
+}
+
+// TestLatestStoreMock tests that latest-only storage upserts on key and removes deleted keys
+func TestLatestStoreMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	store := newRecordStore(StorageLatest, IngestBatch)
+
+	batch := mock.ExpectBatch()
+	batch.ExpectExec(`INSERT INTO etcd_latest .* ON CONFLICT \(key\) DO UPDATE`).
+		WithArgs(now, "key1", "value1", int64(5), int64(2), int64(3), int64(0), "", []byte(nil), []byte(nil)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	batch.ExpectExec(`DELETE FROM etcd_latest WHERE key = \$1 AND revision <> -1 AND revision < \$2`).
+		WithArgs("key2", int64(6)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	err = store.BulkInsert(ctx, mock, []KeyValueRecord{
+		{Key: "key1", Value: "value1", Revision: 5, Ts: now, CreateRevision: 2, Version: 3},
+		{Key: "key2", Revision: 6, Ts: now, Tombstone: true},
+	}, "")
+	require.NoError(t, err)
+
+	mock.ExpectExec(`DELETE FROM etcd_latest WHERE key = \$1 AND ts = \$2 AND revision = -1`).
+		WithArgs("key2", now).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	err = store.MarkSynced(ctx, mock, KeyValueRecord{Key: "key2", Ts: now, Tombstone: true}, 7)
+	require.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestFindRevisionGapsMock tests that the etcd snapshot is passed to etcd_revision_gaps
+func TestFindRevisionGapsMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	keys := []string{"/a", "/b"}
+	revisions := []int64{3, 8}
+	mock.ExpectQuery(`SELECT key, revision, kind FROM etcd_revision_gaps\(\$1, \$2, \$3, \$4\)`).
+		WithArgs("/", keys, revisions, int64(10)).
+		WillReturnRows(pgxmock.NewRows([]string{"key", "revision", "kind"}).
+			AddRow("/a", int64(3), GapMissingRevision).
+			AddRow("/c", int64(5), GapMissingDelete))
+
+	gaps, err := FindRevisionGaps(context.Background(), mock, "/", keys, revisions, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []RevisionGap{
+		{Key: "/a", Revision: 3, Kind: GapMissingRevision},
+		{Key: "/c", Revision: 5, Kind: GapMissingDelete},
+	}, gaps)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestBulkInsertStagingMock tests that staged records are copied and merged in one transaction
+func TestBulkInsertStagingMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	now := time.Now()
+	records := []KeyValueRecord{
+		{Ts: now, Key: "key1", Value: "old", Revision: 5},
+		{Ts: now, Key: "key2", Revision: 6, Tombstone: true},
+		{Ts: now, Key: "key1", Value: "new", Revision: 5},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT nextval\('etcd_staging_batch_seq'\)`).
+		WillReturnRows(pgxmock.NewRows([]string{"nextval"}).AddRow(int64(42)))
+	mock.ExpectCopyFrom(pgx.Identifier{"etcd_staging"}, stagingColumns).WillReturnResult(2)
+	mock.ExpectExec(`INSERT INTO etcd .* FROM etcd_staging s WHERE s.batch = \$1 ON CONFLICT`).
+		WithArgs(int64(42)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	mock.ExpectExec(`DELETE FROM etcd_staging WHERE batch = \$1`).
+		WithArgs(int64(42)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+	mock.ExpectCommit()
+
+	err = BulkInsertStaging(context.Background(), mock, records, "")
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	deduped := dedupRecords(records)
+	require.Len(t, deduped, 2)
+	assert.Equal(t, "key2", deduped[0].Key)
+	assert.Equal(t, "new", deduped[1].Value, "The last record of a duplicate pair should win")
+}
+
+// TestWaitForPrimaryMock tests that the wait ends once the standby is promoted
+func TestWaitForPrimaryMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT pg_is_in_recovery\(\)`).WillReturnRows(pgxmock.NewRows([]string{"pg_is_in_recovery"}).AddRow(true))
+	mock.ExpectQuery(`SELECT pg_is_in_recovery\(\)`).WillReturnRows(pgxmock.NewRows([]string{"pg_is_in_recovery"}).AddRow(false))
+
+	err = WaitForPrimary(context.Background(), mock, time.Millisecond)
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Canceled while still in recovery
+	mock.ExpectQuery(`SELECT pg_is_in_recovery\(\)`).WillReturnRows(pgxmock.NewRows([]string{"pg_is_in_recovery"}).AddRow(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = WaitForPrimary(ctx, mock, time.Hour)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSyncStateMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	mock.ExpectExec(`INSERT INTO etcd_sync_state`).
+		WithArgs("/config/", int64(42)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	err = SaveSyncState(context.Background(), mock, "/config/", 42)
+	require.NoError(t, err)
+
+	mock.ExpectQuery(`SELECT revision FROM etcd_sync_state`).
+		WithArgs("/config/").
+		WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(42)))
+	revision, err := GetSyncState(context.Background(), mock, "/config/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), revision)
+
+	mock.ExpectQuery(`SELECT revision FROM etcd_sync_state`).
+		WithArgs("/other/").
+		WillReturnError(pgx.ErrNoRows)
+	revision, err = GetSyncState(context.Background(), mock, "/other/")
+	require.NoError(t, err)
+	assert.Zero(t, revision, "a prefix never synced starts at 0")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCompactRevisionMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	service := &Service{pgPool: mock, store: historyStore{}, prefixes: []string{"/config/", "/services/"}}
+
+	// The slowest prefix bounds the compaction
+	mock.ExpectQuery(`SELECT revision FROM etcd_sync_state`).
+		WithArgs("/config/").
+		WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(42)))
+	mock.ExpectQuery(`SELECT revision FROM etcd_sync_state`).
+		WithArgs("/services/").
+		WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(17)))
+	revision, err := service.compactRevision(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(17), revision)
+
+	// Nothing is compacted before every prefix was synced once
+	mock.ExpectQuery(`SELECT revision FROM etcd_sync_state`).
+		WithArgs("/config/").
+		WillReturnRows(pgxmock.NewRows([]string{"revision"}).AddRow(int64(42)))
+	mock.ExpectQuery(`SELECT revision FROM etcd_sync_state`).
+		WithArgs("/services/").
+		WillReturnError(pgx.ErrNoRows)
+	revision, err = service.compactRevision(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, revision)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTableAuditLogMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	entries := []AuditLogEntry{
+		{Direction: log.DirectionPgToEtcd, Origin: AuditOriginSQL, Operation: AuditOperationPut, Key: "/config/a", PrevRevision: 7, Revision: 42},
+		{Direction: log.DirectionEtcdToPg, Origin: AuditOriginEtcdEvent, Operation: AuditOperationDelete, Key: "/config/b", Revision: 43},
+	}
+	mock.ExpectCopyFrom(pgx.Identifier{"etcd_audit_log"}, auditLogColumns).WillReturnResult(2)
+	require.NoError(t, NewTableAuditLog(mock).Record(context.Background(), entries))
+
+	mock.ExpectCopyFrom(pgx.Identifier{"etcd_audit_log"}, auditLogColumns).WillReturnError(errors.New("permission denied"))
+	assert.Error(t, NewTableAuditLog(mock).Record(context.Background(), entries))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplicationMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	ctx := context.Background()
+
+	record := KeyValueRecord{Key: "/config/a", Value: "1"}
+	mock.ExpectExec(`INSERT INTO etcd_replica_status`).
+		WithArgs([]string{"dr1:2379/", "dr2:2379/"}, "/config/a", &record.Value, false, int64(7)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	require.NoError(t, QueueReplication(ctx, mock, []string{"dr1:2379/", "dr2:2379/"}, record, 7))
+
+	var noValue *string
+	mock.ExpectExec(`INSERT INTO etcd_replica_status`).
+		WithArgs([]string{"dr1:2379/"}, "/config/b", noValue, true, int64(8)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	require.NoError(t, QueueReplication(ctx, mock, []string{"dr1:2379/"}, KeyValueRecord{Key: "/config/b", Tombstone: true}, 8))
+
+	value := "1"
+	mock.ExpectQuery(`SELECT key, value, tombstone, revision\s+FROM etcd_replica_status`).
+		WithArgs("dr1:2379/", 1000).
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "tombstone", "revision"}).
+			AddRow("/config/a", &value, false, int64(7)).
+			AddRow("/config/b", noValue, true, int64(8)))
+	records, err := PendingReplications(ctx, mock, "dr1:2379/", replicationBatchSize)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "1", records[0].Value)
+	assert.True(t, records[1].Tombstone)
+	assert.Equal(t, int64(8), records[1].Revision)
+
+	mock.ExpectExec(`UPDATE etcd_replica_status\s+SET replica_revision`).
+		WithArgs("dr1:2379/", "/config/a", int64(7), int64(3)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	require.NoError(t, MarkReplicated(ctx, mock, "dr1:2379/", "/config/a", 7, 3))
+
+	mock.ExpectExec(`UPDATE etcd_replica_status SET error`).
+		WithArgs("dr1:2379/", "/config/b", int64(8), "unavailable").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	require.NoError(t, MarkReplicationFailed(ctx, mock, "dr1:2379/", "/config/b", 8, errors.New("unavailable")))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestSaveHeartbeatMock tests upserting the heartbeat row of a keyspace
+func TestSaveHeartbeatMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	lastLoop := time.Now()
+	mock.ExpectExec(`INSERT INTO etcd_sync_heartbeat .* ON CONFLICT \(name\) DO UPDATE`).
+		WithArgs("/config/", "host-1", &lastLoop, int64(42), int64(3), int64(10), int64(4), int64(1), int64(2), int64(5), 1.5).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	err = SaveHeartbeat(context.Background(), mock, Heartbeat{
+		Name: "/config/", Instance: "host-1", LastLoop: lastLoop, Checkpoint: 42, Backlog: 3,
+		Stats: Stats{EventsApplied: 10, PendingsFlushed: 4, Conflicts: 1, Retries: 2, LagRevisions: 5, LagSeconds: 1.5},
+	})
+	require.NoError(t, err)
+
+	mock.ExpectExec(`INSERT INTO etcd_sync_heartbeat`).
+		WithArgs("/config/", "host-1", (*time.Time)(nil), int64(0), int64(0), int64(0), int64(0), int64(0), int64(0), int64(0), 0.0).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	err = SaveHeartbeat(context.Background(), mock, Heartbeat{Name: "/config/", Instance: "host-1"})
+	require.NoError(t, err, "last_loop is NULL before the first loop")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestGetBacklogMock tests reading the depth and age of the pending rows
+func TestGetBacklogMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT count\(\*\) .*min\(ts\).* FROM etcd_latest\s+WHERE revision = -1`).
+		WillReturnRows(pgxmock.NewRows([]string{"count", "age", "failed"}).AddRow(int64(3), 1.5, int64(1)))
+	backlog, err := GetBacklog(context.Background(), mock, "etcd_latest")
+	require.NoError(t, err)
+	assert.Equal(t, Backlog{Records: 3, OldestAge: 1500 * time.Millisecond, Failed: 1}, backlog)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestCorrelatedPoolMock tests commenting the statements of a correlated batch with its id
+func TestCorrelatedPoolMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	pool := correlatedPool{mock}
+
+	ctx := correlate(context.Background())
+	comment := regexp.QuoteMeta("/* trace_id=" + log.CorrelationID(ctx) + " */ ")
+	mock.ExpectExec("^" + comment + "UPDATE etcd").WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("^" + comment + "DELETE FROM etcd").WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("^UPDATE etcd").WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	_, err = pool.Exec(ctx, "UPDATE etcd SET revision = 1")
+	require.NoError(t, err)
+	tx, err := pool.Begin(ctx)
+	require.NoError(t, err)
+	_, err = tx.Exec(ctx, "DELETE FROM etcd")
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit(ctx))
+	_, err = pool.Exec(context.Background(), "UPDATE etcd SET revision = 1")
+	require.NoError(t, err, "uncorrelated statements are unchanged")
+
+	assert.Equal(t, "/* trace_id=1 */ SELECT 1", correlationComment(log.WithCorrelationID(context.Background(), "2"), "/* trace_id=1 */ SELECT 1"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestRecordSyncAttemptMock tests counting failed pushes and marking rows failed at the limit
+func TestRecordSyncAttemptMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	s := NewService(mock, &EtcdClient{}, WithConfig(Config{Prefixes: []string{"/config/"}, MaxSyncAttempts: 3}))
+	cause := &ValidationError{Err: errors.New("etcdserver: request is too large")}
+
+	mock.ExpectQuery(`UPDATE etcd SET sync_attempts = sync_attempts \+ 1, last_error = \$2`).
+		WithArgs("/config/a", cause.Error(), 3).
+		WillReturnRows(pgxmock.NewRows([]string{"failed"}).AddRow(true))
+	failed, err := RecordSyncAttempt(context.Background(), mock, "etcd", "/config/a", cause, 3)
+	require.NoError(t, err)
+	assert.True(t, failed)
+
+	mock.ExpectQuery(`UPDATE etcd_latest SET sync_attempts`).
+		WithArgs("/config/b", cause.Error(), 3).
+		WillReturnError(pgx.ErrNoRows)
+	failed, err = RecordSyncAttempt(context.Background(), mock, "etcd_latest", "/config/b", cause, 3)
+	require.NoError(t, err, "rows pushed meanwhile are no error")
+	assert.False(t, failed)
+
+	// Connection failures are not the fault of the row
+	s.recordAttempt(context.Background(), "/config/c", &ConnectionError{Err: errors.New("connection refused")})
+	mock.ExpectQuery(`UPDATE etcd SET sync_attempts`).
+		WithArgs("/config/c", cause.Error(), 3).
+		WillReturnRows(pgxmock.NewRows([]string{"failed"}).AddRow(false))
+	s.recordAttempt(context.Background(), "/config/c", cause)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestClaimPendingRecordsMock tests claiming pending records and releasing stale claims with pgxmock
+func TestClaimPendingRecordsMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	ctx := context.Background()
+	now := time.Now()
+	one, two := "1", "2"
+	columns := []string{"key", "value", "revision", "ts", "tombstone", "expected_revision"}
+
+	mock.ExpectQuery(`WITH claimed AS \( UPDATE etcd SET claimed_by = \$1, claimed_at = CURRENT_TIMESTAMP .* `+
+		`AND \(claimed_by IS NULL OR claimed_by = \$1 OR claimed_at < .*\) RETURNING seq, .* FROM claimed ORDER BY ts ASC, seq ASC`).
+		WithArgs("host-1", claimTimeout.Seconds()).
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow("/config/a", &one, int64(-1), now, false, (*int64)(nil)).
+			AddRow("/config/b", (*string)(nil), int64(-1), now, true, (*int64)(nil)))
+	records, err := ClaimPendingRecords(ctx, mock, "etcd", "host-1")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "1", records[0].Value)
+	assert.True(t, records[1].Tombstone)
+
+	mock.ExpectQuery(`UPDATE etcd_latest SET claimed_by = \$1, claimed_at = CURRENT_TIMESTAMP WHERE key = \$3 AND .* RETURNING key, value, revision, ts, tombstone, NULL::bigint`).
+		WithArgs("host-1", claimTimeout.Seconds(), "/config/c").
+		WillReturnError(pgx.ErrNoRows)
+	record, err := ClaimPendingRecord(ctx, mock, "etcd_latest", "/config/c", "host-1")
+	require.NoError(t, err)
+	assert.Nil(t, record)
+
+	mock.ExpectQuery(`WHERE revision = -1 AND status IS NULL AND claimed_by IS NOT NULL AND claimed_by <> \$1`).
+		WithArgs("host-1").
+		WillReturnRows(pgxmock.NewRows(columns).AddRow("/config/d", &two, int64(-1), now, false, (*int64)(nil)))
+	records, err = GetStaleClaims(ctx, mock, "etcd", "host-1")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "/config/d", records[0].Key)
+
+	mock.ExpectExec(`UPDATE etcd SET claimed_by = NULL, claimed_at = NULL WHERE key = \$1 AND revision = -1`).
+		WithArgs("/config/d").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	require.NoError(t, ReleaseClaim(ctx, mock, "etcd", "/config/d"))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestParseTenants tests the tenant mappings and pinning the connections to the tenant schema
+func TestParseTenants(t *testing.T) {
+	tenants, err := ParseTenants([]string{"/acme/=acme", "/globex/=globex:prune"})
+	require.NoError(t, err)
+	assert.Equal(t, []Tenant{{Prefix: "/acme/", Schema: "acme"}, {Prefix: "/globex/", Schema: "globex", History: HistoryPrune}}, tenants)
+
+	for _, spec := range []string{"/acme/", "/acme/b/=acme", "acme/=acme", "/acme/=Acme", "/acme/=pg_acme", "/acme/=acme:keep"} {
+		_, err := ParseTenant(spec)
+		assert.Error(t, err, spec)
+	}
+	_, err = ParseTenants([]string{"/acme/=acme", "/acme2/=acme"})
+	assert.Error(t, err, "schema mapped twice")
+
+	config, err := pgxpool.ParseConfig("postgres://localhost/test")
+	require.NoError(t, err)
+	require.NoError(t, tenants[0].Apply(config))
+	assert.Equal(t, `"acme"`, config.ConnConfig.RuntimeParams["search_path"])
+
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	mock.ExpectExec(`CREATE SCHEMA IF NOT EXISTS "acme"`).WillReturnResult(pgxmock.NewResult("CREATE SCHEMA", 0))
+	require.NoError(t, CreateTenantSchema(context.Background(), mock, "acme"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPlanRollbackMock(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	ctx := context.Background()
+	large := strings.Repeat("d", 1000)
+	stored, _ := CompressValue(large, 1)
+
+	mock.ExpectQuery(`WITH target AS`).WithArgs("/config/", int64(10)).
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "encoding", "delete", "current_value", "current_encoding", "current_revision"}).
+			AddRow("/config/a", "1", "", false, "2", "", int64(12)).
+			AddRow("/config/b", "", "", true, "new", "", int64(11)).
+			AddRow("/config/c", "old", "", false, "", "", int64(0)).
+			AddRow("/config/d", stored, EncodingZstd, false, large, "", int64(13)))
+	changes, err := PlanRollback(ctx, mock, "/config/", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []RollbackChange{
+		{Key: "/config/a", Value: "1", CurrentValue: "2", CurrentRevision: 12},
+		{Key: "/config/b", Delete: true, CurrentValue: "new", CurrentRevision: 11},
+		{Key: "/config/c", Value: "old"},
+	}, changes)
+
+	mock.ExpectQuery(`WITH target AS`).WithArgs("/secrets/", int64(10)).
+		WillReturnRows(pgxmock.NewRows([]string{"key", "value", "encoding", "delete", "current_value", "current_encoding", "current_revision"}).
+			AddRow("/secrets/token", "ab12", EncodingSHA256, false, "cd34", EncodingSHA256, int64(12)))
+	_, err = PlanRollback(ctx, mock, "/secrets/", 10)
+	assert.ErrorIs(t, err, ErrRedacted, "values stored as hash cannot be restored")
+
+	_, err = PlanRollback(ctx, mock, "/config/", 0)
+	assert.Error(t, err, "revision 0")
+
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery(`SELECT coalesce\(max\(revision\), 0\) FROM etcd`).WithArgs(ts).
+		WillReturnRows(pgxmock.NewRows([]string{"max"}).AddRow(int64(7)))
+	revision, err := RevisionAt(ctx, mock, ts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), revision)
+
+	mock.ExpectQuery(`SELECT coalesce\(max\(revision\), 0\) FROM etcd`).WithArgs(ts).
+		WillReturnRows(pgxmock.NewRows([]string{"max"}).AddRow(int64(0)))
+	_, err = RevisionAt(ctx, mock, ts)
+	assert.Error(t, err, "nothing mirrored before ts")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
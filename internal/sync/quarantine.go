@@ -0,0 +1,197 @@
+package sync
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// MaxKeyBytes is the largest key accepted into the etcd table by default, well below the btree index entry limit
+const MaxKeyBytes = 2048
+
+// MaxKeyBytesLimit is the largest configurable Config.MaxKeyBytes, incompressible keys above it exceed the btree
+// index entry limit of about 2.7 KB
+const MaxKeyBytesLimit = 2560
+
+// Policies for keys that cannot be stored in the text key column of the etcd table, see Config.KeyPolicy
+const (
+	KeyPolicyQuarantine = "quarantine" // store the raw record in the bytea key column of etcd_quarantine
+	KeyPolicyReject     = "reject"     // leave the record out and report it as failure
+	KeyPolicyHex        = "hex"        // store keys that are no valid UTF-8 hex encoded, oversized keys are quarantined
+)
+
+// hexKeyPrefix starts the keys stored hex encoded by KeyPolicyHex, like the hex format of bytea
+const hexKeyPrefix = `\x`
+
+// Quarantine reasons, kept as a fixed set to be usable as metric labels
+const (
+	ReasonKeyNotUTF8   = "key_not_utf8"
+	ReasonKeyTooLarge  = "key_too_large"
+	ReasonValueNotUTF8 = "value_not_utf8"
+)
+
+// CheckMaxKeyBytes rejects key length limits the key index of the etcd table cannot hold, 0 means MaxKeyBytes
+func CheckMaxKeyBytes(maxKeyBytes int) error {
+	if maxKeyBytes < 0 || maxKeyBytes > MaxKeyBytesLimit {
+		return fmt.Errorf("max key bytes %d outside of 0 to %d", maxKeyBytes, MaxKeyBytesLimit)
+	}
+	return nil
+}
+
+// QuarantineReason returns why a record cannot be stored in the etcd table, or an empty string if it can
+func QuarantineReason(record KeyValueRecord) string {
+	return quarantineReason(record, MaxKeyBytes)
+}
+
+// quarantineReason is QuarantineReason with keys of at most maxKeyBytes
+func quarantineReason(record KeyValueRecord, maxKeyBytes int) string {
+	switch {
+	case !validText(record.Key):
+		return ReasonKeyNotUTF8
+	case len(record.Key) > maxKeyBytes:
+		return ReasonKeyTooLarge
+	case !record.Tombstone && !validText(record.Value):
+		return ReasonValueNotUTF8
+	}
+	return ""
+}
+
+// validText reports whether s can be stored in a PostgreSQL text column
+func validText(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsRune(s, 0)
+}
+
+// QuarantineRecord stores the raw bytes of a record that cannot be represented in the etcd table
+func QuarantineRecord(ctx context.Context, pool PgxIface, record KeyValueRecord, reason string) error {
+	query := `INSERT INTO etcd_quarantine (ts, key, value, revision, tombstone, reason, facts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (key_hash, revision) DO NOTHING`
+
+	var value []byte
+	if !record.Tombstone {
+		value = []byte(record.Value)
+	}
+	_, err := pool.Exec(ctx, query, record.Ts, []byte(record.Key), value, record.Revision, record.Tombstone, reason, record.Facts)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine record: %w", err)
+	}
+
+	metrics.QuarantinedRecords.WithLabelValues(reason).Inc()
+	metrics.Errors.WithLabelValues(CategoryValidation).Inc()
+	log.Default().WithFields(log.Fields{
+		"key":      fmt.Sprintf("%q", record.Key),
+		"revision": record.Revision,
+		"reason":   reason,
+	}).Warn("Quarantined etcd record that cannot be stored in the etcd table")
+
+	return nil
+}
+
+// quarantineInvalid sets the unrepresentable records aside and returns the remaining ones as stored, internal
+// keys of the daemon are dropped
+func (s *Service) quarantineInvalid(ctx context.Context, pool PgxIface, records []KeyValueRecord) ([]KeyValueRecord, error) {
+	valid := records[:0]
+	for _, record := range records {
+		if isInternalKey(record.Key) {
+			continue // daemon state, not data
+		}
+		stored, reason := s.admit(record)
+		if reason == "" {
+			valid = append(valid, stored)
+			continue
+		}
+		if err := s.setAside(ctx, pool, record, reason); err != nil {
+			return nil, err
+		}
+	}
+	return valid, nil
+}
+
+// admit returns record as stored in the etcd table with the key handled by Config.KeyPolicy, and why it cannot
+// be stored if it can't
+func (s *Service) admit(record KeyValueRecord) (KeyValueRecord, string) {
+	stored := record
+	stored.Key = s.storedKey(record.Key)
+	checked := stored
+	if _, hash := s.secret(record.Key); hash {
+		checked.Value = "" // only the hash of the value is stored
+	}
+	if reason := quarantineReason(checked, s.maxKeyBytes); reason != "" {
+		return record, reason
+	}
+	return stored, ""
+}
+
+// storedKey returns the key of the etcd table for an etcd key, hex encoded if it is no valid UTF-8 and
+// Config.KeyPolicy is KeyPolicyHex
+func (s *Service) storedKey(key string) string {
+	if s.keyPolicy != KeyPolicyHex || validText(key) {
+		return key
+	}
+	return hexKeyPrefix + hex.EncodeToString([]byte(key))
+}
+
+// etcdKey returns the etcd key of a key of the etcd table, the inverse of storedKey
+func (s *Service) etcdKey(key string) string {
+	return EtcdKey(key, s.keyPolicy)
+}
+
+// EtcdKey returns the etcd key of a key of the etcd table stored with keyPolicy, see Config.KeyPolicy. Only
+// keys decoding to invalid UTF-8 are decoded, so keys that merely look hex encoded are kept.
+func EtcdKey(key, keyPolicy string) string {
+	encoded, ok := strings.CutPrefix(key, hexKeyPrefix)
+	if keyPolicy != KeyPolicyHex || !ok {
+		return key
+	}
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil || validText(string(decoded)) {
+		return key
+	}
+	return string(decoded)
+}
+
+// etcdRecords returns records with the keys written to etcd, records itself if none is hex encoded
+func (s *Service) etcdRecords(records []KeyValueRecord) []KeyValueRecord {
+	var decoded []KeyValueRecord
+	for i, record := range records {
+		key := s.etcdKey(record.Key)
+		if key == record.Key {
+			continue
+		}
+		if decoded == nil {
+			decoded = append([]KeyValueRecord(nil), records...)
+		}
+		decoded[i].Key = key
+	}
+	if decoded == nil {
+		return records
+	}
+	return decoded
+}
+
+// setAside keeps a record that cannot be stored in the etcd table out of it. Records with keys that cannot be
+// stored are reported as failures and left out with KeyPolicyReject, all others are quarantined.
+func (s *Service) setAside(ctx context.Context, pool PgxIface, record KeyValueRecord, reason string) error {
+	if _, hash := s.secret(record.Key); hash {
+		record = redactValue(record)
+	}
+	if s.keyPolicy != KeyPolicyReject || reason == ReasonValueNotUTF8 {
+		s.rememberFailure(log.DirectionEtcdToPg, record.Key, record.Revision, &ValidationError{Err: fmt.Errorf("quarantined: %s", reason)})
+		return QuarantineRecord(ctx, pool, record, reason)
+	}
+	metrics.RejectedKeys.WithLabelValues(reason).Inc()
+	metrics.Errors.WithLabelValues(CategoryValidation).Inc()
+	s.rememberFailure(log.DirectionEtcdToPg, record.Key, record.Revision, &ValidationError{Err: fmt.Errorf("rejected: %s", reason)})
+	s.logger().WithContext(ctx).WithFields(log.Fields{
+		log.FieldKey:      fmt.Sprintf("%q", record.Key),
+		log.FieldRevision: record.Revision,
+		"reason":          reason,
+	}).Error("Rejected etcd record whose key cannot be stored in the etcd table")
+	return nil
+}
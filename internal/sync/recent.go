@@ -0,0 +1,142 @@
+package sync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultRecentEvents is the number of applied changes and failures kept in memory by default
+const defaultRecentEvents = 100
+
+// RecentFailure is a change that could not be applied
+type RecentFailure struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // log.DirectionEtcdToPg or log.DirectionPgToEtcd
+	Key       string    `json:"key"`
+	Revision  int64     `json:"revision,omitempty"` // etcd revision of a watched event, 0 for PostgreSQL changes
+	Category  string    `json:"category"`
+	Error     string    `json:"error"`
+}
+
+// RecentEvents are the latest applied changes and failures, newest first
+type RecentEvents struct {
+	Applied []AuditLogEntry `json:"applied"`
+	Failed  []RecentFailure `json:"failed"`
+}
+
+// ring keeps the last entries added, a nil ring keeps nothing
+type ring[T any] struct {
+	mu      sync.Mutex
+	entries []T
+	next    int // position overwritten by the next entry once full
+}
+
+func newRing[T any](size int) *ring[T] {
+	return &ring[T]{entries: make([]T, 0, size)}
+}
+
+func (r *ring[T]) add(entries ...T) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range entries {
+		if len(r.entries) < cap(r.entries) {
+			r.entries = append(r.entries, entry)
+			continue
+		}
+		r.entries[r.next] = entry
+		r.next = (r.next + 1) % len(r.entries)
+	}
+}
+
+// list returns the entries newest first
+func (r *ring[T]) list() []T {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]T, 0, len(r.entries))
+	for i := range r.entries {
+		list = append(list, r.entries[(r.next+len(r.entries)-1-i)%len(r.entries)])
+	}
+	return list
+}
+
+// Recent returns the latest applied changes and failures, to debug why a key didn't sync
+func (s *Service) Recent() RecentEvents {
+	return RecentEvents{
+		Applied: s.recentApplied.list(),
+		Failed:  s.recentFailed.list(),
+	}
+}
+
+// recordFailure counts a change that could not be applied and keeps it for Recent
+func (s *Service) recordFailure(direction, key string, revision int64, err error) {
+	countError(err)
+	s.rememberFailure(direction, key, revision, err)
+}
+
+// rememberFailure keeps a change that could not be applied for Recent and passes it to the OnFailure hook
+func (s *Service) rememberFailure(direction, key string, revision int64, err error) {
+	failure := RecentFailure{
+		Time:      s.now(),
+		Direction: direction,
+		Key:       key,
+		Revision:  revision,
+		Category:  ErrorCategory(err),
+		Error:     err.Error(),
+	}
+	s.recentFailed.add(failure)
+	if s.onFailure != nil {
+		s.onFailure(failure)
+	}
+}
+
+// subscriberBuffer is the number of applied changes buffered for a slow subscriber, further ones are dropped
+const subscriberBuffer = 256
+
+// subscribers fans applied changes out to the channels returned by SubscribeAudit
+type subscribers struct {
+	mu       sync.Mutex
+	channels map[chan AuditLogEntry]struct{}
+}
+
+// SubscribeAudit returns a channel receiving the audit entry of every change applied from now on until ctx
+// is done, then it is closed. Changes a slow receiver is too far behind for are dropped instead of holding
+// up the sync, see Subscribe for a feed without gaps.
+func (s *Service) SubscribeAudit(ctx context.Context) <-chan AuditLogEntry {
+	events := make(chan AuditLogEntry, subscriberBuffer)
+	s.subscribers.mu.Lock()
+	if s.subscribers.channels == nil {
+		s.subscribers.channels = make(map[chan AuditLogEntry]struct{})
+	}
+	s.subscribers.channels[events] = struct{}{}
+	s.subscribers.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.subscribers.mu.Lock()
+		delete(s.subscribers.channels, events)
+		s.subscribers.mu.Unlock()
+		close(events)
+	}()
+	return events
+}
+
+// publish passes applied changes to the subscribers without blocking
+func (p *subscribers) publish(entries []AuditLogEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for events := range p.channels {
+		for _, entry := range entries {
+			select {
+			case events <- entry:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package sync
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// EncodingSHA256 is the encoding of the values of secret keys stored as the hex encoded SHA-256 of the value,
+// see SecretRule.Hash. The value cannot be recovered, DecodeValue returns the hash.
+const EncodingSHA256 = "sha256"
+
+// ErrRedacted is returned for values only stored as their hash in PostgreSQL that would have to be written
+// to etcd, e.g. by a rollback
+var ErrRedacted = errors.New("value is only stored as its hash")
+
+// SecretRule marks the keys matching Pattern as secrets, see Config.Secrets. Their values never appear in
+// log messages and reported failures.
+type SecretRule struct {
+	Pattern string // path.Match pattern of the keys or of one of their parents, e.g. /config/*/password or /secrets
+	Hash    bool   // store the SHA-256 of the values in PostgreSQL instead of the values
+}
+
+// ParseSecretRule parses a PATTERN[:hash] secret rule
+func ParseSecretRule(spec string) (SecretRule, error) {
+	pattern, hash := strings.CutSuffix(spec, ":hash")
+	if pattern != "/" {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if pattern == "" {
+		return SecretRule{}, fmt.Errorf("invalid secret %q, expected PATTERN[:hash]", spec)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return SecretRule{}, fmt.Errorf("invalid secret pattern %q: %w", pattern, err)
+	}
+	return SecretRule{Pattern: pattern, Hash: hash}, nil
+}
+
+// matches reports whether key or one of its parents matches the pattern of the rule
+func (r SecretRule) matches(key string) bool {
+	for end := len(key); end > 0; end = strings.LastIndexByte(key[:end], '/') {
+		if ok, _ := path.Match(r.Pattern, key[:end]); ok {
+			return true
+		}
+	}
+	return r.Pattern == "/" && strings.HasPrefix(key, "/")
+}
+
+// secret reports whether key is a secret by Config.Secrets and whether its value is stored as its hash
+func (s *Service) secret(key string) (secret, hash bool) {
+	for _, rule := range s.secrets {
+		if rule.matches(key) {
+			secret, hash = true, hash || rule.Hash
+		}
+	}
+	return secret, hash
+}
+
+// redactError returns err without its message if key is a secret, the messages of validation and decoding
+// errors may quote the value
+func (s *Service) redactError(key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if secret, _ := s.secret(key); !secret {
+		return err
+	}
+	return &ValidationError{Err: errors.New("invalid value of a secret key, details redacted")}
+}
+
+// redactValue returns record with its value replaced by the hex encoded hash of the value and without facts
+func redactValue(record KeyValueRecord) KeyValueRecord {
+	if record.Tombstone {
+		return record
+	}
+	hash := valueHash(record.Value)
+	record.Value, record.Encoding, record.Hash, record.Facts = hex.EncodeToString(hash), EncodingSHA256, hash, nil
+	return record
+}
+
+// redactRecords returns records with the values of the keys hashed by Config.Secrets replaced by their hash,
+// records itself if none is
+func (s *Service) redactRecords(records []KeyValueRecord) []KeyValueRecord {
+	if len(s.secrets) == 0 {
+		return records
+	}
+	var redacted []KeyValueRecord
+	for i, record := range records {
+		if record.Tombstone || record.Encoding != "" {
+			continue
+		}
+		if _, hash := s.secret(record.Key); !hash {
+			continue
+		}
+		if redacted == nil {
+			redacted = append([]KeyValueRecord(nil), records...)
+		}
+		redacted[i] = redactValue(record)
+	}
+	if redacted == nil {
+		return records
+	}
+	return redacted
+}
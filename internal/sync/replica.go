@@ -0,0 +1,222 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+)
+
+// replicationBatchSize is the maximum number of changes applied to a replica per polling interval
+const replicationBatchSize = 1000
+
+// Replica is a secondary etcd cluster receiving the PostgreSQL changes acknowledged by the primary.
+// Replicas are eventually consistent, their progress is tracked in the etcd_replica_status table.
+type Replica struct {
+	Name   string // host and path of the DSN, identifies the replica in etcd_replica_status
+	Client *EtcdClient
+}
+
+// NewReplica connects to a secondary etcd cluster with retry logic
+func NewReplica(ctx context.Context, dsn string, callbacks ...func(*clientv3.Config) error) (*Replica, error) {
+	name, err := replicaName(dsn)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewEtcdClientWithRetry(ctx, dsn, callbacks...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd replica %s: %w", name, err)
+	}
+	return &Replica{Name: name, Client: client}, nil
+}
+
+// replicaName returns the DSN without credentials and parameters
+func replicaName(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse etcd replica DSN: %w", err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("etcd replica DSN has no endpoints")
+	}
+	return u.Host + u.Path, nil
+}
+
+// QueueReplication records a change acknowledged by the primary at revision for every replica.
+// Only the newest change of a key is kept, older unreplicated changes are superseded.
+func QueueReplication(ctx context.Context, db PgxIface, replicas []string, record KeyValueRecord, revision int64) error {
+	query := `INSERT INTO etcd_replica_status (replica, key, value, tombstone, revision)
+		SELECT r, $2, $3, $4, $5 FROM unnest($1::text[]) AS r
+		ON CONFLICT (replica, key) DO UPDATE SET
+		value = EXCLUDED.value, tombstone = EXCLUDED.tombstone, revision = EXCLUDED.revision,
+		replica_revision = NULL, error = NULL, queued_at = CURRENT_TIMESTAMP, replicated_at = NULL
+		WHERE etcd_replica_status.revision < EXCLUDED.revision`
+
+	var value *string
+	if !record.Tombstone {
+		value = &record.Value
+	}
+	if _, err := db.Exec(ctx, query, replicas, record.Key, value, record.Tombstone, revision); err != nil {
+		return fmt.Errorf("failed to queue replication: %w", err)
+	}
+	return nil
+}
+
+// PendingReplications returns up to limit changes not yet applied to replica in primary revision order.
+// The Revision of the returned records is the primary revision.
+func PendingReplications(ctx context.Context, db PgxIface, replica string, limit int) ([]KeyValueRecord, error) {
+	query := `SELECT key, value, tombstone, revision
+		FROM etcd_replica_status
+		WHERE replica = $1 AND replica_revision IS NULL
+		ORDER BY revision
+		LIMIT $2`
+
+	rows, err := db.Query(ctx, query, replica, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending replications: %w", err)
+	}
+	defer rows.Close()
+
+	var records []KeyValueRecord
+	for rows.Next() {
+		var record KeyValueRecord
+		var value *string
+		if err := rows.Scan(&record.Key, &value, &record.Tombstone, &record.Revision); err != nil {
+			return nil, fmt.Errorf("error scanning pending replication: %w", err)
+		}
+		if value != nil {
+			record.Value = *value
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pending replications: %w", err)
+	}
+
+	return records, nil
+}
+
+// MarkReplicated stores the replica revision of an applied change, unless a newer change was queued meanwhile
+func MarkReplicated(ctx context.Context, db PgxIface, replica, key string, revision, replicaRevision int64) error {
+	query := `UPDATE etcd_replica_status
+		SET replica_revision = $4, error = NULL, replicated_at = CURRENT_TIMESTAMP
+		WHERE replica = $1 AND key = $2 AND revision = $3`
+
+	if _, err := db.Exec(ctx, query, replica, key, revision, replicaRevision); err != nil {
+		return fmt.Errorf("failed to mark change replicated: %w", err)
+	}
+	return nil
+}
+
+// MarkReplicationFailed stores the error of the last attempt to apply a change to replica
+func MarkReplicationFailed(ctx context.Context, db PgxIface, replica, key string, revision int64, cause error) error {
+	query := `UPDATE etcd_replica_status SET error = $4
+		WHERE replica = $1 AND key = $2 AND revision = $3`
+
+	if _, err := db.Exec(ctx, query, replica, key, revision, cause.Error()); err != nil {
+		return fmt.Errorf("failed to record replication error: %w", err)
+	}
+	return nil
+}
+
+// queueReplication queues a change acknowledged by the primary for all replicas.
+// The primary already applied it, so a failure is logged instead of retrying the change.
+func (s *Service) queueReplication(ctx context.Context, record KeyValueRecord, revision int64) {
+	if len(s.replicas) == 0 {
+		return
+	}
+	names := make([]string, len(s.replicas))
+	for i, replica := range s.replicas {
+		names[i] = replica.Name
+	}
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		return QueueReplication(ctx, s.pgPool, names, record, revision)
+	})
+	if err != nil {
+		s.logger().WithError(err).WithField("key", record.Key).Error("Failed to queue change for etcd replicas")
+	}
+}
+
+// replicate applies queued changes to replica every polling interval
+func (s *Service) replicate(ctx context.Context, replica *Replica) {
+	s.logger().WithField("replica", replica.Name).Info("Starting replication to etcd replica")
+
+	ticker := time.NewTicker(s.pollingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.Paused() {
+				continue
+			}
+			if err := s.replicateBatch(ctx, replica); err != nil && ctx.Err() == nil {
+				countError(err)
+				s.logger().WithError(err).WithField("replica", replica.Name).Error("Failed to replicate changes")
+			}
+		}
+	}
+}
+
+// replicateBatch applies one batch of queued changes to replica, stopping at the first failure
+func (s *Service) replicateBatch(ctx context.Context, replica *Replica) error {
+	var records []KeyValueRecord
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		records, err = PendingReplications(ctx, s.pgPool, replica.Name, replicationBatchSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var replicaRevision int64
+		key := s.etcdKey(record.Key)
+		err := replica.Client.WithReauth(ctx, func() error {
+			if record.Tombstone {
+				resp, err := replica.Client.Delete(ctx, key)
+				if err != nil {
+					return err
+				}
+				replicaRevision = resp.Header.Revision
+				return nil
+			}
+			resp, err := replica.Client.Put(ctx, key, record.Value)
+			if err != nil {
+				return err
+			}
+			replicaRevision = resp.Header.Revision
+			return nil
+		})
+		if err != nil {
+			metrics.ReplicationErrors.WithLabelValues(replica.Name).Inc()
+			if markErr := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+				return MarkReplicationFailed(ctx, s.pgPool, replica.Name, record.Key, record.Revision, err)
+			}); markErr != nil {
+				s.logger().WithError(markErr).WithField("key", record.Key).Warn("Failed to record replication error")
+			}
+			return fmt.Errorf("failed to apply %s to replica: %w", record.Key, err)
+		}
+
+		err = s.withStatementTimeout(ctx, func(ctx context.Context) error {
+			return MarkReplicated(ctx, s.pgPool, replica.Name, record.Key, record.Revision, replicaRevision)
+		})
+		if err != nil {
+			return err
+		}
+
+		s.logger().WithFields(log.Fields{
+			log.FieldKey:       record.Key,
+			log.FieldRevision:  record.Revision,
+			"replica":          replica.Name,
+			"replica_revision": replicaRevision,
+		}).Debug("Replicated change to etcd replica")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Reasons of automatic resynchronizations, used as metric labels
+const (
+	ResyncAudit      = "audit"
+	ResyncCompaction = "compaction"
+	ResyncWatchGap   = "watch_gap"
+)
+
+// AutoResync configures when the revision audit resynchronizes a whole prefix instead of repairing single keys
+type AutoResync struct {
+	Threshold   int           // differences found by one audit scheduling a full resync, 1 if zero
+	MinInterval time.Duration // minimum time between full resyncs of a prefix, unlimited if zero
+}
+
+func (a AutoResync) threshold() int {
+	return max(a.Threshold, 1)
+}
+
+// resyncTimes remembers the last full resynchronization per prefix
+type resyncTimes struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+// allow reports whether prefix may be resynchronized after minInterval and records it if so
+func (r *resyncTimes) allow(prefix string, minInterval time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if last, ok := r.times[prefix]; ok && minInterval > 0 && now.Sub(last) < minInterval {
+		return false
+	}
+	if r.times == nil {
+		r.times = make(map[string]time.Time)
+	}
+	r.times[prefix] = now
+	return true
+}
+
+// scheduleResync asks the watcher of prefix for a full resynchronization, it reports false if the last one
+// was less than the minimum interval ago
+func (s *Service) scheduleResync(prefix, reason string) bool {
+	if !s.lastResync.allow(prefix, s.autoResync.MinInterval) {
+		s.logger().WithFields(log.Fields{
+			"prefix":       prefix,
+			"reason":       reason,
+			"min_interval": s.autoResync.MinInterval,
+		}).Warn("Full resynchronization rate-limited, repairing the affected keys only")
+		return false
+	}
+	metrics.AutoResyncs.WithLabelValues(reason).Inc()
+	s.logger().WithFields(log.Fields{"prefix": prefix, "reason": reason}).Warn("Scheduling full resynchronization of prefix")
+	if err := s.Resync(prefix); err != nil {
+		s.logger().WithError(err).WithField("prefix", prefix).Error("Failed to schedule resynchronization")
+		return false
+	}
+	return true
+}
+
+// countResync records a full resynchronization the watcher of prefix can't continue without
+func (s *Service) countResync(prefix, reason string) {
+	s.lastResync.allow(prefix, 0)
+	metrics.AutoResyncs.WithLabelValues(reason).Inc()
+}
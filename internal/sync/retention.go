@@ -0,0 +1,134 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// retentionForever is the duration of a RetentionPolicy keeping the history of its prefix
+const retentionForever = "forever"
+
+// RetentionPolicy is how long the history of the keys below Prefix is kept, see Config.Retention
+type RetentionPolicy struct {
+	Prefix string
+	Keep   time.Duration // age of the revisions kept, forever if zero
+}
+
+// ParseRetention parses a PREFIX=DURATION retention policy, e.g. /telemetry/=1d. DURATION is a Go duration,
+// a number of days with the suffix d or forever.
+func ParseRetention(spec string) (RetentionPolicy, error) {
+	prefix, keep, ok := strings.Cut(spec, "=")
+	if !ok || prefix == "" || keep == "" {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention %q, expected PREFIX=DURATION", spec)
+	}
+	policy := RetentionPolicy{Prefix: prefix}
+	if keep == retentionForever {
+		return policy, nil
+	}
+	if days, ok := strings.CutSuffix(keep, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention %q, expected a positive number of days", spec)
+		}
+		policy.Keep = time.Duration(n) * 24 * time.Hour
+		return policy, nil
+	}
+	duration, err := time.ParseDuration(keep)
+	if err != nil || duration <= 0 {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention %q, expected a positive duration or %s", spec, retentionForever)
+	}
+	policy.Keep = duration
+	return policy, nil
+}
+
+// PruneRetention deletes the synced revisions of the keys below prefix, but not below the prefixes of exempt,
+// written before cutoff and superseded by a newer revision of their key, and deletions before cutoff no
+// later revision of their key is kept for. The current value of every key stays intact. The compact revision
+// in etcd_compaction is raised to the first revision the remaining history of the pruned keys is complete from.
+func PruneRetention(ctx context.Context, pool PgxIface, prefix string, exempt []string, cutoff time.Time) (int64, error) {
+	query := `WITH pruned AS (
+			DELETE FROM etcd e
+			WHERE starts_with(e.key, $1) AND e.revision > 0 AND e.ts < $2
+			AND NOT EXISTS (SELECT 1 FROM unnest($3::text[]) x WHERE starts_with(e.key, x))
+			AND (
+				EXISTS (SELECT 1 FROM etcd n WHERE n.key = e.key AND n.revision > e.revision)
+				OR (e.tombstone AND NOT EXISTS (
+					SELECT 1 FROM etcd o WHERE o.key = e.key AND o.revision > 0 AND o.revision < e.revision AND o.ts >= $2
+				))
+			)
+			RETURNING e.key, e.revision
+		), compacted AS (
+			INSERT INTO etcd_compaction (revision)
+			SELECT max(coalesce((SELECT min(n.revision) FROM etcd n WHERE n.key = p.key AND n.revision > p.revision), p.revision))
+			FROM pruned p
+			HAVING count(*) > 0
+			ON CONFLICT (id) DO UPDATE SET revision = greatest(etcd_compaction.revision, excluded.revision),
+				updated_at = CURRENT_TIMESTAMP
+		)
+		SELECT count(*) FROM pruned`
+
+	var deleted int64
+	if err := pool.QueryRow(ctx, query, prefix, cutoff, exempt).Scan(&deleted); err != nil {
+		return 0, fmt.Errorf("failed to prune history of %s: %w", prefix, err)
+	}
+	return deleted, nil
+}
+
+// retentionExempt returns the prefixes of the other policies below the prefix of policy, their own policy
+// applies to them as the longest matching prefix
+func retentionExempt(policies []RetentionPolicy, policy RetentionPolicy) []string {
+	exempt := []string{}
+	for _, other := range policies {
+		if len(other.Prefix) > len(policy.Prefix) && strings.HasPrefix(other.Prefix, policy.Prefix) {
+			exempt = append(exempt, other.Prefix)
+		}
+	}
+	return exempt
+}
+
+// enforceRetention prunes the history of the prefixes of Config.Retention older than their policy
+func (s *Service) enforceRetention(ctx context.Context) {
+	policies := slices.DeleteFunc(slices.Clone(s.retention), func(policy RetentionPolicy) bool {
+		return policy.Keep <= 0
+	})
+	if len(policies) == 0 {
+		return
+	}
+	s.logger().WithField("policies", len(policies)).Info("Pruning PostgreSQL history by retention policy")
+
+	ticker := time.NewTicker(historyCheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, policy := range policies {
+			cutoff := s.now().Add(-policy.Keep)
+			var deleted int64
+			err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+				deleted, err = PruneRetention(ctx, s.pgPool, policy.Prefix, retentionExempt(s.retention, policy), cutoff)
+				return err
+			})
+			logger := s.logger().WithField("prefix", policy.Prefix)
+			if err != nil {
+				logger.WithError(err).Error("Failed to prune history by retention policy")
+				continue
+			}
+			if deleted > 0 {
+				logger.WithFields(log.Fields{
+					"keep":    policy.Keep.String(),
+					"deleted": deleted,
+				}).Info("Pruned PostgreSQL history by retention policy")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
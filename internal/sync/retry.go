@@ -3,9 +3,10 @@ package sync
 import (
 	"context"
 	"fmt"
+	"math/rand/v2"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
 )
 
 // RetryConfig contains retry configuration parameters
@@ -13,6 +14,11 @@ type RetryConfig struct {
 	MaxRetries int
 	BaseDelay  time.Duration
 	MaxDelay   time.Duration
+	// Jitter randomizes each delay by up to this fraction in either direction, so daemons
+	// failing at the same time don't retry in lockstep
+	Jitter float64
+	// Retryable reports whether an error is worth another attempt, nil retries every error
+	Retryable func(error) bool
 }
 
 // DefaultRetryConfig provides sensible defaults for retry operations
@@ -21,9 +27,17 @@ func DefaultRetryConfig() RetryConfig {
 		MaxRetries: 3,
 		BaseDelay:  100 * time.Millisecond,
 		MaxDelay:   5 * time.Second,
+		Jitter:     0.2,
 	}
 }
 
+// EtcdRetryConfig is DefaultRetryConfig giving up on etcd errors that repeating won't fix
+func EtcdRetryConfig() RetryConfig {
+	config := DefaultRetryConfig()
+	config.Retryable = IsRetryableEtcdError
+	return config
+}
+
 // RetryWithBackoff executes a function with exponential backoff retry logic
 func RetryWithBackoff(ctx context.Context, config RetryConfig, operation func() error) error {
 	var lastErr error
@@ -34,16 +48,23 @@ func RetryWithBackoff(ctx context.Context, config RetryConfig, operation func()
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case <-time.After(delay):
+			case <-time.After(jitter(delay, config.Jitter)):
 			}
 		}
 
 		if err := operation(); err != nil {
 			lastErr = err
-			logrus.WithFields(logrus.Fields{
+			if config.Retryable != nil && !config.Retryable(err) {
+				return err
+			}
+			if attempt < config.MaxRetries {
+				retries.Add(1)
+			}
+			log.Default().WithFields(log.Fields{
 				"attempt": attempt + 1,
 				"error":   err,
 				"delay":   delay,
+				"timeout": IsTimeout(err),
 			}).Warn("Operation failed, retrying")
 
 			// Exponential backoff with cap
@@ -59,3 +80,11 @@ func RetryWithBackoff(ctx context.Context, config RetryConfig, operation func()
 
 	return fmt.Errorf("operation failed after %d attempts: %w", config.MaxRetries+1, lastErr)
 }
+
+// jitter randomizes delay by up to fraction in either direction
+func jitter(delay time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || delay <= 0 {
+		return delay
+	}
+	return delay + time.Duration((rand.Float64()*2-1)*fraction*float64(delay))
+}
@@ -0,0 +1,138 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// ErrRollbackConflict is returned by ApplyRollback when a key changed in etcd after the rollback was planned
+// or the mirror lags behind etcd. The batches applied before stay applied, planning again continues the rollback.
+var ErrRollbackConflict = errors.New("etcd changed since the rollback was planned")
+
+// RollbackChange restores a key to the value it had at the rollback revision
+type RollbackChange struct {
+	Key             string `json:"key"`
+	Value           string `json:"value,omitempty"` // value at the rollback revision
+	Delete          bool   `json:"delete"`          // the key did not exist at the rollback revision
+	CurrentValue    string `json:"current_value,omitempty"`
+	CurrentRevision int64  `json:"current_revision"` // mirrored mod revision etcd must still have, 0 if the key does not exist
+}
+
+// PlanRollback returns the changes restoring the keys of prefix to their state at revision, computed from
+// the history in PostgreSQL. Keys are compared by value, keys unchanged since revision are left alone.
+// With --history=prune revisions before the last etcd compaction are incomplete.
+func PlanRollback(ctx context.Context, db PgxIface, prefix string, revision int64) ([]RollbackChange, error) {
+	if revision <= 0 {
+		return nil, fmt.Errorf("invalid rollback revision %d", revision)
+	}
+	query := `WITH target AS (
+			SELECT DISTINCT ON (key) key, value, encoding, tombstone
+			FROM etcd
+			WHERE starts_with(key, $1) AND revision > 0 AND revision <= $2
+			ORDER BY key, revision DESC
+		), current AS (
+			SELECT DISTINCT ON (key) key, value, encoding, revision, tombstone
+			FROM etcd
+			WHERE starts_with(key, $1) AND revision > 0
+			ORDER BY key, revision DESC
+		)
+		SELECT c.key, coalesce(t.value, ''), coalesce(t.encoding, ''), t.key IS NULL OR t.tombstone,
+			CASE WHEN c.tombstone THEN '' ELSE coalesce(c.value, '') END,
+			CASE WHEN c.tombstone THEN '' ELSE coalesce(c.encoding, '') END,
+			CASE WHEN c.tombstone THEN 0 ELSE c.revision END
+		FROM current c
+		LEFT JOIN target t ON t.key = c.key
+		WHERE (t.key IS NULL OR t.tombstone) IS DISTINCT FROM c.tombstone
+			OR NOT c.tombstone AND (t.value, t.encoding) IS DISTINCT FROM (c.value, c.encoding)
+		ORDER BY c.key`
+	rows, err := db.Query(ctx, query, prefix, revision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan rollback: %w", err)
+	}
+	changes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (change RollbackChange, err error) {
+		var encoding, currentEncoding string
+		err = row.Scan(&change.Key, &change.Value, &encoding, &change.Delete, &change.CurrentValue, &currentEncoding,
+			&change.CurrentRevision)
+		if err != nil {
+			return change, err
+		}
+		if encoding == EncodingSHA256 && !change.Delete {
+			return change, fmt.Errorf("%w, cannot restore %s", ErrRedacted, change.Key)
+		}
+		if change.Value, err = DecodeValue(change.Value, encoding); err != nil {
+			return change, err
+		}
+		change.CurrentValue, err = DecodeValue(change.CurrentValue, currentEncoding)
+		return change, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan rollback: %w", err)
+	}
+	// Values stored with different encodings may still be equal
+	return slices.DeleteFunc(changes, func(change RollbackChange) bool {
+		return !change.Delete && change.CurrentRevision > 0 && change.Value == change.CurrentValue
+	}), nil
+}
+
+// RevisionAt returns the latest etcd revision mirrored in PostgreSQL at ts, to roll back to a point in time
+func RevisionAt(ctx context.Context, db PgxIface, ts time.Time) (int64, error) {
+	var revision int64
+	err := db.QueryRow(ctx, `SELECT coalesce(max(revision), 0) FROM etcd WHERE revision > 0 AND ts <= $1`, ts).Scan(&revision)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get revision at %s: %w", ts.Format(time.RFC3339), err)
+	}
+	if revision == 0 {
+		return 0, fmt.Errorf("no revision mirrored before %s", ts.Format(time.RFC3339))
+	}
+	return revision, nil
+}
+
+// ApplyRollback applies the changes of PlanRollback to etcd in transactions of at most maxTxnOps changes.
+// Every transaction is guarded by the current revisions of its keys and fails with ErrRollbackConflict
+// if any of them changed. It returns the etcd revision of the last transaction, 0 if there was nothing to do.
+func (c *EtcdClient) ApplyRollback(ctx context.Context, changes []RollbackChange) (int64, error) {
+	var revision int64
+	for start := 0; start < len(changes); {
+		end, size := start, 0
+		for end < len(changes) && end-start < maxTxnOps {
+			size += len(changes[end].Key) + len(changes[end].Value)
+			if end > start && size > maxTxnBytes {
+				break
+			}
+			end++
+		}
+		batch := changes[start:end]
+		compares := make([]clientv3.Cmp, len(batch))
+		ops := make([]clientv3.Op, len(batch))
+		for i, change := range batch {
+			compares[i] = clientv3.Compare(clientv3.ModRevision(change.Key), "=", change.CurrentRevision)
+			if change.Delete {
+				ops[i] = clientv3.OpDelete(change.Key)
+			} else {
+				ops[i] = clientv3.OpPut(change.Key, change.Value)
+			}
+		}
+		resp, err := c.Txn(ctx).If(compares...).Then(ops...).Commit()
+		if err != nil {
+			return revision, fmt.Errorf("failed to apply rollback: %w", err)
+		}
+		if !resp.Succeeded {
+			return revision, fmt.Errorf("%w: %d of %d changes applied", ErrRollbackConflict, start, len(changes))
+		}
+		revision = resp.Header.Revision
+		log.Default().WithFields(log.Fields{
+			"count":           len(batch),
+			log.FieldRevision: revision,
+		}).Info("Applied rollback batch to etcd")
+		start = end
+	}
+	return revision, nil
+}
@@ -0,0 +1,123 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+)
+
+// KeySchema is a JSON Schema the values of the keys of a prefix must conform to, see Config.Schemas
+type KeySchema struct {
+	Prefix string
+	schema *jsonschema.Schema
+}
+
+// CompileKeySchema compiles the JSON Schema document for the keys of prefix
+func CompileKeySchema(prefix string, document []byte) (KeySchema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(document))
+	if err != nil {
+		return KeySchema{}, fmt.Errorf("invalid JSON Schema for prefix %q: %w", prefix, err)
+	}
+	const url = "schema.json" // every schema has a compiler of its own
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, doc); err != nil {
+		return KeySchema{}, fmt.Errorf("invalid JSON Schema for prefix %q: %w", prefix, err)
+	}
+	schema, err := compiler.Compile(url)
+	if err != nil {
+		return KeySchema{}, fmt.Errorf("invalid JSON Schema for prefix %q: %w", prefix, err)
+	}
+	return KeySchema{Prefix: prefix, schema: schema}, nil
+}
+
+// LoadKeySchema compiles the JSON Schema of a PREFIX=FILE specification
+func LoadKeySchema(spec string) (KeySchema, error) {
+	prefix, file, ok := strings.Cut(spec, "=")
+	if !ok || prefix == "" || file == "" {
+		return KeySchema{}, fmt.Errorf("invalid JSON Schema %q, expected PREFIX=FILE", spec)
+	}
+	document, err := os.ReadFile(file)
+	if err != nil {
+		return KeySchema{}, fmt.Errorf("failed to read JSON Schema for prefix %q: %w", prefix, err)
+	}
+	return CompileKeySchema(prefix, document)
+}
+
+// validateValue checks value against the schema of the longest prefix of key, keys outside all prefixes
+// are not checked. Violations are returned as ValidationError.
+func validateValue(schemas []KeySchema, key, value string) error {
+	var match *KeySchema
+	for i, schema := range schemas {
+		if strings.HasPrefix(key, schema.Prefix) && (match == nil || len(schema.Prefix) > len(match.Prefix)) {
+			match = &schemas[i]
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	instance, err := jsonschema.UnmarshalJSON(strings.NewReader(value))
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("value is not JSON: %w", err)}
+	}
+	if err := match.schema.Validate(instance); err != nil {
+		return &ValidationError{Err: fmt.Errorf("value violates the JSON Schema of prefix %q: %w", match.Prefix, err)}
+	}
+	return nil
+}
+
+// rejectInvalid marks the pending records whose values violate their JSON Schema failed with the violation
+// and returns the remaining ones, deletions are not checked
+func (s *Service) rejectInvalid(ctx context.Context, records []KeyValueRecord) []KeyValueRecord {
+	if len(s.schemas) == 0 {
+		return records
+	}
+	valid := records[:0]
+	for _, record := range records {
+		var err error
+		if !record.Tombstone {
+			err = s.redactError(record.Key, validateValue(s.schemas, record.Key, record.Value))
+		}
+		if err == nil {
+			valid = append(valid, record)
+			continue
+		}
+		metrics.SchemaViolations.WithLabelValues(log.DirectionPgToEtcd).Inc()
+		s.recordFailure(log.DirectionPgToEtcd, record.Key, 0, err)
+		logger := s.logger().WithContext(ctx).WithError(err).WithField(log.FieldKey, record.Key)
+		recordErr := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+			_, recordErr := s.store.RecordAttempt(ctx, s.pgPool, record.Key, err, 1)
+			return recordErr
+		})
+		if recordErr != nil {
+			logger.WithField("record_error", recordErr.Error()).Warn("Failed to mark pending record violating its JSON Schema failed")
+			continue
+		}
+		logger.Error("Rejected pending record violating its JSON Schema, skipping it until etcd_requeue_failed() is called")
+	}
+	return valid
+}
+
+// flagInvalid reports a record from etcd whose value violates its JSON Schema, it is mirrored anyway to
+// keep PostgreSQL consistent with etcd
+func (s *Service) flagInvalid(ctx context.Context, record KeyValueRecord) {
+	if len(s.schemas) == 0 || record.Tombstone {
+		return
+	}
+	err := s.redactError(record.Key, validateValue(s.schemas, record.Key, record.Value))
+	if err == nil {
+		return
+	}
+	metrics.SchemaViolations.WithLabelValues(log.DirectionEtcdToPg).Inc()
+	s.rememberFailure(log.DirectionEtcdToPg, record.Key, record.Revision, err)
+	s.logger().WithContext(ctx).WithError(err).WithFields(log.Fields{
+		log.FieldKey:      record.Key,
+		log.FieldRevision: record.Revision,
+	}).Warn("etcd value violates its JSON Schema")
+}
@@ -0,0 +1,191 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+)
+
+// Backends of slow operations, used as metric labels
+const (
+	BackendPostgreSQL = "postgresql"
+	BackendEtcd       = "etcd"
+)
+
+// SlowOps logs single PostgreSQL and etcd operations taking longer than Threshold at warn level and counts
+// them, disabled if zero. Parameter values are redacted, only their types and sizes are logged.
+type SlowOps struct {
+	Threshold time.Duration
+}
+
+// ApplyPostgreSQL traces the queries, batches and copies of the pool, usable as a New callback
+func (s SlowOps) ApplyPostgreSQL(config *pgxpool.Config) error {
+	if s.Threshold > 0 {
+		config.ConnConfig.Tracer = &slowQueryTracer{threshold: s.Threshold}
+	}
+	return nil
+}
+
+// ApplyEtcd measures the unary etcd requests, usable as a NewEtcdClient callback.
+// Watches and lease keep-alives are long-lived streams and not measured.
+func (s SlowOps) ApplyEtcd(config *clientv3.Config) error {
+	if s.Threshold > 0 {
+		config.DialOptions = append(config.DialOptions, grpc.WithChainUnaryInterceptor(slowUnaryInterceptor(s.Threshold)))
+	}
+	return nil
+}
+
+// slowOp is a started PostgreSQL operation
+type slowOp struct {
+	start     time.Time
+	operation string
+	fields    log.Fields
+}
+
+type slowOpKey struct{}
+
+type expectSlowKey struct{}
+
+// expectSlow marks operations in ctx that wait by design, e.g. for a lock, so they are not reported as slow
+func expectSlow(ctx context.Context) context.Context {
+	return context.WithValue(ctx, expectSlowKey{}, true)
+}
+
+// slowQueryTracer implements pgx.QueryTracer, pgx.BatchTracer and pgx.CopyFromTracer
+type slowQueryTracer struct {
+	threshold time.Duration
+}
+
+func (t *slowQueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, slowOpKey{}, &slowOp{
+		start:     time.Now(),
+		operation: "query",
+		fields:    log.Fields{"sql": compactSQL(data.SQL), "args": redactArgs(data.Args)},
+	})
+}
+
+func (t *slowQueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *slowQueryTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	queries := 0
+	if data.Batch != nil {
+		queries = data.Batch.Len()
+	}
+	return context.WithValue(ctx, slowOpKey{}, &slowOp{
+		start:     time.Now(),
+		operation: "batch",
+		fields:    log.Fields{"queries": queries},
+	})
+}
+
+func (t *slowQueryTracer) TraceBatchQuery(context.Context, *pgx.Conn, pgx.TraceBatchQueryData) {}
+
+func (t *slowQueryTracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *slowQueryTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return context.WithValue(ctx, slowOpKey{}, &slowOp{
+		start:     time.Now(),
+		operation: "copy",
+		fields:    log.Fields{"table": data.TableName.Sanitize(), "columns": data.ColumnNames},
+	})
+}
+
+func (t *slowQueryTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.end(ctx, data.Err)
+}
+
+// end reports the operation started in ctx if it exceeded the threshold
+func (t *slowQueryTracer) end(ctx context.Context, err error) {
+	op, ok := ctx.Value(slowOpKey{}).(*slowOp)
+	if !ok || ctx.Value(expectSlowKey{}) != nil {
+		return
+	}
+	if elapsed := time.Since(op.start); elapsed >= t.threshold {
+		reportSlowOp(BackendPostgreSQL, op.operation, elapsed, op.fields, err)
+	}
+}
+
+// slowUnaryInterceptor reports etcd requests exceeding threshold, every retry attempt is measured on its own
+func slowUnaryInterceptor(threshold time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if elapsed := time.Since(start); elapsed >= threshold && ctx.Value(expectSlowKey{}) == nil {
+			reportSlowOp(BackendEtcd, method, elapsed, etcdRequestFields(req), err)
+		}
+		return err
+	}
+}
+
+// reportSlowOp logs and counts a slow operation
+func reportSlowOp(backend, operation string, elapsed time.Duration, fields log.Fields, err error) {
+	metrics.SlowOperations.WithLabelValues(backend).Inc()
+	entry := log.Default().WithFields(fields).WithFields(log.Fields{
+		"backend":          backend,
+		"operation":        operation,
+		log.FieldLatencyMs: log.LatencyMs(elapsed),
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Warn("Slow operation")
+}
+
+// etcdRequestFields describes an etcd request by its key and the size of its value
+func etcdRequestFields(req any) log.Fields {
+	switch r := req.(type) {
+	case *etcdserverpb.RangeRequest:
+		return log.Fields{log.FieldKey: string(r.Key), "range_end": string(r.RangeEnd), "limit": r.Limit}
+	case *etcdserverpb.PutRequest:
+		return log.Fields{log.FieldKey: string(r.Key), "value": redactArg(r.Value)}
+	case *etcdserverpb.DeleteRangeRequest:
+		return log.Fields{log.FieldKey: string(r.Key), "range_end": string(r.RangeEnd)}
+	case *etcdserverpb.TxnRequest:
+		return log.Fields{"compares": len(r.Compare), "success_ops": len(r.Success), "failure_ops": len(r.Failure)}
+	case *etcdserverpb.CompactionRequest:
+		return log.Fields{log.FieldRevision: r.Revision}
+	}
+	return log.Fields{}
+}
+
+// compactSQL collapses the whitespace of a query into single spaces
+func compactSQL(sql string) string {
+	return strings.Join(strings.Fields(sql), " ")
+}
+
+// redactArgs describes query arguments by type and size without their values
+func redactArgs(args []any) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = redactArg(arg)
+	}
+	return redacted
+}
+
+func redactArg(arg any) string {
+	switch v := arg.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return fmt.Sprintf("string(%d)", len(v))
+	case []byte:
+		return fmt.Sprintf("[]byte(%d)", len(v))
+	case []string:
+		return fmt.Sprintf("[]string(%d)", len(v))
+	}
+	return fmt.Sprintf("%T", arg)
+}
@@ -0,0 +1,127 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Snapshot is the consistent state of an etcd prefix at a revision, e.g. for backups and clones
+type Snapshot struct {
+	Prefix   string       `json:"prefix"`
+	Revision int64        `json:"revision"` // etcd revision the key values correspond to
+	KVs      []SnapshotKV `json:"kvs"`      // in key order, daemon state is left out
+}
+
+// SnapshotKV is a key value of a Snapshot with its etcd metadata
+type SnapshotKV struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	CreateRevision int64  `json:"create_revision"`
+	ModRevision    int64  `json:"mod_revision"`
+	Version        int64  `json:"version"`
+	Lease          int64  `json:"lease,omitempty"`
+}
+
+// Snapshot reads the keys of prefix at the current etcd revision. The keys are read in pages pinned to
+// that revision, so the snapshot is consistent however many keys the prefix holds.
+func (s *Service) Snapshot(ctx context.Context, prefix string) (*Snapshot, error) {
+	if s.etcdClient == nil {
+		return nil, errors.New("snapshots require etcd")
+	}
+	pairs, revision, err := s.etcdClient.GetAllKeys(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %w", err)
+	}
+	return newSnapshot(prefix, revision, pairs), nil
+}
+
+// SnapshotAt reads the keys of prefix at revision, e.g. to snapshot several prefixes at the revision of
+// the first one. It fails with rpctypes.ErrCompacted once etcd compacted the revision.
+func (s *Service) SnapshotAt(ctx context.Context, prefix string, revision int64) (*Snapshot, error) {
+	if s.etcdClient == nil {
+		return nil, errors.New("snapshots require etcd")
+	}
+	if revision <= 0 {
+		return nil, fmt.Errorf("invalid snapshot revision %d", revision)
+	}
+	pairs, err := s.etcdClient.GetKeysAt(ctx, prefix, revision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %w", err)
+	}
+	return newSnapshot(prefix, revision, pairs), nil
+}
+
+// SnapshotFromMirror reads the keys of prefix at revision from the PostgreSQL mirror instead of etcd, e.g. to
+// restore a lost etcd cluster. Revision 0 reads the latest mirrored state, earlier revisions need the history.
+// Pending changes are left out and values stored compressed are decoded.
+func (s *Service) SnapshotFromMirror(ctx context.Context, prefix string, revision int64) (*Snapshot, error) {
+	table := s.hashTable()
+	switch {
+	case table == "":
+		return nil, errors.New("snapshots from the mirror require a built-in store")
+	case revision < 0:
+		return nil, fmt.Errorf("invalid snapshot revision %d", revision)
+	case revision > 0 && table != "etcd":
+		return nil, errors.New("snapshots at a revision require the history, not available with --storage=latest")
+	}
+	if revision == 0 {
+		query := fmt.Sprintf(`SELECT coalesce(max(revision), 0) FROM %s WHERE revision > 0`, table)
+		if err := s.pgPool.QueryRow(ctx, query).Scan(&revision); err != nil {
+			return nil, fmt.Errorf("failed to get mirrored revision: %w", err)
+		}
+	}
+	query := fmt.Sprintf(`SELECT key, coalesce(value, ''), coalesce(encoding, ''), revision, tombstone,
+			coalesce(create_revision, 0), coalesce(version, 0), coalesce(lease, 0)
+		FROM (
+			SELECT DISTINCT ON (key) *
+			FROM %s
+			WHERE starts_with(key, $1) AND revision > 0 AND revision <= $2
+			ORDER BY key, revision DESC
+		) l
+		WHERE NOT tombstone
+		ORDER BY key`, table)
+	rows, err := s.pgPool.Query(ctx, query, prefix, revision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot from PostgreSQL: %w", err)
+	}
+	pairs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (pair KeyValueRecord, err error) {
+		var encoding string
+		err = row.Scan(&pair.Key, &pair.Value, &encoding, &pair.Revision, &pair.Tombstone, &pair.CreateRevision,
+			&pair.Version, &pair.Lease)
+		if err != nil {
+			return pair, err
+		}
+		pair.Key = s.etcdKey(pair.Key)
+		if encoding == EncodingSHA256 {
+			return pair, fmt.Errorf("%w, cannot restore %s", ErrRedacted, pair.Key)
+		}
+		pair.Value, err = DecodeValue(pair.Value, encoding)
+		return pair, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot from PostgreSQL: %w", err)
+	}
+	return newSnapshot(prefix, revision, pairs), nil
+}
+
+// newSnapshot returns the snapshot of the data keys of pairs
+func newSnapshot(prefix string, revision int64, pairs []KeyValueRecord) *Snapshot {
+	snapshot := &Snapshot{Prefix: prefix, Revision: revision, KVs: make([]SnapshotKV, 0, len(pairs))}
+	for _, pair := range pairs {
+		if isInternalKey(pair.Key) {
+			continue
+		}
+		snapshot.KVs = append(snapshot.KVs, SnapshotKV{
+			Key:            pair.Key,
+			Value:          pair.Value,
+			CreateRevision: pair.CreateRevision,
+			ModRevision:    pair.Revision,
+			Version:        pair.Version,
+			Lease:          pair.Lease,
+		})
+	}
+	return snapshot
+}
@@ -0,0 +1,198 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+)
+
+// errSpillFull is returned when buffering more events would exceed the size limit of the spill queue
+var errSpillFull = errors.New("spill queue is full")
+
+// SpillQueue buffers etcd watch events in local files while PostgreSQL is unreachable, one JSON line
+// per event and one file per prefix. The events survive a restart of the daemon and etcd compaction.
+type SpillQueue struct {
+	dir      string
+	maxBytes int64
+
+	mu   sync.Mutex
+	size int64 // bytes of all files
+}
+
+// NewSpillQueue creates dir if needed and keeps at most maxBytes of events in it, unlimited if zero.
+// Events buffered by a previous run are kept and replayed first.
+func NewSpillQueue(dir string, maxBytes int64) (*SpillQueue, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spill files: %w", err)
+	}
+	q := &SpillQueue{dir: dir, maxBytes: maxBytes}
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spill file: %w", err)
+		}
+		q.size += info.Size()
+	}
+	metrics.SpillBytes.Set(float64(q.size))
+	return q, nil
+}
+
+// path returns the file buffering the events of prefix
+func (q *SpillQueue) path(prefix string) string {
+	return filepath.Join(q.dir, url.PathEscape(prefix)+".jsonl")
+}
+
+// pending reports whether events of prefix are buffered
+func (q *SpillQueue) pending(prefix string) bool {
+	if q == nil {
+		return false
+	}
+	info, err := os.Stat(q.path(prefix))
+	return err == nil && info.Size() > 0
+}
+
+// append buffers events of prefix after the ones already buffered, they are synced to disk on return
+func (q *SpillQueue) append(prefix string, events []*clientv3.Event) error {
+	var buf []byte
+	for _, event := range events {
+		line, err := json.Marshal((*mvccpb.Event)(event))
+		if err != nil {
+			return fmt.Errorf("failed to encode spilled event: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes > 0 && q.size+int64(len(buf)) > q.maxBytes {
+		return errSpillFull
+	}
+	file, err := os.OpenFile(q.path(prefix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open spill file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+	if _, err := file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	q.size += int64(len(buf))
+	metrics.SpillBytes.Set(float64(q.size))
+	metrics.SpilledEvents.Add(float64(len(events)))
+	return nil
+}
+
+// load returns the buffered events of prefix in their original order
+func (q *SpillQueue) load(prefix string) ([]*clientv3.Event, error) {
+	file, err := os.Open(q.path(prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spill file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var events []*clientv3.Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 4*maxTxnBytes) // values are base64 encoded
+	for scanner.Scan() {
+		var event mvccpb.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode spilled event: %w", err)
+		}
+		events = append(events, (*clientv3.Event)(&event))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spill file: %w", err)
+	}
+	return events, nil
+}
+
+// clear drops the buffered events of prefix
+func (q *SpillQueue) clear(prefix string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	name := q.path(prefix)
+	info, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spill file: %w", err)
+	}
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("failed to remove spill file: %w", err)
+	}
+	q.size -= info.Size()
+	metrics.SpillBytes.Set(float64(q.size))
+	return nil
+}
+
+// spillable reports whether a failure to apply an etcd event is worth buffering it until PostgreSQL is back
+func (s *Service) spillable(err error) bool {
+	return s.spill != nil && ErrorCategory(err) == CategoryConnection
+}
+
+// replaySpill applies the events of prefix buffered while PostgreSQL was unreachable and records how far
+// the prefix is synced. It reports false if PostgreSQL is still unreachable and the events stay buffered.
+func (s *Service) replaySpill(ctx context.Context, prefix string) bool {
+	if !s.spill.pending(prefix) {
+		return true
+	}
+	events, err := s.spill.load(prefix)
+	if err != nil {
+		countError(err)
+		s.logger().WithError(err).WithField("prefix", prefix).Error("Failed to load spilled etcd events")
+		return false
+	}
+
+	// Applying an event again is harmless, a failed replay starts over from the first event
+	for _, event := range events {
+		if err := s.processEtcdEvent(ctx, event); err != nil {
+			if s.spillable(err) {
+				s.logger().WithContext(ctx).WithError(err).WithField("prefix", prefix).Debug("PostgreSQL still unreachable, keeping spilled etcd events")
+				return false
+			}
+			s.recordFailure(log.DirectionEtcdToPg, string(event.Kv.Key), event.Kv.ModRevision, err)
+			s.logger().WithContext(ctx).WithError(err).WithField("key", string(event.Kv.Key)).Error("Failed to replay spilled etcd event")
+		}
+	}
+	revision := events[len(events)-1].Kv.ModRevision
+	err = s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		return s.store.SaveCheckpoint(ctx, s.pgPool, prefix, revision)
+	})
+	if err != nil {
+		s.logger().WithError(err).WithField("prefix", prefix).Warn("Failed to save sync state, keeping spilled etcd events")
+		return false
+	}
+	if err := s.spill.clear(prefix); err != nil {
+		countError(err)
+		s.logger().WithError(err).WithField("prefix", prefix).Error("Failed to clear spilled etcd events")
+		return false
+	}
+	s.logger().WithContext(ctx).WithFields(log.Fields{
+		"prefix":   prefix,
+		"count":    len(events),
+		"revision": revision,
+	}).Info("Replayed etcd events spilled while PostgreSQL was unreachable")
+	return true
+}
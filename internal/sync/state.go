@@ -0,0 +1,34 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SaveSyncState records the etcd revision prefix is synced up to, a snapshot or the last watched event
+func SaveSyncState(ctx context.Context, db PgxIface, prefix string, revision int64) error {
+	query := `INSERT INTO etcd_sync_state (prefix, revision, updated_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (prefix) DO UPDATE SET revision = EXCLUDED.revision, updated_at = EXCLUDED.updated_at`
+
+	if _, err := db.Exec(ctx, query, prefix, revision); err != nil {
+		return fmt.Errorf("failed to save sync state: %w", err)
+	}
+	return nil
+}
+
+// GetSyncState returns the recorded revision of prefix, 0 if the prefix was never synced
+func GetSyncState(ctx context.Context, db PgxIface, prefix string) (int64, error) {
+	var revision int64
+	err := db.QueryRow(ctx, `SELECT revision FROM etcd_sync_state WHERE prefix = $1`, prefix).Scan(&revision)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sync state: %w", err)
+	}
+	return revision, nil
+}
@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// retries counts the failed attempts of RetryWithBackoff that were retried, of all services of the process
+var retries atomic.Int64
+
+// Stats are the counters of a service since it was created, reported by Service.Stats and with the heartbeat
+// by the etcd_sync_stats() SQL function
+type Stats struct {
+	EventsApplied   int64   `json:"events_applied"`   // etcd changes applied to PostgreSQL
+	PendingsFlushed int64   `json:"pendings_flushed"` // pending PostgreSQL changes written to etcd
+	Conflicts       int64   `json:"conflicts"`        // pending changes rejected by a compare-and-swap
+	Retries         int64   `json:"retries"`          // retried PostgreSQL and etcd operations of the process
+	LagRevisions    int64   `json:"lag_revisions"`    // etcd revisions not applied to PostgreSQL yet
+	LagSeconds      float64 `json:"lag_seconds"`      // age of the oldest etcd change not applied yet
+}
+
+// serviceStats holds the counters of Stats
+type serviceStats struct {
+	eventsApplied   atomic.Int64
+	pendingsFlushed atomic.Int64
+	conflicts       atomic.Int64
+	lagRevisions    atomic.Int64
+	lagNanos        atomic.Int64
+}
+
+// Stats returns the counters of the service. The lag is updated by the lag check every 10 seconds.
+func (s *Service) Stats() Stats {
+	return Stats{
+		EventsApplied:   s.stats.eventsApplied.Load(),
+		PendingsFlushed: s.stats.pendingsFlushed.Load(),
+		Conflicts:       s.stats.conflicts.Load(),
+		Retries:         retries.Load(),
+		LagRevisions:    s.stats.lagRevisions.Load(),
+		LagSeconds:      time.Duration(s.stats.lagNanos.Load()).Seconds(),
+	}
+}
+
+// countSynced counts a change synced in direction
+func (s *serviceStats) countSynced(direction string) {
+	if direction == log.DirectionEtcdToPg {
+		s.eventsApplied.Add(1)
+	} else {
+		s.pendingsFlushed.Add(1)
+	}
+}
+
+// setLag records the lag of the slowest prefix
+func (s *serviceStats) setLag(revisions int64, age time.Duration) {
+	s.lagRevisions.Store(revisions)
+	s.lagNanos.Store(int64(age))
+}
@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PoolStats is a snapshot of PostgreSQL connection pool statistics
+type PoolStats struct {
+	AcquiredConns          int32   `json:"acquired_conns"`
+	IdleConns              int32   `json:"idle_conns"`
+	TotalConns             int32   `json:"total_conns"`
+	MaxConns               int32   `json:"max_conns"`
+	AcquireCount           int64   `json:"acquire_count"`
+	AcquireDurationSeconds float64 `json:"acquire_duration_seconds"`
+	EmptyAcquireCount      int64   `json:"empty_acquire_count"`
+	CanceledAcquireCount   int64   `json:"canceled_acquire_count"`
+}
+
+// EtcdStatus describes the etcd client connection
+type EtcdStatus struct {
+	Endpoints       []string `json:"endpoints"`
+	State           string   `json:"state"`
+	CompactRevision int64    `json:"compact_revision"`
+	NoSpaceAlarm    bool     `json:"nospace_alarm"`
+	WritesHeld      string   `json:"writes_held,omitempty"` // why PostgreSQL changes are held back, see ClusterHold
+}
+
+// Status is the service status reported by the admin endpoint
+type Status struct {
+	Pool       *PoolStats      `json:"pool,omitempty"`
+	Etcd       EtcdStatus      `json:"etcd"`
+	Checkpoint int64           `json:"checkpoint"` // latest etcd revision applied to PostgreSQL
+	Paused     bool            `json:"paused"`     // synchronization paused by an operator
+	Election   *ElectionStatus `json:"election,omitempty"`
+}
+
+// statter is implemented by *pgxpool.Pool
+type statter interface {
+	Stat() *pgxpool.Stat
+}
+
+// PoolStat returns the pool statistics if the PostgreSQL handle is a pool
+func PoolStat(pool PgxIface) *pgxpool.Stat {
+	if p, ok := pool.(correlatedPool); ok {
+		pool = p.PgxIface
+	}
+	if p, ok := pool.(statter); ok {
+		return p.Stat()
+	}
+	return nil
+}
+
+// NewPoolStats converts pgxpool statistics into a PoolStats snapshot
+func NewPoolStats(s *pgxpool.Stat) *PoolStats {
+	if s == nil {
+		return nil
+	}
+	return &PoolStats{
+		AcquiredConns:          s.AcquiredConns(),
+		IdleConns:              s.IdleConns(),
+		TotalConns:             s.TotalConns(),
+		MaxConns:               s.MaxConns(),
+		AcquireCount:           s.AcquireCount(),
+		AcquireDurationSeconds: s.AcquireDuration().Seconds(),
+		EmptyAcquireCount:      s.EmptyAcquireCount(),
+		CanceledAcquireCount:   s.CanceledAcquireCount(),
+	}
+}
+
+// Status returns a snapshot of the connection state of both backends
+func (s *Service) Status() Status {
+	var election *ElectionStatus
+	if s.election != nil {
+		status := s.election.Status()
+		election = &status
+	}
+	etcd := EtcdStatus{NoSpaceAlarm: s.NoSpaceAlarm(), WritesHeld: s.ClusterHold()}
+	if s.etcdClient != nil { // nil when bridging another KV backend
+		etcd.Endpoints = s.etcdClient.Endpoints()
+		etcd.State = s.etcdClient.ConnectionState()
+		etcd.CompactRevision = s.etcdClient.CompactRevision()
+	}
+	return Status{
+		Pool:       NewPoolStats(PoolStat(s.pgPool)),
+		Etcd:       etcd,
+		Checkpoint: s.checkpoint.Load(),
+		Paused:     s.Paused(),
+		Election:   election,
+	}
+}
@@ -0,0 +1,240 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Storage modes of the PostgreSQL mirror
+const (
+	// StorageHistory keeps every revision in the etcd table
+	StorageHistory = "history"
+	// StorageLatest keeps exactly one row per key in the etcd_latest table
+	StorageLatest = "latest"
+)
+
+// Store is the relational layout the service reads pending records from and writes etcd changes to. The
+// built-in stores are selected by StorageMode, others, e.g. for TimescaleDB hypertables, Citus distributed
+// tables or an in-memory store for tests, are set by Config.Store. pool is the connection pool of the
+// service or the transaction a watch response is applied in.
+type Store interface {
+	// BulkInsert writes changes received from etcd and notifies channel of each, unless empty. Values
+	// compressed by Config.CompressThreshold carry their Encoding.
+	BulkInsert(ctx context.Context, pool PgxIface, records []KeyValueRecord, channel string) error
+	// ClaimPending returns the pending records to push to etcd and claims them for instance
+	ClaimPending(ctx context.Context, pool PgxIface, instance string) ([]KeyValueRecord, error)
+	// ClaimPendingRecord claims the pending record of key, nil if there is none
+	ClaimPendingRecord(ctx context.Context, pool PgxIface, key, instance string) (*KeyValueRecord, error)
+	// StaleClaims returns the records still claimed by a previous run of instance
+	StaleClaims(ctx context.Context, pool PgxIface, instance string) ([]KeyValueRecord, error)
+	// ReleaseClaim makes the pending record of key available to the next poll
+	ReleaseClaim(ctx context.Context, pool PgxIface, key string) error
+	// Backlog returns the depth and age of the pending records
+	Backlog(ctx context.Context, pool PgxIface) (Backlog, error)
+	// RecordAttempt counts a failed push of key and reports whether it was marked failed after maxAttempts
+	RecordAttempt(ctx context.Context, pool PgxIface, key string, cause error, maxAttempts int) (bool, error)
+	// MarkSynced stores the etcd revision of a pending record pushed to etcd
+	MarkSynced(ctx context.Context, pool PgxIface, record KeyValueRecord, revision int64) error
+	// UpdateMetadata completes a pushed record with the metadata of its watch event and reports whether it existed
+	UpdateMetadata(ctx context.Context, pool PgxIface, record KeyValueRecord) (bool, error)
+	// DiscardPending removes the pending record of key
+	DiscardPending(ctx context.Context, pool PgxIface, key string) error
+	// RevisionGaps returns the keys of prefix whose etcd revisions are missing at the etcd header revision
+	RevisionGaps(ctx context.Context, pool PgxIface, prefix string, keys []string, revisions []int64, header int64) ([]RevisionGap, error)
+	// SaveCheckpoint records the etcd revision prefix is synced up to
+	SaveCheckpoint(ctx context.Context, pool PgxIface, prefix string, revision int64) error
+	// LoadCheckpoint returns the recorded revision of prefix, 0 if the prefix was never synced
+	LoadCheckpoint(ctx context.Context, pool PgxIface, prefix string) (int64, error)
+}
+
+// newRecordStore returns the store for a storage mode, StorageHistory by default
+func newRecordStore(mode, ingest string) Store {
+	if mode == StorageLatest {
+		return latestStore{}
+	}
+	return historyStore{staging: ingest == IngestStaging}
+}
+
+// syncStateCheckpoints keeps the checkpoints of the built-in stores in the etcd_sync_state table
+type syncStateCheckpoints struct{}
+
+func (syncStateCheckpoints) SaveCheckpoint(ctx context.Context, pool PgxIface, prefix string, revision int64) error {
+	return SaveSyncState(ctx, pool, prefix, revision)
+}
+
+func (syncStateCheckpoints) LoadCheckpoint(ctx context.Context, pool PgxIface, prefix string) (int64, error) {
+	return GetSyncState(ctx, pool, prefix)
+}
+
+// historyStore keeps the full revision history in the etcd table
+type historyStore struct {
+	syncStateCheckpoints
+	staging bool // merge batches through etcd_staging
+}
+
+func (h historyStore) BulkInsert(ctx context.Context, pool PgxIface, records []KeyValueRecord, channel string) error {
+	if h.staging {
+		return BulkInsertStaging(ctx, pool, records, channel)
+	}
+	return BulkInsertWithNotify(ctx, pool, records, channel)
+}
+
+func (historyStore) Backlog(ctx context.Context, pool PgxIface) (Backlog, error) {
+	return GetBacklog(ctx, pool, "etcd")
+}
+
+func (historyStore) RecordAttempt(ctx context.Context, pool PgxIface, key string, cause error, maxAttempts int) (bool, error) {
+	return RecordSyncAttempt(ctx, pool, "etcd", key, cause, maxAttempts)
+}
+
+func (historyStore) ClaimPending(ctx context.Context, pool PgxIface, instance string) ([]KeyValueRecord, error) {
+	return ClaimPendingRecords(ctx, pool, "etcd", instance)
+}
+
+func (historyStore) ClaimPendingRecord(ctx context.Context, pool PgxIface, key, instance string) (*KeyValueRecord, error) {
+	return ClaimPendingRecord(ctx, pool, "etcd", key, instance)
+}
+
+func (historyStore) StaleClaims(ctx context.Context, pool PgxIface, instance string) ([]KeyValueRecord, error) {
+	return GetStaleClaims(ctx, pool, "etcd", instance)
+}
+
+func (historyStore) ReleaseClaim(ctx context.Context, pool PgxIface, key string) error {
+	return ReleaseClaim(ctx, pool, "etcd", key)
+}
+
+func (historyStore) MarkSynced(ctx context.Context, pool PgxIface, record KeyValueRecord, revision int64) error {
+	return UpdateRevision(ctx, pool, record.Key, revision)
+}
+
+func (historyStore) UpdateMetadata(ctx context.Context, pool PgxIface, record KeyValueRecord) (bool, error) {
+	return UpdateMetadata(ctx, pool, "etcd", record)
+}
+
+func (historyStore) DiscardPending(ctx context.Context, pool PgxIface, key string) error {
+	return DeletePendingRecord(ctx, pool, key)
+}
+
+func (historyStore) RevisionGaps(ctx context.Context, pool PgxIface, prefix string, keys []string, revisions []int64, header int64) ([]RevisionGap, error) {
+	return FindRevisionGaps(ctx, pool, prefix, keys, revisions, header)
+}
+
+// latestStore keeps one row per key in the etcd_latest table, upserting on key and deleting tombstones.
+// etcd changes never overwrite a pending row, the pending change is pushed to etcd afterwards.
+type latestStore struct {
+	syncStateCheckpoints
+}
+
+func (latestStore) BulkInsert(ctx context.Context, pool PgxIface, records []KeyValueRecord, channel string) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, record := range records {
+		if record.Tombstone {
+			batch.Queue(`DELETE FROM etcd_latest
+				WHERE key = $1 AND revision <> -1 AND revision < $2`, record.Key, record.Revision)
+			continue
+		}
+		batch.Queue(`INSERT INTO etcd_latest (ts, key, value, revision, tombstone, create_revision, version, lease, encoding, value_hash, facts)
+			VALUES ($1, $2, $3, $4, false, $5, $6, $7, NULLIF($8, ''), $9, $10)
+			ON CONFLICT (key) DO UPDATE SET
+			ts = EXCLUDED.ts, value = EXCLUDED.value, revision = EXCLUDED.revision, tombstone = false,
+			create_revision = EXCLUDED.create_revision, version = EXCLUDED.version, lease = EXCLUDED.lease,
+			encoding = EXCLUDED.encoding, value_hash = EXCLUDED.value_hash, facts = EXCLUDED.facts
+			WHERE etcd_latest.revision <> -1 AND etcd_latest.revision < EXCLUDED.revision`,
+			record.Ts, record.Key, record.Value, record.Revision, record.CreateRevision, record.Version, record.Lease,
+			record.Encoding, record.Hash, record.Facts)
+	}
+	if err := queueNotifications(batch, records, channel); err != nil {
+		return err
+	}
+
+	if err := pool.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("failed to execute batch upsert: %w", err)
+	}
+
+	log.Default().WithField("count", len(records)).Info("Bulk upserted latest records to PostgreSQL")
+	return nil
+}
+
+func (latestStore) Backlog(ctx context.Context, pool PgxIface) (Backlog, error) {
+	return GetBacklog(ctx, pool, "etcd_latest")
+}
+
+func (latestStore) RecordAttempt(ctx context.Context, pool PgxIface, key string, cause error, maxAttempts int) (bool, error) {
+	return RecordSyncAttempt(ctx, pool, "etcd_latest", key, cause, maxAttempts)
+}
+
+func (latestStore) ClaimPending(ctx context.Context, pool PgxIface, instance string) ([]KeyValueRecord, error) {
+	return ClaimPendingRecords(ctx, pool, "etcd_latest", instance)
+}
+
+func (latestStore) ClaimPendingRecord(ctx context.Context, pool PgxIface, key, instance string) (*KeyValueRecord, error) {
+	return ClaimPendingRecord(ctx, pool, "etcd_latest", key, instance)
+}
+
+func (latestStore) StaleClaims(ctx context.Context, pool PgxIface, instance string) ([]KeyValueRecord, error) {
+	return GetStaleClaims(ctx, pool, "etcd_latest", instance)
+}
+
+func (latestStore) ReleaseClaim(ctx context.Context, pool PgxIface, key string) error {
+	return ReleaseClaim(ctx, pool, "etcd_latest", key)
+}
+
+// markSynced stores the etcd revision of a pushed change, synced deletions are removed.
+// The pending row is matched by its timestamp so a change queued meanwhile stays pending.
+func (latestStore) MarkSynced(ctx context.Context, pool PgxIface, record KeyValueRecord, revision int64) error {
+	var err error
+	if record.Tombstone {
+		_, err = pool.Exec(ctx, `DELETE FROM etcd_latest WHERE key = $1 AND ts = $2 AND revision = -1`,
+			record.Key, record.Ts)
+	} else {
+		_, err = pool.Exec(ctx, `UPDATE etcd_latest SET revision = $3 WHERE key = $1 AND ts = $2 AND revision = -1`,
+			record.Key, record.Ts, revision)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update revision: %w", err)
+	}
+
+	return nil
+}
+
+// updateMetadata has nothing to complete for deletions, synced deletions are removed
+func (latestStore) UpdateMetadata(ctx context.Context, pool PgxIface, record KeyValueRecord) (bool, error) {
+	if record.Tombstone {
+		return true, nil
+	}
+	return UpdateMetadata(ctx, pool, "etcd_latest", record)
+}
+
+func (latestStore) DiscardPending(ctx context.Context, pool PgxIface, key string) error {
+	if _, err := pool.Exec(ctx, `DELETE FROM etcd_latest WHERE key = $1 AND revision = -1`, key); err != nil {
+		return fmt.Errorf("failed to delete pending record: %w", err)
+	}
+	return nil
+}
+
+// revisionGaps mirrors etcd_revision_gaps() for the etcd_latest table, where only the newest revision of a key exists
+func (latestStore) RevisionGaps(ctx context.Context, pool PgxIface, prefix string, keys []string, revisions []int64, header int64) ([]RevisionGap, error) {
+	query := `WITH watermark AS (
+			SELECT coalesce(max(e.revision), 0) AS revision
+			FROM etcd_latest e
+			WHERE starts_with(e.key, $1) AND e.revision > 0
+		)
+		SELECT k.key, k.revision, 'missing_revision'
+		FROM unnest($2::text[], $3::bigint[]) AS k(key, revision)
+		CROSS JOIN watermark w
+		LEFT JOIN etcd_latest e ON e.key = k.key
+		WHERE k.revision <= w.revision AND (e.key IS NULL OR (e.revision > 0 AND e.revision < k.revision))
+		UNION ALL
+		SELECT e.key, e.revision, 'missing_delete'
+		FROM etcd_latest e
+		WHERE starts_with(e.key, $1) AND e.revision > 0 AND e.revision <= $4 AND e.key <> ALL ($2)`
+	return queryRevisionGaps(ctx, pool, query, prefix, keys, revisions, header)
+}
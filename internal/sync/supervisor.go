@@ -0,0 +1,70 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// Backoff between restarts of a panicking worker, reset after it ran for supervisorMaxDelay
+const (
+	supervisorBaseDelay = time.Second
+	supervisorMaxDelay  = time.Minute
+)
+
+// supervise runs worker until ctx is done and restarts it with backoff after a panic, so a bug in one
+// goroutine doesn't take the whole process down. An error returned by worker ends the supervision.
+func supervise(ctx context.Context, name string, worker func(ctx context.Context) error) error {
+	delay := supervisorBaseDelay
+	for {
+		start := time.Now()
+		panicked, err := runRecovered(ctx, name, worker)
+		if !panicked {
+			return err
+		}
+		if time.Since(start) > supervisorMaxDelay {
+			delay = supervisorBaseDelay
+		}
+
+		metrics.WorkerRestarts.WithLabelValues(name).Inc()
+		log.Default().WithFields(log.Fields{"worker": name, "delay": delay}).Warn("Restarting worker after panic")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(delay, DefaultRetryConfig().Jitter)):
+		}
+		delay = min(delay*2, supervisorMaxDelay)
+	}
+}
+
+// runRecovered runs worker once and reports whether it panicked, the panic is logged with its stack trace
+func runRecovered(ctx context.Context, name string, worker func(ctx context.Context) error) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			err = fmt.Errorf("worker %s panicked: %v", name, r)
+			countError(err)
+			log.Default().WithFields(log.Fields{
+				"worker": name,
+				"panic":  fmt.Sprint(r),
+				"stack":  string(debug.Stack()),
+			}).Error("Worker panicked")
+		}
+	}()
+	return false, worker(ctx)
+}
+
+// spawn runs a background worker without result in a supervised goroutine
+func spawn(ctx context.Context, name string, worker func(ctx context.Context)) {
+	go func() {
+		_ = supervise(ctx, name, func(ctx context.Context) error {
+			worker(ctx)
+			return nil
+		})
+	}()
+}
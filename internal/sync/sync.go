@@ -2,199 +2,970 @@
 package sync
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/failpoint"
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/tracing"
 )
 
 // Service orchestrates bidirectional synchronization between etcd and PostgreSQL
 type Service struct {
-	pgPool          PgxIface
-	etcdClient      *EtcdClient
-	prefix          string
-	pollingInterval time.Duration
+	pgPool            PgxIface
+	etcdClient        *EtcdClient
+	prefixes          []string
+	metricPrefixes    []string
+	concurrency       int
+	pollingInterval   time.Duration
+	captureMode       string
+	notifyChannel     string
+	statementTimeout  time.Duration
+	historyMode       string
+	store             Store
+	auditInterval     time.Duration
+	compactInterval   time.Duration
+	lagThreshold      time.Duration
+	heartbeatInterval time.Duration
+	backlogAlert      BacklogAlert
+	maxSyncAttempts   int
+	readOnly          bool
+	replicas          []*Replica
+	auditLog          AuditLog
+	recentApplied     *ring[AuditLogEntry]
+	recentFailed      *ring[RecentFailure]
+	subscribers       subscribers // receivers of applied changes, see SubscribeAudit
+	onApplied         func(AuditLogEntry)
+	onFailure         func(RecentFailure)
+	ownWrites         *ownWrites // revisions pushed to etcd whose watch events are echoes
+	election          *Election
+	lag               *lagTracker
+	pause             pauseState
+	resync            map[string]chan struct{} // resynchronization requests per prefix
+	autoResync        AutoResync
+	lastResync        resyncTimes
+	spill             *SpillQueue // watch events buffered while PostgreSQL is unreachable, disabled if nil
+	version           string
+	checkpoint        atomic.Int64  // latest etcd revision applied to PostgreSQL
+	noSpace           atomic.Bool   // etcd has an active NOSPACE alarm
+	clusterHold       atomic.Value  // reason writes to etcd are held back, see ClusterHold
+	etcdLeader        atomic.Uint64 // last etcd leader member ID seen by the cluster health check
+	lastLoop          atomic.Int64  // Unix nanoseconds of the last sync loop iteration, 0 if none
+	backlog           atomic.Int64  // pending PostgreSQL changes found by the last poll
+
+	hooks atomic.Pointer[[]Hook] // receivers of applied changes, see RegisterHook
+	feeds changeFeeds            // subscriptions of applied changes, see Subscribe
+
+	kv KVBackend // key-value store bridged instead of etcd, see startBridge
+
+	stats serviceStats // counters reported by Stats
+
+	pushOnly         bool // DirectionPgToEtcd, etcd changes are not mirrored
+	batchSize        int
+	conflictStrategy string
+	log              log.Logger
+	clock            func() time.Time
+	tenant           string
+
+	compressThreshold int      // see Config.CompressThreshold
+	chunkPrefixes     []string // see Config.ChunkPrefixes
+
+	schemas []KeySchema // see Config.Schemas
+	dedup   bool        // see Config.Dedup
+
+	decoders []PrefixDecoder // see Config.Decoders
+
+	keyPolicy   string // see Config.KeyPolicy
+	maxKeyBytes int    // see Config.MaxKeyBytes
+
+	retention []RetentionPolicy // see Config.Retention
+
+	secrets []SecretRule // see Config.Secrets
 }
 
-// NewService creates a new synchronization service
-func NewService(pgPool PgxIface, etcdClient *EtcdClient, pollingInterval time.Duration) *Service {
+// NewService creates a new synchronization service configured by opts
+func NewService(pgPool PgxIface, etcdClient *EtcdClient, opts ...Option) *Service {
+	var config Config
+	for _, opt := range opts {
+		opt(&config)
+	}
+	prefixes := config.Prefixes
+	if len(prefixes) == 0 && etcdClient != nil {
+		prefixes = []string{etcdClient.Prefix()}
+	}
+	concurrency := config.InitialSyncConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	recentEvents := config.RecentEvents
+	if recentEvents <= 0 {
+		recentEvents = defaultRecentEvents
+	}
+	metricPrefixes := config.MetricPrefixes
+	if len(metricPrefixes) == 0 {
+		metricPrefixes = prefixes
+	}
+	resync := make(map[string]chan struct{}, len(prefixes))
+	for _, prefix := range prefixes {
+		resync[prefix] = make(chan struct{}, 1)
+	}
+	if pgPool != nil {
+		pgPool = correlatedPool{pgPool}
+	}
+	store := config.Store
+	if store == nil {
+		store = newRecordStore(config.StorageMode, config.IngestMode)
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = maxTxnOps
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	conflictStrategy := config.ConflictStrategy
+	if conflictStrategy == ConflictEtcdWins && config.StorageMode == StorageLatest {
+		// The pending row replaced the synced one, so the revision the change is based on is unknown
+		logger.Warn("Conflict strategy etcd_wins requires history storage, pending changes overwrite etcd")
+		conflictStrategy = ConflictPostgreSQLWins
+	}
+	dedup := config.Dedup
+	if dedup && config.StorageMode == StorageLatest {
+		// etcd_latest keeps one row per key anyway
+		logger.Warn("Deduplication requires history storage, ignoring it")
+		dedup = false
+	}
+	retention := config.Retention
+	if len(retention) > 0 && config.StorageMode == StorageLatest {
+		logger.Warn("Retention policies require history storage, ignoring them")
+		retention = nil
+	}
+	historyMode := config.HistoryMode
+	if historyMode == HistoryPrune && config.StorageMode == StorageLatest {
+		// etcd_latest keeps no compacted revisions to prune
+		logger.Warn("History pruning requires history storage, ignoring it")
+		historyMode = HistoryRetain
+	}
 	return &Service{
-		pgPool:          pgPool,
-		etcdClient:      etcdClient,
-		pollingInterval: pollingInterval,
+		pgPool:            pgPool,
+		etcdClient:        etcdClient,
+		prefixes:          prefixes,
+		metricPrefixes:    metricPrefixes,
+		concurrency:       concurrency,
+		pollingInterval:   config.PollingInterval,
+		captureMode:       config.CaptureMode,
+		notifyChannel:     config.NotifyChannel,
+		statementTimeout:  config.StatementTimeout,
+		historyMode:       historyMode,
+		store:             store,
+		auditInterval:     config.AuditInterval,
+		compactInterval:   config.CompactInterval,
+		lagThreshold:      config.LagThreshold,
+		heartbeatInterval: config.HeartbeatInterval,
+		backlogAlert:      config.BacklogAlert,
+		maxSyncAttempts:   config.MaxSyncAttempts,
+		readOnly:          config.ReadOnly || config.Direction == DirectionEtcdToPg,
+		pushOnly:          config.Direction == DirectionPgToEtcd,
+		batchSize:         batchSize,
+		conflictStrategy:  conflictStrategy,
+		log:               logger,
+		clock:             config.Clock,
+		tenant:            config.Tenant,
+		replicas:          config.Replicas,
+		auditLog:          config.AuditLog,
+		recentApplied:     newRing[AuditLogEntry](recentEvents),
+		recentFailed:      newRing[RecentFailure](recentEvents),
+		onApplied:         config.OnApplied,
+		onFailure:         config.OnFailure,
+		ownWrites:         newOwnWrites(),
+		version:           config.Version,
+		lag:               newLagTracker(),
+		resync:            resync,
+		autoResync:        config.AutoResync,
+		spill:             config.Spill,
+		kv:                config.Backend,
+		compressThreshold: config.CompressThreshold,
+		chunkPrefixes:     config.ChunkPrefixes,
+		schemas:           config.Schemas,
+		dedup:             dedup,
+		decoders:          config.Decoders,
+		keyPolicy:         config.KeyPolicy,
+		maxKeyBytes:       cmp.Or(config.MaxKeyBytes, MaxKeyBytes),
+		retention:         retention,
+		secrets:           config.Secrets,
+	}
+}
+
+// withStatementTimeout runs a PostgreSQL operation bounded by the statement timeout.
+// Timeouts are returned as ErrStatementTimeout so the retry loops treat them as transient failures,
+// other errors are classified by ClassifyError.
+func (s *Service) withStatementTimeout(ctx context.Context, operation func(ctx context.Context) error) error {
+	if err := failpoint.Eval(FailpointPostgreSQL); err != nil {
+		return &ConnectionError{Err: err}
+	}
+	if s.statementTimeout <= 0 {
+		return ClassifyError(operation(ctx))
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, s.statementTimeout)
+	defer cancel()
+	err := operation(opCtx)
+	if err != nil && ctx.Err() == nil && opCtx.Err() != nil {
+		return &ConnectionError{Err: fmt.Errorf("%w after %s: %w", ErrStatementTimeout, s.statementTimeout, err)}
 	}
+	return ClassifyError(err)
+}
+
+// InstanceName identifies the synchronized keyspace by its absolute prefixes, instances with the same name
+// must not sync concurrently
+func (s *Service) InstanceName() string {
+	// Prefixes are relative to the namespace
+	prefixes := make([]string, len(s.prefixes))
+	for i, prefix := range s.prefixes {
+		prefixes[i] = prefix
+		if s.etcdClient != nil {
+			prefixes[i] = s.etcdClient.Namespace() + prefix
+		}
+	}
+	return strings.Join(prefixes, ",")
+}
+
+// SetElection reports the leadership of election in the service status, call before serving the status
+func (s *Service) SetElection(election *Election) {
+	s.election = election
+}
+
+// Prefixes returns the etcd key prefixes synchronized by the service
+func (s *Service) Prefixes() []string {
+	return s.prefixes
 }
 
 // Start begins the bidirectional synchronization process
 func (s *Service) Start(ctx context.Context) error {
-	logrus.Info("Starting pg_etcd bidirectional synchronization")
+	if s.kv != nil {
+		return s.startBridge(ctx)
+	}
+	errChan := make(chan error, len(s.prefixes)+1)
+	if s.pushOnly {
+		s.logger().Info("Starting pg_etcd synchronization of PostgreSQL changes to etcd, etcd changes are not mirrored")
+	} else {
+		s.logger().Info("Starting pg_etcd bidirectional synchronization")
+
+		// Perform initial sync from etcd to PostgreSQL
+		if err := s.initialSync(ctx); err != nil {
+			return fmt.Errorf("initial sync failed: %w", err)
+		}
+
+		// Start etcd to PostgreSQL sync, one watcher per prefix. Every worker is restarted after a panic.
+		for _, prefix := range s.prefixes {
+			go func() {
+				errChan <- supervise(ctx, "watcher", func(ctx context.Context) error {
+					return s.syncEtcdToPostgreSQL(ctx, prefix)
+				})
+			}()
+		}
+	}
+
+	// Start PostgreSQL to etcd sync unless running as a read-only mirror
+	if s.readOnly {
+		s.logger().Info("Running as read-only mirror, PostgreSQL changes are not synced to etcd")
+	} else {
+		for _, replica := range s.replicas {
+			spawn(ctx, "replicator", func(ctx context.Context) { s.replicate(ctx, replica) })
+		}
+		// Export the depth and age of the backlog, the objective of the propagation to etcd
+		spawn(ctx, "backlog_monitor", s.monitorBacklog)
+		go func() {
+			errChan <- supervise(ctx, "poller", func(ctx context.Context) error {
+				if s.captureMode == CaptureLogical {
+					return s.syncPostgreSQLToEtcdLogical(ctx)
+				}
+				return s.syncPostgreSQLToEtcd(ctx)
+			})
+		}()
+	}
+
+	// Mirror etcd compaction in PostgreSQL if requested, otherwise history is retained
+	if s.historyMode == HistoryPrune {
+		spawn(ctx, "history_pruner", s.pruneHistory)
+	} else {
+		s.logger().Info("Retaining full revision history in PostgreSQL")
+	}
+
+	// Prune the history of prefixes with a retention policy
+	if len(s.retention) > 0 {
+		spawn(ctx, "retention_pruner", s.enforceRetention)
+	}
+
+	// Compact etcd behind the revision persisted in PostgreSQL if requested, a read-only mirror never writes to
+	// etcd and without mirroring no revision is persisted
+	if s.compactInterval > 0 && !s.readOnly && !s.pushOnly {
+		spawn(ctx, "compactor", s.compactEtcd)
+	}
+
+	// Look for lost etcd events periodically
+	if s.auditInterval > 0 && !s.pushOnly {
+		spawn(ctx, "auditor", s.auditRevisions)
+	}
 
-	// Perform initial sync from etcd to PostgreSQL
-	if err := s.initialSync(ctx); err != nil {
-		return fmt.Errorf("initial sync failed: %w", err)
+	// Write the heartbeat row for monitoring with SQL access only
+	if s.heartbeatInterval > 0 {
+		spawn(ctx, "heartbeat", s.heartbeat)
 	}
 
-	// Start continuous synchronization in both directions
-	errChan := make(chan error, 2)
+	// Export how far PostgreSQL is behind etcd
+	if !s.pushOnly {
+		spawn(ctx, "lag_monitor", s.monitorLag)
+	}
+
+	// Report etcd membership changes picked up by endpoint auto-sync
+	spawn(ctx, "endpoint_monitor", s.etcdClient.LogEndpointChanges)
 
-	// Start etcd to PostgreSQL sync
-	go func() {
-		errChan <- s.syncEtcdToPostgreSQL(ctx)
-	}()
+	// Watch the etcd maintenance status and alarms
+	spawn(ctx, "cluster_monitor", s.monitorCluster)
 
-	// Start PostgreSQL to etcd sync
-	go func() {
-		errChan <- s.syncPostgreSQLToEtcd(ctx)
-	}()
+	// Publish a liveness key so running daemons can be discovered
+	spawn(ctx, "instance_registration", s.registerInstance)
 
 	// Wait for either goroutine to error or context cancellation
 	select {
 	case err := <-errChan:
 		return fmt.Errorf("sync error: %w", err)
 	case <-ctx.Done():
-		logrus.Info("Synchronization stopped due to context cancellation")
+		s.logger().Info("Synchronization stopped due to context cancellation")
 		return ctx.Err()
 	}
 }
 
-// initialSync performs the initial bulk sync from etcd to PostgreSQL
+// initialSync performs the initial bulk sync from etcd to PostgreSQL for all prefixes,
+// running at most s.concurrency prefix syncs in parallel
 func (s *Service) initialSync(ctx context.Context) error {
-	logrus.Info("Starting initial sync from etcd to PostgreSQL")
+	s.logger().WithFields(log.Fields{
+		"prefixes":    len(s.prefixes),
+		"concurrency": s.concurrency,
+	}).Info("Starting initial sync from etcd to PostgreSQL")
+
+	start := s.now()
+	var done, total atomic.Int64
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.concurrency)
+	for _, prefix := range s.prefixes {
+		g.Go(func() error {
+			count, err := s.startPrefix(gctx, prefix)
+			if err != nil {
+				return fmt.Errorf("prefix %s: %w", prefix, err)
+			}
+			total.Add(int64(count))
+			s.logger().WithFields(log.Fields{
+				"prefix":   prefix,
+				"count":    count,
+				"progress": fmt.Sprintf("%d/%d", done.Add(1), len(s.prefixes)),
+			}).Info("Initial sync of prefix completed")
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	s.logger().WithFields(log.Fields{
+		"count":    total.Load(),
+		"duration": s.now().Sub(start),
+	}).Info("Initial sync completed successfully")
+	return nil
+}
+
+// startPrefix brings prefix up to date before it is watched and returns the number of records copied.
+// A prefix synced before resumes from its stored revision if etcd still has the following revisions,
+// otherwise it is copied from a new snapshot and keys deleted in the meantime are reconciled.
+func (s *Service) startPrefix(ctx context.Context, prefix string) (int, error) {
+	revision, err := s.store.LoadCheckpoint(ctx, s.pgPool, prefix)
+	if err != nil {
+		return 0, err
+	}
+	if revision == 0 {
+		return s.initialSyncPrefix(ctx, prefix)
+	}
+
+	current, ok, err := s.etcdClient.CheckResumeRevision(ctx, prefix, revision)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		s.logger().WithFields(log.Fields{
+			"prefix":           prefix,
+			"revision":         revision,
+			"current_revision": current,
+			"behind":           current - revision,
+		}).Info("Resuming prefix from stored revision")
+		s.advanceCheckpoint(revision)
+		return 0, nil
+	}
+
+	compactRevision, _ := s.etcdClient.ProbeCompactRevision(ctx, prefix)
+	s.logger().WithFields(log.Fields{
+		"prefix":           prefix,
+		"revision":         revision,
+		"current_revision": current,
+		"compact_revision": compactRevision,
+		"behind":           current - revision,
+	}).Warn("Stored revision compacted by etcd, resynchronizing prefix")
+	if _, err := s.resyncPrefix(ctx, prefix); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// initialSyncPrefix copies all keys of a single prefix from etcd to PostgreSQL and returns the number of records stored.
+// The records and the snapshot revision the watch resumes from are committed together.
+func (s *Service) initialSyncPrefix(ctx context.Context, prefix string) (count int, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "initial_sync", trace.WithAttributes(attribute.String("etcd.prefix", prefix)))
+	defer func() { tracing.End(span, err) }()
+	ctx = correlate(ctx)
 
 	// Get all keys from etcd with the specified prefix
-	pairs, err := s.etcdClient.GetAllKeys(ctx, s.prefix)
+	pairs, revision, err := s.etcdClient.GetAllKeys(ctx, prefix)
 	if err != nil {
-		return fmt.Errorf("failed to get all keys from etcd: %w", err)
+		return 0, fmt.Errorf("failed to get all keys from etcd: %w", err)
 	}
+	span.SetAttributes(attribute.Int64("etcd.revision", revision), attribute.Int("pg_etcd.count", len(pairs)))
 
 	if len(pairs) == 0 {
-		logrus.Info("No keys found in etcd for initial sync")
-		return nil
+		s.logger().WithField("prefix", prefix).Info("No keys found in etcd for initial sync")
 	}
 
 	// Convert to PostgreSQL records
 	records := make([]KeyValueRecord, len(pairs))
 	for i, pair := range pairs {
 		records[i] = KeyValueRecord{
-			Key:       pair.Key,
-			Value:     pair.Value,
-			Revision:  pair.Revision,
-			Ts:        time.Now(),
-			Tombstone: pair.Tombstone,
+			Key:            pair.Key,
+			Value:          pair.Value,
+			Revision:       pair.Revision,
+			Ts:             s.now(),
+			Tombstone:      pair.Tombstone,
+			CreateRevision: pair.CreateRevision,
+			Version:        pair.Version,
+			Lease:          pair.Lease,
 		}
 	}
 
-	// Bulk insert using COPY
-	if err := BulkInsert(ctx, s.pgPool, records); err != nil {
-		return fmt.Errorf("failed to bulk insert records: %w", err)
+	if err := s.assembleChunks(ctx, records); err != nil {
+		return 0, err
 	}
 
-	logrus.WithField("count", len(records)).Info("Initial sync completed successfully")
-	return nil
+	s.decodeRecords(ctx, records)
+
+	// Keep records that cannot be stored as text out of the etcd table
+	records, err = s.quarantineInvalid(ctx, s.pgPool, records)
+	if err != nil {
+		return 0, fmt.Errorf("failed to quarantine records: %w", err)
+	}
+	for _, record := range records {
+		s.flagInvalid(ctx, record)
+	}
+
+	// Bulk insert and record the snapshot revision in one transaction, a resync only writes what changed
+	err = s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		tx, err := s.pgPool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		changed, err := s.skipMirrored(ctx, tx, records)
+		if err != nil {
+			return err
+		}
+		inserts, bumps, err := s.deduplicate(ctx, tx, changed)
+		if err != nil {
+			return err
+		}
+		if err := bumpRevisions(ctx, tx, bumps, ""); err != nil {
+			return err
+		}
+		if err := s.store.BulkInsert(ctx, tx, compressRecords(s.redactRecords(inserts), s.compressThreshold), ""); err != nil {
+			return fmt.Errorf("failed to bulk insert records: %w", err)
+		}
+		if err := s.store.SaveCheckpoint(ctx, tx, prefix, revision); err != nil {
+			return err
+		}
+		if err := failpoint.Eval(FailpointInitialSync); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.advanceCheckpoint(revision)
+
+	return len(records), nil
 }
 
-// syncEtcdToPostgreSQL continuously watches etcd for changes and syncs to PostgreSQL
-func (s *Service) syncEtcdToPostgreSQL(ctx context.Context) error {
-	logrus.Info("Starting etcd to PostgreSQL sync watcher")
+// syncEtcdToPostgreSQL continuously watches etcd for changes below prefix and syncs to PostgreSQL
+func (s *Service) syncEtcdToPostgreSQL(ctx context.Context, prefix string) error {
+	s.logger().WithField("prefix", prefix).Info("Starting etcd to PostgreSQL sync watcher")
 
-	// Get the latest revision from PostgreSQL to resume from
-	latestRevision, err := GetLatestRevision(ctx, s.pgPool)
+	// Events spilled before a restart precede the stored sync state
+	if !s.replaySpill(ctx, prefix) {
+		return fmt.Errorf("failed to replay spilled etcd events of prefix %s", prefix)
+	}
+
+	// Resume right after the snapshot of the initial sync
+	snapshotRevision, err := s.store.LoadCheckpoint(ctx, s.pgPool, prefix)
 	if err != nil {
-		return fmt.Errorf("failed to get latest revision: %w", err)
+		return err
 	}
 
 	// Start watching from the next revision with automatic recovery
-	watchChan := s.etcdClient.WatchWithRecovery(ctx, latestRevision)
+	var watchChan <-chan clientv3.WatchResponse
+	cancelWatch := func() {}
+	defer func() { cancelWatch() }()
+	// The first events of a started or restarted watch are checked for a gap after the last received revision
+	var received int64
+	resumed := false
+	watch := func(revision int64) {
+		cancelWatch()
+		var watchCtx context.Context
+		watchCtx, cancelWatch = context.WithCancel(ctx)
+		watchChan = s.etcdClient.WatchWithRecovery(watchCtx, prefix, revision, s.prevKVOptions()...)
+		received, resumed = revision, true
+	}
+	s.lag.observe(prefix, snapshotRevision)
+	watch(snapshotRevision)
+	applied := snapshotRevision // all events up to it are applied or lost, a new watch continues from there
+	var failedRevision int64    // first event lost since the watch started, 0 if none
+	var replay <-chan time.Time // retries replaying spilled events, nil if none are spilled
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-s.resync[prefix]:
+			// Requested by an operator or the revision audit, a failed resynchronization keeps the current watch
+			revision, err := s.resyncPrefix(ctx, prefix)
+			if err != nil {
+				countError(err)
+				s.logger().WithError(err).WithField("prefix", prefix).Error("Failed to resynchronize prefix")
+				continue
+			}
+			s.logger().WithFields(log.Fields{"prefix": prefix, "revision": revision}).Info("Resynchronized prefix")
+			snapshotRevision, applied, failedRevision = revision, revision, 0
+			s.lag.observe(prefix, revision)
+			watch(revision)
+		case <-replay:
+			replay = nil
+			if !s.replaySpill(correlate(ctx), prefix) {
+				replay = time.After(s.pollingInterval)
+			}
 		case watchResp, ok := <-watchChan:
 			if !ok {
 				// Watch channel closed, likely due to context cancellation
 				return ctx.Err()
 			}
+			s.markLoop()
+
+			if s.Paused() {
+				// Drop the watch instead of buffering events, the response is received again after resuming
+				cancelWatch()
+				if err := s.pause.wait(ctx); err != nil {
+					return err
+				}
+				watch(applied)
+				continue
+			}
 
-			if watchResp.Canceled {
-				// This should be handled by WatchWithRecovery, but log it
-				logrus.Warn("etcd watch was canceled - recovery should be automatic")
+			if IsCompacted(watchResp.Err()) {
+				// The events since the last synced revision are gone, take a new snapshot and watch from there
+				countError(watchResp.Err())
+				s.logger().WithError(watchResp.Err()).WithFields(log.Fields{
+					"prefix":           prefix,
+					"revision":         snapshotRevision,
+					"compact_revision": watchResp.CompactRevision,
+				}).Warn("etcd watch revision compacted, resynchronizing prefix")
+				s.countResync(prefix, ResyncCompaction)
+				if snapshotRevision, err = s.resyncPrefix(ctx, prefix); err != nil {
+					return err
+				}
+				applied, failedRevision = snapshotRevision, 0
+				s.lag.observe(prefix, snapshotRevision)
+				watch(snapshotRevision)
 				continue
 			}
 
-			if err := watchResp.Err(); err != nil {
-				logrus.WithError(err).Error("etcd watch error - recovery should be automatic")
+			if watchResp.Canceled || watchResp.Err() != nil {
+				// WatchWithRecovery restarts the watch after the last received revision
+				resumed = true
 				continue
 			}
 
-			// Process all events in this watch response
-			for _, event := range watchResp.Events {
-				err := RetryWithBackoff(ctx, DefaultRetryConfig(), func() error {
-					return s.processEtcdEvent(ctx, event)
+			if resumed && len(watchResp.Events) > 0 {
+				resumed = false
+				if s.watchGap(ctx, prefix, received, watchResp.Events[0].Kv.ModRevision) {
+					if snapshotRevision, err = s.resyncPrefix(ctx, prefix); err != nil {
+						return err
+					}
+					applied, failedRevision = snapshotRevision, 0
+					s.lag.observe(prefix, snapshotRevision)
+					watch(snapshotRevision)
+					continue
+				}
+			}
+
+			// Process all events in this watch response as one correlated batch. While earlier events are
+			// spilled because PostgreSQL is unreachable, later ones are spilled after them to keep their order.
+			batchCtx := correlate(ctx)
+			events := watchResp.Events
+			var spilled []*clientv3.Event
+			if len(events) > 0 && !s.replaySpill(batchCtx, prefix) {
+				spilled = events
+			}
+
+			// Remember how far the prefix is synced, a restart resumes the watch from there.
+			// Progress notifications advance quiet prefixes, all events up to their revision were received.
+			// After a lost event the revision stays before it, so a restart replays the event and etcd
+			// compaction doesn't drop it.
+			revision := watchResp.Header.Revision
+			if n := len(events); n > 0 {
+				revision = events[n-1].Kv.ModRevision
+			}
+			received = max(received, revision)
+
+			// The events are applied together with the sync state in one transaction. If it fails for another
+			// reason than an unreachable PostgreSQL, they are applied one by one so a broken event doesn't
+			// hold up the others.
+			saved := false
+			if spilled == nil && len(events) > 0 {
+				stateRevision := revision
+				if failedRevision > 0 {
+					stateRevision = min(revision, failedRevision-1)
+				}
+				err := RetryWithBackoff(batchCtx, DefaultRetryConfig(), func() error {
+					return s.applyWatchEvents(batchCtx, prefix, events, stateRevision)
 				})
+				switch {
+				case err == nil:
+					saved = true
+				case s.spillable(err):
+					spilled = events
+				default:
+					s.logger().WithContext(batchCtx).WithError(err).WithField("prefix", prefix).Warn("Failed to apply etcd events in one transaction, applying them one by one")
+					var failed int64
+					spilled, failed = s.applyEventsOneByOne(batchCtx, events)
+					if failedRevision == 0 {
+						failedRevision = failed
+					}
+				}
+			}
+
+			if spilled != nil {
+				if err := s.spill.append(prefix, spilled); err != nil {
+					// Lost like any other failed event, the sync state stays before the first one
+					countError(err)
+					s.logger().WithContext(batchCtx).WithError(err).WithField("prefix", prefix).Error("Failed to spill etcd events")
+					if failedRevision == 0 {
+						failedRevision = spilled[0].Kv.ModRevision
+					}
+				} else {
+					s.logger().WithContext(batchCtx).WithFields(log.Fields{
+						"prefix": prefix,
+						"count":  len(spilled),
+						"first":  spilled[0].Kv.ModRevision,
+					}).Warn("PostgreSQL unreachable, spilled etcd events to disk")
+				}
+				if replay == nil {
+					replay = time.After(s.pollingInterval)
+				}
+			}
 
-				if err != nil {
-					logrus.WithError(err).WithField("key", string(event.Kv.Key)).Error("Failed to process etcd event after retries")
-					// Continue processing other events rather than failing entirely
+			if failedRevision > 0 {
+				revision = min(revision, failedRevision-1)
+			}
+			if len(events) > 0 || watchResp.IsProgressNotify() {
+				applied = revision
+				s.lag.observe(prefix, revision)
+				if !saved {
+					err := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+						return s.store.SaveCheckpoint(ctx, s.pgPool, prefix, revision)
+					})
+					if err != nil {
+						s.logger().WithError(err).WithField("prefix", prefix).Warn("Failed to save sync state")
+					}
 				}
 			}
 		}
 	}
 }
 
+// applyEventsOneByOne applies events in separate transactions and returns the revision of the first failed
+// one, 0 if none. The events from the first one PostgreSQL couldn't be reached for are returned for spilling.
+func (s *Service) applyEventsOneByOne(ctx context.Context, events []*clientv3.Event) (spilled []*clientv3.Event, failedRevision int64) {
+	for i, event := range events {
+		err := RetryWithBackoff(ctx, DefaultRetryConfig(), func() error {
+			return s.processEtcdEvent(ctx, event)
+		})
+		if err != nil && s.spillable(err) {
+			return events[i:], failedRevision
+		}
+		if err != nil {
+			s.recordFailure(log.DirectionEtcdToPg, string(event.Kv.Key), event.Kv.ModRevision, err)
+			s.logger().WithContext(ctx).WithError(err).WithField("key", string(event.Kv.Key)).Error("Failed to process etcd event after retries")
+			// Continue processing other events rather than failing entirely
+			if failedRevision == 0 {
+				failedRevision = event.Kv.ModRevision
+			}
+		}
+	}
+	return nil, failedRevision
+}
+
+// resyncPrefix copies the current state of prefix like the initial sync and reconciles keys deleted
+// in the meantime, it returns the revision to resume watching from
+func (s *Service) resyncPrefix(ctx context.Context, prefix string) (int64, error) {
+	if !s.replaySpill(ctx, prefix) {
+		return 0, fmt.Errorf("failed to resynchronize prefix: spilled etcd events not replayed")
+	}
+	if _, err := s.initialSyncPrefix(ctx, prefix); err != nil {
+		return 0, fmt.Errorf("failed to resynchronize prefix: %w", err)
+	}
+	gaps, header, err := s.findGaps(ctx, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resynchronize prefix: %w", err)
+	}
+	if err := s.repairGaps(ctx, prefix, gaps, header); err != nil {
+		return 0, fmt.Errorf("failed to resynchronize prefix: %w", err)
+	}
+	return s.store.LoadCheckpoint(ctx, s.pgPool, prefix)
+}
+
 // processEtcdEvent processes a single etcd event and syncs it to PostgreSQL
-func (s *Service) processEtcdEvent(ctx context.Context, event *clientv3.Event) error {
+func (s *Service) processEtcdEvent(ctx context.Context, event *clientv3.Event) (err error) {
+	start := s.now()
 	key := string(event.Kv.Key)
 	revision := event.Kv.ModRevision
+	if isInternalKey(key) {
+		return nil // daemon state, not data
+	}
 
-	var record KeyValueRecord
-	record.Key = key
-	record.Revision = revision
-	record.Ts = time.Now()
+	ctx, span := tracing.Tracer().Start(ctx, "apply_etcd_event", trace.WithAttributes(
+		attribute.String("etcd.key", key),
+		attribute.Int64("etcd.revision", revision),
+		attribute.String("etcd.event_type", event.Type.String()),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	record, err := eventRecord(ctx, event)
+	if err != nil {
+		return err
+	}
+	records := []KeyValueRecord{record}
+	if err := s.assembleChunks(ctx, records); err != nil {
+		return err
+	}
+	var mirrored []bool
+	err = s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		mirrored, err = s.applyRecords(ctx, s.pgPool, records)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.advanceCheckpoint(revision)
+	if mirrored[0] {
+		s.completeRecord(ctx, records[0], prevRevision(event.PrevKv), start)
+	}
+	return nil
+}
+
+// applyWatchEvents applies the events of one watch response and records revision as the sync state of prefix
+// in a single transaction, so a crash never persists only part of them. Applying them again is idempotent.
+func (s *Service) applyWatchEvents(ctx context.Context, prefix string, events []*clientv3.Event, revision int64) (err error) {
+	start := s.now()
+	ctx, span := tracing.Tracer().Start(ctx, "apply_watch_response", trace.WithAttributes(
+		attribute.Int("pg_etcd.count", len(events)),
+		attribute.Int64("etcd.revision", revision),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	var applied []*clientv3.Event // events of data keys, daemon state is not mirrored
+	var records []KeyValueRecord
+	for _, event := range events {
+		if isInternalKey(string(event.Kv.Key)) {
+			continue
+		}
+		record, err := eventRecord(ctx, event)
+		if err != nil {
+			return err
+		}
+		applied = append(applied, event)
+		records = append(records, record)
+	}
+	if err := s.assembleChunks(ctx, records); err != nil {
+		return err
+	}
+
+	mirrored, err := s.commitRecords(ctx, prefix, records, revision)
+	if err != nil {
+		return err
+	}
+	for i, event := range applied {
+		if mirrored[i] {
+			s.completeRecord(ctx, records[i], prevRevision(event.PrevKv), start)
+		}
+	}
+	return nil
+}
+
+// commitRecords applies records and records revision as the sync state of prefix in one transaction,
+// it reports which of them were mirrored
+func (s *Service) commitRecords(ctx context.Context, prefix string, records []KeyValueRecord, revision int64) ([]bool, error) {
+	var mirrored []bool
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) error {
+		tx, err := s.pgPool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		if mirrored, err = s.applyRecords(ctx, tx, records); err != nil {
+			return err
+		}
+		if err := s.store.SaveCheckpoint(ctx, tx, prefix, revision); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.advanceCheckpoint(revision)
+	return mirrored, nil
+}
+
+// eventRecord converts a watch event into the record mirrored in PostgreSQL
+func eventRecord(ctx context.Context, event *clientv3.Event) (KeyValueRecord, error) {
+	record := KeyValueRecord{
+		Key:            string(event.Kv.Key),
+		Revision:       event.Kv.ModRevision,
+		Ts:             time.Now(),
+		CreateRevision: event.Kv.CreateRevision,
+		Version:        event.Kv.Version,
+		Lease:          event.Kv.Lease,
+	}
 
 	switch event.Type {
 	case clientv3.EventTypePut:
-		value := string(event.Kv.Value)
-		record.Value = value
-		record.Tombstone = false
-		logrus.WithFields(logrus.Fields{
-			"key":      key,
-			"revision": revision,
+		record.Value = string(event.Kv.Value)
+		log.Default().WithContext(ctx).WithFields(log.Fields{
+			"key":      record.Key,
+			"revision": record.Revision,
 			"type":     "PUT",
 		}).Debug("Processing etcd PUT event")
 
 	case clientv3.EventTypeDelete:
-		record.Value = ""
 		record.Tombstone = true
-		logrus.WithFields(logrus.Fields{
-			"key":      key,
-			"revision": revision,
+		log.Default().WithContext(ctx).WithFields(log.Fields{
+			"key":      record.Key,
+			"revision": record.Revision,
 			"type":     "DELETE",
 		}).Debug("Processing etcd DELETE event")
 
 	default:
-		return fmt.Errorf("unknown event type: %v", event.Type)
+		return KeyValueRecord{}, fmt.Errorf("unknown event type: %v", event.Type)
 	}
+	return record, nil
+}
 
-	// Insert the record into PostgreSQL
-	if err := BulkInsert(ctx, s.pgPool, []KeyValueRecord{record}); err != nil {
-		return fmt.Errorf("failed to insert event into PostgreSQL: %w", err)
+// applyRecords stores the records of watch events using db and reports which of them were mirrored.
+// Records that cannot be stored as text are quarantined and changes pushed by this daemon, which come
+// back as watch events, only complete the pushed row. The others are inserted in one batch.
+func (s *Service) applyRecords(ctx context.Context, db PgxIface, records []KeyValueRecord) ([]bool, error) {
+	mirrored := make([]bool, len(records))
+	var inserts []KeyValueRecord
+	s.decodeRecords(ctx, records)
+	for i, record := range records {
+		// Set records that cannot be stored as text aside instead of failing on every retry
+		stored, reason := s.admit(record)
+		if reason != "" {
+			if err := s.setAside(ctx, db, record, reason); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		record = stored
+		if s.ownWrites.take(record.Key, record.Revision) {
+			echo, err := s.applyEcho(ctx, db, record)
+			if err != nil {
+				return nil, err
+			}
+			if echo {
+				continue
+			}
+		}
+		s.flagInvalid(ctx, record)
+		mirrored[i] = true
+		inserts = append(inserts, record)
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"key":      key,
-		"revision": revision,
-		"type":     event.Type.String(),
-	}).Info("Synced etcd event to PostgreSQL")
+	// Unchanged values move the revision of the latest row with --dedup
+	inserts, bumps, err := s.deduplicate(ctx, db, inserts)
+	if err != nil {
+		return nil, err
+	}
+	if err := bumpRevisions(ctx, db, bumps, s.notifyChannel); err != nil {
+		return nil, err
+	}
+	if err := s.store.BulkInsert(ctx, db, compressRecords(s.redactRecords(inserts), s.compressThreshold), s.notifyChannel); err != nil {
+		return nil, fmt.Errorf("failed to insert event into PostgreSQL: %w", err)
+	}
+	return mirrored, nil
+}
 
-	return nil
+// completeRecord reports a change mirrored in PostgreSQL as record, prevRev is the revision it replaced
+func (s *Service) completeRecord(ctx context.Context, record KeyValueRecord, prevRev int64, start time.Time) {
+	s.observeSynced(log.DirectionEtcdToPg, record.Key, start)
+	s.audit(ctx, AuditLogEntry{
+		Direction:    log.DirectionEtcdToPg,
+		Origin:       AuditOriginEtcdEvent,
+		Operation:    auditOperation(record),
+		Key:          record.Key,
+		PrevRevision: prevRev,
+		Revision:     record.Revision,
+	})
+	s.notifyApplied(ctx, log.DirectionEtcdToPg, record)
+
+	eventType := "PUT"
+	if record.Tombstone {
+		eventType = "DELETE"
+	}
+	s.logger().WithContext(ctx).WithFields(log.Fields{
+		log.FieldDirection: log.DirectionEtcdToPg,
+		log.FieldKey:       record.Key,
+		log.FieldRevision:  record.Revision,
+		log.FieldLatencyMs: log.LatencyMs(s.now().Sub(start)),
+		"type":             eventType,
+	}).Info("Synced etcd event to PostgreSQL")
 }
 
 // syncPostgreSQLToEtcd polls for pending records and syncs them to etcd
 func (s *Service) syncPostgreSQLToEtcd(ctx context.Context) error {
-	logrus.Info("Starting PostgreSQL to etcd sync poller with polling mechanism")
+	s.logger().Info("Starting PostgreSQL to etcd sync poller with polling mechanism")
+
+	if err := s.recoverClaims(ctx); err != nil {
+		countError(err)
+		s.logger().WithError(err).Warn("Failed to recover pending records claimed by a previous daemon, pushing them again")
+	}
 
 	ticker := time.NewTicker(s.pollingInterval)
 	defer ticker.Stop()
@@ -205,97 +976,261 @@ func (s *Service) syncPostgreSQLToEtcd(ctx context.Context) error {
 			return ctx.Err()
 		case <-ticker.C:
 			if err := s.pollAndProcessPendingRecords(ctx); err != nil {
-				logrus.WithError(err).Error("Failed to poll and process pending records")
+				countError(err)
+				s.logger().WithError(err).Error("Failed to poll and process pending records")
 			}
+			s.markLoop()
 		}
 	}
 }
 
 func (s *Service) pollAndProcessPendingRecords(ctx context.Context) error {
-	// Get pending records (revision = -1) using SELECT FOR UPDATE SKIP LOCKED
-	pendingRecords, err := GetPendingRecords(ctx, s.pgPool)
+	_, err := s.pushPendingRecords(ctx)
+	return err
+}
+
+// pushPendingRecords pushes the pending records to etcd and reports whether records were left pending,
+// because writes are held or their push failed
+func (s *Service) pushPendingRecords(ctx context.Context) (bool, error) {
+	// etcd rejects writes without leader or with alarms, keep the records pending, also while paused
+	if s.ClusterHold() != "" || s.Paused() {
+		return true, nil
+	}
+
+	// Claim the pending records (revision = -1) so a crash while pushing them can be recovered
+	var pendingRecords []KeyValueRecord
+	err := s.withStatementTimeout(ctx, func(ctx context.Context) (err error) {
+		pendingRecords, err = s.store.ClaimPending(ctx, s.pgPool, instanceID())
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get pending records: %w", err)
+		return false, fmt.Errorf("failed to get pending records: %w", err)
 	}
+	s.observeBacklog(pendingRecords)
 
+	pendingRecords = s.rejectInvalid(ctx, pendingRecords)
 	if len(pendingRecords) == 0 {
-		return nil // No pending records to process
+		return false, nil // No pending records to process
 	}
 
-	logrus.WithField("count", len(pendingRecords)).Debug("Found pending records to sync to etcd")
+	s.logger().WithContext(ctx).WithField("count", len(pendingRecords)).Debug("Found pending records to sync to etcd")
+	if err := s.pinBaseRevisions(ctx, pendingRecords); err != nil {
+		return false, err
+	}
 
-	// Process each pending record with retry logic
-	for _, record := range pendingRecords {
-		err := RetryWithBackoff(ctx, DefaultRetryConfig(), func() error {
-			return s.processPendingRecord(ctx, record)
+	// Push the records in transactions with retry logic, each transaction is a correlated batch
+	// Changes of chunked keys are pushed one by one, they also remove the chunks of earlier values
+	failed := false
+	isolate := func(record KeyValueRecord) bool { return s.chunked(record.Key) }
+	for _, batch := range batchPendingRecords(pendingRecords, s.batchSize, isolate) {
+		ctx := correlate(ctx)
+		err := s.retryPending(ctx, func() error {
+			return s.processPendingBatch(ctx, batch)
 		})
+		if err == nil || len(batch) == 1 || ctx.Err() != nil || errors.Is(err, errUnacknowledged) {
+			if err != nil {
+				failed = true
+				s.recordFailure(log.DirectionPgToEtcd, batch[0].Key, 0, err)
+				s.recordAttempt(ctx, batch[0].Key, err)
+				s.logger().WithContext(ctx).WithError(err).WithField("key", batch[0].Key).Error("Failed to process pending record after retries")
+			}
+			continue
+		}
 
-		if err != nil {
-			logrus.WithError(err).WithField("key", record.Key).Error("Failed to process pending record after retries")
-			// Continue processing other records rather than failing entirely
+		// A single rejected record fails the whole transaction, push the records one by one
+		s.logger().WithContext(ctx).WithError(err).WithField("count", len(batch)).Warn("Failed to push pending records in a transaction, retrying one by one")
+		for _, record := range batch {
+			err := s.retryPending(ctx, func() error {
+				return s.processPendingRecord(ctx, record)
+			})
+			if err != nil {
+				failed = true
+				s.recordFailure(log.DirectionPgToEtcd, record.Key, 0, err)
+				s.recordAttempt(ctx, record.Key, err)
+				s.logger().WithContext(ctx).WithError(err).WithField("key", record.Key).Error("Failed to process pending record after retries")
+				// Continue processing other records rather than failing entirely
+			}
 		}
 	}
 
-	return nil
+	return failed, nil
+}
+
+// retryPending runs an operation pushing pending records while its errors are retryable,
+// with refreshed credentials if etcd rejects the authentication. Records etcd applied are not pushed again.
+func (s *Service) retryPending(ctx context.Context, operation func() error) error {
+	config := EtcdRetryConfig()
+	config.Retryable = func(err error) bool {
+		return !errors.Is(err, errUnacknowledged) && IsRetryableEtcdError(err)
+	}
+	return RetryWithBackoff(ctx, config, func() error {
+		return s.etcdClient.WithReauth(ctx, operation)
+	})
 }
 
 // processPendingRecord processes a single pending record and syncs it to etcd
-func (s *Service) processPendingRecord(ctx context.Context, record KeyValueRecord) error {
-	logrus.WithFields(logrus.Fields{
+func (s *Service) processPendingRecord(ctx context.Context, record KeyValueRecord) (err error) {
+	start := s.now()
+	ctx, span := tracing.Tracer().Start(ctx, "push_pending_record", trace.WithAttributes(
+		attribute.String("etcd.key", record.Key),
+		attribute.Bool("pg_etcd.tombstone", record.Tombstone),
+		attribute.Bool("pg_etcd.cas", record.ExpectedRevision != nil),
+	))
+	defer func() { tracing.End(span, err) }()
+	s.logger().WithContext(ctx).WithFields(log.Fields{
 		"key":       record.Key,
 		"tombstone": record.Tombstone,
 	}).Debug("Processing pending record")
 
-	// Apply the change to etcd with retry logic
-	var newRevision int64
-	if record.Tombstone {
+	// Apply the change to etcd with retry logic, under the key decoded by Config.KeyPolicy
+	key := s.etcdKey(record.Key)
+	var newRevision, prevRev int64
+	if record.ExpectedRevision != nil {
+		// Conditional change created by etcd_cas()
+		var applied bool
+		attempts := 0
+		pushed := record
+		pushed.Key = key
+		err := RetryEtcdOperation(ctx, func() error {
+			var casErr error
+			attempts++
+			applied, newRevision, casErr = s.etcdClient.CompareAndSwap(ctx, pushed, *record.ExpectedRevision)
+			return casErr
+		})
+
+		if err != nil {
+			s.logger().WithContext(ctx).WithError(err).WithFields(log.Fields{
+				"key":       record.Key,
+				"operation": "etcd_cas",
+			}).Error("Failed to sync compare-and-swap to etcd after retries")
+			return fmt.Errorf("failed to compare-and-swap key in etcd: %w", err)
+		}
+
+		if !applied && attempts > 1 {
+			// An earlier attempt may have been applied with its response lost, its own change then fails the comparison
+			var landed bool
+			landed, newRevision, err = s.appliedInEtcd(ctx, record)
+			if err != nil {
+				return fmt.Errorf("failed to check compare-and-swap in etcd: %w", err)
+			}
+			if landed && record.Tombstone {
+				// The deletion revision is unknown, the watch mirrors the deletion
+				return s.withStatementTimeout(ctx, func(ctx context.Context) error {
+					return s.store.DiscardPending(ctx, s.pgPool, record.Key)
+				})
+			}
+			applied = landed
+		}
+
+		if !applied {
+			// etcd changed since the CAS was accepted, the watch delivers the winning value
+			conflict := &ConflictError{
+				Err: fmt.Errorf("compare-and-swap rejected, key changed since revision %d", *record.ExpectedRevision),
+			}
+			s.recordFailure(log.DirectionPgToEtcd, record.Key, 0, conflict)
+			s.notifyConflict(ctx, record, conflict)
+			s.logger().WithContext(ctx).WithFields(log.Fields{
+				log.FieldDirection:  log.DirectionPgToEtcd,
+				log.FieldKey:        record.Key,
+				"expected_revision": *record.ExpectedRevision,
+			}).Warn("Compare-and-swap rejected by etcd, discarding pending change")
+			return s.withStatementTimeout(ctx, func(ctx context.Context) error {
+				return s.store.DiscardPending(ctx, s.pgPool, record.Key)
+			})
+		}
+
+		prevRev = *record.ExpectedRevision
+		s.logger().WithContext(ctx).WithFields(log.Fields{
+			log.FieldDirection: log.DirectionPgToEtcd,
+			log.FieldKey:       record.Key,
+			log.FieldRevision:  newRevision,
+			log.FieldLatencyMs: log.LatencyMs(s.now().Sub(start)),
+		}).Info("Synced PostgreSQL change to etcd (CAS)")
+	} else if record.Tombstone {
 		// Delete operation
 		err := RetryEtcdOperation(ctx, func() error {
-			resp, delErr := s.etcdClient.Delete(ctx, record.Key)
+			if s.chunked(record.Key) {
+				var delErr error
+				newRevision, prevRev, delErr = s.etcdClient.DeleteChunked(ctx, key, s.prevKVOptions()...)
+				return delErr
+			}
+			resp, delErr := s.etcdClient.Delete(ctx, key, s.prevKVOptions()...)
 			if delErr != nil {
 				return delErr
 			}
 			newRevision = resp.Header.Revision
+			if len(resp.PrevKvs) > 0 {
+				prevRev = prevRevision(resp.PrevKvs[0])
+			}
 			return nil
 		})
 
 		if err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
+			s.logger().WithContext(ctx).WithError(err).WithFields(log.Fields{
 				"key":       record.Key,
 				"operation": "etcd_delete",
 			}).Error("Failed to sync delete to etcd after retries")
 			return fmt.Errorf("failed to delete key from etcd: %w", err)
 		}
 
-		logrus.WithFields(logrus.Fields{
-			"key":      record.Key,
-			"revision": newRevision,
+		s.logger().WithContext(ctx).WithFields(log.Fields{
+			log.FieldDirection: log.DirectionPgToEtcd,
+			log.FieldKey:       record.Key,
+			log.FieldRevision:  newRevision,
+			log.FieldLatencyMs: log.LatencyMs(s.now().Sub(start)),
 		}).Info("Synced PostgreSQL change to etcd (DELETE)")
 	} else {
 		// Put operation
 		err := RetryEtcdOperation(ctx, func() error {
-			resp, putErr := s.etcdClient.Put(ctx, record.Key, record.Value)
+			if s.chunked(record.Key) {
+				var putErr error
+				newRevision, prevRev, putErr = s.etcdClient.PutChunked(ctx, key, record.Value, s.prevKVOptions()...)
+				return putErr
+			}
+			resp, putErr := s.etcdClient.Put(ctx, key, record.Value, s.prevKVOptions()...)
 			if putErr != nil {
 				return putErr
 			}
 			newRevision = resp.Header.Revision
+			prevRev = prevRevision(resp.PrevKv)
 			return nil
 		})
 
 		if err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
+			s.logger().WithContext(ctx).WithError(err).WithFields(log.Fields{
 				"key":       record.Key,
 				"operation": "etcd_put",
 			}).Error("Failed to sync put to etcd after retries")
 			return fmt.Errorf("failed to put key to etcd: %w", err)
 		}
 
-		logrus.WithFields(logrus.Fields{
-			"key":      record.Key,
-			"revision": newRevision,
+		s.logger().WithContext(ctx).WithFields(log.Fields{
+			log.FieldDirection: log.DirectionPgToEtcd,
+			log.FieldKey:       record.Key,
+			log.FieldRevision:  newRevision,
+			log.FieldLatencyMs: log.LatencyMs(s.now().Sub(start)),
 		}).Info("Synced PostgreSQL change to etcd (PUT)")
 	}
 
 	// Update local record with the new etcd revision
-	return UpdateRevision(ctx, s.pgPool, record.Key, newRevision)
+	s.ownWrites.add(record.Key, newRevision)
+	if err := failpoint.Eval(FailpointPushAfterEtcd); err != nil {
+		return fmt.Errorf("%w: %w", errUnacknowledged, err)
+	}
+	if err := s.ackPending(ctx, record, newRevision); err != nil {
+		return fmt.Errorf("%w: %w", errUnacknowledged, err)
+	}
+
+	s.observeSynced(log.DirectionPgToEtcd, record.Key, start)
+	s.audit(ctx, AuditLogEntry{
+		Direction:    log.DirectionPgToEtcd,
+		Origin:       AuditOriginSQL,
+		Operation:    auditOperation(record),
+		Key:          record.Key,
+		PrevRevision: prevRev,
+		Revision:     newRevision,
+	})
+	s.notifyApplied(ctx, log.DirectionPgToEtcd, syncedRecord(record, newRevision))
+	s.queueReplication(ctx, record, newRevision)
+	return nil
 }
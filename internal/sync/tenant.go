@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// tenantSchema matches the PostgreSQL schema names accepted for tenants, unquoted identifiers
+// outside of the reserved pg_ namespace
+var tenantSchema = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// Tenant maps a top-level etcd prefix to a PostgreSQL schema of its own holding the mirror, so the
+// access to the data of every tenant is controlled by the privileges on its schema
+type Tenant struct {
+	Prefix  string // top-level etcd prefix, e.g. /acme/
+	Schema  string // PostgreSQL schema of the mirror tables and functions
+	History string // HistoryRetain or HistoryPrune, the default history mode if empty
+}
+
+// ParseTenant parses a PREFIX=SCHEMA[:HISTORY] tenant mapping, e.g. /acme/=acme:prune
+func ParseTenant(spec string) (Tenant, error) {
+	prefix, schema, ok := strings.Cut(spec, "=")
+	if !ok {
+		return Tenant{}, fmt.Errorf("tenant %q is not PREFIX=SCHEMA[:HISTORY]", spec)
+	}
+	schema, history, _ := strings.Cut(schema, ":")
+	tenant := Tenant{Prefix: prefix, Schema: schema, History: history}
+	if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") || strings.Count(prefix, "/") != 2 || prefix == "//" {
+		return Tenant{}, fmt.Errorf("tenant prefix %q is not a top-level prefix like /acme/", prefix)
+	}
+	if !tenantSchema.MatchString(schema) || strings.HasPrefix(schema, "pg_") {
+		return Tenant{}, fmt.Errorf("tenant schema %q is not a lower case identifier outside of pg_", schema)
+	}
+	if history != "" && history != HistoryRetain && history != HistoryPrune {
+		return Tenant{}, fmt.Errorf("tenant history %q is neither %s nor %s", history, HistoryRetain, HistoryPrune)
+	}
+	return tenant, nil
+}
+
+// ParseTenants parses tenant mappings and rejects prefixes or schemas mapped twice
+func ParseTenants(specs []string) ([]Tenant, error) {
+	tenants := make([]Tenant, 0, len(specs))
+	prefixes := make(map[string]bool, len(specs))
+	schemas := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		tenant, err := ParseTenant(spec)
+		if err != nil {
+			return nil, err
+		}
+		if prefixes[tenant.Prefix] || schemas[tenant.Schema] {
+			return nil, fmt.Errorf("tenant %q maps a prefix or schema of another tenant", spec)
+		}
+		prefixes[tenant.Prefix], schemas[tenant.Schema] = true, true
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// Apply resolves the unqualified mirror tables and functions in the schema of the tenant on every
+// connection, usable as a New callback
+func (t Tenant) Apply(config *pgxpool.Config) error {
+	config.ConnConfig.RuntimeParams["search_path"] = pgx.Identifier{t.Schema}.Sanitize()
+	return nil
+}
+
+// CreateTenantSchema creates the schema of a tenant unless it exists, before the migrations are
+// applied in it. Connections of a missing schema would create the mirror in the next schema of the
+// search path otherwise.
+func CreateTenantSchema(ctx context.Context, db PgxIface, schema string) error {
+	if _, err := db.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{schema}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to create schema of tenant: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// getRequestTimeout extracts the request_timeout parameter from the etcd DSN, 0 if unset or invalid
+func getRequestTimeout(dsn string) time.Duration {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return 0
+	}
+	timeout, err := time.ParseDuration(u.Query().Get("request_timeout"))
+	if err != nil || timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
+// timeoutKV bounds every key-value request by a timeout, so a hung etcd member fails the request
+// instead of blocking the caller until its context ends
+type timeoutKV struct {
+	clientv3.KV
+	timeout time.Duration
+}
+
+// newTimeoutKV wraps kv with a per-request timeout, kv is returned as is if timeout is not positive
+func newTimeoutKV(kv clientv3.KV, timeout time.Duration) clientv3.KV {
+	if timeout <= 0 {
+		return kv
+	}
+	return &timeoutKV{KV: kv, timeout: timeout}
+}
+
+func (kv *timeoutKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+	return kv.KV.Get(ctx, key, opts...)
+}
+
+func (kv *timeoutKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+	return kv.KV.Put(ctx, key, val, opts...)
+}
+
+func (kv *timeoutKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+	return kv.KV.Delete(ctx, key, opts...)
+}
+
+func (kv *timeoutKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+	return kv.KV.Compact(ctx, rev, opts...)
+}
+
+func (kv *timeoutKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+	return kv.KV.Do(ctx, op)
+}
+
+func (kv *timeoutKV) Txn(ctx context.Context) clientv3.Txn {
+	return &timeoutTxn{kv: kv, ctx: ctx}
+}
+
+// timeoutTxn collects a transaction and starts the timeout when it is committed
+type timeoutTxn struct {
+	kv               *timeoutKV
+	ctx              context.Context
+	cmps             []clientv3.Cmp
+	thenOps, elseOps []clientv3.Op
+}
+
+func (txn *timeoutTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	txn.cmps = append(txn.cmps, cs...)
+	return txn
+}
+
+func (txn *timeoutTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	txn.thenOps = append(txn.thenOps, ops...)
+	return txn
+}
+
+func (txn *timeoutTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	txn.elseOps = append(txn.elseOps, ops...)
+	return txn
+}
+
+func (txn *timeoutTxn) Commit() (*clientv3.TxnResponse, error) {
+	ctx, cancel := context.WithTimeout(txn.ctx, txn.kv.timeout)
+	defer cancel()
+	return txn.kv.KV.Txn(ctx).If(txn.cmps...).Then(txn.thenOps...).Else(txn.elseOps...).Commit()
+}
@@ -0,0 +1,139 @@
+package sync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// EtcdTLS describes the TLS setup of the etcd connection. Empty fields keep the current setting,
+// so DSN parameters and command line flags can be combined.
+type EtcdTLS struct {
+	CAFile             string // PEM bundle of CAs verifying the server, system roots if empty
+	CertFile           string // PEM client certificate for mutual TLS
+	KeyFile            string // PEM private key of CertFile
+	ServerName         string // name verified against the server certificate
+	InsecureSkipVerify bool   // disables server verification, for development only
+}
+
+// configured reports whether any TLS setting is present
+func (t EtcdTLS) configured() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" || t.InsecureSkipVerify
+}
+
+// Apply enables TLS on config if any setting is present and merges the settings, usable as a NewEtcdClient callback
+func (t EtcdTLS) Apply(config *clientv3.Config) error {
+	if !t.configured() {
+		return nil
+	}
+	if config.TLS == nil {
+		config.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return t.applyTo(config.TLS)
+}
+
+// applyTo sets the configured fields on cfg
+func (t EtcdTLS) applyTo(cfg *tls.Config) error {
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read etcd CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in etcd CA file %s", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("etcd client certificate and key must be given together")
+	}
+	if t.CertFile != "" {
+		reloader := &certReloader{certFile: t.CertFile, keyFile: t.KeyFile}
+		if err := reloader.load(); err != nil {
+			return err
+		}
+		cfg.Certificates = nil
+		cfg.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	if t.ServerName != "" {
+		cfg.ServerName = t.ServerName
+	}
+	if t.InsecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+	}
+	return nil
+}
+
+// certReloader serves the client certificate for every TLS handshake and reloads it when the
+// files change, so rotated short-lived certificates are used for new connections without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// modified returns the latest modification time of the certificate and key files
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the certificate and key files
+func (r *certReloader) load() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return fmt.Errorf("failed to load etcd client certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load etcd client certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate, reloading changed files first.
+// A failed reload, e.g. while the files are being replaced, keeps the previous certificate.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	modTime, err := r.modified()
+	r.mu.Lock()
+	changed := err == nil && !modTime.Equal(r.modTime)
+	r.mu.Unlock()
+
+	if changed {
+		if err := r.load(); err != nil {
+			log.Default().WithError(err).Warn("Failed to reload etcd client certificate, using the previous one")
+		} else {
+			log.Default().WithField("cert_file", r.certFile).Info("Reloaded etcd client certificate")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
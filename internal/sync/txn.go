@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/failpoint"
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/tracing"
+)
+
+// Limits of a transaction pushing pending records to etcd, below the etcd defaults
+// --max-txn-ops=128 and --max-request-bytes=1.5 MiB
+const (
+	maxTxnOps   = 128
+	maxTxnBytes = 1 << 20
+)
+
+// batchPendingRecords groups pending records into transactions of at most maxOps operations and
+// maxTxnBytes of keys and values, keeping their order. Conditional changes of etcd_cas(), records
+// too large to share a transaction and those isolate reports, unless nil, form a group of their own.
+func batchPendingRecords(records []KeyValueRecord, maxOps int, isolate func(KeyValueRecord) bool) [][]KeyValueRecord {
+	var batches [][]KeyValueRecord
+	var current []KeyValueRecord
+	size := 0
+	for _, record := range records {
+		recordSize := len(record.Key) + len(record.Value)
+		if record.ExpectedRevision != nil || recordSize > maxTxnBytes || isolate != nil && isolate(record) {
+			if len(current) > 0 {
+				batches = append(batches, current)
+				current, size = nil, 0
+			}
+			batches = append(batches, []KeyValueRecord{record})
+			continue
+		}
+		if len(current) == maxOps || size+recordSize > maxTxnBytes {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, record)
+		size += recordSize
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// ApplyBatch puts and deletes records in a single etcd transaction, opts apply to every operation.
+// The header revision of the response is the new mod revision of every key put.
+func (c *EtcdClient) ApplyBatch(ctx context.Context, records []KeyValueRecord, opts ...clientv3.OpOption) (*clientv3.TxnResponse, error) {
+	ops := make([]clientv3.Op, len(records))
+	for i, record := range records {
+		if record.Tombstone {
+			ops[i] = clientv3.OpDelete(record.Key, opts...)
+		} else {
+			ops[i] = clientv3.OpPut(record.Key, record.Value, opts...)
+		}
+	}
+
+	return c.Txn(ctx).Then(ops...).Commit()
+}
+
+// txnPrevRevision returns the previous mod revision of the key changed by a transaction operation
+// executed with clientv3.WithPrevKV(), 0 if the key did not exist
+func txnPrevRevision(resp *etcdserverpb.ResponseOp) int64 {
+	if put := resp.GetResponsePut(); put != nil {
+		return prevRevision(put.PrevKv)
+	}
+	if del := resp.GetResponseDeleteRange(); del != nil && len(del.PrevKvs) > 0 {
+		return prevRevision(del.PrevKvs[0])
+	}
+	return 0
+}
+
+// errUnacknowledged marks pending records etcd applied whose revision could not be stored. Pushing them
+// again would write them twice, they stay claimed until recoverClaims reconciles them with etcd.
+var errUnacknowledged = errors.New("applied to etcd but not acknowledged")
+
+// processPendingBatch pushes a group of pending records to etcd in one transaction and marks them synced.
+// A single record, e.g. a conditional change, is processed on its own.
+func (s *Service) processPendingBatch(ctx context.Context, records []KeyValueRecord) (err error) {
+	if len(records) == 1 {
+		return s.processPendingRecord(ctx, records[0])
+	}
+
+	start := s.now()
+	ctx, span := tracing.Tracer().Start(ctx, "push_pending_batch", trace.WithAttributes(attribute.Int("pg_etcd.count", len(records))))
+	defer func() { tracing.End(span, err) }()
+
+	var resp *clientv3.TxnResponse
+	err = RetryEtcdOperation(ctx, func() (err error) {
+		resp, err = s.etcdClient.ApplyBatch(ctx, s.etcdRecords(records), s.prevKVOptions()...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	newRevision := resp.Header.Revision
+	span.SetAttributes(attribute.Int64("etcd.revision", newRevision))
+
+	for _, record := range records {
+		s.ownWrites.add(record.Key, newRevision)
+	}
+	if err := failpoint.Eval(FailpointPushAfterEtcd); err != nil {
+		return fmt.Errorf("%w: %w", errUnacknowledged, err)
+	}
+	for i, record := range records {
+		if i > 0 {
+			if err := failpoint.Eval(FailpointPushMidBatch); err != nil {
+				return fmt.Errorf("%w: %w", errUnacknowledged, err)
+			}
+		}
+		if err := s.ackPending(ctx, record, newRevision); err != nil {
+			return fmt.Errorf("%w: %w", errUnacknowledged, err)
+		}
+		s.observeSynced(log.DirectionPgToEtcd, record.Key, start)
+		s.audit(ctx, AuditLogEntry{
+			Direction:    log.DirectionPgToEtcd,
+			Origin:       AuditOriginSQL,
+			Operation:    auditOperation(record),
+			Key:          record.Key,
+			PrevRevision: txnPrevRevision(resp.Responses[i]),
+			Revision:     newRevision,
+		})
+		s.notifyApplied(ctx, log.DirectionPgToEtcd, syncedRecord(record, newRevision))
+		s.queueReplication(ctx, record, newRevision)
+	}
+
+	s.logger().WithContext(ctx).WithFields(log.Fields{
+		log.FieldDirection: log.DirectionPgToEtcd,
+		log.FieldRevision:  newRevision,
+		log.FieldLatencyMs: log.LatencyMs(s.now().Sub(start)),
+		"count":            len(records),
+		"first":            records[0].Key,
+	}).Info("Synced PostgreSQL changes to etcd (TXN)")
+	return nil
+}
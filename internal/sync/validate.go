@@ -0,0 +1,210 @@
+package sync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/migrations"
+)
+
+// validateTimeout bounds every single preflight check
+const validateTimeout = 10 * time.Second
+
+// certExpiryWarning is how long before the expiry of a TLS certificate the preflight check fails
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// requiredFunctions are the SQL functions the daemon and its SQL interface depend on
+var requiredFunctions = []string{
+	"etcd_put", "etcd_delete", "etcd_get", "etcd_cas", "etcd_latest_put", "etcd_latest_delete",
+	"etcd_revision_gaps", "etcd_requeue_failed", "etcd_set_read_only", "etcd_set_backlog_rejected", "etcd_sync_stats",
+	"etcd_decode", "etcd_hash_value", "etcd_set_key_path", "etcd_is_redacted",
+	"etcd_get_at", "etcd_get_at_revision", "etcd_get_prefix_at", "etcd_get_prefix_at_revision",
+}
+
+// requiredPrivileges are the table privileges of the daemon role by table
+var requiredPrivileges = map[string]string{
+	"etcd":                "SELECT, INSERT, UPDATE, DELETE",
+	"etcd_latest":         "SELECT, INSERT, UPDATE, DELETE",
+	"etcd_sync_state":     "SELECT, INSERT, UPDATE",
+	"etcd_quarantine":     "INSERT",
+	"etcd_replica_status": "SELECT, INSERT, UPDATE",
+	"etcd_sync_heartbeat": "INSERT, UPDATE",
+	"etcd_compaction":     "SELECT, INSERT, UPDATE",
+}
+
+// ValidationCheck is the result of a single preflight check
+type ValidationCheck struct {
+	Name    string `json:"name"`
+	Prefix  string `json:"prefix,omitempty"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// ValidationReport is the machine-readable result of the preflight checks, OK if every check passed
+type ValidationReport struct {
+	OK     bool              `json:"ok"`
+	Time   time.Time         `json:"time"`
+	Checks []ValidationCheck `json:"checks"`
+}
+
+// Add records the result of a check, err fails it and becomes its message
+func (r *ValidationReport) Add(name, prefix string, err error, message string) {
+	check := ValidationCheck{Name: name, Prefix: prefix, OK: err == nil, Message: message}
+	if err != nil {
+		check.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+	r.OK = r.OK && check.OK
+}
+
+// NewValidationReport returns an empty passing report
+func NewValidationReport() *ValidationReport {
+	return &ValidationReport{OK: true, Time: time.Now()}
+}
+
+// ValidatePostgreSQL checks the schema version, the required functions and the table privileges of the role
+func ValidatePostgreSQL(ctx context.Context, pool PgxIface, report *ValidationReport) {
+	check := func(name string, fn func(ctx context.Context) (string, error)) {
+		ctx, cancel := context.WithTimeout(ctx, validateTimeout)
+		defer cancel()
+		message, err := fn(ctx)
+		report.Add(name, "", err, message)
+	}
+
+	check("schema_version", func(ctx context.Context) (string, error) {
+		if err := migrations.CheckCompatibility(ctx, pool); err != nil {
+			return "", err
+		}
+		version, err := migrations.AppliedVersion(ctx, pool)
+		return fmt.Sprintf("version %d applied, %d required", version, migrations.RequiredVersion), err
+	})
+
+	check("schema_functions", func(ctx context.Context) (string, error) {
+		var missing []string
+		err := pool.QueryRow(ctx, `SELECT coalesce(array_agg(f ORDER BY f), '{}')
+			FROM unnest($1::text[]) AS f
+			WHERE NOT EXISTS (SELECT FROM pg_proc p WHERE p.proname = f AND pg_function_is_visible(p.oid))`,
+			requiredFunctions).Scan(&missing)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up functions: %w", err)
+		}
+		if len(missing) > 0 {
+			return "", fmt.Errorf("missing functions: %s", strings.Join(missing, ", "))
+		}
+		return fmt.Sprintf("%d functions found", len(requiredFunctions)), nil
+	})
+
+	check("postgresql_privileges", func(ctx context.Context) (string, error) {
+		var denied []string
+		for table, privileges := range requiredPrivileges {
+			var granted bool
+			err := pool.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL AND has_table_privilege($1, $2)`,
+				table, privileges).Scan(&granted)
+			if err != nil {
+				return "", fmt.Errorf("failed to check privileges on %s: %w", table, err)
+			}
+			if !granted {
+				denied = append(denied, fmt.Sprintf("%s (%s)", table, privileges))
+			}
+		}
+		if len(denied) > 0 {
+			return "", fmt.Errorf("missing privileges on %s", strings.Join(denied, ", "))
+		}
+		return "", nil
+	})
+}
+
+// ValidateEtcd checks that the etcd user can read, write and watch every prefix. The write is a probe key
+// below the internal .pg_etcd/ directory, removed right away and never synchronized.
+func ValidateEtcd(ctx context.Context, client *EtcdClient, prefixes []string, report *ValidationReport) {
+	for _, prefix := range prefixes {
+		ctx, cancel := context.WithTimeout(ctx, validateTimeout)
+		_, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		report.Add("etcd_read", prefix, err, "")
+		report.Add("etcd_watch_write", prefix, validateWatchWrite(ctx, client, prefix), "")
+		cancel()
+	}
+}
+
+// validateWatchWrite watches prefix, puts and deletes a probe key and waits for both events
+func validateWatchWrite(ctx context.Context, client *EtcdClient, prefix string) error {
+	key := probeKey(prefix, instanceID())
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	watchChan := client.Watch(watchCtx, key, clientv3.WithCreatedNotify())
+	if resp := <-watchChan; resp.Err() != nil || !resp.Created {
+		return fmt.Errorf("failed to watch: %w", errors.Join(resp.Err(), ctx.Err()))
+	}
+
+	if _, err := client.Put(ctx, key, "pg_etcd validate"); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if _, err := client.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	for events := 0; events < 2; {
+		resp, ok := <-watchChan
+		if !ok || resp.Err() != nil {
+			return fmt.Errorf("failed to receive watch events: %w", errors.Join(resp.Err(), ctx.Err()))
+		}
+		events += len(resp.Events)
+	}
+	return nil
+}
+
+// ValidateTLS checks that the etcd TLS files can be loaded and the certificates are not about to expire
+func ValidateTLS(t EtcdTLS, report *ValidationReport) {
+	if !t.configured() {
+		return
+	}
+	if t.CAFile != "" {
+		message, err := checkCertificates(t.CAFile)
+		report.Add("etcd_tls_ca", "", err, message)
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		message, err := checkCertificates(t.CertFile)
+		if err == nil {
+			if _, keyErr := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); keyErr != nil {
+				err = fmt.Errorf("failed to load client certificate and key: %w", keyErr)
+			}
+		}
+		report.Add("etcd_tls_client_cert", "", err, message)
+	}
+}
+
+// checkCertificates parses the PEM certificates in name and fails if one expires within certExpiryWarning
+func checkCertificates(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	var expiry time.Time
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse certificate in %s: %w", name, err)
+		}
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	if expiry.IsZero() {
+		return "", fmt.Errorf("no certificates found in %s", name)
+	}
+	if time.Until(expiry) < certExpiryWarning {
+		return "", fmt.Errorf("certificate in %s expires %s", name, expiry.Format(time.RFC3339))
+	}
+	return "expires " + expiry.Format(time.RFC3339), nil
+}
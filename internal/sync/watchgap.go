@@ -0,0 +1,43 @@
+package sync
+
+import (
+	"context"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/metrics"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+)
+
+// watchGap reports whether a resumed watch lost events of prefix: its first event at revision first doesn't
+// directly follow the last received revision and keys below prefix changed in between. A gap that can't be
+// ruled out, e.g. because the revisions are compacted, is reported as well.
+func (s *Service) watchGap(ctx context.Context, prefix string, received, first int64) bool {
+	if first <= received+1 {
+		return false
+	}
+	var changed int64
+	err := RetryEtcdOperation(ctx, func() (err error) {
+		changed, err = s.etcdClient.CountChanged(ctx, prefix, received+1, first-1)
+		return err
+	})
+	if err == nil && changed == 0 {
+		return false
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	metrics.WatchGaps.WithLabelValues(prefix).Inc()
+	entry := s.logger().WithFields(log.Fields{
+		"prefix":         prefix,
+		"revision":       received,
+		"first_revision": first,
+		"changed_keys":   changed,
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Warn("Resumed etcd watch skipped events, resynchronizing prefix")
+	s.countResync(prefix, ResyncWatchGap)
+	return true
+}
@@ -0,0 +1,31 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestEnd tests that failed operations are marked on their span
+func TestEnd(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(instrumentationName)
+
+	_, span := tracer.Start(context.Background(), "apply_etcd_event")
+	End(span, nil)
+	_, span = tracer.Start(context.Background(), "push_pending_record")
+	End(span, errors.New("etcdserver: permission denied"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "etcdserver: permission denied", spans[1].Status().Description)
+	assert.Len(t, spans[1].Events(), 1, "the error is recorded as span event")
+}
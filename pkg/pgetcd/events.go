@@ -0,0 +1,93 @@
+package pgetcd
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// Direction is the way a change is synchronized
+type Direction string
+
+// Directions of synchronized changes
+const (
+	EtcdToPostgreSQL Direction = log.DirectionEtcdToPg
+	PostgreSQLToEtcd Direction = log.DirectionPgToEtcd
+)
+
+// Operations of applied changes
+const (
+	OperationPut       = sync.AuditOperationPut
+	OperationDelete    = sync.AuditOperationDelete
+	OperationCASPut    = sync.AuditOperationCASPut    // put by etcd_cas()
+	OperationCASDelete = sync.AuditOperationCASDelete // delete by etcd_cas()
+)
+
+// Record is a key-value change with its etcd metadata as passed to a Hook
+type Record = sync.KeyValueRecord
+
+// Hook receives every applied put and delete and every rejected compare-and-swap with the full record, see
+// WithHook. The directions are the values of Direction.
+type Hook = sync.Hook
+
+// HookFuncs implements Hook by functions, nil functions are skipped
+type HookFuncs = sync.HookFuncs
+
+// ChangeEvent is a change durably applied to PostgreSQL, see Mirror.Subscribe. Its Direction is a value
+// of Direction and its Revision the checkpoint of the consumer.
+type ChangeEvent = sync.ChangeEvent
+
+// Event is passed to the handler of WithEventHandler, either a ChangeApplied or a ChangeFailed
+type Event interface {
+	event()
+}
+
+// ChangeApplied is a change synchronized to the other store
+type ChangeApplied struct {
+	Time         time.Time
+	Direction    Direction
+	Operation    string // OperationPut, OperationDelete, OperationCASPut or OperationCASDelete
+	Key          string
+	PrevRevision int64 // etcd mod revision before the change, 0 if the key did not exist or is unknown
+	Revision     int64 // etcd revision of the change
+}
+
+// ChangeFailed is a change that could not be synchronized, failures of changes retried later are reported
+// for every attempt
+type ChangeFailed struct {
+	Time      time.Time
+	Direction Direction
+	Key       string
+	Revision  int64  // etcd revision of a watched event, 0 for PostgreSQL changes
+	Category  string // connection, conflict, validation, compaction, permission or other
+	Err       error
+}
+
+func (ChangeApplied) event() {}
+func (ChangeFailed) event()  {}
+
+// changeApplied converts an audited change of the sync engine
+func changeApplied(entry sync.AuditLogEntry) ChangeApplied {
+	return ChangeApplied{
+		Time:         entry.Time,
+		Direction:    Direction(entry.Direction),
+		Operation:    entry.Operation,
+		Key:          entry.Key,
+		PrevRevision: entry.PrevRevision,
+		Revision:     entry.Revision,
+	}
+}
+
+// changeFailed converts a failure of the sync engine
+func changeFailed(failure sync.RecentFailure) ChangeFailed {
+	return ChangeFailed{
+		Time:      failure.Time,
+		Direction: Direction(failure.Direction),
+		Key:       failure.Key,
+		Revision:  failure.Revision,
+		Category:  failure.Category,
+		Err:       errors.New(failure.Error),
+	}
+}
@@ -0,0 +1,59 @@
+package pgetcd_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybertec-postgresql/pg_etcd/pkg/pgetcd"
+	"github.com/cybertec-postgresql/pg_etcd/pkg/pgetcdtest"
+)
+
+// TestMirror tests synchronizing both directions and the change feed of an embedded mirror
+func TestMirror(t *testing.T) {
+	env := pgetcdtest.New(t)
+	mirror := env.StartMirror(t, pgetcd.WithPrefixes("/config/"))
+	ctx := context.Background()
+	events, cancel, err := mirror.Subscribe("/config/")
+	require.NoError(t, err)
+	defer cancel()
+
+	resp, err := env.Etcd.Put(ctx, "/config/a", "1")
+	require.NoError(t, err)
+	env.WaitForPostgreSQL(t, "/config/a", "1")
+	event := <-events
+	assert.Equal(t, string(pgetcd.EtcdToPostgreSQL), event.Direction)
+	assert.Equal(t, resp.Header.Revision, event.Revision)
+
+	_, err = env.Pool.Exec(ctx, `INSERT INTO etcd (key, value, revision) VALUES ('/config/b', '2', -1)`)
+	require.NoError(t, err)
+	env.WaitForEtcd(t, "/config/b", "2")
+	event = <-events
+	assert.Equal(t, string(pgetcd.PostgreSQLToEtcd), event.Direction)
+	assert.Equal(t, "/config/b", event.Key)
+}
+
+// TestCompression tests storing large values compressed and reading them back decompressed
+func TestCompression(t *testing.T) {
+	env := pgetcdtest.New(t)
+	env.StartMirror(t, pgetcd.WithPrefixes("/config/"), pgetcd.WithCompression(1024))
+	ctx := context.Background()
+
+	large := strings.Repeat("compressible ", 1000)
+	_, err := env.Etcd.Put(ctx, "/config/large", large)
+	require.NoError(t, err)
+	env.WaitForPostgreSQL(t, "/config/large", large)
+	_, err = env.Etcd.Put(ctx, "/config/small", "1")
+	require.NoError(t, err)
+	env.WaitForPostgreSQL(t, "/config/small", "1")
+
+	var encoding *string
+	require.NoError(t, env.Pool.QueryRow(ctx, `SELECT encoding FROM etcd WHERE key = '/config/large'`).Scan(&encoding))
+	require.NotNil(t, encoding)
+	assert.Equal(t, "zstd", *encoding)
+	require.NoError(t, env.Pool.QueryRow(ctx, `SELECT encoding FROM etcd WHERE key = '/config/small'`).Scan(&encoding))
+	assert.Nil(t, encoding, "small values stay plain")
+}
@@ -0,0 +1,353 @@
+package pgetcd
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// PostgreSQL change capture modes, see WithCapture
+const (
+	CapturePoll    = sync.CapturePoll
+	CaptureLogical = sync.CaptureLogical
+)
+
+// PostgreSQL storage modes, see WithStorage
+const (
+	StorageHistory = sync.StorageHistory
+	StorageLatest  = sync.StorageLatest
+)
+
+// Behaviors when another instance syncs the same prefixes, see WithInstanceLock
+const (
+	LockBlock   = sync.LockBlock
+	LockExit    = sync.LockExit
+	LockStandby = sync.LockStandby
+)
+
+// Policies for keys that cannot be stored in the etcd table, see WithKeyPolicy
+const (
+	KeyPolicyQuarantine = sync.KeyPolicyQuarantine
+	KeyPolicyReject     = sync.KeyPolicyReject
+	KeyPolicyHex        = sync.KeyPolicyHex
+)
+
+// Store is the relational layout of the mirror, see WithStore
+type Store = sync.Store
+
+// ValueDecoder extracts facts from the values of a prefix, see WithDecoder
+type ValueDecoder = sync.ValueDecoder
+
+// DecoderFunc adapts a function to a ValueDecoder
+type DecoderFunc = sync.DecoderFunc
+
+// BuiltinDecoder returns the built-in decoder of name: json, yaml, patroni or kubernetes
+func BuiltinDecoder(name string) (ValueDecoder, error) {
+	return sync.BuiltinDecoder(name)
+}
+
+// Logger is the structured logger of the synchronization, see WithLogger
+type Logger = log.Logger
+
+// SlogLogger returns a Logger writing to logger, zap and other loggers can be used by their slog handlers
+func SlogLogger(logger *slog.Logger) Logger {
+	return log.NewSlog(logger)
+}
+
+// LogrusLogger returns a Logger writing to logger
+func LogrusLogger(logger *logrus.Logger) Logger {
+	return log.NewLogrus(logrus.NewEntry(logger))
+}
+
+// Option configures a Mirror
+type Option func(*options)
+
+type options struct {
+	config   sync.Config
+	pool     sync.PoolSettings
+	tls      sync.EtcdTLS
+	migrate  bool
+	lockMode string
+	hooks    []Hook
+
+	schemaErr error // first invalid JSON Schema, see WithJSONSchema
+	secretErr error // first invalid secret pattern, see WithSecret
+}
+
+// defaultOptions are the defaults of the pg_etcd flags
+func defaultOptions() options {
+	return options{
+		config: sync.Config{
+			PollingInterval:        time.Second,
+			CaptureMode:            CapturePoll,
+			StatementTimeout:       30 * time.Second,
+			HistoryMode:            sync.HistoryRetain,
+			StorageMode:            StorageHistory,
+			IngestMode:             sync.IngestBatch,
+			AuditInterval:          10 * time.Minute,
+			AutoResync:             sync.AutoResync{Threshold: 1, MinInterval: 10 * time.Minute},
+			MaxSyncAttempts:        10,
+			InitialSyncConcurrency: 4,
+			KeyPolicy:              KeyPolicyQuarantine,
+			Version:                "embedded",
+		},
+		lockMode: LockBlock,
+	}
+}
+
+// validate rejects unknown modes before connecting
+func (o *options) validate() error {
+	if !slices.Contains([]string{CapturePoll, CaptureLogical}, o.config.CaptureMode) {
+		return fmt.Errorf("unknown capture mode %q", o.config.CaptureMode)
+	}
+	if !slices.Contains([]string{StorageHistory, StorageLatest}, o.config.StorageMode) {
+		return fmt.Errorf("unknown storage mode %q", o.config.StorageMode)
+	}
+	if !slices.Contains([]string{LockBlock, LockExit, LockStandby}, o.lockMode) {
+		return fmt.Errorf("unknown instance lock mode %q", o.lockMode)
+	}
+	if !slices.Contains([]string{KeyPolicyQuarantine, KeyPolicyReject, KeyPolicyHex}, o.config.KeyPolicy) {
+		return fmt.Errorf("unknown key policy %q", o.config.KeyPolicy)
+	}
+	if err := sync.CheckMaxKeyBytes(o.config.MaxKeyBytes); err != nil {
+		return err
+	}
+	if o.config.PollingInterval <= 0 {
+		return fmt.Errorf("polling interval must be positive")
+	}
+	if o.secretErr != nil {
+		return o.secretErr
+	}
+	return o.schemaErr
+}
+
+// WithPrefixes sets the etcd key prefixes to synchronize, the path of the etcd DSN by default
+func WithPrefixes(prefixes ...string) Option {
+	return func(o *options) {
+		o.config.Prefixes = prefixes
+	}
+}
+
+// WithPollingInterval sets the interval of polling PostgreSQL for pending changes, 1s by default
+func WithPollingInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.config.PollingInterval = interval
+	}
+}
+
+// WithCapture sets how PostgreSQL changes are captured, CapturePoll by default
+func WithCapture(mode string) Option {
+	return func(o *options) {
+		o.config.CaptureMode = mode
+	}
+}
+
+// WithStorage sets how etcd keys are stored in PostgreSQL, StorageHistory by default
+func WithStorage(mode string) Option {
+	return func(o *options) {
+		o.config.StorageMode = mode
+	}
+}
+
+// WithStore replaces the built-in relational layout selected by WithStorage, e.g. by one for TimescaleDB
+// hypertables or Citus distributed tables. The store works with the PostgreSQL connection of the Mirror.
+func WithStore(store Store) Option {
+	return func(o *options) {
+		o.config.Store = store
+	}
+}
+
+// WithPruneHistory removes revisions compacted in etcd from PostgreSQL instead of retaining them
+func WithPruneHistory() Option {
+	return func(o *options) {
+		o.config.HistoryMode = sync.HistoryPrune
+	}
+}
+
+// WithCompression stores values of at least threshold bytes received from etcd zstd compressed in PostgreSQL.
+// The read paths decompress them, the SQL functions need an extension providing zstd_decompress(bytea).
+func WithCompression(threshold int) Option {
+	return func(o *options) {
+		o.config.CompressThreshold = threshold
+	}
+}
+
+// WithChunking splits values of the keys below prefixes exceeding the etcd request limit into <key>/.chunks/NNN
+// sub-keys and a manifest in the key, and reassembles them in PostgreSQL
+func WithChunking(prefixes ...string) Option {
+	return func(o *options) {
+		o.config.ChunkPrefixes = prefixes
+	}
+}
+
+// WithDedup moves the revision of the latest row of a key instead of adding a row when etcd sets the key to
+// the value it already has. It requires history storage.
+func WithDedup() Option {
+	return func(o *options) {
+		o.config.Dedup = true
+	}
+}
+
+// WithKeyPath splits the keys of the etcd tables on / into their key_path column with a trigger, enabled when
+// the mirror starts
+func WithKeyPath() Option {
+	return func(o *options) {
+		o.config.KeyPath = true
+	}
+}
+
+// WithKeyPolicy sets how etcd keys that are no valid UTF-8 or longer than maxKeyBytes are handled,
+// KeyPolicyQuarantine by default. maxKeyBytes of 0 keeps the default of 2048 bytes, at most 2560 are accepted.
+func WithKeyPolicy(policy string, maxKeyBytes int) Option {
+	return func(o *options) {
+		o.config.KeyPolicy = policy
+		o.config.MaxKeyBytes = maxKeyBytes
+	}
+}
+
+// WithRetention keeps the history of the keys below prefix for keep, forever if keep is zero. The longest
+// matching prefix of the retention policies applies, the current value of every key is always kept.
+func WithRetention(prefix string, keep time.Duration) Option {
+	return func(o *options) {
+		o.config.Retention = append(o.config.Retention, sync.RetentionPolicy{Prefix: prefix, Keep: keep})
+	}
+}
+
+// WithSecret masks the values of the keys matching the path.Match pattern, or whose parent matches it, in log
+// messages and reported failures. With hash PostgreSQL only stores the SHA-256 of their values. New fails if
+// pattern is invalid.
+func WithSecret(pattern string, hash bool) Option {
+	return func(o *options) {
+		if hash {
+			pattern += ":hash"
+		}
+		rule, err := sync.ParseSecretRule(pattern)
+		if err != nil {
+			o.secretErr = cmp.Or(o.secretErr, err)
+			return
+		}
+		o.config.Secrets = append(o.config.Secrets, rule)
+	}
+}
+
+// WithDecoder stores the facts decoder extracts from the values of the keys below prefix as JSON in the facts
+// column. fields are the dot separated paths of the facts stored, all if none are given.
+func WithDecoder(prefix string, decoder ValueDecoder, fields ...string) Option {
+	return func(o *options) {
+		o.config.Decoders = append(o.config.Decoders, sync.PrefixDecoder{Prefix: prefix, Decoder: decoder, Fields: fields})
+	}
+}
+
+// WithJSONSchema validates the values of the keys below prefix against the JSON Schema document. Pending rows
+// violating it are marked failed instead of being pushed to etcd, violating etcd values are mirrored and reported
+// as failures. New fails if document is not a valid JSON Schema.
+func WithJSONSchema(prefix string, document []byte) Option {
+	return func(o *options) {
+		schema, err := sync.CompileKeySchema(prefix, document)
+		if err != nil {
+			o.schemaErr = cmp.Or(o.schemaErr, err)
+			return
+		}
+		o.config.Schemas = append(o.config.Schemas, schema)
+	}
+}
+
+// WithReadOnly syncs etcd to PostgreSQL only and rejects pending rows in PostgreSQL
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.config.ReadOnly = true
+	}
+}
+
+// WithStatementTimeout sets the deadline of a single PostgreSQL operation, 30s by default and disabled if zero
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.config.StatementTimeout = timeout
+	}
+}
+
+// WithAuditInterval sets the interval of comparing etcd with PostgreSQL, 10m by default and disabled if zero
+func WithAuditInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.config.AuditInterval = interval
+	}
+}
+
+// WithMaxSyncAttempts sets the failed pushes to etcd after which a pending row is marked failed, 10 by default
+// and retried forever if zero
+func WithMaxSyncAttempts(attempts int) Option {
+	return func(o *options) {
+		o.config.MaxSyncAttempts = attempts
+	}
+}
+
+// WithPoolSize sets the maximum and minimum size of the PostgreSQL connection pool
+func WithPoolSize(maxConns, minConns int32) Option {
+	return func(o *options) {
+		o.pool.MaxConns = maxConns
+		o.pool.MinConns = minConns
+	}
+}
+
+// WithEtcdTLS sets the PEM files of the CA verifying etcd and of the client certificate for mutual TLS,
+// they override the TLS parameters of the etcd DSN
+func WithEtcdTLS(caFile, certFile, keyFile string) Option {
+	return func(o *options) {
+		o.tls.CAFile = caFile
+		o.tls.CertFile = certFile
+		o.tls.KeyFile = keyFile
+	}
+}
+
+// WithMigrate applies pending database migrations when the Mirror starts
+func WithMigrate() Option {
+	return func(o *options) {
+		o.migrate = true
+	}
+}
+
+// WithInstanceLock sets the behavior when another instance syncs the same prefixes, LockBlock by default
+func WithInstanceLock(mode string) Option {
+	return func(o *options) {
+		o.lockMode = mode
+	}
+}
+
+// WithVersion sets the version of the embedding program published in the instance liveness key
+func WithVersion(version string) Option {
+	return func(o *options) {
+		o.config.Version = version
+	}
+}
+
+// WithHook registers hook for the applied changes and conflicts, may be repeated. Hooks are called
+// synchronously by the synchronization in the order they were added and must not block.
+func WithHook(hook Hook) Option {
+	return func(o *options) {
+		o.hooks = append(o.hooks, hook)
+	}
+}
+
+// WithEventHandler calls handler for every applied change and every change that could not be applied.
+// It is called synchronously by the synchronization and must not block.
+func WithEventHandler(handler func(Event)) Option {
+	return func(o *options) {
+		o.config.OnApplied = func(entry sync.AuditLogEntry) { handler(changeApplied(entry)) }
+		o.config.OnFailure = func(failure sync.RecentFailure) { handler(changeFailed(failure)) }
+	}
+}
+
+// WithLogger logs to logger instead of the global logrus logger. It replaces the global logrus logger
+// for the messages not bound to the Mirror as well, e.g. of connection retries.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.config.Logger = logger
+	}
+}
@@ -0,0 +1,243 @@
+// Package pgetcd embeds the bidirectional synchronization between etcd and PostgreSQL of the pg_etcd
+// daemon in other Go programs, e.g. operators or cluster tooling, instead of running the binary.
+//
+// A Mirror is configured by functional options, connects to both stores in Start and syncs in the
+// background until Stop is called:
+//
+//	mirror, err := pgetcd.New(postgresDSN, etcdDSN,
+//		pgetcd.WithPrefixes("/service/"),
+//		pgetcd.WithEventHandler(func(event pgetcd.Event) {
+//			if failed, ok := event.(pgetcd.ChangeFailed); ok {
+//				log.Printf("failed to sync %s: %s", failed.Key, failed.Err)
+//			}
+//		}))
+//	if err != nil {
+//		return err
+//	}
+//	if err := mirror.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer mirror.Stop(context.Background())
+//
+// The PostgreSQL schema must be installed, either by the pg_etcd --migrate flag or WithMigrate.
+// Logging uses the global logrus logger unless WithLogger is given, metrics use the default Prometheus
+// registry like the daemon.
+package pgetcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/log"
+	"github.com/cybertec-postgresql/pg_etcd/internal/migrations"
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// ErrNotStarted is returned by the control methods of a Mirror before Start succeeded
+var ErrNotStarted = errors.New("mirror is not started")
+
+// ErrLockLost stops the synchronization when the session holding the instance lock is gone
+var ErrLockLost = errors.New("lost instance lock")
+
+// Status is the health report of a running Mirror, the same as served by the daemon on /status
+type Status = sync.Status
+
+// Mirror synchronizes etcd key prefixes with PostgreSQL
+type Mirror struct {
+	postgresDSN string
+	etcdDSN     string
+	options     options
+
+	pgPool     *pgxpool.Pool
+	etcdClient *sync.EtcdClient
+	lock       *sync.InstanceLock
+	service    *sync.Service
+	cancel     context.CancelCauseFunc
+	done       chan struct{}
+	err        error // why the synchronization stopped, valid once done is closed
+}
+
+// New returns a Mirror between the PostgreSQL database and the etcd cluster given by their connection
+// strings, in the formats accepted by the pg_etcd --postgres-dsn and --etcd-dsn flags. It does not connect yet.
+func New(postgresDSN, etcdDSN string, opts ...Option) (*Mirror, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return &Mirror{postgresDSN: postgresDSN, etcdDSN: etcdDSN, options: o}, nil
+}
+
+// Start connects to PostgreSQL and etcd, waits for the instance lock and starts the synchronization in the
+// background. The initial sync of the prefixes runs in the background as well, see Done for its outcome.
+// A Mirror can be started once.
+func (m *Mirror) Start(ctx context.Context) (err error) {
+	if m.done != nil {
+		return errors.New("mirror is already started")
+	}
+	defer func() {
+		if err != nil {
+			m.close()
+		}
+	}()
+
+	if m.options.config.Logger != nil {
+		log.SetDefault(m.options.config.Logger)
+	}
+	m.pgPool, err = sync.NewWithRetry(ctx, m.postgresDSN, m.options.pool.Apply)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	if m.options.migrate {
+		if err := sync.MigrateSchema(ctx, m.pgPool); err != nil {
+			return fmt.Errorf("failed to apply database migrations: %w", err)
+		}
+	}
+	if err := migrations.CheckCompatibility(ctx, m.pgPool); err != nil {
+		return err
+	}
+	m.etcdClient, err = sync.NewEtcdClientWithRetry(ctx, m.etcdDSN, m.options.tls.Apply)
+	if err != nil {
+		return fmt.Errorf("failed to connect to etcd: %w", err)
+	}
+
+	config := m.options.config
+	config.PostgresDSN = m.postgresDSN
+	config.EtcdDSN = m.etcdDSN
+	service := sync.NewService(m.pgPool, m.etcdClient, sync.WithConfig(config))
+	for _, hook := range m.options.hooks {
+		service.RegisterHook(hook)
+	}
+
+	if err := sync.WaitForPrimary(ctx, m.pgPool, config.PollingInterval); err != nil {
+		return fmt.Errorf("failed to check PostgreSQL recovery state: %w", err)
+	}
+	if config.KeyPath {
+		if err := sync.SetKeyPath(ctx, m.pgPool, true); err != nil {
+			return fmt.Errorf("failed to enable key paths: %w", err)
+		}
+	}
+	if config.ReadOnly {
+		if err := sync.SetReadOnly(ctx, m.pgPool, true); err != nil {
+			return fmt.Errorf("failed to enable read-only mirror: %w", err)
+		}
+	}
+	m.lock, err = sync.AcquireInstanceLock(ctx, m.pgPool, service.InstanceName(), m.options.lockMode, config.PollingInterval)
+	if err != nil {
+		return fmt.Errorf("failed to acquire instance lock: %w", err)
+	}
+
+	// The synchronization outlives ctx, it runs until Stop or the loss of the instance lock
+	runCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	m.lock.Monitor(runCtx, func() { cancel(ErrLockLost) })
+	m.service, m.cancel, m.done = service, cancel, make(chan struct{})
+	go func() {
+		defer close(m.done)
+		m.err = service.Start(runCtx)
+		if runCtx.Err() != nil {
+			m.err = context.Cause(runCtx)
+		}
+	}()
+	return nil
+}
+
+// Done is closed when the synchronization stopped, after Stop or because it failed, see Err
+func (m *Mirror) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the synchronization stopped, nil while it runs or after Stop
+func (m *Mirror) Err() error {
+	select {
+	case <-m.done:
+		if errors.Is(m.err, context.Canceled) {
+			return nil
+		}
+		return m.err
+	default:
+		return nil
+	}
+}
+
+// Stop ends the synchronization and closes the connections. It waits for the running operations to
+// finish until ctx is done and returns the error that stopped the synchronization before, if any.
+func (m *Mirror) Stop(ctx context.Context) error {
+	if m.done == nil {
+		return ErrNotStarted
+	}
+	m.cancel(nil)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	m.close()
+	return m.Err()
+}
+
+// close releases the instance lock and the connections opened so far
+func (m *Mirror) close() {
+	if m.lock != nil {
+		m.lock.Release(context.Background())
+		m.lock = nil
+	}
+	if m.etcdClient != nil {
+		_ = m.etcdClient.Close()
+		m.etcdClient = nil
+	}
+	if m.pgPool != nil {
+		m.pgPool.Close()
+		m.pgPool = nil
+	}
+}
+
+// Status returns the health of the synchronization, the zero Status before Start
+func (m *Mirror) Status() Status {
+	if m.service == nil {
+		return Status{}
+	}
+	return m.service.Status()
+}
+
+// Pause stops propagating changes in both directions until Resume, watch events are not lost
+func (m *Mirror) Pause() error {
+	if m.service == nil {
+		return ErrNotStarted
+	}
+	m.service.Pause()
+	return nil
+}
+
+// Resume continues the propagation stopped by Pause
+func (m *Mirror) Resume() error {
+	if m.service == nil {
+		return ErrNotStarted
+	}
+	m.service.Resume()
+	return nil
+}
+
+// Resync requests a full resynchronization of prefix from a new etcd snapshot, of all prefixes if empty
+func (m *Mirror) Resync(prefix string) error {
+	if m.service == nil {
+		return ErrNotStarted
+	}
+	return m.service.Resync(prefix)
+}
+
+// Subscribe returns a feed of the changes of keys under prefix, of all keys if empty, once they are durably
+// applied to PostgreSQL. The changes of a prefix arrive in etcd revision order, cancel ends the subscription.
+// A receiver falling more than 1024 changes behind is unsubscribed, its channel is closed without a call of
+// cancel and it must catch up from the mirror tables after the Revision of its last change.
+func (m *Mirror) Subscribe(prefix string) (events <-chan ChangeEvent, cancel func(), err error) {
+	if m.service == nil {
+		return nil, nil, ErrNotStarted
+	}
+	events, cancel = m.service.Subscribe(prefix)
+	return events, cancel, nil
+}
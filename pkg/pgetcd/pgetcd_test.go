@@ -0,0 +1,82 @@
+package pgetcd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+)
+
+// TestNew tests the defaults and the validation of the options
+func TestNew(t *testing.T) {
+	mirror, err := New("postgres://localhost/test", "etcd://localhost:2379/config/")
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, mirror.options.config.PollingInterval)
+	assert.Equal(t, CapturePoll, mirror.options.config.CaptureMode)
+	assert.Equal(t, StorageHistory, mirror.options.config.StorageMode)
+	assert.Equal(t, LockBlock, mirror.options.lockMode)
+
+	mirror, err = New("", "", WithPrefixes("/a/", "/b/"), WithStorage(StorageLatest), WithReadOnly(), WithInstanceLock(LockExit),
+		WithCompression(4096), WithChunking("/b/"), WithJSONSchema("/a/", []byte(`{"type": "object"}`)), WithDedup(), WithKeyPath(),
+		WithKeyPolicy(KeyPolicyHex, 2560), WithRetention("/a/", time.Hour), WithRetention("/a/b/", 0),
+		WithSecret("/a/*/password", false), WithSecret("/secrets", true),
+		WithDecoder("/a/", DecoderFunc(func(string, string) (map[string]any, error) { return nil, nil }), "state"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a/", "/b/"}, mirror.options.config.Prefixes)
+	assert.Equal(t, StorageLatest, mirror.options.config.StorageMode)
+	assert.True(t, mirror.options.config.ReadOnly)
+	assert.Equal(t, LockExit, mirror.options.lockMode)
+	assert.Equal(t, 4096, mirror.options.config.CompressThreshold)
+	assert.Equal(t, []string{"/b/"}, mirror.options.config.ChunkPrefixes)
+	require.Len(t, mirror.options.config.Schemas, 1)
+	assert.True(t, mirror.options.config.Dedup)
+	assert.True(t, mirror.options.config.KeyPath)
+	assert.Equal(t, KeyPolicyHex, mirror.options.config.KeyPolicy)
+	assert.Equal(t, 2560, mirror.options.config.MaxKeyBytes)
+	assert.Len(t, mirror.options.config.Retention, 2)
+	assert.Equal(t, []sync.SecretRule{{Pattern: "/a/*/password"}, {Pattern: "/secrets", Hash: true}}, mirror.options.config.Secrets)
+	require.Len(t, mirror.options.config.Decoders, 1)
+	assert.Equal(t, []string{"state"}, mirror.options.config.Decoders[0].Fields)
+
+	for _, opt := range []Option{WithCapture("trigger"), WithStorage("kv"), WithInstanceLock("wait"), WithPollingInterval(0),
+		WithKeyPolicy("drop", 0), WithKeyPolicy(KeyPolicyHex, -1), WithKeyPolicy(KeyPolicyHex, 4096), WithSecret("[", false), WithJSONSchema("/a/", []byte(`{"type": 5}`))} {
+		_, err := New("", "", opt)
+		assert.Error(t, err)
+	}
+}
+
+// TestNotStarted tests the control methods before Start
+func TestNotStarted(t *testing.T) {
+	mirror, err := New("", "")
+	require.NoError(t, err)
+	assert.ErrorIs(t, mirror.Pause(), ErrNotStarted)
+	assert.ErrorIs(t, mirror.Resume(), ErrNotStarted)
+	assert.ErrorIs(t, mirror.Resync(""), ErrNotStarted)
+	assert.ErrorIs(t, mirror.Stop(context.Background()), ErrNotStarted)
+	assert.Zero(t, mirror.Status())
+	assert.NoError(t, mirror.Err())
+}
+
+// TestEventHandler tests converting the changes reported by the sync engine to typed events
+func TestEventHandler(t *testing.T) {
+	var events []Event
+	o := defaultOptions()
+	WithEventHandler(func(event Event) { events = append(events, event) })(&o)
+
+	o.config.OnApplied(sync.AuditLogEntry{Direction: "etcd_to_pg", Operation: OperationPut, Key: "/config/a", Revision: 5, PrevRevision: 3})
+	o.config.OnFailure(sync.RecentFailure{Direction: "pg_to_etcd", Key: "/config/b", Category: sync.CategoryConflict, Error: "compare-and-swap rejected"})
+
+	require.Len(t, events, 2)
+	applied, ok := events[0].(ChangeApplied)
+	require.True(t, ok)
+	assert.Equal(t, ChangeApplied{Direction: EtcdToPostgreSQL, Operation: OperationPut, Key: "/config/a", Revision: 5, PrevRevision: 3}, applied)
+	failed, ok := events[1].(ChangeFailed)
+	require.True(t, ok)
+	assert.Equal(t, PostgreSQLToEtcd, failed.Direction)
+	assert.Equal(t, sync.CategoryConflict, failed.Category)
+	assert.EqualError(t, failed.Err, "compare-and-swap rejected")
+}
@@ -0,0 +1,264 @@
+// Package pgetcdtest runs PostgreSQL and etcd in containers for integration tests of programs embedding
+// the synchronization, and of pg_etcd itself:
+//
+//	func TestCache(t *testing.T) {
+//		env := pgetcdtest.New(t)
+//		env.StartMirror(t, pgetcd.WithPrefixes("/config/"))
+//		_, err := env.Etcd.Put(context.Background(), "/config/a", "1")
+//		require.NoError(t, err)
+//		env.WaitForPostgreSQL(t, "/config/a", "1")
+//		...
+//	}
+//
+// The containers need a Docker compatible daemon, tests using them are skipped with -short.
+package pgetcdtest
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/cybertec-postgresql/pg_etcd/internal/sync"
+	"github.com/cybertec-postgresql/pg_etcd/pkg/pgetcd"
+)
+
+// Default container images
+const (
+	PostgreSQLImage = "postgres:17-alpine"
+	EtcdImage       = "quay.io/coreos/etcd:v3.5.9"
+)
+
+// WaitTimeout bounds the waits for a synchronized change
+const WaitTimeout = 10 * time.Second
+
+// Env is a PostgreSQL database with the pg_etcd schema and an etcd cluster, removed when the test ends
+type Env struct {
+	PostgresDSN string           // connection string of the database
+	EtcdDSN     string           // etcd://host:port/ DSN of the cluster, the prefix is set by pgetcd.WithPrefixes
+	Pool        *pgxpool.Pool    // connection pool of the database
+	Etcd        *clientv3.Client // client of the cluster
+}
+
+// Option configures the containers of New
+type Option func(*options)
+
+type options struct {
+	postgresImage string
+	etcdImage     string
+	etcdEnv       map[string]string
+	noMigrations  bool
+}
+
+// WithPostgreSQLImage runs image instead of PostgreSQLImage
+func WithPostgreSQLImage(image string) Option {
+	return func(o *options) { o.postgresImage = image }
+}
+
+// WithEtcdImage runs image instead of EtcdImage
+func WithEtcdImage(image string) Option {
+	return func(o *options) { o.etcdImage = image }
+}
+
+// WithEtcdEnv adds environment settings of etcd, e.g. ETCD_MAX_REQUEST_BYTES, may be repeated
+func WithEtcdEnv(env map[string]string) Option {
+	return func(o *options) { maps.Copy(o.etcdEnv, env) }
+}
+
+// WithoutMigrations leaves the database empty, e.g. to test pgetcd.WithMigrate
+func WithoutMigrations() Option {
+	return func(o *options) { o.noMigrations = true }
+}
+
+// New starts PostgreSQL and etcd, applies the pg_etcd migrations and removes both when the test ends.
+// The test is skipped with -short.
+func New(t testing.TB, opts ...Option) *Env {
+	t.Helper()
+	o := setup(t, opts)
+	env := &Env{}
+	env.PostgresDSN, env.Pool = startPostgreSQL(t, o)
+	env.EtcdDSN, env.Etcd = startEtcd(t, o)
+	return env
+}
+
+// StartPostgreSQL starts PostgreSQL alone like New and returns its connection string and pool
+func StartPostgreSQL(t testing.TB, opts ...Option) (string, *pgxpool.Pool) {
+	t.Helper()
+	return startPostgreSQL(t, setup(t, opts))
+}
+
+// StartEtcd starts etcd alone like New and returns its DSN and client
+func StartEtcd(t testing.TB, opts ...Option) (string, *clientv3.Client) {
+	t.Helper()
+	return startEtcd(t, setup(t, opts))
+}
+
+// setup skips the test with -short and returns the options of the containers
+func setup(t testing.TB, opts []Option) options {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+	o := options{postgresImage: PostgreSQLImage, etcdImage: EtcdImage, etcdEnv: map[string]string{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// startPostgreSQL starts the PostgreSQL container and connects to it
+func startPostgreSQL(t testing.TB, o options) (string, *pgxpool.Pool) {
+	t.Helper()
+	ctx := context.Background()
+	container, err := postgres.Run(ctx,
+		o.postgresImage,
+		postgres.WithDatabase("testdb"),
+		postgres.WithUsername("test"),
+		postgres.WithPassword("test"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).WithStartupTimeout(30*time.Second)),
+	)
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatalf("failed to start PostgreSQL: %v", err)
+	}
+	dsn, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatalf("failed to get PostgreSQL connection string: %v", err)
+	}
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatalf("failed to connect to PostgreSQL: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	if !o.noMigrations {
+		if err := sync.MigrateSchema(ctx, pool); err != nil {
+			t.Fatalf("failed to apply database migrations: %v", err)
+		}
+	}
+	return dsn, pool
+}
+
+// startEtcd starts the single member etcd container and connects to it
+func startEtcd(t testing.TB, o options) (string, *clientv3.Client) {
+	t.Helper()
+	ctx := context.Background()
+	env := map[string]string{
+		"ETCD_ADVERTISE_CLIENT_URLS":       "http://0.0.0.0:2379",
+		"ETCD_LISTEN_CLIENT_URLS":          "http://0.0.0.0:2379",
+		"ETCD_LISTEN_PEER_URLS":            "http://0.0.0.0:2380",
+		"ETCD_INITIAL_ADVERTISE_PEER_URLS": "http://0.0.0.0:2380",
+		"ETCD_INITIAL_CLUSTER":             "default=http://0.0.0.0:2380",
+		"ETCD_NAME":                        "default",
+	}
+	maps.Copy(env, o.etcdEnv)
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        o.etcdImage,
+			ExposedPorts: []string{"2379/tcp"},
+			Env:          env,
+			WaitingFor:   wait.ForListeningPort("2379/tcp"),
+		},
+		Started: true,
+	})
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+	endpoint, err := container.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatalf("failed to get etcd endpoint: %v", err)
+	}
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to connect to etcd: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return "etcd://" + endpoint + "/", client
+}
+
+// StartMirror starts the synchronization between the containers configured by opts and stops it when
+// the test ends
+func (e *Env) StartMirror(t testing.TB, opts ...pgetcd.Option) *pgetcd.Mirror {
+	t.Helper()
+	mirror, err := pgetcd.New(e.PostgresDSN, e.EtcdDSN, opts...)
+	if err != nil {
+		t.Fatalf("failed to create mirror: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	if err := mirror.Start(ctx); err != nil {
+		t.Fatalf("failed to start mirror: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+		defer cancel()
+		if err := mirror.Stop(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("failed to stop mirror: %v", err)
+		}
+	})
+	return mirror
+}
+
+// WaitForPostgreSQL waits until the latest row of key in PostgreSQL was synced from etcd with value
+func (e *Env) WaitForPostgreSQL(t testing.TB, key, value string) {
+	t.Helper()
+	e.waitFor(t, "PostgreSQL value of "+key, func(ctx context.Context) (bool, error) {
+		var current, encoding string
+		err := e.Pool.QueryRow(ctx, `SELECT value, coalesce(encoding, '') FROM etcd
+			WHERE key = $1 AND revision > 0 AND NOT tombstone
+			ORDER BY revision DESC LIMIT 1`, key).Scan(&current, &encoding)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		current, err = sync.DecodeValue(current, encoding)
+		return current == value, err
+	})
+}
+
+// WaitForEtcd waits until key has value in etcd, e.g. after inserting a pending row in PostgreSQL
+func (e *Env) WaitForEtcd(t testing.TB, key, value string) {
+	t.Helper()
+	e.waitFor(t, "etcd value of "+key, func(ctx context.Context) (bool, error) {
+		resp, err := e.Etcd.Get(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		return len(resp.Kvs) == 1 && string(resp.Kvs[0].Value) == value, nil
+	})
+}
+
+// waitFor polls done until it reports true, an error or WaitTimeout fail the test
+func (e *Env) waitFor(t testing.TB, what string, done func(ctx context.Context) (bool, error)) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		ok, err := done(ctx)
+		if err != nil && ctx.Err() == nil {
+			t.Fatalf("failed to check %s: %v", what, err)
+		}
+		if ok {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", what)
+		case <-ticker.C:
+		}
+	}
+}